@@ -1,28 +1,319 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
-	"log"
+	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	api "corti-kkv/internal/api"
+	"corti-kkv/internal/auth"
+	"corti-kkv/internal/binproto"
+	"corti-kkv/internal/blob"
+	"corti-kkv/internal/config"
+	"corti-kkv/internal/logging"
+	"corti-kkv/internal/metrics"
 	"corti-kkv/internal/queue"
+	"corti-kkv/internal/ratelimit"
+	"corti-kkv/internal/resp"
+	"corti-kkv/internal/stomp"
+	"corti-kkv/internal/tenant"
+	"corti-kkv/internal/tlsutil"
+	"corti-kkv/internal/trace"
+	"corti-kkv/internal/webhook"
 )
 
 func main() {
-	addr := flag.String("addr", ":8080", "address to listen on")
-	flag.Parse()
+	cfg, cfgPath, err := loadConfig(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	var logLevel slog.LevelVar
+	lvl, _ := logging.ParseLevel(cfg.Log.Level)
+	logLevel.Set(lvl)
+	logger, err := logging.NewLeveled(os.Stderr, &logLevel, cfg.Log.Format)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
+
+	var tracer *trace.Tracer
+	if cfg.Trace.Export != "" {
+		exp, err := trace.NewExporter(cfg.Trace.Export)
+		if err != nil {
+			fatal("configure trace export", "err", err)
+		}
+		tracer = trace.NewTracer("queue-service", exp)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	manager := queue.NewQueueManager()
+	manager.SetPolicy(cfg.Policy())
+	var blobs *blob.Store
+	if cfg.Storage.Blobs != "" {
+		if blobs, err = blob.Open(cfg.Storage.Blobs); err != nil {
+			fatal("open blob store", "path", cfg.Storage.Blobs, "err", err)
+		}
+		manager.SetBlobStore(blobs, int(cfg.Storage.BlobThreshold))
+	}
+	if cfg.Storage.Snapshot != "" {
+		if err := manager.LoadSnapshot(cfg.Storage.Snapshot); err != nil {
+			fatal("load snapshot", "path", cfg.Storage.Snapshot, "err", err)
+		}
+	}
 	srv := api.NewServer(manager)
+	srv.Tracer = tracer
+	srv.Webhooks = webhook.NewDispatcher(manager)
+	if cfg.Auth.Credentials != "" {
+		store, err := auth.Load(cfg.Auth.Credentials)
+		if err != nil {
+			fatal("load credentials", "err", err)
+		}
+		store.SetAnonymous(queue.DefaultNamespace, cfg.AnonymousGrants())
+		srv.Auth = store
+	}
+	if cfg.Auth.Tenants != "" {
+		tenants, err := tenant.Load(cfg.Auth.Tenants)
+		if err != nil {
+			fatal("load tenants", "err", err)
+		}
+		srv.Tenants = tenants
+	}
+	// The limiter always exists so that a reload can add rules.
+	queueRules, clientRules, _ := cfg.RateRules()
+	srv.Limiter = ratelimit.New(queueRules, clientRules)
+
+	var reloadMu sync.Mutex
+	reload := func() {
+		reloadMu.Lock()
+		defer reloadMu.Unlock()
+		next, _, err := loadConfig(os.Args[1:])
+		if err != nil {
+			slog.Error("reload configuration", "err", err)
+			return
+		}
+		if err := apply(next, manager, srv, &logLevel); err != nil {
+			slog.Error("reload configuration", "err", err)
+			return
+		}
+		if changed := cfg.RestartRequired(next); len(changed) > 0 {
+			slog.Warn("configuration changes need a restart", "settings", changed)
+		}
+		slog.Info("reloaded configuration", "path", cfgPath)
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-hup:
+				reload()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	if cfgPath != "" {
+		go config.Watch(ctx, cfgPath, 2*time.Second, reload)
+	}
+	go func() {
+		tick := time.NewTicker(time.Second)
+		defer tick.Stop()
+		// Blobs are swept from the reaper so that no message is between
+		// queues, on its way to a dead-letter queue, while collecting keys.
+		sweep := time.NewTicker(30 * time.Second)
+		defer sweep.Stop()
+		for {
+			select {
+			case now := <-tick.C:
+				manager.Reap(now)
+			case now := <-sweep.C:
+				if blobs != nil {
+					sweepBlobs(blobs, manager, now)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// The protocol listeners are closed after the HTTP server has drained.
+	var listeners []io.Closer
+	serveListener := func(c io.Closer, serve func() error, closed error) {
+		listeners = append(listeners, c)
+		go func() {
+			if err := serve(); !errors.Is(err, closed) {
+				fatal("protocol listener failed", "err", err)
+			}
+		}()
+	}
+	if cfg.Listen.RESP != "" {
+		respSrv := resp.NewServer(manager)
+		serveListener(respSrv, func() error { return respSrv.ListenAndServe(cfg.Listen.RESP) }, resp.ErrServerClosed)
+	}
+	if cfg.Listen.Binary != "" {
+		binSrv := binproto.NewServer(manager)
+		serveListener(binSrv, func() error { return binSrv.ListenAndServe(cfg.Listen.Binary) }, binproto.ErrServerClosed)
+	}
+	if cfg.Listen.STOMP != "" {
+		stompSrv := stomp.NewServer(manager)
+		serveListener(stompSrv, func() error { return stompSrv.ListenAndServe(cfg.Listen.STOMP) }, stomp.ErrServerClosed)
+	}
+
+	health := &api.Health{}
+	reg := metrics.NewRegistry()
+	httpMetrics := metrics.NewHTTPMetrics(reg)
+	reg.Register(srv, srv.Webhooks)
+	if blobs != nil {
+		reg.Register(blobs)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", reg.Handler())
+	mux.Handle("/healthz", health.Handler())
+	mux.Handle("/readyz", health.Handler())
+	mux.Handle("/ui/", api.UIHandler())
+	mux.Handle("/ui", http.RedirectHandler("/ui/", http.StatusMovedPermanently))
+	mux.Handle("/", srv.Handler())
 
 	server := &http.Server{
-		Addr:    *addr,
-		Handler: srv.Handler(),
+		Addr:    cfg.Listen.HTTP,
+		Handler: logging.Middleware(logger, trace.Middleware(httpMetrics.Instrument(api.Route, mux))),
+	}
+	server.RegisterOnShutdown(srv.Shutdown)
+
+	errc := make(chan error, 1)
+	if cfg.TLS.Cert != "" || cfg.TLS.Key != "" {
+		tlsCfg, err := tlsutil.ServerConfig(cfg.TLS.Cert, cfg.TLS.Key, cfg.TLS.ClientCA)
+		if err != nil {
+			fatal("load TLS configuration", "err", err)
+		}
+		server.TLSConfig = tlsCfg
+		slog.Info("queue service listening", "addr", cfg.Listen.HTTP, "tls", true)
+		go func() { errc <- server.ListenAndServeTLS("", "") }()
+	} else {
+		slog.Info("queue service listening", "addr", cfg.Listen.HTTP, "tls", false)
+		go func() { errc <- server.ListenAndServe() }()
+	}
+	health.SetReady(true)
+
+	select {
+	case err := <-errc:
+		fatal("serve", "err", err)
+	case <-ctx.Done():
+	}
+	stop()
+
+	slog.Info("shutting down", "timeout", cfg.ShutdownTimeout)
+	health.SetReady(false)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("shutdown incomplete", "err", err)
+	}
+	// Messages still being pushed go back to their queues for the snapshot.
+	srv.Webhooks.Close()
+	if err := tracer.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("flush spans", "err", err)
+	}
+	for _, l := range listeners {
+		l.Close()
+	}
+	if cfg.Storage.Snapshot != "" {
+		if err := manager.SaveSnapshot(cfg.Storage.Snapshot); err != nil {
+			fatal("save snapshot", "path", cfg.Storage.Snapshot, "err", err)
+		}
+		slog.Info("saved snapshot", "path", cfg.Storage.Snapshot)
 	}
+}
+
+// loadConfig reads the configuration file named by -config or KKV_CONFIG
+// and the environment, then applies the flags over them.
+func loadConfig(args []string) (*config.Config, string, error) {
+	path := os.Getenv("KKV_CONFIG")
+	newFlags := func(cfg *config.Config) *flag.FlagSet {
+		fs := flag.NewFlagSet("queue-service", flag.ExitOnError)
+		fs.StringVar(&path, "config", path, "YAML or JSON configuration file, reloaded on SIGHUP or change (env KKV_CONFIG)")
+		cfg.RegisterFlags(fs)
+		return fs
+	}
+	// The first pass only finds the file; the second lets flags win over it.
+	newFlags(config.Default()).Parse(args)
+	cfg, err := config.Load(path)
+	if err != nil {
+		return nil, "", err
+	}
+	newFlags(cfg).Parse(args)
+	if err := cfg.Validate(); err != nil {
+		return nil, "", err
+	}
+	return cfg, path, nil
+}
 
-	log.Printf("queue service listening on %s", *addr)
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatal(err)
+// apply makes the reloadable parts of cfg take effect: queue policies, rate
+// limits, the contents of the credentials and tenants files, anonymous
+// access and the log level. Queued messages are kept.
+func apply(cfg *config.Config, manager *queue.QueueManager, srv *api.Server, logLevel *slog.LevelVar) error {
+	queueRules, clientRules, err := cfg.RateRules()
+	if err != nil {
+		return err
+	}
+	lvl, err := logging.ParseLevel(cfg.Log.Level)
+	if err != nil {
+		return err
+	}
+	var store *auth.Store
+	if srv.Auth != nil && cfg.Auth.Credentials != "" {
+		if store, err = auth.Load(cfg.Auth.Credentials); err != nil {
+			return err
+		}
+	}
+	var tenants *tenant.Config
+	if srv.Tenants != nil && cfg.Auth.Tenants != "" {
+		if tenants, err = tenant.Load(cfg.Auth.Tenants); err != nil {
+			return err
+		}
+	}
+	// Everything is loaded, so the changes go in together.
+	manager.SetPolicy(cfg.Policy())
+	srv.Limiter.SetRules(queueRules, clientRules)
+	if store != nil {
+		srv.Auth.Replace(store)
+		srv.Auth.SetAnonymous(queue.DefaultNamespace, cfg.AnonymousGrants())
+	}
+	if tenants != nil {
+		srv.Tenants.Replace(tenants)
+	}
+	logLevel.Set(lvl)
+	return nil
+}
+
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// sweepBlobs removes the blobs no message refers to. Blobs stored in the
+// last minute are kept, as their messages may not be queued yet.
+func sweepBlobs(store *blob.Store, manager *queue.QueueManager, now time.Time) {
+	keys := manager.BlobKeys()
+	n, err := store.Sweep(func(key string) bool { return keys[key] }, now.Add(-time.Minute))
+	if err != nil {
+		slog.Error("sweep blobs", "err", err)
+	}
+	if n > 0 {
+		slog.Debug("swept blobs", "removed", n)
 	}
 }
@@ -1,12 +1,22 @@
 package main
 
 import (
+	"context"
 	"flag"
-	"log"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	api "corti-kkv/internal/api"
+	"corti-kkv/internal/logging"
+	"corti-kkv/internal/metrics"
 	"corti-kkv/internal/rwclient"
+	"corti-kkv/internal/tlsutil"
+	"corti-kkv/internal/trace"
 )
 
 func main() {
@@ -16,23 +26,122 @@ func main() {
 		qName   string
 		inPath  string
 		outPath string
+		token   string
+
+		tlsCert, tlsKey, clientCA    string
+		queueCA, queueCert, queueKey string
 	)
 	flag.StringVar(&addr, "addr", ":8081", "address to listen on")
 	flag.StringVar(&qURL, "queue-url", "http://localhost:8080", "queue service base URL")
 	flag.StringVar(&qName, "queue", "lines", "queue name")
 	flag.StringVar(&inPath, "in", "/data/input.txt", "path to input file")
 	flag.StringVar(&outPath, "out", "/data/output.txt", "path to output file")
+	flag.StringVar(&token, "token", os.Getenv("QUEUE_TOKEN"), "bearer token for the queue service (default $QUEUE_TOKEN)")
+	flag.StringVar(&tlsCert, "tls-cert", "", "TLS certificate file; serves HTTPS when set together with -tls-key")
+	flag.StringVar(&tlsKey, "tls-key", "", "TLS private key file")
+	flag.StringVar(&clientCA, "client-ca", "", "CA bundle for verifying client certificates (requires clients to present one)")
+	flag.StringVar(&queueCA, "queue-ca", "", "CA bundle for verifying an https queue service (default system roots)")
+	flag.StringVar(&queueCert, "queue-cert", "", "client certificate presented to the queue service")
+	flag.StringVar(&queueKey, "queue-key", "", "private key for -queue-cert")
+	split := flag.String("split", "", "splitter for uploads that do not pass ?split=: lines, crlf, paragraphs, csv, jsonl, fixed:<bytes> or delim:<delimiter> (default lines)")
+	retry := rwclient.DefaultRetryPolicy()
+	flag.IntVar(&retry.MaxAttempts, "queue-attempts", retry.MaxAttempts, "how often a failed queue request is tried in total (1 disables retries)")
+	flag.DurationVar(&retry.BaseBackoff, "queue-backoff", retry.BaseBackoff, "wait before the first retry, doubled for each further one")
+	flag.DurationVar(&retry.MaxBackoff, "queue-max-backoff", retry.MaxBackoff, "longest wait between retries")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "how long to wait for running uploads on shutdown")
+	logLevel := flag.String("log-level", "info", "log level: debug, info, warn or error")
+	logFormat := flag.String("log-format", "text", "log format: text or json")
+	traceExport := flag.String("trace-export", "", "export spans to this JSON-lines file or OTLP/HTTP collector URL (disabled if empty)")
 	flag.Parse()
 
+	logger, err := logging.New(os.Stderr, *logLevel, *logFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
+
+	var tracer *trace.Tracer
+	if *traceExport != "" {
+		exp, err := trace.NewExporter(*traceExport)
+		if err != nil {
+			fatal("configure trace export", "err", err)
+		}
+		tracer = trace.NewTracer("upload-service", exp)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	client := rwclient.New(qURL, qName)
+	client.Token = token
+	client.Tracer = tracer
+	client.Retry = retry
+	client.OnRetry = func(r rwclient.Retry) {
+		slog.Warn("retrying queue request", "op", r.Op, "attempt", r.Attempt, "wait", r.Wait, "err", r.Err)
+	}
+	if queueCA != "" || queueCert != "" || queueKey != "" {
+		if err := client.SetTLS(queueCA, queueCert, queueKey); err != nil {
+			fatal("configure queue TLS", "err", err)
+		}
+	}
+	if err := client.ValidateSplit(*split); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 	uploadServer := api.NewUploadServer(client, inPath)
+	uploadServer.Split = *split
+	uploadServer.Tracer = tracer
 
+	reg := metrics.NewRegistry()
+	httpMetrics := metrics.NewHTTPMetrics(reg)
+	reg.Register(uploadServer, client)
+
+	health := &api.Health{}
 	mux := http.NewServeMux()
 	mux.Handle("/upload", uploadServer.Handler())
+	mux.Handle("/metrics", reg.Handler())
+	mux.Handle("/healthz", health.Handler())
+	mux.Handle("/readyz", health.Handler())
+
+	server := &http.Server{Addr: addr, Handler: logging.Middleware(logger, trace.Middleware(httpMetrics.Instrument(api.Route, mux)))}
+	errc := make(chan error, 1)
+	if tlsCert != "" || tlsKey != "" {
+		cfg, err := tlsutil.ServerConfig(tlsCert, tlsKey, clientCA)
+		if err != nil {
+			fatal("load TLS configuration", "err", err)
+		}
+		server.TLSConfig = cfg
+		slog.Info("upload service listening", "addr", addr, "tls", true, "queue", qName, "queue_url", qURL)
+		go func() { errc <- server.ListenAndServeTLS("", "") }()
+	} else {
+		slog.Info("upload service listening", "addr", addr, "tls", false, "queue", qName, "queue_url", qURL)
+		go func() { errc <- server.ListenAndServe() }()
+	}
+	health.SetReady(true)
+
+	select {
+	case err := <-errc:
+		fatal("serve", "err", err)
+	case <-ctx.Done():
+	}
+	stop()
 
-	server := &http.Server{Addr: addr, Handler: mux}
-	log.Printf("upload service listening on %s (queue %s at %s)", addr, qName, qURL)
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatal(err)
+	// Uploads run to completion: Shutdown waits for their handlers, which
+	// keep producing until the whole file is enqueued.
+	slog.Info("shutting down", "timeout", *shutdownTimeout)
+	health.SetReady(false)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("shutdown incomplete", "err", err)
+	}
+	if err := tracer.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("flush spans", "err", err)
 	}
 }
+
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
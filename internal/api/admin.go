@@ -0,0 +1,215 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"corti-kkv/internal/auth"
+	"corti-kkv/internal/queue"
+)
+
+// DLQSuffix marks a dead-letter queue.
+const DLQSuffix = queue.DLQSuffix
+
+// MaxPeek caps the messages returned by one peek.
+const MaxPeek = 100
+
+// maxMoveBody caps the JSON body of a move request.
+const maxMoveBody = 64 << 10
+
+// moveRequest is the body of POST /admin/queues/{name}/move.
+type moveRequest struct {
+	Target   string `json:"target"`
+	Max      int    `json:"max"`
+	Selector string `json:"selector"`
+}
+
+// adminQueue is the admin API's view of one queue. Rates are left to
+// clients, which can difference the counters between polls.
+type adminQueue struct {
+	Name     string `json:"name"`
+	Tenant   string `json:"tenant"`
+	Queue    string `json:"queue"`
+	Depth    int    `json:"depth"`
+	Inflight int    `json:"inflight"`
+	Bytes    int64  `json:"bytes"`
+	Enqueued uint64 `json:"enqueued"`
+	Dequeued uint64 `json:"dequeued"`
+	// DLQFor names the queue this one dead-letters for, if it is a DLQ.
+	DLQFor string `json:"dlq_for,omitempty"`
+}
+
+type adminMessage struct {
+	ID          uint64            `json:"id"`
+	Data        string            `json:"data"`
+	Encoding    string            `json:"encoding,omitempty"`
+	Bytes       int               `json:"bytes"`
+	Traceparent string            `json:"traceparent,omitempty"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+}
+
+// parseAdminQueuePath splits /admin/queues/{name}[/{action}] using the
+// escaped path, since stored names of tenant queues contain a slash that
+// clients send as %2F.
+func parseAdminQueuePath(u *url.URL) (name, action string, ok bool) {
+	rest, ok := strings.CutPrefix(u.EscapedPath(), "/admin/queues")
+	if !ok {
+		return "", "", false
+	}
+	rest = strings.Trim(rest, "/")
+	if rest == "" {
+		return "", "", true
+	}
+	escaped, action, _ := strings.Cut(rest, "/")
+	name, err := url.PathUnescape(escaped)
+	if err != nil || name == "" || strings.Contains(action, "/") {
+		return "", "", false
+	}
+	return name, action, true
+}
+
+// handleQueueAdmin serves the queue administration API used by the
+// dashboard. Queues are addressed by their stored name, tenant/queue for
+// tenant queues, and every call needs an unconfined admin token:
+//
+//	GET    /admin/queues                    list queues with depth and counters
+//	GET    /admin/queues/{name}/messages    peek at up to ?limit messages matching ?selector
+//	POST   /admin/queues/{name}/purge       drop queued messages
+//	POST   /admin/queues/{name}/redrive     move a DLQ's messages back
+//	POST   /admin/queues/{name}/move        move messages to another queue
+//	DELETE /admin/queues/{name}             remove the queue
+func (s *Server) handleQueueAdmin(w http.ResponseWriter, r *http.Request, p *auth.Principal) {
+	if !isAdmin(p) {
+		http.Error(w, "token lacks admin permission", http.StatusForbidden)
+		return
+	}
+	name, action, ok := parseAdminQueuePath(r.URL)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	route := r.Method + " " + action
+	if name == "" {
+		route = r.Method + " list"
+	}
+	switch route {
+	case "GET list":
+		out := []adminQueue{}
+		for _, n := range s.Manager.Names() {
+			out = append(out, adminQueueInfo(n, s.Manager.Get(n)))
+		}
+		writeJSON(w, map[string]any{"queues": out})
+	case "GET messages":
+		q, ok := s.Manager.Lookup(name)
+		if !ok {
+			http.Error(w, fmt.Sprintf("no queue %q", name), http.StatusNotFound)
+			return
+		}
+		limit := 10
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				http.Error(w, fmt.Sprintf("invalid limit: %q", v), http.StatusBadRequest)
+				return
+			}
+			limit = min(n, MaxPeek)
+		}
+		sel, err := queue.ParseSelector(r.URL.Query().Get("selector"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		out := []adminMessage{}
+		for _, m := range q.PeekMatching(sel, limit) {
+			am := adminMessage{ID: m.ID, Data: string(m.Body), Bytes: len(m.Body), Traceparent: m.Traceparent, Attributes: m.Attributes}
+			if !utf8.Valid(m.Body) {
+				am.Data, am.Encoding = encodeData(m.Body, "base64"), "base64"
+			}
+			out = append(out, am)
+		}
+		writeJSON(w, map[string]any{"queue": name, "messages": out})
+	case "POST purge":
+		q, ok := s.Manager.Lookup(name)
+		if !ok {
+			http.Error(w, fmt.Sprintf("no queue %q", name), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, map[string]any{"queue": name, "purged": q.Purge()})
+	case "POST redrive":
+		target, ok := strings.CutSuffix(name, DLQSuffix)
+		if !ok || target == "" || strings.HasSuffix(target, "/") {
+			http.Error(w, fmt.Sprintf("queue %q is not a dead-letter queue", name), http.StatusBadRequest)
+			return
+		}
+		if _, ok := s.Manager.Lookup(name); !ok {
+			http.Error(w, fmt.Sprintf("no queue %q", name), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, map[string]any{"queue": name, "target": target, "moved": s.Manager.Move(name, target, 0)})
+	case "POST move":
+		var req moveRequest
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxMoveBody))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid move: %v", err), http.StatusBadRequest)
+			return
+		}
+		sel, err := queue.ParseSelector(req.Selector)
+		switch {
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case req.Target == "" || req.Target == name:
+			http.Error(w, "invalid move: target must name another queue", http.StatusBadRequest)
+			return
+		case req.Max < 0:
+			http.Error(w, "invalid move: max must not be negative", http.StatusBadRequest)
+			return
+		}
+		if _, ok := s.Manager.Lookup(name); !ok {
+			http.Error(w, fmt.Sprintf("no queue %q", name), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, map[string]any{"queue": name, "target": req.Target, "moved": s.Manager.MoveMatching(name, req.Target, sel, req.Max)})
+	case "DELETE ":
+		n, ok := s.Manager.Delete(name)
+		if !ok {
+			http.Error(w, fmt.Sprintf("no queue %q", name), http.StatusNotFound)
+			return
+		}
+		s.streamsMu.Lock()
+		delete(s.streams, name)
+		s.streamsMu.Unlock()
+		writeJSON(w, map[string]any{"queue": name, "deleted": n})
+	default:
+		if name == "" || action == "" || action == "messages" || action == "purge" || action == "redrive" || action == "move" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		http.NotFound(w, r)
+	}
+}
+
+func adminQueueInfo(name string, q *queue.Queue) adminQueue {
+	ns, qn := queue.SplitName(name)
+	st := q.Stats()
+	a := adminQueue{
+		Name:     name,
+		Tenant:   ns,
+		Queue:    qn,
+		Depth:    q.Len(),
+		Inflight: q.Inflight(),
+		Bytes:    q.Size(),
+		Enqueued: st.Enqueued,
+		Dequeued: st.Dequeued,
+	}
+	if target, ok := strings.CutSuffix(name, DLQSuffix); ok && target != "" {
+		a.DLQFor = target
+	}
+	return a
+}
@@ -0,0 +1,136 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"corti-kkv/internal/auth"
+	"corti-kkv/internal/queue"
+)
+
+func TestServerQueueAdmin(t *testing.T) {
+	store, err := auth.Parse(strings.NewReader("root ops *:admin\nwk worker *:consume\n"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	m := queue.NewQueueManager()
+	s := NewServer(m)
+	s.Auth = store
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	m.Get("lines").Enqueue([]byte("a"))
+	m.Get("lines.dlq").EnqueueMessage(queue.Message{Body: []byte("failed"), Traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"})
+	m.Get("lines.dlq").Enqueue([]byte{0xff, 0xfe})
+	m.Namespace("acme").Get("jobs").Enqueue([]byte("j"))
+
+	do := func(method, path, token string, out any) int {
+		req, _ := http.NewRequest(method, ts.URL+path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		defer resp.Body.Close()
+		if out != nil && resp.StatusCode == http.StatusOK {
+			assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(out))
+		}
+		io.Copy(io.Discard, resp.Body)
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusForbidden, do(http.MethodGet, "/admin/queues", "wk", nil))
+
+	var list struct{ Queues []adminQueue }
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/admin/queues", "root", &list))
+	assert.Equal(t, []adminQueue{
+		{Name: "acme/jobs", Tenant: "acme", Queue: "jobs", Depth: 1, Bytes: 1, Enqueued: 1},
+		{Name: "lines", Tenant: "default", Queue: "lines", Depth: 1, Bytes: 1, Enqueued: 1},
+		{Name: "lines.dlq", Tenant: "default", Queue: "lines.dlq", Depth: 2, Bytes: 8, Enqueued: 2, DLQFor: "lines"},
+	}, list.Queues)
+
+	var peek struct{ Messages []adminMessage }
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/admin/queues/lines.dlq/messages?limit=5", "root", &peek))
+	assert.Equal(t, []adminMessage{
+		{ID: 1, Data: "failed", Bytes: 6, Traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		{ID: 2, Data: "//4=", Encoding: "base64", Bytes: 2},
+	}, peek.Messages)
+	assert.Equal(t, 2, m.Get("lines.dlq").Len(), "peeking leaves messages queued")
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/admin/queues/acme%2Fjobs/messages", "root", &peek))
+	assert.Len(t, peek.Messages, 1)
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodGet, "/admin/queues/lines/messages?limit=0", "root", nil))
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/admin/queues/nope/messages", "root", nil))
+
+	var res map[string]any
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/admin/queues/lines/redrive", "root", nil))
+	assert.Equal(t, http.StatusOK, do(http.MethodPost, "/admin/queues/lines.dlq/redrive", "root", &res))
+	assert.Equal(t, map[string]any{"queue": "lines.dlq", "target": "lines", "moved": float64(2)}, res)
+	assert.Equal(t, 3, m.Get("lines").Len())
+
+	move := func(path, token, body string, out any) int {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		defer resp.Body.Close()
+		if out != nil && resp.StatusCode == http.StatusOK {
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(out))
+		}
+		return resp.StatusCode
+	}
+	m.Get("lines").EnqueueMessage(queue.Message{Body: []byte("tagged"), Priority: 2, Attributes: map[string]string{"source": "upload-42"}})
+	assert.Equal(t, http.StatusForbidden, move("/admin/queues/lines/move", "wk", `{"target": "x"}`, nil))
+	assert.Equal(t, http.StatusBadRequest, move("/admin/queues/lines/move", "root", `{"target": "lines"}`, nil))
+	assert.Equal(t, http.StatusBadRequest, move("/admin/queues/lines/move", "root", `{"target": "x", "max": -1}`, nil))
+	assert.Equal(t, http.StatusBadRequest, move("/admin/queues/lines/move", "root", `{"target": "x", "selector": "a >"}`, nil))
+	assert.Equal(t, http.StatusBadRequest, move("/admin/queues/lines/move", "root", `{"dst": "x"}`, nil))
+	assert.Equal(t, http.StatusNotFound, move("/admin/queues/nope/move", "root", `{"target": "x"}`, nil))
+	assert.Equal(t, http.StatusOK, move("/admin/queues/lines/move", "root", `{"target": "acme/tagged", "selector": "source ^= upload-"}`, &res))
+	assert.Equal(t, map[string]any{"queue": "lines", "target": "acme/tagged", "moved": float64(1)}, res)
+	assert.Equal(t, []queue.Message{{ID: 1, Body: []byte("tagged"), Priority: 2, Attributes: map[string]string{"source": "upload-42"}}}, m.Get("acme/tagged").Peek(10))
+	assert.Equal(t, http.StatusOK, move("/admin/queues/lines/move", "root", `{"target": "lines.backlog", "max": 2}`, &res))
+	assert.Equal(t, float64(2), res["moved"])
+	assert.Equal(t, http.StatusOK, move("/admin/queues/lines.backlog/move", "root", `{"target": "lines"}`, &res))
+	assert.Equal(t, float64(2), res["moved"])
+	assert.Equal(t, []string{"\xff\xfe", "a", "failed"}, bodies(m.Get("lines").Peek(10)), "moved messages go to the tail")
+	_, _ = m.Delete("lines.backlog")
+	_, _ = m.Delete("acme/tagged")
+
+	assert.Equal(t, http.StatusOK, do(http.MethodPost, "/admin/queues/lines/purge", "root", &res))
+	assert.Equal(t, float64(3), res["purged"])
+	assert.Equal(t, http.StatusMethodNotAllowed, do(http.MethodGet, "/admin/queues/lines/purge", "root", nil))
+
+	assert.Equal(t, http.StatusOK, do(http.MethodDelete, "/admin/queues/acme%2Fjobs", "root", &res))
+	assert.Equal(t, float64(1), res["deleted"])
+	assert.Equal(t, http.StatusNotFound, do(http.MethodDelete, "/admin/queues/acme%2Fjobs", "root", nil))
+	assert.Equal(t, []string{"lines", "lines.dlq"}, m.Names())
+}
+
+func TestUIHandler(t *testing.T) {
+	ts := httptest.NewServer(UIHandler())
+	defer ts.Close()
+
+	for path, want := range map[string]string{
+		"/ui/":       "<title>kkv queues</title>",
+		"/ui/app.js": "/admin/queues",
+	} {
+		resp, err := http.Get(ts.URL + path)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode, path)
+		assert.Contains(t, string(b), want, path)
+		assert.Equal(t, "default-src 'self'", resp.Header.Get("Content-Security-Policy"))
+	}
+}
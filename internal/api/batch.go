@@ -0,0 +1,106 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"corti-kkv/internal/frame"
+	"corti-kkv/internal/queue"
+	"corti-kkv/internal/trace"
+)
+
+// batchFailure reports why one message of a batch enqueue was rejected.
+type batchFailure struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+// isFramed reports whether an enqueue body holds several messages in the
+// frame format.
+func isFramed(r *http.Request) bool {
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return ct == frame.ContentType
+}
+
+// pushErrorStatus maps a queue.Push error to an HTTP status.
+func pushErrorStatus(err error) int {
+	if errors.Is(err, queue.ErrInvalid) {
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusInsufficientStorage
+}
+
+// handleEnqueueBatch queues the framed messages of body. Every message is
+// checked against the queue's validator first and, if any fails, none is
+// queued and the 422 answer lists the failures by index. A queue limit
+// reached part way leaves the messages before it queued; the 507 answer
+// says how many. Every message gets the priority and attributes of tmpl.
+func (s *Server) handleEnqueueBatch(w http.ResponseWriter, r *http.Request, ns *queue.View, name string, body []byte, tmpl queue.Message) {
+	msgs, err := frame.Read(bytes.NewReader(body))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid batch: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(msgs) == 0 {
+		http.Error(w, "empty batch", http.StatusBadRequest)
+		return
+	}
+	size := 0
+	for _, m := range msgs {
+		size += len(m)
+	}
+	q, qerr := s.openQueue(ns, name)
+	if qerr == nil {
+		qerr = s.checkQuota(ns, size)
+	}
+	if qerr != nil {
+		writeQuotaError(w, qerr)
+		return
+	}
+	name = ns.Name(name)
+	var failed []batchFailure
+	for i, m := range msgs {
+		if len(m) == 0 {
+			failed = append(failed, batchFailure{Index: i, Error: "empty body"})
+		} else if err := q.Validate(m); err != nil {
+			failed = append(failed, batchFailure{Index: i, Error: err.Error()})
+		}
+	}
+	if len(failed) > 0 {
+		writeJSONStatus(w, http.StatusUnprocessableEntity, map[string]any{
+			"error":  fmt.Sprintf("%d of %d messages are invalid, none were enqueued", len(failed), len(msgs)),
+			"failed": failed,
+		})
+		return
+	}
+
+	ctx, span := s.Tracer.Start(r.Context(), "enqueue", trace.Server)
+	defer span.End()
+	span.SetAttr("queue", name)
+	span.SetAttr("bytes", size)
+	span.SetAttr("count", len(msgs))
+	sc := trace.FromContext(ctx)
+	for i, m := range msgs {
+		if _, err := q.Push(queue.Message{Body: m, Priority: tmpl.Priority, Attributes: tmpl.Attributes, Traceparent: sc.Traceparent(), Tracestate: sc.State}, false); err != nil {
+			span.SetError(err)
+			writeJSONStatus(w, pushErrorStatus(err), map[string]any{"error": err.Error(), "enqueued": i})
+			return
+		}
+	}
+	slog.DebugContext(ctx, "enqueued batch", "queue", name, "count", len(msgs), "bytes", size)
+	trace.Inject(sc, w.Header())
+	w.Header().Set("X-Batch-Count", strconv.Itoa(len(msgs)))
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func writeJSONStatus(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
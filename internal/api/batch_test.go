@@ -0,0 +1,92 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"corti-kkv/internal/frame"
+	"corti-kkv/internal/queue"
+	"corti-kkv/internal/schema"
+)
+
+func TestServerValidation(t *testing.T) {
+	v, err := schema.New(schema.Spec{UTF8: true, JSONSchema: []byte(`{"type": "object", "required": ["id"]}`)})
+	if !assert.NoError(t, err) {
+		return
+	}
+	m := queue.NewQueueManager()
+	m.SetPolicy(func(name string) queue.Options {
+		if name == "orders" {
+			return queue.Options{MaxLen: 4, Validator: v}
+		}
+		return queue.Options{}
+	})
+	ts := httptest.NewServer(NewServer(m).Handler())
+	defer ts.Close()
+
+	post := func(contentType string, body []byte) (*http.Response, string) {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/queues/orders", bytes.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		resp, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp, string(b)
+	}
+	batch := func(msgs ...string) []byte {
+		var buf bytes.Buffer
+		in := make([][]byte, len(msgs))
+		for i, s := range msgs {
+			in[i] = []byte(s)
+		}
+		assert.NoError(t, frame.Write(&buf, in))
+		return buf.Bytes()
+	}
+
+	resp, _ := post("application/json", []byte(`{"id": 1}`))
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	resp, body := post("application/json", []byte(`{"name": "x"}`))
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+	assert.Equal(t, "invalid message: document: missing required property \"id\"\n", body)
+	resp, body = post("text/plain", []byte("\xff"))
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+	assert.Contains(t, body, "not valid UTF-8 at byte 0")
+
+	resp, body = post(frame.ContentType, batch(`{"id": 2}`, `[]`, `{"id": 3}`, "", `{"id"`))
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+	var rejected struct {
+		Error  string         `json:"error"`
+		Failed []batchFailure `json:"failed"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(body), &rejected))
+	assert.Equal(t, "3 of 5 messages are invalid, none were enqueued", rejected.Error)
+	assert.Equal(t, []batchFailure{
+		{Index: 1, Error: "invalid message: document: expected object, got array"},
+		{Index: 3, Error: "empty body"},
+		{Index: 4, Error: "invalid message: invalid JSON: unexpected EOF"},
+	}, rejected.Failed)
+	assert.Equal(t, 1, m.Get("orders").Len())
+
+	resp, _ = post(frame.ContentType+"; charset=binary", batch(`{"id": 2}`, `{"id": 3}`))
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.Equal(t, "2", resp.Header.Get("X-Batch-Count"))
+	assert.Equal(t, 3, m.Get("orders").Len())
+
+	resp, body = post(frame.ContentType, batch(`{"id": 4}`, `{"id": 5}`))
+	assert.Equal(t, http.StatusInsufficientStorage, resp.StatusCode)
+	assert.Contains(t, body, `"enqueued":1`)
+	assert.Equal(t, 4, m.Get("orders").Len())
+
+	resp, body = post(frame.ContentType, []byte{0, 0, 0, 9, 'x'})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.True(t, strings.HasPrefix(body, "invalid batch"))
+}
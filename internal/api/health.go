@@ -0,0 +1,32 @@
+package api
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// Health backs /healthz and /readyz. /healthz answers 200 for as long as the
+// process serves HTTP; /readyz only between SetReady(true) and the start of
+// shutdown, so load balancers stop routing to an instance that is draining.
+type Health struct {
+	ready atomic.Bool
+}
+
+func (h *Health) SetReady(ready bool) { h.ready.Store(ready) }
+
+func (h *Health) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz":
+			w.Write([]byte("ok\n"))
+		case "/readyz":
+			if !h.ready.Load() {
+				http.Error(w, "not ready", http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte("ready\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
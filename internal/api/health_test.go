@@ -0,0 +1,83 @@
+package api
+
+import (
+	"context"
+	"corti-kkv/internal/queue"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealth(t *testing.T) {
+	h := &Health{}
+	get := func(path string) int {
+		rec := httptest.NewRecorder()
+		h.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Code
+	}
+	assert.Equal(t, http.StatusOK, get("/healthz"))
+	assert.Equal(t, http.StatusServiceUnavailable, get("/readyz"))
+	h.SetReady(true)
+	assert.Equal(t, http.StatusOK, get("/readyz"))
+	h.SetReady(false)
+	assert.Equal(t, http.StatusServiceUnavailable, get("/readyz"))
+	assert.Equal(t, http.StatusOK, get("/healthz"))
+}
+
+func TestServerGracefulShutdown(t *testing.T) {
+	m := queue.NewQueueManager()
+	s := NewServer(m)
+	ts := httptest.NewUnstartedServer(s.Handler())
+	ts.Config.RegisterOnShutdown(s.Shutdown)
+	ts.Start()
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream := openStream(t, ctx, ts.URL+"/queues/events/stream", "")
+	defer stream.Body.Close()
+	c := dialWS(t, ts)
+	defer c.conn.Close()
+	assert.Equal(t, "ok", c.call(wsCommand{Op: "enqueue", Queue: "other", Data: "x"}).Op)
+
+	type result struct {
+		code int
+		body string
+	}
+	polled := make(chan result, 1)
+	go func() {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodDelete, ts.URL+"/queues/lp?wait=3s", nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			polled <- result{}
+			return
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		polled <- result{resp.StatusCode, string(b)}
+	}()
+	time.Sleep(50 * time.Millisecond) // let the long-poll reach the handler
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- ts.Config.Shutdown(ctx) }()
+
+	// Streams and WebSocket sessions end right away.
+	_, err := io.ReadAll(stream.Body)
+	assert.NoError(t, err)
+	_, _, err = c.conn.ReadMessage()
+	assert.Error(t, err)
+
+	// The long-poll is still served and Shutdown waits for it.
+	select {
+	case <-shutdown:
+		t.Fatal("Shutdown returned before the long-poll finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+	m.Get("lp").Enqueue([]byte("late"))
+	assert.Equal(t, result{http.StatusOK, "late"}, <-polled)
+	assert.NoError(t, <-shutdown)
+}
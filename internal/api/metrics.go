@@ -0,0 +1,89 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"corti-kkv/internal/metrics"
+	"corti-kkv/internal/queue"
+)
+
+// Route maps a request to the route label used in HTTP metrics.
+func Route(r *http.Request) string {
+	path, prefix := r.URL.Path, ""
+	switch {
+	case path == "/admin/tenants":
+		return path
+	case strings.HasPrefix(path, "/admin/tenants/"):
+		return "/admin/tenants/{tenant}"
+	case path == "/admin/queues":
+		return path
+	case strings.HasPrefix(path, "/admin/queues/"):
+		switch _, action, ok := parseAdminQueuePath(r.URL); {
+		case !ok:
+			return "other"
+		case action == "":
+			return "/admin/queues/{name}"
+		case action == "messages", action == "purge", action == "redrive":
+			return "/admin/queues/{name}/" + action
+		}
+		return "other"
+	case path == "/ui" || strings.HasPrefix(path, "/ui/"):
+		return "/ui"
+	case strings.HasPrefix(path, "/tenants/"):
+		_, rest, _ := strings.Cut(strings.TrimPrefix(path, "/tenants/"), "/")
+		path, prefix = "/"+rest, "/tenants/{tenant}"
+	}
+	switch path {
+	case "/ws":
+		return prefix + path
+	case "/upload", "/metrics", "/healthz", "/readyz":
+		if prefix == "" {
+			return path
+		}
+	}
+	_, action, ok := parseQueuePath(path)
+	switch {
+	case !ok:
+		return "other"
+	case action == "":
+		return prefix + "/queues/{name}"
+	case action == "stream", action == "subscriptions":
+		return prefix + "/queues/{name}/" + action
+	case strings.HasPrefix(action, "subscriptions/"):
+		return prefix + "/queues/{name}/subscriptions/{id}"
+	}
+	return "other"
+}
+
+// Collect reports per-queue depth and traffic at scrape time.
+func (s *Server) Collect(e *metrics.Encoder) {
+	type queueStats struct {
+		name            string
+		depth, inflight int
+		stats           queue.Stats
+	}
+	var all []queueStats
+	for _, name := range s.Manager.Names() {
+		q := s.Manager.Get(name)
+		all = append(all, queueStats{name, q.Len(), q.Inflight(), q.Stats()})
+	}
+	families := []struct {
+		name, help, typ string
+		value           func(queueStats) float64
+	}{
+		{"kkv_queue_depth", "Messages waiting in the queue.", "gauge", func(q queueStats) float64 { return float64(q.depth) }},
+		{"kkv_queue_inflight", "Messages delivered but not yet acknowledged.", "gauge", func(q queueStats) float64 { return float64(q.inflight) }},
+		{"kkv_queue_enqueued_total", "Messages enqueued.", "counter", func(q queueStats) float64 { return float64(q.stats.Enqueued) }},
+		{"kkv_queue_dequeued_total", "Messages dequeued, counting redeliveries.", "counter", func(q queueStats) float64 { return float64(q.stats.Dequeued) }},
+		{"kkv_queue_enqueued_bytes_total", "Payload bytes enqueued.", "counter", func(q queueStats) float64 { return float64(q.stats.EnqueuedBytes) }},
+		{"kkv_queue_dequeued_bytes_total", "Payload bytes dequeued.", "counter", func(q queueStats) float64 { return float64(q.stats.DequeuedBytes) }},
+		{"kkv_queue_dead_lettered_total", "Messages that expired or ran out of deliveries.", "counter", func(q queueStats) float64 { return float64(q.stats.DeadLettered) }},
+	}
+	for _, f := range families {
+		e.Header(f.name, f.help, f.typ)
+		for _, q := range all {
+			e.Sample(f.name, f.value(q), "queue", q.name)
+		}
+	}
+}
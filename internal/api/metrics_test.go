@@ -0,0 +1,116 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"corti-kkv/internal/metrics"
+	"corti-kkv/internal/queue"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoute(t *testing.T) {
+	tests := map[string]string{
+		"/queues/lines":        "/queues/{name}",
+		"/queues/lines/":       "/queues/{name}",
+		"/queues/lines/stream": "/queues/{name}/stream",
+		"/queues/lines/other":  "other",
+		"/queues/":             "other",
+		"/ws":                  "/ws",
+		"/upload":              "/upload",
+		"/metrics":             "/metrics",
+		"/favicon.ico":         "other",
+
+		"/tenants/acme/queues/lines":        "/tenants/{tenant}/queues/{name}",
+		"/tenants/acme/queues/lines/stream": "/tenants/{tenant}/queues/{name}/stream",
+		"/tenants/acme/ws":                  "/tenants/{tenant}/ws",
+		"/tenants/acme/metrics":             "other",
+		"/admin/tenants":                    "/admin/tenants",
+		"/admin/tenants/acme":               "/admin/tenants/{tenant}",
+		"/admin/queues":                     "/admin/queues",
+		"/admin/queues/acme%2Flines":        "/admin/queues/{name}",
+		"/admin/queues/lines.dlq/redrive":   "/admin/queues/{name}/redrive",
+		"/admin/queues/lines/other":         "other",
+		"/ui/app.js":                        "/ui",
+	}
+	for path, want := range tests {
+		assert.Equal(t, want, Route(httptest.NewRequest(http.MethodGet, path, nil)), path)
+	}
+}
+
+func TestServerMetrics(t *testing.T) {
+	s := NewServer(queue.NewQueueManager())
+	reg := metrics.NewRegistry()
+	reg.Register(s)
+	ts := httptest.NewServer(metrics.NewHTTPMetrics(reg).Instrument(Route, s.Handler()))
+	defer ts.Close()
+
+	for _, body := range []string{"hello", "world!"} {
+		resp, err := http.Post(ts.URL+"/queues/m", "text/plain", strings.NewReader(body))
+		if assert.NoError(t, err) {
+			resp.Body.Close()
+		}
+	}
+	req, _ := http.NewRequest(http.MethodDelete, ts.URL+"/queues/m", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+	}
+
+	// The instrumented handler must still allow WebSocket upgrades.
+	c := dialWS(t, ts)
+	assert.Equal(t, "ok", c.call(wsCommand{Op: "enqueue", Queue: "m", Data: "x"}).Op)
+	c.conn.Close()
+
+	var buf bytes.Buffer
+	reg.WriteTo(&buf)
+	out := buf.String()
+	for _, want := range []string{
+		`kkv_queue_depth{queue="m"} 2`,
+		`kkv_queue_enqueued_total{queue="m"} 3`,
+		`kkv_queue_dequeued_total{queue="m"} 1`,
+		`kkv_queue_enqueued_bytes_total{queue="m"} 12`,
+		`kkv_queue_dequeued_bytes_total{queue="m"} 5`,
+		`http_requests_total{route="/queues/{name}",method="POST",code="202"} 2`,
+		`http_requests_total{route="/queues/{name}",method="DELETE",code="200"} 1`,
+	} {
+		assert.Contains(t, out, want)
+	}
+	// The WebSocket request is counted once its handler returns.
+	assert.Eventually(t, func() bool {
+		buf.Reset()
+		reg.WriteTo(&buf)
+		return strings.Contains(buf.String(), `http_requests_total{route="/ws",method="GET",code="101"} 1`)
+	}, time.Second, 5*time.Millisecond)
+}
+
+type stubProducer struct{ err error }
+
+func (p stubProducer) Produce(ctx context.Context, inputPath string) error { return p.err }
+func (p stubProducer) QueueLength(ctx context.Context) (int, error)        { return 0, nil }
+
+func TestUploadMetrics(t *testing.T) {
+	dir := t.TempDir()
+	ok := NewUploadServer(stubProducer{}, filepath.Join(dir, "in.txt"))
+	failing := NewUploadServer(stubProducer{err: errors.New("down")}, filepath.Join(dir, "in2.txt"))
+	for _, s := range []*UploadServer{ok, failing} {
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("a\nb\n")))
+	}
+	assert.Equal(t, float64(1), ok.uploads.Value("ok"))
+	assert.Equal(t, float64(4), ok.uploadBytes.Value())
+	assert.Equal(t, float64(1), failing.uploads.Value("error"))
+
+	var buf bytes.Buffer
+	reg := metrics.NewRegistry()
+	reg.Register(ok)
+	reg.WriteTo(&buf)
+	assert.Contains(t, buf.String(), `kkv_upload_duration_seconds_count{result="ok"} 1`)
+}
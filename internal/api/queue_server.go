@@ -1,42 +1,200 @@
 package api
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"corti-kkv/internal/auth"
+	"corti-kkv/internal/frame"
 	"corti-kkv/internal/queue"
+	"corti-kkv/internal/ratelimit"
+	"corti-kkv/internal/tenant"
+	"corti-kkv/internal/trace"
+	"corti-kkv/internal/webhook"
+)
+
+const (
+	// MaxBatch caps the number of messages returned by one batch dequeue.
+	MaxBatch = 1000
+	// MaxBatchBytes caps the payload returned by one batch dequeue. A first
+	// message that is larger is returned on its own.
+	MaxBatchBytes = 64 << 20
+	// MaxWait caps how long a dequeue may long-poll for messages.
+	MaxWait = 20 * time.Second
+	// PriorityHeader sets the priority of an enqueued message, 1 to 9 with
+	// higher delivered first. Messages without it get the queue's default.
+	PriorityHeader = "X-Priority"
+	// AttributeHeaderPrefix starts the headers that set the attributes of
+	// an enqueued message, and of a dequeued one in the answer; the rest of
+	// the header name, in lower case, is the attribute's name.
+	AttributeHeaderPrefix = "X-Attr-"
+	// MaxAttributes caps the attributes of one message.
+	MaxAttributes = 32
 )
 
 type Server struct {
 	Manager *queue.QueueManager
+	// Auth, when set, requires every request to carry a bearer token with
+	// permission on the queue it touches.
+	Auth *auth.Store
+	// Limiter, when set, throttles enqueues and dequeues.
+	Limiter *ratelimit.Limiter
+	// Tracer, when set, records enqueue and dequeue spans. Trace context is
+	// stored with messages either way.
+	Tracer *trace.Tracer
+	// Tenants, when set, restricts which tenants exist and enforces their
+	// quotas. Without it any valid tenant name may be used without limits.
+	Tenants *tenant.Config
+	// Webhooks, when set, serves push subscriptions of queues.
+	Webhooks *webhook.Dispatcher
+
+	streamsMu sync.Mutex
+	streams   map[string]*streamLog
+
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
 func NewServer(m *queue.QueueManager) *Server {
-	return &Server{Manager: m}
+	return &Server{Manager: m, done: make(chan struct{})}
+}
+
+// Shutdown ends open event streams and WebSocket sessions, which would
+// otherwise never finish, so that http.Server.Shutdown only has to wait for
+// ordinary requests and long-polls. Register it with RegisterOnShutdown.
+func (s *Server) Shutdown() {
+	s.closeOnce.Do(func() { close(s.done) })
 }
 
 func (s *Server) Handler() http.Handler {
 	return http.HandlerFunc(s.handle)
 }
 
-func parseQueuePath(p string) (string, bool) {
+// parseQueuePath splits /queues/{name}[/{action}] into its parts.
+func parseQueuePath(p string) (name, action string, ok bool) {
 	if !strings.HasPrefix(p, "/queues/") {
-		return "", false
+		return "", "", false
+	}
+	rest := strings.Trim(strings.TrimPrefix(p, "/queues/"), "/")
+	name, action, _ = strings.Cut(rest, "/")
+	if id, ok := strings.CutPrefix(action, "subscriptions/"); ok {
+		return name, action, id != "" && !strings.Contains(id, "/")
+	}
+	if name == "" || strings.Contains(action, "/") {
+		return "", "", false
+	}
+	return name, action, true
+}
+
+// authenticate resolves the caller's token or, failing that, its verified
+// client certificate, answering 401 if neither is known. The principal is
+// nil when authentication is disabled.
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request) (*auth.Principal, bool) {
+	if s.Auth == nil {
+		return nil, true
+	}
+	if token := auth.Token(r); token != "" {
+		if p, ok := s.Auth.Lookup(token); ok {
+			return p, true
+		}
+	} else if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		if p, ok := s.Auth.LookupCert(r.TLS.VerifiedChains[0][0]); ok {
+			return p, true
+		}
+	} else if p, ok := s.Auth.Anonymous(); ok {
+		return p, true
+	}
+	w.Header().Set("WWW-Authenticate", `Bearer realm="kkv"`)
+	http.Error(w, "missing or invalid token", http.StatusUnauthorized)
+	return nil, false
+}
+
+// authorize answers 403 unless p holds one of perms on the named queue of
+// ns.
+func authorize(w http.ResponseWriter, p *auth.Principal, ns *queue.View, name string, perms auth.Permission) bool {
+	if allowed(p, ns, name, perms) {
+		return true
+	}
+	http.Error(w, fmt.Sprintf("token lacks %s permission on queue %q", perms, name), http.StatusForbidden)
+	return false
+}
+
+// allowed reports whether p holds one of perms on the named queue of ns.
+// The grants of a principal confined to a tenant apply to the queue names
+// within it; those of other principals to stored names, so that a grant
+// such as lines*:produce does not reach acme/lines.
+func allowed(p *auth.Principal, ns *queue.View, name string, perms auth.Permission) bool {
+	if isAdmin(p) {
+		return true
+	}
+	if p.Tenant == "" {
+		name = ns.Name(name)
+	}
+	return p.Allowed(name, perms)
+}
+
+// clientKey identifies the caller for rate limiting: its principal when
+// authenticated, otherwise its IP address.
+func clientKey(r *http.Request, p *auth.Principal) string {
+	if p != nil && p.Name != auth.AnonymousName {
+		return "id:" + p.Name
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// allow answers 429 with Retry-After if op on the named queue is throttled.
+func (s *Server) allow(w http.ResponseWriter, r *http.Request, p *auth.Principal, op, name string) bool {
+	if s.Limiter == nil {
+		return true
 	}
-	name := strings.Trim(strings.TrimPrefix(p, "/queues/"), "/")
-	if name == "" || strings.Contains(name, "/") {
-		return "", false
+	ok, wait := s.Limiter.Allow(op, name, clientKey(r, p))
+	if ok {
+		return true
 	}
-	return name, true
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+	return false
 }
 
 func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
-	name, ok := parseQueuePath(r.URL.Path)
+	p, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/admin/tenants") {
+		s.handleTenantAdmin(w, r, p)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/admin/queues") {
+		s.handleQueueAdmin(w, r, p)
+		return
+	}
+	ns, path, ok := s.namespace(w, r, p)
 	if !ok {
-		if strings.HasPrefix(r.URL.Path, "/queues/") {
+		return
+	}
+	if path == "/ws" {
+		s.handleWebSocket(w, r, p, ns)
+		return
+	}
+	name, action, ok := parseQueuePath(path)
+	if !ok {
+		if strings.HasPrefix(path, "/queues/") {
 			http.Error(w, "missing or invalid queue name", http.StatusBadRequest)
 		} else {
 			http.NotFound(w, r)
@@ -44,22 +202,72 @@ func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	switch {
+	case action == "":
+	case action == "stream":
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorize(w, p, ns, name, auth.Consume) {
+			return
+		}
+		s.handleStream(w, r, ns, name)
+		return
+	case action == "subscriptions" || strings.HasPrefix(action, "subscriptions/"):
+		if !authorize(w, p, ns, name, auth.Consume) {
+			return
+		}
+		s.handleSubscriptions(w, r, ns, name, action)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	var need auth.Permission
+	var op string
 	switch r.Method {
 	case http.MethodHead:
-		q := s.Manager.Get(name)
+		need = auth.Produce | auth.Consume
+	case http.MethodPost:
+		need, op = auth.Produce, "enqueue"
+	case http.MethodDelete:
+		need, op = auth.Consume, "dequeue"
+	}
+	if need != 0 && !authorize(w, p, ns, name, need) {
+		return
+	}
+	if op != "" && !s.allow(w, r, p, op, ns.Name(name)) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		q, err := s.openQueue(ns, name)
+		if err != nil {
+			writeQuotaError(w, err)
+			return
+		}
 		w.Header().Set("X-Queue-Len", fmt.Sprintf("%d", q.Len()))
 		w.WriteHeader(http.StatusOK)
 	case http.MethodPost:
-		s.handleEnqueue(w, r, name)
+		s.handleEnqueue(w, r, ns, name)
 	case http.MethodDelete:
-		s.handleDequeue(w, name)
+		s.handleDequeue(w, r, ns, name)
 	default:
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
-func (s *Server) handleEnqueue(w http.ResponseWriter, r *http.Request, name string) {
-	body, err := io.ReadAll(r.Body)
+func (s *Server) handleEnqueue(w http.ResponseWriter, r *http.Request, ns *queue.View, name string) {
+	// A message must fit one frame of a batch dequeue.
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, frame.MaxFrameSize))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf("body larger than %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+		return
+	}
 	if err != nil {
 		http.Error(w, "failed to read body", http.StatusBadRequest)
 		return
@@ -71,20 +279,264 @@ func (s *Server) handleEnqueue(w http.ResponseWriter, r *http.Request, name stri
 		http.Error(w, "empty body", http.StatusBadRequest)
 		return
 	}
-	log.Printf("received on queue: %q (%d bytes)", name, len(body))
-	q := s.Manager.Get(name)
-	q.Enqueue(body)
+	prio, err := parsePriority(r.Header.Get(PriorityHeader))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	attrs, err := parseAttributes(r.Header)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if isFramed(r) {
+		s.handleEnqueueBatch(w, r, ns, name, body, queue.Message{Priority: prio, Attributes: attrs})
+		return
+	}
+	q, qerr := s.openQueue(ns, name)
+	if qerr == nil {
+		qerr = s.checkQuota(ns, len(body))
+	}
+	if qerr != nil {
+		writeQuotaError(w, qerr)
+		return
+	}
+	name = ns.Name(name)
+	ctx, span := s.Tracer.Start(r.Context(), "enqueue", trace.Server)
+	defer span.End()
+	span.SetAttr("queue", name)
+	span.SetAttr("bytes", len(body))
+	sc := trace.FromContext(ctx)
+	id, err := q.Push(queue.Message{Body: body, Priority: prio, Attributes: attrs, Traceparent: sc.Traceparent(), Tracestate: sc.State}, false)
+	if err != nil {
+		span.SetError(err)
+		http.Error(w, err.Error(), pushErrorStatus(err))
+		return
+	}
+	span.SetAttr("message_id", int64(id))
+	slog.DebugContext(ctx, "enqueued", "queue", name, "bytes", len(body))
+	trace.Inject(sc, w.Header())
 	w.WriteHeader(http.StatusAccepted)
 }
 
-func (s *Server) handleDequeue(w http.ResponseWriter, name string) {
-	q := s.Manager.Get(name)
-	msg := q.Dequeue()
-	if len(msg) == 0 {
+func (s *Server) handleDequeue(w http.ResponseWriter, r *http.Request, ns *queue.View, name string) {
+	max, batch, err := parseMax(r.URL.Query().Get("max"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	wait, err := parseWait(r.URL.Query().Get("wait"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sel, err := queue.ParseSelector(r.URL.Query().Get("selector"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q, qerr := s.openQueue(ns, name)
+	if qerr != nil {
+		writeQuotaError(w, qerr)
+		return
+	}
+	name = ns.Name(name)
+	// The messages stay in flight until the answer is written, so that they
+	// go back to the queue if it cannot be.
+	taken := waitDequeue(r.Context(), q, sel, max, wait)
+	settle := func(ok bool) {
+		for _, m := range taken {
+			if ok {
+				q.Ack(m.ID)
+			} else {
+				q.Release(m.ID)
+			}
+		}
+	}
+	msgs := s.traceDequeue(r.Context(), name, taken)
+	if len(msgs) == 0 || (!batch && len(msgs[0].body) == 0) {
+		settle(true)
 		w.WriteHeader(http.StatusNoContent)
 		return
 	}
-	w.Header().Set("Content-Type", "application/octet-stream")
+	if !batch {
+		trace.Inject(msgs[0].sc, w.Header())
+		for k, v := range msgs[0].attrs {
+			w.Header().Set(AttributeHeaderPrefix+k, v)
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.WriteHeader(http.StatusOK)
+		_, err = w.Write(msgs[0].body)
+		settle(err == nil)
+		return
+	}
+	var buf bytes.Buffer
+	ct := frame.ContentType
+	if acceptsTraced(r) {
+		ct = frame.TracedContentType
+		out := make([]frame.Message, len(msgs))
+		for i, m := range msgs {
+			out[i] = frame.Message{Body: m.body, Traceparent: m.sc.Traceparent(), Tracestate: m.sc.State}
+		}
+		err = frame.WriteMessages(&buf, out)
+	} else {
+		bodies := make([][]byte, len(msgs))
+		for i, m := range msgs {
+			bodies[i] = m.body
+		}
+		err = frame.Write(&buf, bodies)
+	}
+	if err != nil {
+		settle(false)
+		http.Error(w, "failed to encode batch", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", ct)
+	w.Header().Set("X-Batch-Count", strconv.Itoa(len(msgs)))
 	w.WriteHeader(http.StatusOK)
-	_, _ = w.Write(msg)
+	_, err = w.Write(buf.Bytes())
+	settle(err == nil)
+}
+
+// acceptsTraced reports whether the client asked for batches with trace
+// context per message.
+func acceptsTraced(r *http.Request) bool {
+	for _, v := range r.Header.Values("Accept") {
+		if strings.Contains(v, frame.TracedContentType) {
+			return true
+		}
+	}
+	return false
+}
+
+// tracedMessage is a dequeued body with the trace context handed to the
+// consumer.
+type tracedMessage struct {
+	body  []byte
+	attrs map[string]string
+	sc    trace.SpanContext
+}
+
+// traceDequeue records a dequeue span per message in the message's own
+// trace, linked to the consumer's request, and returns the context to pass
+// on: the dequeue span's, or the stored one when tracing is off.
+func (s *Server) traceDequeue(ctx context.Context, name string, msgs []queue.Message) []tracedMessage {
+	consumer := trace.FromContext(ctx)
+	out := make([]tracedMessage, len(msgs))
+	for i, m := range msgs {
+		out[i].body, out[i].attrs = m.Body, m.Attributes
+		sc, ok := trace.Parse(m.Traceparent, m.Tracestate)
+		if !ok {
+			continue
+		}
+		_, span := s.Tracer.Start(trace.ContextWithSpanContext(ctx, sc), "dequeue", trace.Server)
+		if span != nil {
+			span.SetAttr("queue", name)
+			span.SetAttr("message_id", int64(m.ID))
+			span.AddLink(consumer)
+			span.End()
+			sc = span.Context()
+		}
+		out[i].sc = sc
+	}
+	return out
+}
+
+// waitDequeue reserves up to max messages matching sel from q, at most
+// MaxBatchBytes of them, waiting up to wait for the first one to arrive if
+// there is none.
+func waitDequeue(ctx context.Context, q *queue.Queue, sel *queue.Selector, max int, wait time.Duration) []queue.Message {
+	var timeout <-chan time.Time
+	if wait > 0 {
+		t := time.NewTimer(wait)
+		defer t.Stop()
+		timeout = t.C
+	}
+	for {
+		ready := q.Ready()
+		if msgs := q.ReserveWithin(sel, max, MaxBatchBytes); len(msgs) > 0 || wait <= 0 {
+			return msgs
+		}
+		select {
+		case <-ready:
+		case <-timeout:
+			return nil
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// parseMax reads the max query parameter. batch reports whether the caller
+// asked for a framed batch response rather than a single raw message.
+func parseMax(v string) (max int, batch bool, err error) {
+	if v == "" {
+		return 1, false, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 0, false, fmt.Errorf("invalid max: %q", v)
+	}
+	if n > MaxBatch {
+		n = MaxBatch
+	}
+	return n, true, nil
+}
+
+// parseWait reads the wait query parameter, either a Go duration or a
+// number of seconds.
+func parseWait(v string) (time.Duration, error) {
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		secs, convErr := strconv.Atoi(v)
+		if convErr != nil {
+			return 0, fmt.Errorf("invalid wait: %q", v)
+		}
+		d = time.Duration(secs) * time.Second
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("invalid wait: %q", v)
+	}
+	if d > MaxWait {
+		d = MaxWait
+	}
+	return d, nil
+}
+
+// parsePriority reads the X-Priority header, where empty means the queue's
+// default.
+func parsePriority(v string) (uint8, error) {
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 || n > queue.MaxPriority {
+		return 0, fmt.Errorf("invalid priority: %q, want 1 to %d", v, queue.MaxPriority)
+	}
+	return uint8(n), nil
+}
+
+// parseAttributes collects the message attributes set by X-Attr-* headers.
+func parseAttributes(h http.Header) (map[string]string, error) {
+	var attrs map[string]string
+	for k, vs := range h {
+		name, ok := strings.CutPrefix(k, AttributeHeaderPrefix)
+		if !ok || len(vs) == 0 {
+			continue
+		}
+		if name == "" {
+			return nil, fmt.Errorf("attribute header %q lacks a name", k)
+		}
+		if attrs == nil {
+			attrs = make(map[string]string)
+		}
+		attrs[strings.ToLower(name)] = vs[0]
+	}
+	if len(attrs) > MaxAttributes {
+		return nil, fmt.Errorf("too many attributes: %d, limit is %d", len(attrs), MaxAttributes)
+	}
+	return attrs, nil
 }
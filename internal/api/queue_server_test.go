@@ -2,12 +2,21 @@ package api
 
 import (
 	"bytes"
+	"corti-kkv/internal/auth"
+	"corti-kkv/internal/frame"
 	"corti-kkv/internal/queue"
+	"corti-kkv/internal/ratelimit"
+	"corti-kkv/internal/tlsutil"
+	"corti-kkv/internal/tlsutil/tlstest"
+	"corti-kkv/internal/trace"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -99,3 +108,447 @@ func TestServer(t *testing.T) {
 		})
 	}
 }
+
+func TestServerBatchDequeue(t *testing.T) {
+	tests := []struct {
+		name      string
+		pushes    []string
+		query     string
+		want      int
+		expect    []string
+		remaining int
+	}{
+		{name: "MaxAboveLength_ReturnsAll", pushes: []string{"a\n", "b\n"}, query: "?max=10", want: http.StatusOK, expect: []string{"a\n", "b\n"}},
+		{name: "MaxBelowLength_ReturnsFirstN", pushes: []string{"a", "b", "c"}, query: "?max=2", want: http.StatusOK, expect: []string{"a", "b"}, remaining: 1},
+		{name: "EmptyQueue_Returns204", query: "?max=5", want: http.StatusNoContent},
+		{name: "InvalidMax_Returns400", pushes: []string{"a"}, query: "?max=0", want: http.StatusBadRequest, remaining: 1},
+		{name: "InvalidWait_Returns400", pushes: []string{"a"}, query: "?max=1&wait=soon", want: http.StatusBadRequest, remaining: 1},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			m := queue.NewQueueManager()
+			ts := httptest.NewServer(NewServer(m).Handler())
+			defer ts.Close()
+			for _, p := range tc.pushes {
+				m.Get("b").Enqueue([]byte(p))
+			}
+			req, err := http.NewRequest(http.MethodDelete, ts.URL+"/queues/b"+tc.query, nil)
+			assert.NoError(t, err)
+			resp, err := http.DefaultClient.Do(req)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer resp.Body.Close()
+			assert.Equal(t, tc.want, resp.StatusCode)
+			if tc.want == http.StatusOK {
+				assert.Equal(t, frame.ContentType, resp.Header.Get("Content-Type"))
+				msgs, err := frame.Read(resp.Body)
+				assert.NoError(t, err)
+				var got []string
+				for _, m := range msgs {
+					got = append(got, string(m))
+				}
+				assert.Equal(t, tc.expect, got)
+			}
+			assert.Equal(t, tc.remaining, m.Get("b").Len())
+		})
+	}
+}
+
+func TestServerBatchDequeueBytes(t *testing.T) {
+	m := queue.NewQueueManager()
+	ts := httptest.NewServer(NewServer(m).Handler())
+	defer ts.Close()
+	dequeue := func() *http.Response {
+		req, _ := http.NewRequest(http.MethodDelete, ts.URL+"/queues/b?max=10", nil)
+		resp, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+	q := m.Get("b")
+	half := make([]byte, MaxBatchBytes/2+1)
+	q.Enqueue(half)
+	q.Enqueue(half)
+	resp := dequeue()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("X-Batch-Count"))
+	assert.Equal(t, 1, q.Len())
+
+	q.Purge()
+	q.Enqueue(make([]byte, frame.MaxFrameSize+1))
+	resp = dequeue()
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	assert.Equal(t, 1, q.Len(), "a batch that cannot be encoded goes back")
+	assert.Equal(t, 0, q.Inflight())
+}
+
+func TestServerEnqueueTooLarge(t *testing.T) {
+	m := queue.NewQueueManager()
+	ts := httptest.NewServer(NewServer(m).Handler())
+	defer ts.Close()
+	enqueue := func(size int) int {
+		resp, err := http.Post(ts.URL+"/queues/big", "application/octet-stream", bytes.NewReader(make([]byte, size)))
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusRequestEntityTooLarge, enqueue(frame.MaxFrameSize+1))
+	assert.Equal(t, 0, m.Get("big").Len())
+	assert.Equal(t, http.StatusAccepted, enqueue(frame.MaxFrameSize))
+	assert.Equal(t, 1, m.Get("big").Len())
+}
+
+func TestServerLongPollDequeue(t *testing.T) {
+	m := queue.NewQueueManager()
+	ts := httptest.NewServer(NewServer(m).Handler())
+	defer ts.Close()
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		m.Get("lp").Enqueue([]byte("late"))
+	}()
+	start := time.Now()
+	req, _ := http.NewRequest(http.MethodDelete, ts.URL+"/queues/lp?wait=2s", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	b, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "late", string(b))
+	assert.Less(t, time.Since(start), time.Second)
+
+	req, _ = http.NewRequest(http.MethodDelete, ts.URL+"/queues/lp?max=3&wait=30ms", nil)
+	resp, err = http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		_ = resp.Body.Close()
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	}
+}
+
+func TestServerAuth(t *testing.T) {
+	store, err := auth.Parse(strings.NewReader("up uploader lines:produce\nwk worker lines:consume\n"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	s := NewServer(queue.NewQueueManager())
+	s.Auth = store
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		want   int
+	}{
+		{name: "NoToken_Returns401", method: http.MethodPost, path: "/queues/lines", want: http.StatusUnauthorized},
+		{name: "UnknownToken_Returns401", method: http.MethodPost, path: "/queues/lines", token: "bad", want: http.StatusUnauthorized},
+		{name: "ProduceAllowed", method: http.MethodPost, path: "/queues/lines", token: "up", want: http.StatusAccepted},
+		{name: "ProduceOtherQueue_Returns403", method: http.MethodPost, path: "/queues/other", token: "up", want: http.StatusForbidden},
+		{name: "ConsumeWithoutPermission_Returns403", method: http.MethodDelete, path: "/queues/lines", token: "up", want: http.StatusForbidden},
+		{name: "HeadWithProduce", method: http.MethodHead, path: "/queues/lines", token: "up", want: http.StatusOK},
+		{name: "ConsumeAllowed", method: http.MethodDelete, path: "/queues/lines", token: "wk", want: http.StatusOK},
+		{name: "StreamWithoutConsume_Returns403", method: http.MethodGet, path: "/queues/lines/stream", token: "up", want: http.StatusForbidden},
+		{name: "QueryToken", method: http.MethodPost, path: "/queues/lines?access_token=up", want: http.StatusAccepted},
+		{name: "WebSocketWithoutToken_Returns401", method: http.MethodGet, path: "/ws", want: http.StatusUnauthorized},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tc.method, ts.URL+tc.path, strings.NewReader("x"))
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if !assert.NoError(t, err) {
+				return
+			}
+			resp.Body.Close()
+			assert.Equal(t, tc.want, resp.StatusCode)
+			if tc.want == http.StatusUnauthorized {
+				assert.Contains(t, resp.Header.Get("WWW-Authenticate"), "Bearer")
+			}
+		})
+	}
+}
+
+func TestServerClientCertificateIdentity(t *testing.T) {
+	ca := tlstest.NewCA(t, "test-ca")
+	srvCert, srvKey := ca.Server()
+	cliCert, cliKey := ca.Client("worker-1")
+
+	store, err := auth.Parse(strings.NewReader("cert:worker-1 worker lines:consume\n"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	s := NewServer(queue.NewQueueManager())
+	s.Auth = store
+	s.Manager.Get("lines").Enqueue([]byte("hello"))
+	ts := httptest.NewUnstartedServer(s.Handler())
+	ts.TLS, err = tlsutil.ServerConfig(srvCert, srvKey, ca.CertFile)
+	if !assert.NoError(t, err) {
+		return
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	cfg, err := tlsutil.ClientConfig(ca.CertFile, cliCert, cliKey)
+	if !assert.NoError(t, err) {
+		return
+	}
+	c := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+	do := func(method, path string) int {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader("x"))
+		resp, err := c.Do(req)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusOK, do(http.MethodDelete, "/queues/lines"))
+	assert.Equal(t, http.StatusForbidden, do(http.MethodPost, "/queues/lines"))
+}
+
+func TestServerRateLimit(t *testing.T) {
+	s := NewServer(queue.NewQueueManager())
+	s.Limiter = ratelimit.New(nil, []ratelimit.Rule{{Pattern: "slow", Limit: ratelimit.Limit{Rate: 0.1, Burst: 2}}})
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	post := func(name string) *http.Response {
+		resp, err := http.Post(ts.URL+"/queues/"+name, "text/plain", strings.NewReader("x"))
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		resp.Body.Close()
+		return resp
+	}
+	assert.Equal(t, http.StatusAccepted, post("slow").StatusCode)
+	assert.Equal(t, http.StatusAccepted, post("slow").StatusCode)
+	resp := post("slow")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "10", resp.Header.Get("Retry-After"))
+	assert.Equal(t, http.StatusAccepted, post("fast").StatusCode, "queues without a rule are not limited")
+
+	req, _ := http.NewRequest(http.MethodDelete, ts.URL+"/queues/slow", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode, "dequeues have their own bucket")
+	}
+	assert.Equal(t, 1, s.Manager.Get("slow").Len())
+}
+
+func TestServerTraceContext(t *testing.T) {
+	const tp1 = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	const tp2 = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	s := NewServer(queue.NewQueueManager())
+	ts := httptest.NewServer(trace.Middleware(s.Handler()))
+	defer ts.Close()
+
+	do := func(method, path, body string, hdr ...string) *http.Response {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		for i := 0; i+1 < len(hdr); i += 2 {
+			req.Header.Set(hdr[i], hdr[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return resp
+	}
+
+	resp := do(http.MethodPost, "/queues/t", "one", "traceparent", tp1, "tracestate", "k=v")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.Equal(t, tp1, resp.Header.Get("traceparent"), "without a tracer the incoming context is stored as is")
+	do(http.MethodPost, "/queues/t", "two", "traceparent", tp2).Body.Close()
+	do(http.MethodPost, "/queues/t", "three").Body.Close()
+
+	resp = do(http.MethodDelete, "/queues/t", "")
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "one", string(body))
+	assert.Equal(t, tp1, resp.Header.Get("traceparent"))
+	assert.Equal(t, "k=v", resp.Header.Get("tracestate"))
+
+	// Batches carry trace context only for clients that ask for it.
+	s.Manager.Get("t").EnqueueFront([]byte("zero"))
+	resp = do(http.MethodDelete, "/queues/t?max=1", "")
+	assert.Equal(t, frame.ContentType, resp.Header.Get("Content-Type"))
+	resp.Body.Close()
+	resp = do(http.MethodDelete, "/queues/t?max=10", "", "Accept", frame.TracedContentType)
+	defer resp.Body.Close()
+	assert.Equal(t, frame.TracedContentType, resp.Header.Get("Content-Type"))
+	msgs, err := frame.ReadMessages(resp.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, []frame.Message{
+		{Body: []byte("two"), Traceparent: tp2},
+		{Body: []byte("three")},
+	}, msgs)
+}
+
+func TestServerQueueOptions(t *testing.T) {
+	m := queue.NewQueueManager()
+	m.SetPolicy(func(name string) queue.Options { return queue.Options{MaxLen: 2} })
+	ts := httptest.NewServer(NewServer(m).Handler())
+	defer ts.Close()
+
+	post := func(body, priority string) int {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/queues/jobs", strings.NewReader(body))
+		if priority != "" {
+			req.Header.Set(PriorityHeader, priority)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusBadRequest, post("a", "0"))
+	assert.Equal(t, http.StatusBadRequest, post("a", "high"))
+	assert.Equal(t, http.StatusAccepted, post("low", ""))
+	assert.Equal(t, http.StatusAccepted, post("urgent", "9"))
+	assert.Equal(t, http.StatusInsufficientStorage, post("more", ""))
+
+	req, _ := http.NewRequest(http.MethodDelete, ts.URL+"/queues/jobs", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "urgent", string(body))
+	}
+}
+
+func TestServerAnonymousAccess(t *testing.T) {
+	store, err := auth.Parse(strings.NewReader("wk worker *:consume\n"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	store.SetAnonymous(queue.DefaultNamespace, []auth.Grant{{Pattern: "public.*", Perms: auth.Consume}})
+	s := NewServer(queue.NewQueueManager())
+	s.Auth = store
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		want   int
+	}{
+		{name: "AnonymousConsume", method: http.MethodDelete, path: "/queues/public.news", want: http.StatusNoContent},
+		{name: "AnonymousProduce_Returns403", method: http.MethodPost, path: "/queues/public.news", want: http.StatusForbidden},
+		{name: "AnonymousOtherQueue_Returns403", method: http.MethodDelete, path: "/queues/jobs", want: http.StatusForbidden},
+		{name: "AnonymousTenant_Returns403", method: http.MethodDelete, path: "/tenants/acme/queues/public.news", want: http.StatusForbidden},
+		{name: "BadToken_Returns401", method: http.MethodDelete, path: "/queues/public.news", token: "bad", want: http.StatusUnauthorized},
+		{name: "Token", method: http.MethodDelete, path: "/queues/jobs", token: "wk", want: http.StatusNoContent},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tc.method, ts.URL+tc.path, strings.NewReader("x"))
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if !assert.NoError(t, err) {
+				return
+			}
+			resp.Body.Close()
+			assert.Equal(t, tc.want, resp.StatusCode)
+		})
+	}
+}
+
+func TestServerSelectors(t *testing.T) {
+	m := queue.NewQueueManager()
+	ts := httptest.NewServer(NewServer(m).Handler())
+	defer ts.Close()
+
+	do := func(method, path, body string, header map[string]string) (*http.Response, string) {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp, string(b)
+	}
+	for i, source := range []string{"upload-41", "upload-42", "upload-42", "cli"} {
+		resp, _ := do(http.MethodPost, "/queues/lines", "line"+strconv.Itoa(i), map[string]string{"X-Attr-Source": source, "X-Attr-Size": strconv.Itoa(i * 10)})
+		assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	}
+	resp, _ := do(http.MethodPost, "/queues/lines", "plain", nil)
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	resp, body := do(http.MethodDelete, "/queues/lines?selector="+url.QueryEscape("source = upload-42"), "", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "line1", body)
+	assert.Equal(t, "upload-42", resp.Header.Get("X-Attr-Source"))
+	assert.Equal(t, "10", resp.Header.Get("X-Attr-Size"))
+
+	resp, body = do(http.MethodGet, "/admin/queues/lines/messages?selector="+url.QueryEscape("source IN (cli, upload-41)"), "", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, body, `"data":"line0","bytes":5,"attributes":{"size":"0","source":"upload-41"}`)
+	assert.Contains(t, body, `"data":"line3"`)
+	assert.NotContains(t, body, `"data":"line2"`)
+
+	resp, body = do(http.MethodDelete, "/queues/lines?max=10&selector="+url.QueryEscape("source ^= upload AND size >= 0"), "", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	msgs, err := frame.Read(strings.NewReader(body))
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("line0"), []byte("line2")}, msgs)
+
+	resp, _ = do(http.MethodDelete, "/queues/lines?selector="+url.QueryEscape("source = nobody"), "", nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp, body = do(http.MethodDelete, "/queues/lines?selector="+url.QueryEscape("size > big"), "", nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Contains(t, body, "invalid selector")
+	assert.Equal(t, []string{"line3", "plain"}, bodies(m.Get("lines").Peek(10)), "unselected messages keep their order")
+
+	done := make(chan string)
+	go func() {
+		_, body := do(http.MethodDelete, "/queues/lines?wait=2s&selector="+url.QueryEscape("source = late"), "", nil)
+		done <- body
+	}()
+	time.Sleep(20 * time.Millisecond)
+	do(http.MethodPost, "/queues/lines", "other", map[string]string{"X-Attr-Source": "early"})
+	do(http.MethodPost, "/queues/lines", "wanted", map[string]string{"X-Attr-Source": "late"})
+	select {
+	case body := <-done:
+		assert.Equal(t, "wanted", body)
+	case <-time.After(3 * time.Second):
+		t.Fatal("long poll with selector did not return")
+	}
+
+	many := map[string]string{}
+	for i := 0; i <= MaxAttributes; i++ {
+		many["X-Attr-A"+strconv.Itoa(i)] = "x"
+	}
+	resp, body = do(http.MethodPost, "/queues/lines", "x", many)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Contains(t, body, "too many attributes")
+}
+
+func bodies(msgs []queue.Message) []string {
+	out := make([]string, len(msgs))
+	for i, m := range msgs {
+		out[i] = string(m.Body)
+	}
+	return out
+}
@@ -0,0 +1,253 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"corti-kkv/internal/queue"
+)
+
+const (
+	// StreamHistory is how many streamed messages per queue are kept so a
+	// reconnecting client can resume from its Last-Event-ID.
+	StreamHistory = 1024
+	// StreamHistoryAge is how long a streamed message can be resumed from.
+	// A queue's history is dropped once it has had no streams for as long.
+	StreamHistoryAge = 5 * time.Minute
+	// StreamRetry is the reconnect delay advertised to clients, in
+	// milliseconds.
+	StreamRetry = 1000
+
+	streamHeartbeat    = 15 * time.Second
+	streamWriteTimeout = 30 * time.Second
+)
+
+// streamLog remembers recently streamed messages per stream session.
+type streamLog struct {
+	mu     sync.Mutex
+	events []streamEvent
+	// streams counts the open streams of the queue and idle is when the
+	// last one closed; both are guarded by Server.streamsMu.
+	streams int
+	idle    time.Time
+}
+
+type streamEvent struct {
+	session string
+	msg     queue.Message
+	at      time.Time
+}
+
+func (l *streamLog) add(session string, m queue.Message) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.events = append(l.events, streamEvent{session: session, msg: m, at: now})
+	l.expire(now)
+}
+
+// expire drops the events beyond StreamHistory and those older than
+// StreamHistoryAge. The caller must hold l.mu.
+func (l *streamLog) expire(now time.Time) {
+	i := 0
+	for i < len(l.events) && (len(l.events)-i > StreamHistory || now.Sub(l.events[i].at) >= StreamHistoryAge) {
+		i++
+	}
+	clear(l.events[:i])
+	l.events = l.events[i:]
+}
+
+// since returns the messages streamed to session after the one with ID
+// after, oldest first.
+func (l *streamLog) since(session string, after uint64) []queue.Message {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.expire(time.Now())
+	var out []queue.Message
+	for _, ev := range l.events {
+		if ev.session == session && ev.msg.ID > after {
+			out = append(out, ev.msg)
+		}
+	}
+	return out
+}
+
+// openStream returns the history of the named queue for a new stream,
+// which must call closeStream when done.
+func (s *Server) openStream(name string) *streamLog {
+	s.streamsMu.Lock()
+	defer s.streamsMu.Unlock()
+	if s.streams == nil {
+		s.streams = make(map[string]*streamLog)
+	}
+	l := s.streams[name]
+	if l == nil {
+		l = &streamLog{}
+		s.streams[name] = l
+	}
+	l.streams++
+	return l
+}
+
+// closeStream ends a stream of the named queue. Once the queue has had no
+// streams for StreamHistoryAge, its history is dropped.
+func (s *Server) closeStream(name string, l *streamLog) {
+	s.streamsMu.Lock()
+	defer s.streamsMu.Unlock()
+	if l.streams--; l.streams == 0 {
+		l.idle = time.Now()
+		time.AfterFunc(StreamHistoryAge, func() { s.pruneStreams(time.Now()) })
+	}
+}
+
+// pruneStreams drops the histories of queues without streams since
+// StreamHistoryAge before now.
+func (s *Server) pruneStreams(now time.Time) {
+	s.streamsMu.Lock()
+	defer s.streamsMu.Unlock()
+	for name, l := range s.streams {
+		if l.streams == 0 && now.Sub(l.idle) >= StreamHistoryAge {
+			delete(s.streams, name)
+		}
+	}
+}
+
+// handleStream pushes messages from the queue to the client as server-sent
+// events. A message is only taken off the queue once the previous event has
+// been written and flushed, so a slow reader holds messages back in the
+// queue rather than in server memory.
+func (s *Server) handleStream(w http.ResponseWriter, r *http.Request, ns *queue.View, name string) {
+	rc := http.NewResponseController(w)
+	encode := encodeText
+	switch r.URL.Query().Get("encoding") {
+	case "", "text":
+	case "base64":
+		encode = encodeBase64
+	default:
+		http.Error(w, "invalid encoding", http.StatusBadRequest)
+		return
+	}
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("lastEventId")
+	}
+	session, after, err := parseEventID(lastID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if session == "" {
+		session = newStreamSession()
+	}
+	q, qerr := s.openQueue(ns, name)
+	if qerr != nil {
+		writeQuotaError(w, qerr)
+		return
+	}
+	name = ns.Name(name)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if _, err := fmt.Fprintf(w, "retry: %d\n\n", StreamRetry); err != nil {
+		return
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	history := s.openStream(name)
+	defer s.closeStream(name, history)
+	for _, m := range history.since(session, after) {
+		if err := writeEvent(w, rc, session, m, encode); err != nil {
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		ready := q.Ready()
+		if msgs := q.TakeN(1); len(msgs) > 0 {
+			// Record before writing so a failed write is replayed on resume.
+			history.add(session, msgs[0])
+			if err := writeEvent(w, rc, session, msgs[0], encode); err != nil {
+				return
+			}
+			continue
+		}
+		select {
+		case <-ready:
+		case <-heartbeat.C:
+			_ = rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+			if _, err := io.WriteString(w, ": ping\n\n"); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func writeEvent(w io.Writer, rc *http.ResponseController, session string, m queue.Message, encode func([]byte) []string) error {
+	_ = rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+	var b strings.Builder
+	fmt.Fprintf(&b, "id: %s:%d\n", session, m.ID)
+	for _, line := range encode(m.Body) {
+		b.WriteString("data: ")
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+	b.WriteByte('\n')
+	if _, err := io.WriteString(w, b.String()); err != nil {
+		return err
+	}
+	return rc.Flush()
+}
+
+// encodeText maps a body onto SSE data lines. Newlines survive the round
+// trip; carriage returns do not, so binary payloads should use base64.
+func encodeText(body []byte) []string {
+	return strings.Split(string(body), "\n")
+}
+
+func encodeBase64(body []byte) []string {
+	return []string{base64.StdEncoding.EncodeToString(body)}
+}
+
+// parseEventID splits an event ID of the form {session}:{message id}.
+func parseEventID(v string) (session string, id uint64, err error) {
+	if v == "" {
+		return "", 0, nil
+	}
+	session, rawID, ok := strings.Cut(v, ":")
+	if !ok || session == "" {
+		return "", 0, errors.New("invalid Last-Event-ID")
+	}
+	id, err = strconv.ParseUint(rawID, 10, 64)
+	if err != nil {
+		return "", 0, errors.New("invalid Last-Event-ID")
+	}
+	return session, id, nil
+}
+
+func newStreamSession() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,172 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"corti-kkv/internal/queue"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type sseEvent struct {
+	id   string
+	data string
+}
+
+// readSSE collects n events from an open stream response.
+func readSSE(t *testing.T, br *bufio.Reader, n int) []sseEvent {
+	t.Helper()
+	var out []sseEvent
+	var cur sseEvent
+	var data []string
+	for len(out) < n {
+		line, err := br.ReadString('\n')
+		if !assert.NoError(t, err) {
+			return out
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if data != nil {
+				cur.data = strings.Join(data, "\n")
+				out = append(out, cur)
+			}
+			cur, data = sseEvent{}, nil
+		case strings.HasPrefix(line, "id: "):
+			cur.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			data = append(data, strings.TrimPrefix(line, "data: "))
+		}
+	}
+	return out
+}
+
+func openStream(t *testing.T, ctx context.Context, url, lastID string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	assert.NoError(t, err)
+	if lastID != "" {
+		req.Header.Set("Last-Event-ID", lastID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return resp
+}
+
+func TestServerStream(t *testing.T) {
+	m := queue.NewQueueManager()
+	ts := httptest.NewServer(NewServer(m).Handler())
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	resp := openStream(t, ctx, ts.URL+"/queues/s/stream", "")
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	m.Get("s").Enqueue([]byte("first\n"))
+	m.Get("s").Enqueue([]byte("second"))
+	events := readSSE(t, bufio.NewReader(resp.Body), 2)
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, "first\n", events[0].data)
+		assert.Equal(t, "second", events[1].data)
+		assert.True(t, strings.HasSuffix(events[0].id, ":1"))
+		assert.True(t, strings.HasSuffix(events[1].id, ":2"))
+	}
+	assert.Equal(t, 0, m.Get("s").Len())
+}
+
+func TestServerStreamResume(t *testing.T) {
+	m := queue.NewQueueManager()
+	ts := httptest.NewServer(NewServer(m).Handler())
+	defer ts.Close()
+	m.Get("r").Enqueue([]byte("a"))
+	m.Get("r").Enqueue([]byte("b"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	resp := openStream(t, ctx, ts.URL+"/queues/r/stream?encoding=base64", "")
+	events := readSSE(t, bufio.NewReader(resp.Body), 2)
+	cancel()
+	_ = resp.Body.Close()
+	if !assert.Len(t, events, 2) {
+		return
+	}
+	assert.Equal(t, "YQ==", events[0].data)
+
+	// The client claims it only saw the first event; the second is replayed.
+	ctx, cancel = context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	resp = openStream(t, ctx, ts.URL+"/queues/r/stream", events[0].id)
+	defer resp.Body.Close()
+	replayed := readSSE(t, bufio.NewReader(resp.Body), 1)
+	if assert.Len(t, replayed, 1) {
+		assert.Equal(t, events[1].id, replayed[0].id)
+		assert.Equal(t, "b", replayed[0].data)
+	}
+}
+
+func TestServerStreamErrors(t *testing.T) {
+	ts := httptest.NewServer(NewServer(queue.NewQueueManager()).Handler())
+	defer ts.Close()
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		lastID string
+		want   int
+	}{
+		{name: "WrongMethod_Returns405", method: http.MethodPost, path: "/queues/e/stream", want: http.StatusMethodNotAllowed},
+		{name: "BadEncoding_Returns400", method: http.MethodGet, path: "/queues/e/stream?encoding=hex", want: http.StatusBadRequest},
+		{name: "BadLastEventID_Returns400", method: http.MethodGet, path: "/queues/e/stream", lastID: "nope", want: http.StatusBadRequest},
+		{name: "UnknownAction_Returns404", method: http.MethodGet, path: "/queues/e/other", want: http.StatusNotFound},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tc.method, ts.URL+tc.path, nil)
+			if tc.lastID != "" {
+				req.Header.Set("Last-Event-ID", tc.lastID)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if assert.NoError(t, err) {
+				_ = resp.Body.Close()
+				assert.Equal(t, tc.want, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestStreamHistoryExpires(t *testing.T) {
+	s := NewServer(queue.NewQueueManager())
+	l := s.openStream("q")
+	for i := 1; i <= StreamHistory+2; i++ {
+		l.add("s1", queue.Message{ID: uint64(i)})
+	}
+	msgs := l.since("s1", 0)
+	if assert.Len(t, msgs, StreamHistory) {
+		assert.Equal(t, uint64(3), msgs[0].ID, "the oldest are dropped")
+	}
+
+	l.mu.Lock()
+	for i := range l.events[:10] {
+		l.events[i].at = time.Now().Add(-StreamHistoryAge)
+	}
+	l.mu.Unlock()
+	assert.Len(t, l.since("s1", 0), StreamHistory-10, "old events expire")
+
+	// The history outlives the stream until StreamHistoryAge has passed.
+	s.closeStream("q", l)
+	s.pruneStreams(time.Now())
+	assert.Same(t, l, s.openStream("q"))
+	s.closeStream("q", l)
+	s.pruneStreams(time.Now().Add(StreamHistoryAge))
+	assert.Empty(t, s.streams)
+}
@@ -0,0 +1,92 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"corti-kkv/internal/queue"
+	"corti-kkv/internal/webhook"
+)
+
+// maxSubscriptionBody bounds the JSON accepted when registering a
+// subscription.
+const maxSubscriptionBody = 64 << 10
+
+type subscriptionRequest struct {
+	URL         string `json:"url"`
+	Secret      string `json:"secret"`
+	Concurrency int    `json:"concurrency"`
+	MaxAttempts int    `json:"max_attempts"`
+}
+
+// handleSubscriptions serves the push subscriptions of a queue. The caller
+// has been authorized to consume from it.
+//
+//	GET    /queues/{name}/subscriptions        list with delivery counters
+//	POST   /queues/{name}/subscriptions        register, answering the secret once
+//	GET    /queues/{name}/subscriptions/{id}   one subscription
+//	DELETE /queues/{name}/subscriptions/{id}   stop delivering
+func (s *Server) handleSubscriptions(w http.ResponseWriter, r *http.Request, ns *queue.View, name, action string) {
+	if s.Webhooks == nil {
+		http.Error(w, "push subscriptions are not enabled", http.StatusNotFound)
+		return
+	}
+	stored := ns.Name(name)
+	id, _ := strings.CutPrefix(action, "subscriptions")
+	id = strings.TrimPrefix(id, "/")
+	if id == "" {
+		switch r.Method {
+		case http.MethodGet:
+			out := s.Webhooks.List(stored)
+			if out == nil {
+				out = []webhook.Status{}
+			}
+			writeJSON(w, map[string]any{"queue": name, "subscriptions": out})
+		case http.MethodPost:
+			var req subscriptionRequest
+			dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSubscriptionBody))
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(&req); err != nil {
+				http.Error(w, fmt.Sprintf("invalid subscription: %v", err), http.StatusBadRequest)
+				return
+			}
+			sub, err := s.Webhooks.Subscribe(webhook.Subscription{
+				Queue:       stored,
+				URL:         req.URL,
+				Secret:      req.Secret,
+				Concurrency: req.Concurrency,
+				MaxAttempts: req.MaxAttempts,
+			})
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Location", r.URL.Path+"/"+sub.ID)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(struct {
+				webhook.Subscription
+				Secret string `json:"secret"`
+			}{sub, sub.Secret})
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+	st, ok := s.Webhooks.Get(id)
+	if !ok || st.Queue != stored {
+		http.Error(w, fmt.Sprintf("no subscription %q on queue %q", id, name), http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, st)
+	case http.MethodDelete:
+		s.Webhooks.Unsubscribe(id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"corti-kkv/internal/auth"
+	"corti-kkv/internal/queue"
+	"corti-kkv/internal/webhook"
+)
+
+func TestServerSubscriptions(t *testing.T) {
+	got := make(chan string, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if err := webhook.Verify("k", r.Header, body, time.Minute); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		got <- r.Header.Get(webhook.QueueHeader) + ":" + string(body)
+	}))
+	defer receiver.Close()
+
+	store, err := auth.Parse(strings.NewReader("wk worker *:consume\nup uploader *:produce\nacme etl tenant=acme *:consume\n"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	m := queue.NewQueueManager()
+	s := NewServer(m)
+	s.Auth = store
+	s.Webhooks = webhook.NewDispatcher(m)
+	defer s.Webhooks.Close()
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	do := func(method, path, token, body string, out any) int {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		defer resp.Body.Close()
+		if out != nil && resp.StatusCode/100 == 2 {
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(out))
+		}
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusForbidden, do(http.MethodPost, "/queues/jobs/subscriptions", "up", `{"url": "`+receiver.URL+`"}`, nil))
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/queues/jobs/subscriptions", "wk", `{"url": "ftp://x"}`, nil))
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/queues/jobs/subscriptions", "wk", `{"uri": "http://x"}`, nil))
+
+	var created struct {
+		ID     string `json:"id"`
+		Queue  string `json:"queue"`
+		Secret string `json:"secret"`
+	}
+	assert.Equal(t, http.StatusCreated, do(http.MethodPost, "/queues/jobs/subscriptions", "wk", `{"url": "`+receiver.URL+`", "secret": "k", "max_attempts": 2}`, &created))
+	assert.Equal(t, "k", created.Secret)
+	assert.Equal(t, "jobs", created.Queue)
+
+	assert.Equal(t, http.StatusAccepted, do(http.MethodPost, "/queues/jobs", "up", "hello", nil))
+	select {
+	case v := <-got:
+		assert.Equal(t, "jobs:hello", v)
+	case <-time.After(2 * time.Second):
+		t.Fatal("message not pushed")
+	}
+
+	var list struct {
+		Subscriptions []map[string]any `json:"subscriptions"`
+	}
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/queues/jobs/subscriptions", "wk", "", &list))
+	if assert.Len(t, list.Subscriptions, 1) {
+		assert.Equal(t, created.ID, list.Subscriptions[0]["id"])
+		assert.NotContains(t, list.Subscriptions[0], "secret")
+	}
+	assert.Eventually(t, func() bool {
+		var st webhook.Status
+		do(http.MethodGet, "/queues/jobs/subscriptions/"+created.ID, "wk", "", &st)
+		return st.Delivered == 1
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/queues/other/subscriptions/"+created.ID, "wk", "", nil))
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/tenants/acme/queues/jobs/subscriptions/"+created.ID, "acme", "", nil))
+
+	assert.Equal(t, http.StatusCreated, do(http.MethodPost, "/queues/jobs/subscriptions", "acme", `{"url": "`+receiver.URL+`", "secret": "k"}`, &created))
+	assert.Equal(t, "acme/jobs", created.Queue)
+	m.Namespace("acme").Get("jobs").Enqueue([]byte("tenant"))
+	select {
+	case v := <-got:
+		assert.Equal(t, "acme/jobs:tenant", v)
+	case <-time.After(2 * time.Second):
+		t.Fatal("tenant message not pushed")
+	}
+
+	assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/tenants/acme/queues/jobs/subscriptions/"+created.ID, "acme", "", nil))
+	assert.Equal(t, http.StatusNotFound, do(http.MethodDelete, "/tenants/acme/queues/jobs/subscriptions/"+created.ID, "acme", "", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, do(http.MethodPut, "/queues/jobs/subscriptions", "wk", "", nil))
+}
+
+func TestRouteSubscriptions(t *testing.T) {
+	for path, want := range map[string]string{
+		"/queues/jobs/subscriptions":                  "/queues/{name}/subscriptions",
+		"/queues/jobs/subscriptions/abc":              "/queues/{name}/subscriptions/{id}",
+		"/tenants/acme/queues/jobs/subscriptions/abc": "/tenants/{tenant}/queues/{name}/subscriptions/{id}",
+		"/queues/jobs/subscriptions/abc/def":          "other",
+	} {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		assert.Equal(t, want, Route(r), path)
+	}
+}
@@ -0,0 +1,188 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"corti-kkv/internal/auth"
+	"corti-kkv/internal/queue"
+	"corti-kkv/internal/tenant"
+)
+
+// namespace resolves the tenant of a request from a /tenants/{tenant} path
+// prefix or from the caller's principal, and returns its view together with
+// the path with the prefix removed. Requests naming neither use the default
+// namespace.
+func (s *Server) namespace(w http.ResponseWriter, r *http.Request, p *auth.Principal) (*queue.View, string, bool) {
+	path := r.URL.Path
+	name := ""
+	if rest, ok := strings.CutPrefix(path, "/tenants/"); ok {
+		name, rest, _ = strings.Cut(rest, "/")
+		if !tenant.Valid(name) {
+			http.Error(w, "missing or invalid tenant name", http.StatusBadRequest)
+			return nil, "", false
+		}
+		path = "/" + rest
+	}
+	if p != nil && p.Tenant != "" {
+		if name != "" && name != p.Tenant {
+			http.Error(w, fmt.Sprintf("token is confined to tenant %q", p.Tenant), http.StatusForbidden)
+			return nil, "", false
+		}
+		name = p.Tenant
+	}
+	if name == "" {
+		name = queue.DefaultNamespace
+	}
+	if _, ok := s.Tenants.Quota(name); !ok {
+		http.Error(w, fmt.Sprintf("unknown tenant %q", name), http.StatusNotFound)
+		return nil, "", false
+	}
+	return s.Manager.Namespace(name), path, true
+}
+
+// quotaError is an enqueue refused by a tenant quota.
+type quotaError struct {
+	code int
+	msg  string
+	wait time.Duration
+}
+
+func (e *quotaError) Error() string { return e.msg }
+
+// openQueue returns the named queue of ns, creating it unless the tenant
+// has reached its queue quota.
+func (s *Server) openQueue(ns *queue.View, name string) (*queue.Queue, *quotaError) {
+	var max int
+	if s.Tenants != nil {
+		q, _ := s.Tenants.Quota(ns.Namespace())
+		max = q.MaxQueues
+	}
+	q, ok := ns.GetLimit(name, max)
+	if !ok {
+		return nil, &quotaError{code: http.StatusInsufficientStorage, msg: fmt.Sprintf("tenant %q has reached its limit of %d queues", ns.Namespace(), max)}
+	}
+	return q, nil
+}
+
+// checkQuota reports whether size more bytes may be enqueued to ns. It takes
+// from the tenant's message rate if so.
+func (s *Server) checkQuota(ns *queue.View, size int) *quotaError {
+	if s.Tenants == nil {
+		return nil
+	}
+	t := ns.Namespace()
+	q, _ := s.Tenants.Quota(t)
+	if q.MaxBytes > 0 && ns.Size()+int64(size) > q.MaxBytes {
+		return &quotaError{code: http.StatusInsufficientStorage, msg: fmt.Sprintf("tenant %q has reached its limit of %d bytes", t, q.MaxBytes)}
+	}
+	if ok, wait := s.Tenants.Allow(t); !ok {
+		return &quotaError{code: http.StatusTooManyRequests, msg: fmt.Sprintf("tenant %q message rate exceeded", t), wait: wait}
+	}
+	return nil
+}
+
+// writeQuotaError answers with e's status, adding Retry-After for rates.
+func writeQuotaError(w http.ResponseWriter, e *quotaError) {
+	if e.wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(e.wait.Seconds()))))
+	}
+	http.Error(w, e.msg, e.code)
+}
+
+// tenantUsage is the admin API's view of one tenant.
+type tenantUsage struct {
+	Name     string       `json:"name"`
+	Queues   int          `json:"queues"`
+	Messages int          `json:"messages"`
+	Inflight int          `json:"inflight"`
+	Bytes    int64        `json:"bytes"`
+	Quota    *quotaJSON   `json:"quota,omitempty"`
+	List     []queueUsage `json:"queue_list,omitempty"`
+}
+
+type quotaJSON struct {
+	MaxQueues int     `json:"max_queues,omitempty"`
+	MaxBytes  int64   `json:"max_bytes,omitempty"`
+	Rate      float64 `json:"rate,omitempty"`
+	Burst     int     `json:"burst,omitempty"`
+}
+
+type queueUsage struct {
+	Name     string `json:"name"`
+	Messages int    `json:"messages"`
+	Inflight int    `json:"inflight"`
+	Bytes    int64  `json:"bytes"`
+}
+
+func (s *Server) usage(name string, perQueue bool) tenantUsage {
+	u := tenantUsage{Name: name}
+	if q, _ := s.Tenants.Quota(name); q != (tenant.Quota{}) {
+		u.Quota = &quotaJSON{MaxQueues: q.MaxQueues, MaxBytes: q.MaxBytes, Rate: q.Rate.Rate, Burst: q.Rate.Burst}
+	}
+	ns := s.Manager.Namespace(name)
+	for _, qn := range ns.Names() {
+		q := ns.Get(qn)
+		qu := queueUsage{Name: qn, Messages: q.Len(), Inflight: q.Inflight(), Bytes: q.Size()}
+		u.Queues++
+		u.Messages += qu.Messages
+		u.Inflight += qu.Inflight
+		u.Bytes += qu.Bytes
+		if perQueue {
+			u.List = append(u.List, qu)
+		}
+	}
+	return u
+}
+
+// isAdmin reports whether p may administer every tenant.
+func isAdmin(p *auth.Principal) bool {
+	return p == nil || (p.Tenant == "" && p.Allowed("*", auth.Admin))
+}
+
+// handleTenantAdmin serves GET /admin/tenants, listing every tenant that is
+// configured or has queues, and GET /admin/tenants/{tenant} with per-queue
+// usage. A principal confined to a tenant may only read its own.
+func (s *Server) handleTenantAdmin(w http.ResponseWriter, r *http.Request, p *auth.Principal) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/tenants"), "/")
+	if name == "" {
+		if !isAdmin(p) {
+			http.Error(w, "token lacks admin permission", http.StatusForbidden)
+			return
+		}
+		names := append(s.Manager.Namespaces(), s.Tenants.Names()...)
+		sort.Strings(names)
+		out := []tenantUsage{}
+		for i, n := range names {
+			if i == 0 || n != names[i-1] {
+				out = append(out, s.usage(n, false))
+			}
+		}
+		writeJSON(w, map[string]any{"tenants": out})
+		return
+	}
+	if !isAdmin(p) && !(p.Tenant == name && p.Allowed("*", auth.Admin)) {
+		http.Error(w, "token lacks admin permission", http.StatusForbidden)
+		return
+	}
+	if _, ok := s.Tenants.Quota(name); !ok || !tenant.Valid(name) {
+		http.Error(w, fmt.Sprintf("unknown tenant %q", name), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, s.usage(name, true))
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
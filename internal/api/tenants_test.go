@@ -0,0 +1,153 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"corti-kkv/internal/auth"
+	"corti-kkv/internal/queue"
+	"corti-kkv/internal/tenant"
+	"corti-kkv/internal/ws"
+)
+
+func TestServerTenants(t *testing.T) {
+	store, err := auth.Parse(strings.NewReader(`
+root  ops   *:admin
+acme  etl   tenant=acme *:produce,consume
+aadm  boss  tenant=acme *:admin
+prod  feed  lines*:produce
+aprod feed  acme/lines*:produce
+`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	tenants, err := tenant.Parse(strings.NewReader("acme queues=2 bytes=8\nglobex rate=1:1\n"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	s := NewServer(queue.NewQueueManager())
+	s.Auth = store
+	s.Tenants = tenants
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	do := func(method, path, token, body string) (int, string) {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	tests := []struct {
+		name, method, path, token, body string
+		want                            int
+	}{
+		{name: "DefaultNamespace", method: http.MethodPost, path: "/queues/lines", token: "root", body: "default", want: http.StatusAccepted},
+		{name: "TenantFromPath", method: http.MethodPost, path: "/tenants/acme/queues/lines", token: "root", body: "a1", want: http.StatusAccepted},
+		{name: "TenantFromToken", method: http.MethodPost, path: "/queues/lines", token: "acme", body: "a2", want: http.StatusAccepted},
+		{name: "OwnTenantPath", method: http.MethodPost, path: "/tenants/acme/queues/jobs", token: "acme", body: "a3", want: http.StatusAccepted},
+		{name: "OtherTenant_Returns403", method: http.MethodPost, path: "/tenants/globex/queues/lines", token: "acme", body: "x", want: http.StatusForbidden},
+		{name: "UnconfinedGrantOnDefault", method: http.MethodPost, path: "/queues/lines", token: "prod", body: "p", want: http.StatusAccepted},
+		{name: "UnconfinedGrantOnTenant_Returns403", method: http.MethodPost, path: "/tenants/acme/queues/lines", token: "prod", body: "x", want: http.StatusForbidden},
+		{name: "TenantQualifiedGrant", method: http.MethodPost, path: "/tenants/acme/queues/lines", token: "aprod", body: "q", want: http.StatusAccepted},
+		{name: "TenantQualifiedGrantOnDefault_Returns403", method: http.MethodPost, path: "/queues/lines", token: "aprod", body: "x", want: http.StatusForbidden},
+		{name: "UnknownTenant_Returns404", method: http.MethodPost, path: "/tenants/initech/queues/lines", token: "root", body: "x", want: http.StatusNotFound},
+		{name: "InvalidTenant_Returns400", method: http.MethodPost, path: "/tenants/a*b/queues/lines", token: "root", body: "x", want: http.StatusBadRequest},
+		{name: "QueueLimit_Returns507", method: http.MethodPost, path: "/queues/third", token: "acme", body: "x", want: http.StatusInsufficientStorage},
+		{name: "QueueLimitOnLength_Returns507", method: http.MethodHead, path: "/queues/third", token: "acme", want: http.StatusInsufficientStorage},
+		{name: "QueueLimitOnDequeue_Returns507", method: http.MethodDelete, path: "/queues/third", token: "acme", want: http.StatusInsufficientStorage},
+		{name: "QueueLimitOnStream_Returns507", method: http.MethodGet, path: "/queues/third/stream", token: "acme", want: http.StatusInsufficientStorage},
+		{name: "ByteLimit_Returns507", method: http.MethodPost, path: "/queues/lines", token: "acme", body: "toolong", want: http.StatusInsufficientStorage},
+		{name: "Rate", method: http.MethodPost, path: "/tenants/globex/queues/q", token: "root", body: "g", want: http.StatusAccepted},
+		{name: "RateExceeded_Returns429", method: http.MethodPost, path: "/tenants/globex/queues/q", token: "root", body: "g", want: http.StatusTooManyRequests},
+		{name: "DequeueIsolated", method: http.MethodDelete, path: "/queues/lines", token: "acme", want: http.StatusOK},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			code, _ := do(tc.method, tc.path, tc.token, tc.body)
+			assert.Equal(t, tc.want, code)
+		})
+	}
+	assert.Equal(t, []string{"acme/jobs", "acme/lines", "globex/q", "lines"}, s.Manager.Names())
+	assert.Equal(t, []byte("default"), s.Manager.Get("lines").Dequeue())
+	assert.Equal(t, 2, s.Manager.Get("acme/lines").Len(), "a1 was dequeued by the acme token, a2 and q are left")
+
+	code, body := do(http.MethodGet, "/admin/tenants", "root", "")
+	assert.Equal(t, http.StatusOK, code)
+	var list struct{ Tenants []tenantUsage }
+	assert.NoError(t, json.Unmarshal([]byte(body), &list))
+	if assert.Len(t, list.Tenants, 3) {
+		acme := list.Tenants[0]
+		assert.Equal(t, "acme", acme.Name)
+		assert.Equal(t, 2, acme.Queues)
+		assert.Equal(t, 3, acme.Messages)
+		assert.Equal(t, int64(5), acme.Bytes)
+		assert.Equal(t, &quotaJSON{MaxQueues: 2, MaxBytes: 8}, acme.Quota)
+		assert.Equal(t, "default", list.Tenants[1].Name)
+		assert.Equal(t, "globex", list.Tenants[2].Name)
+		assert.Equal(t, &quotaJSON{Rate: 1, Burst: 1}, list.Tenants[2].Quota)
+	}
+
+	code, _ = do(http.MethodGet, "/admin/tenants", "aadm", "")
+	assert.Equal(t, http.StatusForbidden, code)
+	code, _ = do(http.MethodGet, "/admin/tenants/globex", "aadm", "")
+	assert.Equal(t, http.StatusForbidden, code)
+	code, _ = do(http.MethodGet, "/admin/tenants/acme", "acme", "")
+	assert.Equal(t, http.StatusForbidden, code)
+	code, _ = do(http.MethodGet, "/admin/tenants/initech", "root", "")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, body = do(http.MethodGet, "/admin/tenants/acme", "aadm", "")
+	assert.Equal(t, http.StatusOK, code)
+	var one tenantUsage
+	assert.NoError(t, json.Unmarshal([]byte(body), &one))
+	assert.Equal(t, []queueUsage{{Name: "jobs", Messages: 1, Bytes: 2}, {Name: "lines", Messages: 2, Bytes: 3}}, one.List)
+}
+
+func TestWebSocketTenant(t *testing.T) {
+	tenants, _ := tenant.Parse(strings.NewReader("acme bytes=3 queues=1\n"))
+	s := NewServer(queue.NewQueueManager())
+	s.Tenants = tenants
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, err := ws.Dial(ctx, "ws"+strings.TrimPrefix(ts.URL, "http")+"/tenants/acme/ws", nil, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	c := &wsClient{t: t, conn: conn}
+	defer conn.Close()
+
+	r := c.call(wsCommand{Op: "enqueue", Queue: "lines", Data: "abc"})
+	assert.Equal(t, "ok", r.Op)
+	r = c.call(wsCommand{Op: "enqueue", Queue: "lines", Data: "d"})
+	assert.Equal(t, "error", r.Op)
+	assert.Contains(t, r.Error, "limit of 3 bytes")
+	assert.Equal(t, 1, s.Manager.Get("acme/lines").Len())
+	assert.Equal(t, 0, s.Manager.Get("lines").Len())
+	r = c.call(wsCommand{Op: "dequeue", Queue: "lines"})
+	if assert.Len(t, r.Messages, 1) {
+		assert.Equal(t, "lines", r.Queue)
+		assert.Equal(t, "abc", r.Messages[0].Data)
+	}
+	for _, op := range []string{"dequeue", "subscribe"} {
+		r = c.call(wsCommand{Op: op, Queue: "jobs"})
+		assert.Equal(t, "error", r.Op, op)
+		assert.Contains(t, r.Error, "limit of 1 queues", op)
+	}
+	assert.Equal(t, []string{"lines"}, s.Manager.Namespace("acme").Names())
+}
@@ -0,0 +1,136 @@
+// Dashboard for the queue service, built only on its /admin JSON API.
+"use strict";
+
+const POLL_MS = 2000;
+const tokenInput = document.getElementById("token");
+const statusEl = document.getElementById("status");
+const tbody = document.querySelector("#queues tbody");
+let previous = null; // last poll: {at, queues: Map(name -> queue)}
+let peeking = null;
+
+tokenInput.value = localStorage.getItem("kkv-token") || "";
+document.getElementById("token-form").addEventListener("submit", (ev) => {
+  ev.preventDefault();
+  localStorage.setItem("kkv-token", tokenInput.value);
+  refresh();
+});
+document.getElementById("peek-close").addEventListener("click", () => {
+  peeking = null;
+  document.getElementById("peek").hidden = true;
+});
+
+async function api(method, path, body) {
+  const headers = {};
+  if (tokenInput.value) headers.Authorization = "Bearer " + tokenInput.value;
+  if (body !== undefined) headers["Content-Type"] = "application/json";
+  const resp = await fetch(path, { method, headers, body: body === undefined ? undefined : JSON.stringify(body) });
+  if (!resp.ok) throw new Error(method + " " + path + ": " + resp.status + " " + (await resp.text()).trim());
+  return resp.json();
+}
+
+function queuePath(name, action) {
+  return "/admin/queues/" + encodeURIComponent(name) + (action ? "/" + action : "");
+}
+
+function rate(q, field, now) {
+  const prev = previous && previous.queues.get(q.name);
+  if (!prev) return "–";
+  const secs = (now - previous.at) / 1000;
+  return secs > 0 ? ((q[field] - prev[field]) / secs).toFixed(1) : "–";
+}
+
+function cell(row, text, cls) {
+  const td = row.insertCell();
+  td.textContent = text;
+  if (cls) td.className = cls;
+  return td;
+}
+
+function button(td, label, onClick) {
+  const b = document.createElement("button");
+  b.type = "button";
+  b.textContent = label;
+  b.addEventListener("click", onClick);
+  td.appendChild(b);
+}
+
+async function act(method, name, action, question, body) {
+  if (question && !confirm(question)) return;
+  try {
+    await api(method, queuePath(name, action), body);
+    await refresh();
+  } catch (err) {
+    statusEl.textContent = err.message;
+  }
+}
+
+async function refresh() {
+  let data;
+  try {
+    data = await api("GET", "/admin/queues");
+  } catch (err) {
+    statusEl.textContent = err.message;
+    return;
+  }
+  statusEl.textContent = "";
+  const now = Date.now();
+  tbody.replaceChildren();
+  for (const q of data.queues) {
+    const row = tbody.insertRow();
+    if (q.dlq_for) row.className = "dlq";
+    cell(row, q.queue);
+    cell(row, q.tenant);
+    cell(row, q.depth, "num");
+    cell(row, q.inflight, "num");
+    cell(row, q.bytes, "num");
+    cell(row, rate(q, "enqueued", now), "num");
+    cell(row, rate(q, "dequeued", now), "num");
+    const actions = cell(row, "");
+    button(actions, "Peek", () => { peeking = q.name; peek(); });
+    button(actions, "Purge", () => act("POST", q.name, "purge", "Drop every queued message in " + q.name + "?"));
+    button(actions, "Delete", () => act("DELETE", q.name, "", "Delete queue " + q.name + " and its messages?"));
+    button(actions, "Move", () => move(q.name));
+    if (q.dlq_for) {
+      button(actions, "Redrive", () => act("POST", q.name, "redrive", "Move every message in " + q.name + " back to " + q.dlq_for + "?"));
+    }
+  }
+  previous = { at: now, queues: new Map(data.queues.map((q) => [q.name, q])) };
+  if (peeking) peek();
+}
+
+function move(name) {
+  const target = prompt("Move messages from " + name + " to queue:");
+  if (!target) return;
+  const selector = prompt("Only messages matching selector (empty for all):", "");
+  if (selector === null) return;
+  const max = prompt("At most this many messages (0 for all):", "0");
+  if (max === null) return;
+  act("POST", name, "move", null, { target, selector, max: parseInt(max, 10) || 0 });
+}
+
+async function peek() {
+  const name = peeking;
+  let data;
+  try {
+    data = await api("GET", queuePath(name, "messages") + "?limit=20");
+  } catch (err) {
+    statusEl.textContent = err.message;
+    return;
+  }
+  document.getElementById("peek-name").textContent = name;
+  const list = document.getElementById("peek-list");
+  list.replaceChildren();
+  for (const m of data.messages) {
+    const li = document.createElement("li");
+    const meta = document.createElement("span");
+    meta.className = "meta";
+    meta.textContent = "#" + m.id + " · " + m.bytes + " B" + (m.encoding ? " · " + m.encoding : "");
+    li.append(meta, m.data);
+    list.appendChild(li);
+  }
+  if (data.messages.length === 0) list.textContent = "(empty)";
+  document.getElementById("peek").hidden = false;
+}
+
+refresh();
+setInterval(refresh, POLL_MS);
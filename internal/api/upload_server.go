@@ -2,14 +2,18 @@ package api
 
 import (
 	"context"
+	"errors"
 	"io"
-	"log"
+	"log/slog"
 	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
+
+	"corti-kkv/internal/metrics"
+	"corti-kkv/internal/trace"
 )
 
 // UploadServer handles the /upload endpoint and enqueues uploaded content
@@ -17,6 +21,15 @@ import (
 type UploadServer struct {
 	Client    Producer
 	InputPath string
+	// Split is the splitter used for uploads that do not name one with
+	// ?split=; empty means lines.
+	Split string
+	// Tracer, when set, records a span per upload.
+	Tracer *trace.Tracer
+
+	uploads       *metrics.CounterVec
+	uploadBytes   *metrics.CounterVec
+	uploadSeconds *metrics.HistogramVec
 }
 
 // Producer abstracts the minimal queue client API needed by UploadServer.
@@ -26,8 +39,32 @@ type Producer interface {
 	QueueLength(ctx context.Context) (int, error)
 }
 
+// SplitProducer is a Producer that can cut its input into messages other
+// than lines, as described by a splitter spec such as "csv" or
+// "fixed:4096". Implemented by rwclient.Client.
+type SplitProducer interface {
+	Producer
+	ValidateSplit(split string) error
+	ProduceSplit(ctx context.Context, inputPath, split string) error
+}
+
 func NewUploadServer(c Producer, inPath string) *UploadServer {
-	return &UploadServer{Client: c, InputPath: inPath}
+	return &UploadServer{
+		Client:        c,
+		InputPath:     inPath,
+		uploads:       metrics.NewCounterVec("kkv_uploads_total", "Uploads by result.", "result"),
+		uploadBytes:   metrics.NewCounterVec("kkv_upload_bytes_total", "Bytes received in uploads."),
+		uploadSeconds: metrics.NewHistogramVec("kkv_upload_duration_seconds", "Time to save and enqueue an upload, by result.", uploadBuckets, "result"),
+	}
+}
+
+var uploadBuckets = []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// Collect reports upload counts, bytes and durations.
+func (s *UploadServer) Collect(e *metrics.Encoder) {
+	s.uploads.Collect(e)
+	s.uploadBytes.Collect(e)
+	s.uploadSeconds.Collect(e)
 }
 
 func (s *UploadServer) Handler() http.Handler {
@@ -43,6 +80,42 @@ func (s *UploadServer) handle(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	start := time.Now()
+	result := "ok"
+	if code := s.upload(w, r); code >= 400 {
+		result = "error"
+	}
+	s.uploads.Inc(result)
+	s.uploadSeconds.Observe(time.Since(start).Seconds(), result)
+}
+
+// upload saves the request body or file and produces it, returning the
+// status code it answered with.
+func (s *UploadServer) upload(w http.ResponseWriter, r *http.Request) int {
+	// Keep the request ID and trace context for rwclient to pass on, but
+	// finish the upload even if the client goes away.
+	ctx, span := s.Tracer.Start(context.WithoutCancel(r.Context()), "upload", trace.Server)
+	defer span.End()
+	trace.Inject(trace.FromContext(ctx), w.Header())
+	fail := func(msg string, code int) int {
+		span.SetError(errors.New(msg))
+		http.Error(w, msg, code)
+		return code
+	}
+
+	split := r.URL.Query().Get("split")
+	if split == "" {
+		split = s.Split
+	}
+	if split != "" {
+		sp, ok := s.Client.(SplitProducer)
+		if !ok {
+			return fail("splitters are not supported", http.StatusBadRequest)
+		}
+		if err := sp.ValidateSplit(split); err != nil {
+			return fail(err.Error(), http.StatusBadRequest)
+		}
+	}
 
 	ct := r.Header.Get("Content-Type")
 	mediatype, _, err := mime.ParseMediaType(ct)
@@ -54,13 +127,11 @@ func (s *UploadServer) handle(w http.ResponseWriter, r *http.Request) {
 	switch {
 	case strings.HasPrefix(mediatype, "multipart/"):
 		if err := r.ParseMultipartForm(32 << 20); err != nil { // 32MB
-			http.Error(w, "invalid multipart form", http.StatusBadRequest)
-			return
+			return fail("invalid multipart form", http.StatusBadRequest)
 		}
 		file, header, err := r.FormFile("file")
 		if err != nil {
-			http.Error(w, "missing file field", http.StatusBadRequest)
-			return
+			return fail("missing file field", http.StatusBadRequest)
 		}
 		defer file.Close()
 		// save to InputPath (or derive from filename in /data)
@@ -68,68 +139,74 @@ func (s *UploadServer) handle(w http.ResponseWriter, r *http.Request) {
 		if dest == "" {
 			dest = filepath.Join("/data", filepath.Base(header.Filename))
 		}
-		if err := saveToFile(dest, file); err != nil {
-			log.Printf("save error: %v", err)
-			http.Error(w, "failed to save file", http.StatusInternalServerError)
-			return
+		n, err := saveToFile(dest, file)
+		s.uploadBytes.Add(float64(n))
+		span.SetAttr("bytes", n)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "save upload", "path", dest, "err", err)
+			return fail("failed to save file", http.StatusInternalServerError)
 		}
-		if err := s.Client.Produce(context.Background(), dest); err != nil {
-			log.Printf("produce error: %v", err)
-			http.Error(w, "failed to enqueue", http.StatusInternalServerError)
-			return
+		if err := s.produce(ctx, dest, split); err != nil {
+			slog.ErrorContext(r.Context(), "produce upload", "path", dest, "err", err)
+			return fail("failed to enqueue", http.StatusInternalServerError)
 		}
 		// brief drain loop to help consumer flush
 		deadline := time.Now().Add(200 * time.Millisecond)
 		for time.Now().Before(deadline) {
-			n, err := s.Client.QueueLength(context.Background())
+			n, err := s.Client.QueueLength(ctx)
 			if err == nil && n == 0 {
 				break
 			}
 			time.Sleep(10 * time.Millisecond)
 		}
 		w.WriteHeader(http.StatusAccepted)
-		return
+		return http.StatusAccepted
 	default:
 		reader = r.Body
 		defer r.Body.Close()
 	}
 
 	if reader == nil {
-		http.Error(w, "no input provided", http.StatusBadRequest)
-		return
+		return fail("no input provided", http.StatusBadRequest)
 	}
-	if err := saveToFile(s.InputPath, reader); err != nil {
-		log.Printf("save error: %v", err)
-		http.Error(w, "failed to save file", http.StatusInternalServerError)
-		return
+	n, err := saveToFile(s.InputPath, reader)
+	s.uploadBytes.Add(float64(n))
+	span.SetAttr("bytes", n)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "save upload", "path", s.InputPath, "err", err)
+		return fail("failed to save file", http.StatusInternalServerError)
 	}
-	if err := s.Client.Produce(context.Background(), s.InputPath); err != nil {
-		log.Printf("produce error: %v", err)
-		http.Error(w, "failed to enqueue", http.StatusInternalServerError)
-		return
+	if err := s.produce(ctx, s.InputPath, split); err != nil {
+		slog.ErrorContext(r.Context(), "produce upload", "path", s.InputPath, "err", err)
+		return fail("failed to enqueue", http.StatusInternalServerError)
 	}
 	deadline := time.Now().Add(200 * time.Millisecond)
 	for time.Now().Before(deadline) {
-		n, err := s.Client.QueueLength(context.Background())
+		n, err := s.Client.QueueLength(ctx)
 		if err == nil && n == 0 {
 			break
 		}
 		time.Sleep(10 * time.Millisecond)
 	}
 	w.WriteHeader(http.StatusAccepted)
+	return http.StatusAccepted
+}
+
+func (s *UploadServer) produce(ctx context.Context, path, split string) error {
+	if split == "" {
+		return s.Client.Produce(ctx, path)
+	}
+	return s.Client.(SplitProducer).ProduceSplit(ctx, path, split)
 }
 
-func saveToFile(path string, r io.Reader) error {
+func saveToFile(path string, r io.Reader) (int64, error) {
 	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
-		return err
+		return 0, err
 	}
 	f, err := os.Create(path)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer f.Close()
-	if _, err := io.Copy(f, r); err != nil {
-		return err
-	}
-	return nil
+	return io.Copy(f, r)
 }
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type splitProducer struct {
+	stubProducer
+	splits []string
+}
+
+func (p *splitProducer) ValidateSplit(split string) error {
+	if split == "words" {
+		return errors.New(`unknown splitter "words"`)
+	}
+	return nil
+}
+
+func (p *splitProducer) ProduceSplit(ctx context.Context, inputPath, split string) error {
+	p.splits = append(p.splits, split)
+	return nil
+}
+
+func TestUploadSplit(t *testing.T) {
+	p := &splitProducer{}
+	s := NewUploadServer(p, filepath.Join(t.TempDir(), "in.txt"))
+	upload := func(s *UploadServer, query string, multi bool) (int, string) {
+		body, ct := strings.NewReader("a,b\n"), "text/csv"
+		if multi {
+			var buf bytes.Buffer
+			mw := multipart.NewWriter(&buf)
+			fw, _ := mw.CreateFormFile("file", "in.csv")
+			fw.Write([]byte("a,b\n"))
+			mw.Close()
+			body, ct = strings.NewReader(buf.String()), mw.FormDataContentType()
+		}
+		req := httptest.NewRequest(http.MethodPost, "/upload"+query, body)
+		req.Header.Set("Content-Type", ct)
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, req)
+		return rec.Code, rec.Body.String()
+	}
+
+	code, _ := upload(s, "?split=csv", false)
+	assert.Equal(t, http.StatusAccepted, code)
+	code, _ = upload(s, "?split=fixed:4", true)
+	assert.Equal(t, http.StatusAccepted, code)
+	code, msg := upload(s, "?split=words", false)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Contains(t, msg, `unknown splitter "words"`)
+	code, _ = upload(s, "", false)
+	assert.Equal(t, http.StatusAccepted, code, "lines need no splitter support")
+	s.Split = "paragraphs"
+	code, _ = upload(s, "", false)
+	assert.Equal(t, http.StatusAccepted, code)
+	assert.Equal(t, []string{"csv", "fixed:4", "paragraphs"}, p.splits)
+
+	code, msg = upload(NewUploadServer(stubProducer{}, s.InputPath), "?split=csv", false)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Contains(t, msg, "splitters are not supported")
+}
@@ -0,0 +1,366 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"corti-kkv/internal/auth"
+	"corti-kkv/internal/queue"
+	"corti-kkv/internal/ws"
+)
+
+// DefaultPrefetch is how many unacknowledged messages a subscription with
+// acks enabled may hold when the client does not ask for a limit.
+const DefaultPrefetch = 10
+
+// wsCommand is a client request on the WebSocket endpoint. ID is echoed in
+// the reply so clients can correlate pipelined commands.
+type wsCommand struct {
+	Op       string `json:"op"`
+	ID       string `json:"id,omitempty"`
+	Queue    string `json:"queue"`
+	Data     string `json:"data,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	MsgID    uint64 `json:"msg_id,omitempty"`
+	Max      int    `json:"max,omitempty"`
+	Ack      bool   `json:"ack,omitempty"`
+	Prefetch int    `json:"prefetch,omitempty"`
+}
+
+// wsReply answers a command ("ok" or "error") or pushes a subscribed
+// message ("message").
+type wsReply struct {
+	Op       string      `json:"op"`
+	ID       string      `json:"id,omitempty"`
+	Queue    string      `json:"queue,omitempty"`
+	MsgID    uint64      `json:"msg_id,omitempty"`
+	Data     string      `json:"data,omitempty"`
+	Encoding string      `json:"encoding,omitempty"`
+	Messages []wsMessage `json:"messages,omitempty"`
+	Error    string      `json:"error,omitempty"`
+}
+
+type wsMessage struct {
+	MsgID    uint64 `json:"msg_id"`
+	Data     string `json:"data"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type pendingKey struct {
+	queue string
+	id    uint64
+}
+
+// wsSession is the state of one WebSocket connection: its subscriptions and
+// the messages it holds without having acknowledged them.
+type wsSession struct {
+	s      *Server
+	p      *auth.Principal
+	ns     *queue.View
+	client string
+	conn   *ws.Conn
+	ctx    context.Context
+	wg     sync.WaitGroup
+
+	mu      sync.Mutex
+	subs    map[string]*wsSub
+	pending map[pendingKey]*wsSub
+}
+
+type wsSub struct {
+	cancel   context.CancelFunc
+	credits  chan struct{}
+	ack      bool
+	encoding string
+}
+
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request, p *auth.Principal, ns *queue.View) {
+	conn, err := ws.Upgrade(w, r)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	sess := &wsSession{
+		s:       s,
+		p:       p,
+		ns:      ns,
+		client:  clientKey(r, p),
+		conn:    conn,
+		ctx:     ctx,
+		subs:    make(map[string]*wsSub),
+		pending: make(map[pendingKey]*wsSub),
+	}
+	defer func() {
+		cancel()
+		conn.Close()
+		sess.wg.Wait()
+		sess.releaseAll()
+	}()
+	// Closing the connection on shutdown ends the read loop below.
+	go func() {
+		select {
+		case <-s.done:
+			conn.Close()
+		case <-ctx.Done():
+		}
+	}()
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var cmd wsCommand
+		if err := json.Unmarshal(data, &cmd); err != nil {
+			_ = sess.reply(wsReply{Op: "error", Error: "invalid command: " + err.Error()})
+			continue
+		}
+		_ = sess.reply(sess.dispatch(cmd))
+	}
+}
+
+func (sess *wsSession) dispatch(cmd wsCommand) wsReply {
+	if cmd.Queue == "" {
+		return wsError(cmd, "missing queue")
+	}
+	need := auth.Consume
+	if cmd.Op == "enqueue" {
+		need = auth.Produce
+	}
+	if !allowed(sess.p, sess.ns, cmd.Queue, need) {
+		return wsError(cmd, fmt.Sprintf("token lacks %s permission on queue %q", need, cmd.Queue))
+	}
+	if (cmd.Op == "enqueue" || cmd.Op == "dequeue") && sess.s.Limiter != nil {
+		if ok, wait := sess.s.Limiter.Allow(cmd.Op, sess.ns.Name(cmd.Queue), sess.client); !ok {
+			return wsError(cmd, fmt.Sprintf("rate limit exceeded, retry after %s", wait.Round(time.Millisecond)))
+		}
+	}
+	switch cmd.Op {
+	case "enqueue":
+		body, err := decodeData(cmd.Data, cmd.Encoding)
+		if err != nil {
+			return wsError(cmd, err.Error())
+		}
+		if len(body) == 0 {
+			return wsError(cmd, "empty data")
+		}
+		q, qerr := sess.s.openQueue(sess.ns, cmd.Queue)
+		if qerr == nil {
+			qerr = sess.s.checkQuota(sess.ns, len(body))
+		}
+		if qerr != nil {
+			return wsError(cmd, qerr.Error())
+		}
+		id, err := q.Push(queue.Message{Body: body}, false)
+		if err != nil {
+			return wsError(cmd, err.Error())
+		}
+		return wsReply{Op: "ok", ID: cmd.ID, Queue: cmd.Queue, MsgID: id}
+	case "dequeue":
+		return sess.dequeue(cmd)
+	case "subscribe":
+		return sess.subscribe(cmd)
+	case "unsubscribe":
+		sess.mu.Lock()
+		sub := sess.subs[cmd.Queue]
+		delete(sess.subs, cmd.Queue)
+		sess.mu.Unlock()
+		if sub == nil {
+			return wsError(cmd, "not subscribed")
+		}
+		sub.cancel()
+		return wsReply{Op: "ok", ID: cmd.ID, Queue: cmd.Queue}
+	case "ack", "nack":
+		if !sess.settle(cmd.Queue, cmd.MsgID, cmd.Op == "ack") {
+			return wsError(cmd, fmt.Sprintf("message %d is not pending", cmd.MsgID))
+		}
+		return wsReply{Op: "ok", ID: cmd.ID, Queue: cmd.Queue, MsgID: cmd.MsgID}
+	default:
+		return wsError(cmd, fmt.Sprintf("unknown op %q", cmd.Op))
+	}
+}
+
+// dequeue takes up to max messages. Without ack they are removed like
+// DELETE /queues/{name}; with ack they stay pending until acked.
+func (sess *wsSession) dequeue(cmd wsCommand) wsReply {
+	max := cmd.Max
+	if max < 1 {
+		max = 1
+	}
+	if max > MaxBatch {
+		max = MaxBatch
+	}
+	q, qerr := sess.s.openQueue(sess.ns, cmd.Queue)
+	if qerr != nil {
+		return wsError(cmd, qerr.Error())
+	}
+	var msgs []queue.Message
+	if cmd.Ack {
+		msgs = q.Reserve(max)
+		sess.mu.Lock()
+		for _, m := range msgs {
+			sess.pending[pendingKey{cmd.Queue, m.ID}] = nil
+		}
+		sess.mu.Unlock()
+	} else {
+		msgs = q.TakeN(max)
+	}
+	out := make([]wsMessage, len(msgs))
+	for i, m := range msgs {
+		out[i] = wsMessage{MsgID: m.ID, Data: encodeData(m.Body, cmd.Encoding), Encoding: cmd.Encoding}
+	}
+	return wsReply{Op: "ok", ID: cmd.ID, Queue: cmd.Queue, Messages: out}
+}
+
+// subscribe starts pushing messages from the queue as they arrive. With ack
+// enabled at most Prefetch messages are outstanding at a time; without it
+// delivery is paced by how fast the connection accepts writes.
+func (sess *wsSession) subscribe(cmd wsCommand) wsReply {
+	if _, err := decodeData("", cmd.Encoding); err != nil {
+		return wsError(cmd, err.Error())
+	}
+	q, qerr := sess.s.openQueue(sess.ns, cmd.Queue)
+	if qerr != nil {
+		return wsError(cmd, qerr.Error())
+	}
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.subs[cmd.Queue] != nil {
+		return wsError(cmd, "already subscribed")
+	}
+	ctx, cancel := context.WithCancel(sess.ctx)
+	sub := &wsSub{cancel: cancel, ack: cmd.Ack, encoding: cmd.Encoding}
+	if cmd.Ack {
+		prefetch := cmd.Prefetch
+		if prefetch < 1 {
+			prefetch = DefaultPrefetch
+		}
+		sub.credits = make(chan struct{}, prefetch)
+	}
+	sess.subs[cmd.Queue] = sub
+	sess.wg.Add(1)
+	go sess.deliver(ctx, cmd.Queue, q, sub)
+	return wsReply{Op: "ok", ID: cmd.ID, Queue: cmd.Queue}
+}
+
+func (sess *wsSession) deliver(ctx context.Context, name string, q *queue.Queue, sub *wsSub) {
+	defer sess.wg.Done()
+	for {
+		if sub.credits != nil {
+			select {
+			case sub.credits <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+		}
+		var msg queue.Message
+		for {
+			ready := q.Ready()
+			var msgs []queue.Message
+			if sub.ack {
+				msgs = q.Reserve(1)
+			} else {
+				msgs = q.TakeN(1)
+			}
+			if len(msgs) > 0 {
+				msg = msgs[0]
+				break
+			}
+			select {
+			case <-ready:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if sub.ack {
+			sess.mu.Lock()
+			sess.pending[pendingKey{name, msg.ID}] = sub
+			sess.mu.Unlock()
+		}
+		err := sess.reply(wsReply{Op: "message", Queue: name, MsgID: msg.ID, Data: encodeData(msg.Body, sub.encoding), Encoding: sub.encoding})
+		if err != nil {
+			return
+		}
+	}
+}
+
+// settle acks or nacks a pending message and returns its subscription's
+// prefetch credit.
+func (sess *wsSession) settle(name string, id uint64, ack bool) bool {
+	key := pendingKey{name, id}
+	sess.mu.Lock()
+	sub, ok := sess.pending[key]
+	delete(sess.pending, key)
+	sess.mu.Unlock()
+	if !ok {
+		return false
+	}
+	if q, ok := sess.ns.Lookup(name); ok {
+		if ack {
+			q.Ack(id)
+		} else {
+			q.Release(id)
+		}
+	}
+	if sub != nil && sub.credits != nil {
+		select {
+		case <-sub.credits:
+		default:
+		}
+	}
+	return true
+}
+
+// releaseAll hands every unacknowledged message back to its queue.
+func (sess *wsSession) releaseAll() {
+	sess.mu.Lock()
+	pending := sess.pending
+	sess.pending = make(map[pendingKey]*wsSub)
+	sess.mu.Unlock()
+	for key := range pending {
+		if q, ok := sess.ns.Lookup(key.queue); ok {
+			q.Release(key.id)
+		}
+	}
+}
+
+func (sess *wsSession) reply(r wsReply) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return sess.conn.WriteMessage(ws.TextMessage, b)
+}
+
+func wsError(cmd wsCommand, msg string) wsReply {
+	return wsReply{Op: "error", ID: cmd.ID, Queue: cmd.Queue, Error: msg}
+}
+
+// decodeData interprets a JSON data field. Text is taken as-is; base64 is
+// needed for payloads that are not valid UTF-8.
+func decodeData(data, encoding string) ([]byte, error) {
+	switch encoding {
+	case "", "text":
+		return []byte(data), nil
+	case "base64":
+		b, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return nil, errors.New("invalid base64 data")
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("unknown encoding %q", encoding)
+	}
+}
+
+func encodeData(body []byte, encoding string) string {
+	if encoding == "base64" {
+		return base64.StdEncoding.EncodeToString(body)
+	}
+	return string(body)
+}
@@ -0,0 +1,176 @@
+package api
+
+import (
+	"context"
+	"corti-kkv/internal/auth"
+	"corti-kkv/internal/queue"
+	"corti-kkv/internal/ws"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type wsClient struct {
+	t    *testing.T
+	conn *ws.Conn
+}
+
+func dialWS(t *testing.T, ts *httptest.Server) *wsClient {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, err := ws.Dial(ctx, "ws"+strings.TrimPrefix(ts.URL, "http")+"/ws", nil, nil)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return &wsClient{t: t, conn: conn}
+}
+
+func (c *wsClient) send(cmd wsCommand) {
+	b, _ := json.Marshal(cmd)
+	assert.NoError(c.t, c.conn.WriteMessage(ws.TextMessage, b))
+}
+
+func (c *wsClient) recv() wsReply {
+	_, b, err := c.conn.ReadMessage()
+	assert.NoError(c.t, err)
+	var r wsReply
+	assert.NoError(c.t, json.Unmarshal(b, &r))
+	return r
+}
+
+func (c *wsClient) call(cmd wsCommand) wsReply {
+	c.send(cmd)
+	return c.recv()
+}
+
+func TestWebSocketEnqueueDequeue(t *testing.T) {
+	m := queue.NewQueueManager()
+	ts := httptest.NewServer(NewServer(m).Handler())
+	defer ts.Close()
+	c := dialWS(t, ts)
+	defer c.conn.Close()
+
+	r := c.call(wsCommand{Op: "enqueue", ID: "1", Queue: "w", Data: "hello\n"})
+	assert.Equal(t, "ok", r.Op)
+	assert.Equal(t, "1", r.ID)
+	assert.Equal(t, uint64(1), r.MsgID)
+	r = c.call(wsCommand{Op: "enqueue", ID: "2", Queue: "w", Data: "/w==", Encoding: "base64"})
+	assert.Equal(t, "ok", r.Op)
+	assert.Equal(t, 2, m.Get("w").Len())
+
+	r = c.call(wsCommand{Op: "dequeue", ID: "3", Queue: "w", Max: 5, Encoding: "base64"})
+	assert.Equal(t, "ok", r.Op)
+	if assert.Len(t, r.Messages, 2) {
+		assert.Equal(t, "aGVsbG8K", r.Messages[0].Data)
+		assert.Equal(t, "/w==", r.Messages[1].Data)
+	}
+	assert.Equal(t, 0, m.Get("w").Len())
+
+	tests := []struct {
+		name string
+		cmd  wsCommand
+	}{
+		{name: "MissingQueue", cmd: wsCommand{Op: "enqueue", Data: "x"}},
+		{name: "EmptyData", cmd: wsCommand{Op: "enqueue", Queue: "w"}},
+		{name: "BadBase64", cmd: wsCommand{Op: "enqueue", Queue: "w", Data: "!!", Encoding: "base64"}},
+		{name: "UnknownOp", cmd: wsCommand{Op: "purge", Queue: "w"}},
+		{name: "AckUnknownMessage", cmd: wsCommand{Op: "ack", Queue: "w", MsgID: 99}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := c.call(tc.cmd)
+			assert.Equal(t, "error", r.Op)
+			assert.NotEmpty(t, r.Error)
+		})
+	}
+}
+
+func TestWebSocketSubscribeWithAcks(t *testing.T) {
+	m := queue.NewQueueManager()
+	ts := httptest.NewServer(NewServer(m).Handler())
+	defer ts.Close()
+	q := m.Get("sub")
+	for _, s := range []string{"a", "b", "c"} {
+		q.Enqueue([]byte(s))
+	}
+
+	c := dialWS(t, ts)
+	r := c.call(wsCommand{Op: "subscribe", ID: "s", Queue: "sub", Ack: true, Prefetch: 2})
+	assert.Equal(t, "ok", r.Op)
+
+	first, second := c.recv(), c.recv()
+	assert.Equal(t, "message", first.Op)
+	assert.Equal(t, "a", first.Data)
+	assert.Equal(t, "b", second.Data)
+	// Prefetch is exhausted, so "c" stays queued until something is acked.
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 1, q.Len())
+	assert.Equal(t, 2, q.Inflight())
+
+	c.send(wsCommand{Op: "ack", ID: "ack-a", Queue: "sub", MsgID: first.MsgID})
+	got := map[string]wsReply{}
+	for i := 0; i < 2; i++ {
+		r := c.recv()
+		got[r.Op] = r
+	}
+	assert.Equal(t, "ack-a", got["ok"].ID)
+	assert.Equal(t, "c", got["message"].Data)
+
+	// Closing without acking hands b and c back to the queue in order.
+	assert.NoError(t, c.conn.Close())
+	assert.Eventually(t, func() bool { return q.Len() == 2 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, []byte("b"), q.Dequeue())
+	assert.Equal(t, []byte("c"), q.Dequeue())
+}
+
+func TestWebSocketNackRedelivers(t *testing.T) {
+	m := queue.NewQueueManager()
+	ts := httptest.NewServer(NewServer(m).Handler())
+	defer ts.Close()
+	m.Get("n").Enqueue([]byte("x"))
+
+	c := dialWS(t, ts)
+	defer c.conn.Close()
+	r := c.call(wsCommand{Op: "dequeue", Queue: "n", Ack: true})
+	if !assert.Len(t, r.Messages, 1) {
+		return
+	}
+	assert.Equal(t, 0, m.Get("n").Len())
+	r = c.call(wsCommand{Op: "nack", Queue: "n", MsgID: r.Messages[0].MsgID})
+	assert.Equal(t, "ok", r.Op)
+	assert.Equal(t, 1, m.Get("n").Len())
+}
+
+func TestWebSocketAuth(t *testing.T) {
+	store, err := auth.Parse(strings.NewReader("up uploader lines:produce\n"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	s := NewServer(queue.NewQueueManager())
+	s.Auth = store
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, err := ws.Dial(ctx, "ws"+strings.TrimPrefix(ts.URL, "http")+"/ws", http.Header{"Authorization": {"Bearer up"}}, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	c := &wsClient{t: t, conn: conn}
+	defer conn.Close()
+
+	assert.Equal(t, "ok", c.call(wsCommand{Op: "enqueue", Queue: "lines", Data: "x"}).Op)
+	r := c.call(wsCommand{Op: "dequeue", Queue: "lines"})
+	assert.Equal(t, "error", r.Op)
+	assert.Contains(t, r.Error, "consume permission")
+	r = c.call(wsCommand{Op: "enqueue", Queue: "other", Data: "x"})
+	assert.Equal(t, "error", r.Op)
+	assert.Equal(t, 1, s.Manager.Get("lines").Len())
+}
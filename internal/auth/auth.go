@@ -0,0 +1,250 @@
+// Package auth loads bearer-token credentials and decides which queues a
+// token may use.
+//
+// A credentials file has one token per line:
+//
+//	# token   name      grants
+//	s3cret    uploader  lines*:produce
+//	t0ken     worker    lines*:consume jobs:produce,consume
+//	r00t      ops       *:admin
+//	4cme      acme-etl  tenant=acme *:produce,consume
+//
+// Each grant is a path.Match pattern for queue names and a comma-separated
+// list of permissions. A tenant=<name> field confines the token to that
+// tenant's queues, to which its grants then apply; the grants of other
+// tokens apply to stored names such as acme/lines. A first field of the
+// form cert:<common name> grants the permissions to clients presenting a
+// verified TLS certificate with that common name instead of to a token.
+// Blank lines and lines starting with # are ignored.
+package auth
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// AnonymousName is the name of the principal used for requests without
+// credentials, if the store allows any.
+const AnonymousName = "anonymous"
+
+// Permission is a set of rights on a queue.
+type Permission uint8
+
+const (
+	Produce Permission = 1 << iota
+	Consume
+	// Admin covers produce and consume as well as administrative operations.
+	Admin
+)
+
+var permNames = map[string]Permission{
+	"produce": Produce,
+	"consume": Consume,
+	"admin":   Admin,
+}
+
+func (p Permission) String() string {
+	var names []string
+	for _, n := range []string{"produce", "consume", "admin"} {
+		if p&permNames[n] != 0 {
+			names = append(names, n)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// Grant gives Perms on every queue whose name matches Pattern.
+type Grant struct {
+	Pattern string
+	Perms   Permission
+}
+
+// Principal is an authenticated caller. Tenant is empty unless the caller
+// is confined to one tenant.
+type Principal struct {
+	Name   string
+	Tenant string
+	Grants []Grant
+}
+
+// Allowed reports whether p holds any of perms on the named queue.
+func (p *Principal) Allowed(queue string, perms Permission) bool {
+	for _, g := range p.Grants {
+		if ok, _ := path.Match(g.Pattern, queue); !ok {
+			continue
+		}
+		if g.Perms&Admin != 0 || g.Perms&perms != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+type credential struct {
+	token     []byte
+	principal *Principal
+}
+
+// Store holds the known tokens and certificate identities. It is safe to
+// replace them while in use.
+type Store struct {
+	mu    sync.RWMutex
+	creds []credential
+	certs map[string]*Principal
+	anon  *Principal
+}
+
+// Load reads a credentials file.
+func Load(filename string) (*Store, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return s, nil
+}
+
+// Parse reads credentials in the format described in the package comment.
+func Parse(r io.Reader) (*Store, error) {
+	s := &Store{certs: make(map[string]*Principal)}
+	seen := make(map[string]bool)
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("line %d: want token, name and at least one grant", n)
+		}
+		if seen[fields[0]] {
+			return nil, fmt.Errorf("line %d: duplicate token", n)
+		}
+		seen[fields[0]] = true
+		p := &Principal{Name: fields[1]}
+		for _, f := range fields[2:] {
+			if t, ok := strings.CutPrefix(f, "tenant="); ok {
+				if t == "" || strings.Contains(t, "/") {
+					return nil, fmt.Errorf("line %d: invalid tenant %q", n, t)
+				}
+				p.Tenant = t
+				continue
+			}
+			g, err := parseGrant(f)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			p.Grants = append(p.Grants, g)
+		}
+		if len(p.Grants) == 0 {
+			return nil, fmt.Errorf("line %d: want at least one grant", n)
+		}
+		if cn, ok := strings.CutPrefix(fields[0], "cert:"); ok {
+			s.certs[cn] = p
+			continue
+		}
+		s.creds = append(s.creds, credential{token: []byte(fields[0]), principal: p})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func parseGrant(s string) (Grant, error) {
+	pattern, perms, ok := strings.Cut(s, ":")
+	if !ok || pattern == "" {
+		return Grant{}, fmt.Errorf("invalid grant %q, want pattern:perm[,perm]", s)
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return Grant{}, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+	g := Grant{Pattern: pattern}
+	for _, name := range strings.Split(perms, ",") {
+		p, ok := permNames[name]
+		if !ok {
+			return Grant{}, fmt.Errorf("unknown permission %q", name)
+		}
+		g.Perms |= p
+	}
+	return g, nil
+}
+
+// Lookup returns the principal for token. Every stored token is compared so
+// the time taken does not reveal which one nearly matched.
+func (s *Store) Lookup(token string) (*Principal, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var found *Principal
+	for _, c := range s.creds {
+		if subtle.ConstantTimeCompare(c.token, []byte(token)) == 1 {
+			found = c.principal
+		}
+	}
+	return found, found != nil
+}
+
+// LookupCert returns the principal for a verified client certificate.
+func (s *Store) LookupCert(cert *x509.Certificate) (*Principal, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p, ok := s.certs[cert.Subject.CommonName]
+	return p, ok
+}
+
+// Anonymous returns the principal for requests that present no credentials,
+// if the store allows them any access.
+func (s *Store) Anonymous() (*Principal, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.anon, s.anon != nil
+}
+
+// SetAnonymous gives requests without credentials grants within tenant.
+// No grants turns anonymous access off.
+func (s *Store) SetAnonymous(tenant string, grants []Grant) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.anon = nil
+	if len(grants) > 0 {
+		s.anon = &Principal{Name: AnonymousName, Tenant: tenant, Grants: grants}
+	}
+}
+
+// Replace swaps in the tokens and certificate identities of from, keeping
+// the anonymous grants.
+func (s *Store) Replace(from *Store) {
+	from.mu.RLock()
+	creds, certs := from.creds, from.certs
+	from.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.creds, s.certs = creds, certs
+}
+
+// Token extracts the bearer token from the Authorization header, falling
+// back to the access_token query parameter for clients such as browsers'
+// EventSource and WebSocket that cannot set headers.
+func Token(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); h != "" {
+		scheme, token, ok := strings.Cut(h, " ")
+		if ok && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+		return ""
+	}
+	return r.URL.Query().Get("access_token")
+}
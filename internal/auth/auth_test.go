@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testCreds = `
+# token  name      grants
+up       uploader  lines*:produce
+wk       worker    lines*:consume jobs:produce,consume
+root     ops       *:admin
+acme     etl       tenant=acme *:produce,consume
+`
+
+func TestParseAndAllowed(t *testing.T) {
+	s, err := Parse(strings.NewReader(testCreds))
+	assert.NoError(t, err)
+
+	tests := []struct {
+		token string
+		queue string
+		perms Permission
+		want  bool
+	}{
+		{token: "up", queue: "lines", perms: Produce, want: true},
+		{token: "up", queue: "lines-2", perms: Produce, want: true},
+		{token: "up", queue: "lines", perms: Consume, want: false},
+		{token: "up", queue: "lines", perms: Produce | Consume, want: true},
+		{token: "up", queue: "other", perms: Produce, want: false},
+		{token: "wk", queue: "lines", perms: Consume, want: true},
+		{token: "wk", queue: "jobs", perms: Produce, want: true},
+		{token: "wk", queue: "jobs", perms: Admin, want: false},
+		{token: "root", queue: "anything", perms: Consume, want: true},
+		{token: "root", queue: "anything", perms: Admin, want: true},
+	}
+	for _, tc := range tests {
+		p, ok := s.Lookup(tc.token)
+		if !assert.True(t, ok, tc.token) {
+			continue
+		}
+		assert.Equal(t, tc.want, p.Allowed(tc.queue, tc.perms), "%s %s %s", tc.token, tc.queue, tc.perms)
+	}
+
+	p, _ := s.Lookup("wk")
+	assert.Equal(t, "worker", p.Name)
+	assert.Empty(t, p.Tenant)
+	p, _ = s.Lookup("acme")
+	assert.Equal(t, "acme", p.Tenant)
+	assert.True(t, p.Allowed("lines", Consume))
+	_, ok := s.Lookup("nope")
+	assert.False(t, ok)
+	_, ok = s.Lookup("")
+	assert.False(t, ok)
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "MissingGrant", in: "tok name\n", want: "line 1"},
+		{name: "NoColon", in: "tok name lines\n", want: "invalid grant"},
+		{name: "UnknownPermission", in: "tok name lines:write\n", want: "unknown permission"},
+		{name: "BadPattern", in: "tok name [:produce\n", want: "invalid pattern"},
+		{name: "TenantOnly", in: "tok name tenant=acme\n", want: "line 1: want at least one grant"},
+		{name: "InvalidTenant", in: "tok name tenant=a/b q:produce\n", want: "invalid tenant"},
+		{name: "DuplicateToken", in: "a x q:produce\na y q:consume\n", want: "line 2: duplicate token"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(tc.in))
+			assert.ErrorContains(t, err, tc.want)
+		})
+	}
+}
+
+func TestToken(t *testing.T) {
+	r := httptest.NewRequest("GET", "/queues/a?access_token=q", nil)
+	assert.Equal(t, "q", Token(r))
+	r.Header.Set("Authorization", "Bearer  h ")
+	assert.Equal(t, "h", Token(r))
+	r.Header.Set("Authorization", "Basic abc")
+	assert.Equal(t, "", Token(r))
+}
+
+func TestStoreReplaceAndAnonymous(t *testing.T) {
+	s, err := Parse(strings.NewReader("old worker lines:consume\n"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, ok := s.Anonymous()
+	assert.False(t, ok)
+	s.SetAnonymous("default", []Grant{{Pattern: "public", Perms: Consume}})
+
+	next, err := Parse(strings.NewReader("new worker lines:consume\n"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	s.Replace(next)
+	_, ok = s.Lookup("old")
+	assert.False(t, ok)
+	_, ok = s.Lookup("new")
+	assert.True(t, ok)
+
+	p, ok := s.Anonymous()
+	if assert.True(t, ok, "anonymous grants survive a replace") {
+		assert.Equal(t, &Principal{Name: AnonymousName, Tenant: "default", Grants: []Grant{{Pattern: "public", Perms: Consume}}}, p)
+	}
+	s.SetAnonymous("default", nil)
+	_, ok = s.Anonymous()
+	assert.False(t, ok)
+}
@@ -0,0 +1,296 @@
+package binproto
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"corti-kkv/internal/queue"
+)
+
+// ErrConnClosed fails calls that were outstanding when the connection broke.
+var ErrConnClosed = errors.New("binproto: connection closed")
+
+// Client is a pipelining client. Calls from any number of goroutines share
+// one connection, which is opened on first use and re-opened after a
+// failure.
+type Client struct {
+	network string
+	addr    string
+
+	// mu guards the connection and the pending calls; wmu serialises writes.
+	// They are separate so the read loop can always deliver responses while
+	// a write is blocked on a full socket buffer.
+	mu      sync.Mutex
+	conn    net.Conn
+	bw      *bufio.Writer
+	nextID  uint64
+	pending map[uint64]*Call
+	wmu     sync.Mutex
+}
+
+// NewClient returns a client for network ("tcp" or "unix") and addr. No
+// connection is made until the first call.
+func NewClient(network, addr string) *Client {
+	return &Client{network: network, addr: addr}
+}
+
+// Call is an outstanding request.
+type Call struct {
+	done chan struct{}
+	resp Frame
+	err  error
+}
+
+// Wait blocks until the response arrives or ctx is done.
+func (c *Call) Wait(ctx context.Context) (Frame, error) {
+	select {
+	case <-c.done:
+		if c.err != nil {
+			return Frame{}, c.err
+		}
+		if c.resp.Op == StatusError {
+			return Frame{}, fmt.Errorf("binproto: %s", c.resp.Payload)
+		}
+		return c.resp, nil
+	case <-ctx.Done():
+		return Frame{}, ctx.Err()
+	}
+}
+
+// Start sends a request without waiting for its response.
+func (c *Client) Start(ctx context.Context, op Op, payload []byte) (*Call, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.mu.Lock()
+	if c.conn == nil {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, c.network, c.addr)
+		if err != nil {
+			c.mu.Unlock()
+			return nil, err
+		}
+		c.conn = conn
+		c.bw = bufio.NewWriter(conn)
+		c.pending = make(map[uint64]*Call)
+		go c.readLoop(conn, c.pending)
+	}
+	c.nextID++
+	id, conn, bw := c.nextID, c.conn, c.bw
+	call := &Call{done: make(chan struct{})}
+	c.pending[id] = call
+	c.mu.Unlock()
+
+	err := WriteFrame(bw, Frame{Op: op, ID: id, Payload: payload})
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		c.mu.Lock()
+		c.failLocked(conn, err)
+		c.mu.Unlock()
+		return nil, err
+	}
+	return call, nil
+}
+
+func (c *Client) do(ctx context.Context, op Op, payload []byte) (Frame, error) {
+	call, err := c.Start(ctx, op, payload)
+	if err != nil {
+		return Frame{}, err
+	}
+	return call.Wait(ctx)
+}
+
+func (c *Client) readLoop(conn net.Conn, pending map[uint64]*Call) {
+	br := bufio.NewReader(conn)
+	for {
+		f, err := ReadFrame(br)
+		c.mu.Lock()
+		if err != nil {
+			c.failLocked(conn, err)
+			c.mu.Unlock()
+			return
+		}
+		call := pending[f.ID]
+		delete(pending, f.ID)
+		c.mu.Unlock()
+		if call != nil {
+			call.resp = f
+			close(call.done)
+		}
+	}
+}
+
+// failLocked tears down conn and fails its outstanding calls. The caller
+// must hold c.mu.
+func (c *Client) failLocked(conn net.Conn, err error) {
+	if c.conn != conn {
+		return
+	}
+	conn.Close()
+	for id, call := range c.pending {
+		call.err = fmt.Errorf("%w: %v", ErrConnClosed, err)
+		close(call.done)
+		delete(c.pending, id)
+	}
+	c.conn = nil
+}
+
+// Close closes the current connection, if any.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil {
+		c.failLocked(c.conn, errors.New("client closed"))
+	}
+	return nil
+}
+
+func (c *Client) Ping(ctx context.Context) error {
+	_, err := c.do(ctx, OpPing, nil)
+	return err
+}
+
+// Enqueue adds body to the named queue and returns its message ID.
+func (c *Client) Enqueue(ctx context.Context, name string, body []byte) (uint64, error) {
+	call, err := c.StartEnqueue(ctx, name, body)
+	if err != nil {
+		return 0, err
+	}
+	return EnqueueResult(ctx, call)
+}
+
+// StartEnqueue sends an enqueue without waiting for it to be confirmed, so
+// several can be in flight at once. The server applies them in the order
+// they were sent.
+func (c *Client) StartEnqueue(ctx context.Context, name string, body []byte) (*Call, error) {
+	var e encoder
+	e.string(name)
+	e.bytes(body)
+	return c.Start(ctx, OpEnqueue, e.buf)
+}
+
+// EnqueueResult waits for a call made by StartEnqueue and returns the
+// message ID.
+func EnqueueResult(ctx context.Context, call *Call) (uint64, error) {
+	f, err := call.Wait(ctx)
+	if err != nil {
+		return 0, err
+	}
+	d := decoder{buf: f.Payload}
+	id := d.uint64()
+	return id, d.err
+}
+
+// Dequeue takes up to max messages, waiting up to wait for the first. With
+// ack set they stay in flight until Ack or Nack, and messages the server
+// reserves after ctx ends are handed back with Nack.
+func (c *Client) Dequeue(ctx context.Context, name string, max int, wait time.Duration, ack bool) ([]queue.Message, error) {
+	var e encoder
+	e.string(name)
+	e.uint16(uint16(min(max, MaxBatch)))
+	e.uint32(uint32(wait / time.Millisecond))
+	var flags uint8
+	if ack {
+		flags |= FlagAck
+	}
+	e.uint8(flags)
+	call, err := c.Start(ctx, OpDequeue, e.buf)
+	if err != nil {
+		return nil, err
+	}
+	f, err := call.Wait(ctx)
+	if err != nil {
+		if ack && ctx.Err() != nil {
+			go c.releaseLate(name, call)
+		}
+		return nil, err
+	}
+	return decodeMessages(f.Payload)
+}
+
+// releaseLate waits for the answer to a dequeue its caller gave up on and
+// releases what it reserved, which would otherwise stay in flight until the
+// connection closes.
+func (c *Client) releaseLate(name string, call *Call) {
+	ctx := context.Background()
+	f, err := call.Wait(ctx)
+	if err != nil {
+		return
+	}
+	msgs, _ := decodeMessages(f.Payload)
+	ids := make([]uint64, len(msgs))
+	for i, m := range msgs {
+		ids[i] = m.ID
+	}
+	c.NackAll(ctx, name, ids)
+}
+
+func decodeMessages(payload []byte) ([]queue.Message, error) {
+	d := decoder{buf: payload}
+	n := int(d.uint16())
+	msgs := make([]queue.Message, 0, n)
+	for i := 0; i < n; i++ {
+		msgs = append(msgs, queue.Message{ID: d.uint64(), Body: d.bytes()})
+	}
+	return msgs, d.err
+}
+
+func (c *Client) Ack(ctx context.Context, name string, id uint64) error {
+	return c.settle(ctx, OpAck, name, []uint64{id})
+}
+
+func (c *Client) Nack(ctx context.Context, name string, id uint64) error {
+	return c.settle(ctx, OpNack, name, []uint64{id})
+}
+
+// AckAll acknowledges several messages, sending every request before
+// waiting for the first answer.
+func (c *Client) AckAll(ctx context.Context, name string, ids []uint64) error {
+	return c.settle(ctx, OpAck, name, ids)
+}
+
+// NackAll is AckAll for Nack.
+func (c *Client) NackAll(ctx context.Context, name string, ids []uint64) error {
+	return c.settle(ctx, OpNack, name, ids)
+}
+
+func (c *Client) settle(ctx context.Context, op Op, name string, ids []uint64) error {
+	calls := make([]*Call, 0, len(ids))
+	var errs []error
+	for _, id := range ids {
+		var e encoder
+		e.string(name)
+		e.uint64(id)
+		call, err := c.Start(ctx, op, e.buf)
+		if err != nil {
+			errs = append(errs, err)
+			break
+		}
+		calls = append(calls, call)
+	}
+	for _, call := range calls {
+		if _, err := call.Wait(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Len returns the number of queued messages.
+func (c *Client) Len(ctx context.Context, name string) (int, error) {
+	var e encoder
+	e.string(name)
+	f, err := c.do(ctx, OpLen, e.buf)
+	if err != nil {
+		return 0, err
+	}
+	d := decoder{buf: f.Payload}
+	n := d.uint64()
+	return int(n), d.err
+}
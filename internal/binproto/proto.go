@@ -0,0 +1,183 @@
+// Package binproto implements a compact length-prefixed binary protocol for
+// queue operations over TCP or Unix sockets.
+//
+// Every frame, in both directions, is
+//
+//	uint32 length | uint8 op | uint64 request id | payload
+//
+// where length counts everything after itself and all integers are
+// big-endian. Requests carry the client's request ID, which the matching
+// response echoes. Strings are a uint16 length followed by the bytes; message
+// bodies are a uint32 length followed by the bytes.
+//
+// Request payloads:
+//
+//	Ping:    (empty)
+//	Enqueue: queue string | body
+//	Dequeue: queue string | uint16 max | uint32 wait ms | uint8 flags
+//	Ack:     queue string | uint64 message id
+//	Nack:    queue string | uint64 message id
+//	Len:     queue string
+//
+// A StatusOK response carries a uint64 message ID for Enqueue, a uint64
+// length for Len, and for Dequeue a uint16 count followed by that many
+// (uint64 message id | body) pairs. StatusError carries an error string.
+package binproto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+type Op uint8
+
+const (
+	OpPing    Op = 0x01
+	OpEnqueue Op = 0x02
+	OpDequeue Op = 0x03
+	OpAck     Op = 0x04
+	OpNack    Op = 0x05
+	OpLen     Op = 0x06
+
+	StatusOK    Op = 0x80
+	StatusError Op = 0x81
+)
+
+// FlagAck asks Dequeue to keep the returned messages in flight until they
+// are acked or nacked instead of removing them outright.
+const FlagAck uint8 = 0x01
+
+// MaxFrameSize bounds the length field of a frame.
+const MaxFrameSize = 64<<20 + 1024
+
+const headerLen = 1 + 8
+
+type Frame struct {
+	Op      Op
+	ID      uint64
+	Payload []byte
+}
+
+// WriteFrame encodes f onto w.
+func WriteFrame(w io.Writer, f Frame) error {
+	n := headerLen + len(f.Payload)
+	if n > MaxFrameSize {
+		return fmt.Errorf("binproto: frame too large: %d bytes", n)
+	}
+	buf := make([]byte, 4+headerLen, 4+n)
+	binary.BigEndian.PutUint32(buf[0:4], uint32(n))
+	buf[4] = byte(f.Op)
+	binary.BigEndian.PutUint64(buf[5:13], f.ID)
+	buf = append(buf, f.Payload...)
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadFrame decodes the next frame from r.
+func ReadFrame(r io.Reader) (Frame, error) {
+	var hdr [4 + headerLen]byte
+	if _, err := io.ReadFull(r, hdr[:4]); err != nil {
+		return Frame{}, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:4])
+	if n < headerLen || n > MaxFrameSize {
+		return Frame{}, fmt.Errorf("binproto: invalid frame length %d", n)
+	}
+	if _, err := io.ReadFull(r, hdr[4:]); err != nil {
+		return Frame{}, unexpected(err)
+	}
+	payload := make([]byte, n-headerLen)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return Frame{}, unexpected(err)
+	}
+	return Frame{
+		Op:      Op(hdr[4]),
+		ID:      binary.BigEndian.Uint64(hdr[5:13]),
+		Payload: payload,
+	}, nil
+}
+
+func unexpected(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// encoder appends payload fields.
+type encoder struct{ buf []byte }
+
+func (e *encoder) string(s string) {
+	e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *encoder) uint8(v uint8)   { e.buf = append(e.buf, v) }
+func (e *encoder) uint16(v uint16) { e.buf = binary.BigEndian.AppendUint16(e.buf, v) }
+func (e *encoder) uint32(v uint32) { e.buf = binary.BigEndian.AppendUint32(e.buf, v) }
+func (e *encoder) uint64(v uint64) { e.buf = binary.BigEndian.AppendUint64(e.buf, v) }
+
+// decoder reads payload fields. The first short read sets err and every
+// later read returns zero values, so callers check err once at the end.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+var errShortPayload = errors.New("binproto: payload too short")
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.buf) < n {
+		d.err = errShortPayload
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) string() string {
+	return string(d.next(int(d.uint16())))
+}
+
+func (d *decoder) bytes() []byte {
+	return d.next(int(d.uint32()))
+}
+
+func (d *decoder) uint8() uint8 {
+	if b := d.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *decoder) uint16() uint16 {
+	if b := d.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *decoder) uint32() uint32 {
+	if b := d.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *decoder) uint64() uint64 {
+	if b := d.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
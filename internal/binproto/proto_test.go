@@ -0,0 +1,69 @@
+package binproto
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	frames := []Frame{
+		{Op: OpPing, ID: 1},
+		{Op: OpEnqueue, ID: 1 << 40, Payload: []byte("payload")},
+		{Op: StatusError, ID: 3, Payload: []byte("boom")},
+	}
+	var buf bytes.Buffer
+	for _, f := range frames {
+		assert.NoError(t, WriteFrame(&buf, f))
+	}
+	for _, want := range frames {
+		got, err := ReadFrame(&buf)
+		assert.NoError(t, err)
+		assert.Equal(t, want.Op, got.Op)
+		assert.Equal(t, want.ID, got.ID)
+		assert.Equal(t, string(want.Payload), string(got.Payload))
+	}
+	_, err := ReadFrame(&buf)
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestReadFrameErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "LengthBelowHeader", data: []byte{0, 0, 0, 3, 1, 2, 3}},
+		{name: "LengthAboveMax", data: []byte{0xFF, 0xFF, 0xFF, 0xFF}},
+		{name: "TruncatedPayload", data: []byte{0, 0, 0, 12, 1, 0, 0, 0, 0, 0, 0, 0, 1, 'a'}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ReadFrame(bytes.NewReader(tc.data))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestCodec(t *testing.T) {
+	var e encoder
+	e.string("lines")
+	e.bytes([]byte("body"))
+	e.uint8(7)
+	e.uint16(513)
+	e.uint32(70000)
+	e.uint64(1 << 50)
+
+	d := decoder{buf: e.buf}
+	assert.Equal(t, "lines", d.string())
+	assert.Equal(t, "body", string(d.bytes()))
+	assert.Equal(t, uint8(7), d.uint8())
+	assert.Equal(t, uint16(513), d.uint16())
+	assert.Equal(t, uint32(70000), d.uint32())
+	assert.Equal(t, uint64(1<<50), d.uint64())
+	assert.NoError(t, d.err)
+
+	assert.Equal(t, uint64(0), d.uint64())
+	assert.ErrorIs(t, d.err, errShortPayload)
+}
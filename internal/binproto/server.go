@@ -0,0 +1,353 @@
+package binproto
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"corti-kkv/internal/queue"
+)
+
+const (
+	// MaxBatch caps the number of messages returned by one Dequeue.
+	MaxBatch = 1000
+	// MaxWait caps how long a Dequeue may wait for messages.
+	MaxWait = 20 * time.Second
+)
+
+type Server struct {
+	Manager *queue.QueueManager
+
+	mu     sync.Mutex
+	lns    map[net.Listener]struct{}
+	conns  map[net.Conn]struct{}
+	done   chan struct{}
+	closed bool
+}
+
+func NewServer(m *queue.QueueManager) *Server {
+	return &Server{
+		Manager: m,
+		lns:     make(map[net.Listener]struct{}),
+		conns:   make(map[net.Conn]struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// ErrServerClosed is returned by Serve after Close.
+var ErrServerClosed = errors.New("binproto: server closed")
+
+// Listen opens a listener for addr, which is either host:port or
+// unix:///path/to/socket. A stale socket file is removed first.
+func Listen(addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, "unix://"); ok {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// ListenAndServe listens on addr (see Listen) and serves until Close is
+// called.
+func (s *Server) ListenAndServe(addr string) error {
+	ln, err := Listen(addr)
+	if err != nil {
+		return err
+	}
+	slog.Info("binary protocol listener started", "addr", ln.Addr().String())
+	return s.Serve(ln)
+}
+
+// Serve accepts connections on ln until Close is called.
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ln.Close()
+		return ErrServerClosed
+	}
+	s.lns[ln] = struct{}{}
+	s.mu.Unlock()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-s.done:
+				return ErrServerClosed
+			default:
+				return err
+			}
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops all listeners and drops open connections.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	for ln := range s.lns {
+		ln.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	return nil
+}
+
+// session is the state of one connection: its output and the messages it
+// has reserved without settling them.
+type session struct {
+	s   *Server
+	br  *bufio.Reader
+	ctx context.Context
+	wg  sync.WaitGroup
+
+	wmu sync.Mutex
+	bw  *bufio.Writer
+
+	mu      sync.Mutex
+	pending map[pendingKey]struct{}
+}
+
+type pendingKey struct {
+	queue string
+	id    uint64
+}
+
+// serveConn handles requests in the order they arrive, so pipelined
+// enqueues keep their order. Only dequeues that have to wait are handled in
+// the background; their responses may overtake later ones, which is why
+// every response carries the request ID.
+func (s *Server) serveConn(conn net.Conn) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sess := &session{
+		s:       s,
+		br:      bufio.NewReader(conn),
+		bw:      bufio.NewWriter(conn),
+		ctx:     ctx,
+		pending: make(map[pendingKey]struct{}),
+	}
+	defer func() {
+		cancel()
+		conn.Close()
+		sess.wg.Wait()
+		sess.releaseAll()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+	for {
+		f, err := ReadFrame(sess.br)
+		if err != nil {
+			return
+		}
+		if f.Op == OpDequeue {
+			req, err := parseDequeue(f.Payload)
+			if err != nil {
+				if sess.write(errorFrame(f.ID, err), false) != nil {
+					return
+				}
+				continue
+			}
+			if req.wait > 0 {
+				sess.wg.Add(1)
+				go func() {
+					defer sess.wg.Done()
+					_ = sess.write(sess.dequeue(f.ID, req), true)
+				}()
+				continue
+			}
+			if sess.write(sess.dequeue(f.ID, req), false) != nil {
+				return
+			}
+			continue
+		}
+		if sess.write(sess.handle(f), false) != nil {
+			return
+		}
+	}
+}
+
+// write sends a response. Unless flush is set the buffer is only flushed
+// once no further pipelined requests are waiting to be read.
+func (sess *session) write(f Frame, flush bool) error {
+	sess.wmu.Lock()
+	defer sess.wmu.Unlock()
+	if err := WriteFrame(sess.bw, f); err != nil {
+		return err
+	}
+	if flush || sess.br.Buffered() == 0 {
+		return sess.bw.Flush()
+	}
+	return nil
+}
+
+func (sess *session) handle(f Frame) Frame {
+	d := decoder{buf: f.Payload}
+	switch f.Op {
+	case OpPing:
+		return Frame{Op: StatusOK, ID: f.ID}
+	case OpEnqueue:
+		name, body := d.string(), d.bytes()
+		if err := checkName(name, d.err); err != nil {
+			return errorFrame(f.ID, err)
+		}
+		if len(body) == 0 {
+			return errorFrame(f.ID, errors.New("empty body"))
+		}
+		id, err := sess.s.Manager.Get(name).Push(queue.Message{Body: body}, false)
+		if err != nil {
+			return errorFrame(f.ID, err)
+		}
+		var e encoder
+		e.uint64(id)
+		return Frame{Op: StatusOK, ID: f.ID, Payload: e.buf}
+	case OpAck, OpNack:
+		name, id := d.string(), d.uint64()
+		if err := checkName(name, d.err); err != nil {
+			return errorFrame(f.ID, err)
+		}
+		if !sess.settle(name, id, f.Op == OpAck) {
+			return errorFrame(f.ID, fmt.Errorf("message %d is not pending", id))
+		}
+		return Frame{Op: StatusOK, ID: f.ID}
+	case OpLen:
+		name := d.string()
+		if err := checkName(name, d.err); err != nil {
+			return errorFrame(f.ID, err)
+		}
+		var e encoder
+		e.uint64(uint64(sess.s.Manager.Get(name).Len()))
+		return Frame{Op: StatusOK, ID: f.ID, Payload: e.buf}
+	default:
+		return errorFrame(f.ID, fmt.Errorf("unknown op 0x%02x", uint8(f.Op)))
+	}
+}
+
+type dequeueRequest struct {
+	queue string
+	max   int
+	wait  time.Duration
+	ack   bool
+}
+
+func parseDequeue(payload []byte) (dequeueRequest, error) {
+	d := decoder{buf: payload}
+	req := dequeueRequest{
+		queue: d.string(),
+		max:   int(d.uint16()),
+		wait:  time.Duration(d.uint32()) * time.Millisecond,
+	}
+	req.ack = d.uint8()&FlagAck != 0
+	if err := checkName(req.queue, d.err); err != nil {
+		return req, err
+	}
+	req.max = min(max(req.max, 1), MaxBatch)
+	req.wait = min(req.wait, MaxWait)
+	return req, nil
+}
+
+func (sess *session) dequeue(reqID uint64, req dequeueRequest) Frame {
+	q := sess.s.Manager.Get(req.queue)
+	var timeout <-chan time.Time
+	if req.wait > 0 {
+		t := time.NewTimer(req.wait)
+		defer t.Stop()
+		timeout = t.C
+	}
+	// Only take what fits one reply: the count, and an ID and a length per
+	// message, besides the bodies.
+	budget := int64(MaxFrameSize - headerLen - 2 - 12*req.max)
+	var msgs []queue.Message
+	for {
+		ready := q.Ready()
+		if req.ack {
+			msgs = q.ReserveWithin(nil, req.max, budget)
+		} else {
+			msgs = q.TakeWithin(nil, req.max, budget)
+		}
+		if len(msgs) > 0 || req.wait <= 0 {
+			break
+		}
+		select {
+		case <-ready:
+			continue
+		case <-timeout:
+		case <-sess.ctx.Done():
+		}
+		break
+	}
+	if req.ack && len(msgs) > 0 {
+		sess.mu.Lock()
+		for _, m := range msgs {
+			sess.pending[pendingKey{req.queue, m.ID}] = struct{}{}
+		}
+		sess.mu.Unlock()
+	}
+	var e encoder
+	e.uint16(uint16(len(msgs)))
+	for _, m := range msgs {
+		e.uint64(m.ID)
+		e.bytes(m.Body)
+	}
+	return Frame{Op: StatusOK, ID: reqID, Payload: e.buf}
+}
+
+func (sess *session) settle(name string, id uint64, ack bool) bool {
+	key := pendingKey{name, id}
+	sess.mu.Lock()
+	_, ok := sess.pending[key]
+	delete(sess.pending, key)
+	sess.mu.Unlock()
+	if !ok {
+		return false
+	}
+	q := sess.s.Manager.Get(name)
+	if ack {
+		return q.Ack(id)
+	}
+	return q.Release(id)
+}
+
+// releaseAll hands every unsettled message back to its queue.
+func (sess *session) releaseAll() {
+	sess.mu.Lock()
+	pending := sess.pending
+	sess.pending = make(map[pendingKey]struct{})
+	sess.mu.Unlock()
+	for key := range pending {
+		sess.s.Manager.Get(key.queue).Release(key.id)
+	}
+}
+
+func checkName(name string, decodeErr error) error {
+	if decodeErr != nil {
+		return decodeErr
+	}
+	if name == "" || strings.Contains(name, "/") {
+		return errors.New("missing or invalid queue name")
+	}
+	return nil
+}
+
+func errorFrame(id uint64, err error) Frame {
+	return Frame{Op: StatusError, ID: id, Payload: []byte(err.Error())}
+}
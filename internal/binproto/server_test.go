@@ -0,0 +1,181 @@
+package binproto
+
+import (
+	"context"
+	"corti-kkv/internal/queue"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func startServer(t *testing.T, network string) (*Server, *Client) {
+	t.Helper()
+	s := NewServer(queue.NewQueueManager())
+	addr := "127.0.0.1:0"
+	if network == "unix" {
+		addr = "unix://" + filepath.Join(t.TempDir(), "kkv.sock")
+	}
+	ln, err := Listen(addr)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	go s.Serve(ln)
+	c := NewClient(network, ln.Addr().String())
+	t.Cleanup(func() {
+		c.Close()
+		s.Close()
+	})
+	return s, c
+}
+
+func TestEnqueueDequeue(t *testing.T) {
+	for _, network := range []string{"tcp", "unix"} {
+		t.Run(network, func(t *testing.T) {
+			_, c := startServer(t, network)
+			ctx := context.Background()
+
+			assert.NoError(t, c.Ping(ctx))
+			// Pipeline a batch of enqueues and only then wait for them.
+			var calls []*Call
+			for i := 0; i < 50; i++ {
+				call, err := c.StartEnqueue(ctx, "lines", []byte(fmt.Sprintf("m%d\n", i)))
+				assert.NoError(t, err)
+				calls = append(calls, call)
+			}
+			for i, call := range calls {
+				id, err := EnqueueResult(ctx, call)
+				assert.NoError(t, err)
+				assert.Equal(t, uint64(i+1), id)
+			}
+			n, err := c.Len(ctx, "lines")
+			assert.NoError(t, err)
+			assert.Equal(t, 50, n)
+
+			msgs, err := c.Dequeue(ctx, "lines", 10, 0, false)
+			assert.NoError(t, err)
+			if assert.Len(t, msgs, 10) {
+				assert.Equal(t, "m0\n", string(msgs[0].Body))
+				assert.Equal(t, "m9\n", string(msgs[9].Body))
+			}
+		})
+	}
+}
+
+func TestDequeueFitsOneFrame(t *testing.T) {
+	s, c := startServer(t, "tcp")
+	ctx := context.Background()
+	big := make([]byte, 25<<20)
+	for i := 0; i < 3; i++ {
+		s.Manager.Get("big").Enqueue(big)
+	}
+	for _, want := range []int{2, 1} {
+		msgs, err := c.Dequeue(ctx, "big", 10, 0, false)
+		assert.NoError(t, err)
+		assert.Len(t, msgs, want)
+	}
+	assert.Equal(t, 0, s.Manager.Get("big").Len())
+}
+
+func TestAckNack(t *testing.T) {
+	s, c := startServer(t, "tcp")
+	ctx := context.Background()
+	q := s.Manager.Get("a")
+	q.Enqueue([]byte("x"))
+	q.Enqueue([]byte("y"))
+
+	msgs, err := c.Dequeue(ctx, "a", 2, 0, true)
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 2)
+	assert.Equal(t, 2, q.Inflight())
+
+	assert.NoError(t, c.Ack(ctx, "a", msgs[0].ID))
+	assert.NoError(t, c.Nack(ctx, "a", msgs[1].ID))
+	assert.Error(t, c.Ack(ctx, "a", msgs[1].ID), "already settled")
+	assert.Equal(t, 0, q.Inflight())
+	assert.Equal(t, 1, q.Len())
+
+	// Reserved messages go back to the queue when the connection drops.
+	_, err = c.Dequeue(ctx, "a", 1, 0, true)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, q.Len())
+	c.Close()
+	assert.Eventually(t, func() bool { return q.Len() == 1 }, time.Second, 5*time.Millisecond)
+}
+
+func TestLongPollDoesNotBlockPipeline(t *testing.T) {
+	s, c := startServer(t, "tcp")
+	ctx := context.Background()
+
+	waiting := make(chan []queue.Message, 1)
+	go func() {
+		msgs, err := c.Dequeue(ctx, "lp", 1, 2*time.Second, false)
+		assert.NoError(t, err)
+		waiting <- msgs
+	}()
+	time.Sleep(20 * time.Millisecond)
+	// This enqueue is sent on the same connection after the waiting dequeue.
+	_, err := c.Enqueue(ctx, "lp", []byte("late"))
+	assert.NoError(t, err)
+	select {
+	case msgs := <-waiting:
+		if assert.Len(t, msgs, 1) {
+			assert.Equal(t, "late", string(msgs[0].Body))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("long-poll dequeue not woken")
+	}
+	assert.Equal(t, 0, s.Manager.Get("lp").Len())
+}
+
+func TestErrors(t *testing.T) {
+	_, c := startServer(t, "tcp")
+	ctx := context.Background()
+
+	_, err := c.Enqueue(ctx, "", []byte("x"))
+	assert.ErrorContains(t, err, "invalid queue name")
+	_, err = c.Enqueue(ctx, "q", nil)
+	assert.ErrorContains(t, err, "empty body")
+	_, err = c.do(ctx, Op(0x7F), nil)
+	assert.ErrorContains(t, err, "unknown op")
+	_, err = c.do(ctx, OpLen, []byte{0})
+	assert.ErrorContains(t, err, "too short")
+
+	// The connection is still usable after error responses.
+	assert.NoError(t, c.Ping(ctx))
+}
+
+func TestClientReconnects(t *testing.T) {
+	s, c := startServer(t, "tcp")
+	ctx := context.Background()
+	assert.NoError(t, c.Ping(ctx))
+
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	assert.Eventually(t, func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.conn == nil
+	}, time.Second, 5*time.Millisecond)
+	assert.NoError(t, c.Ping(ctx))
+}
+
+func TestListenRemovesStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stale.sock")
+	ln, err := net.Listen("unix", path)
+	assert.NoError(t, err)
+	// Leave the socket file behind as a crashed process would.
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+
+	ln, err = Listen("unix://" + path)
+	if assert.NoError(t, err) {
+		ln.Close()
+	}
+}
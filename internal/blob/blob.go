@@ -0,0 +1,165 @@
+// Package blob is a local content-addressed store for message payloads too
+// large to keep in memory. A blob's key is the hex SHA-256 of its content,
+// so storing the same payload twice keeps one file.
+package blob
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"corti-kkv/internal/metrics"
+)
+
+// Store keeps blobs in a directory, each at <dir>/<key[:2]>/<key>. It is
+// safe for concurrent use.
+type Store struct {
+	dir string
+
+	mu           sync.Mutex
+	count, bytes int64
+}
+
+// Open returns the store in dir, creating the directory if needed.
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &Store{dir: dir}
+	err := s.walk(func(_ string, fi fs.FileInfo) {
+		s.count++
+		s.bytes += fi.Size()
+	})
+	return s, err
+}
+
+// Dir returns the store's directory.
+func (s *Store) Dir() string { return s.dir }
+
+func (s *Store) path(key string) (string, error) {
+	if b, err := hex.DecodeString(key); err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return filepath.Join(s.dir, key[:2], key), nil
+}
+
+// Put stores data and returns its key. Storing content that is already
+// there refreshes its modification time, which Sweep goes by.
+func (s *Store) Put(data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	key := hex.EncodeToString(sum[:])
+	p, _ := s.path(key)
+	now := time.Now()
+	if err := os.Chtimes(p, now, now); err == nil {
+		return key, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp(filepath.Dir(p), key+".tmp*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	_, statErr := os.Stat(p)
+	if err := os.Rename(f.Name(), p); err != nil {
+		return "", err
+	}
+	if statErr == nil {
+		// Another Put stored the same content meanwhile.
+		return key, nil
+	}
+	s.mu.Lock()
+	s.count++
+	s.bytes += int64(len(data))
+	s.mu.Unlock()
+	return key, nil
+}
+
+// Get returns the content stored under key, checking it against the key.
+func (s *Store) Get(key string) ([]byte, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != key {
+		return nil, fmt.Errorf("blob %s is corrupt", key)
+	}
+	return data, nil
+}
+
+// Sweep removes the blobs last stored before cutoff for which inUse
+// returns false, and returns how many it removed. The cutoff protects
+// blobs stored for messages that are not queued yet.
+func (s *Store) Sweep(inUse func(key string) bool, cutoff time.Time) (int, error) {
+	n := 0
+	var errs []error
+	err := s.walk(func(p string, fi fs.FileInfo) {
+		if inUse(fi.Name()) || !fi.ModTime().Before(cutoff) {
+			return
+		}
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, err)
+			return
+		}
+		n++
+		s.mu.Lock()
+		s.count--
+		s.bytes -= fi.Size()
+		s.mu.Unlock()
+	})
+	return n, errors.Join(append(errs, err)...)
+}
+
+// walk calls fn for every blob file, skipping temporary ones.
+func (s *Store) walk(fn func(path string, fi fs.FileInfo)) error {
+	return filepath.WalkDir(s.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if _, err := s.path(d.Name()); err != nil {
+			// Leftover temporary files are removed once they are old.
+			if fi, err := d.Info(); err == nil && time.Since(fi.ModTime()) > time.Hour {
+				os.Remove(p)
+			}
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		fn(p, fi)
+		return nil
+	})
+}
+
+// Collect reports the number and size of the stored blobs.
+func (s *Store) Collect(e *metrics.Encoder) {
+	s.mu.Lock()
+	count, bytes := s.count, s.bytes
+	s.mu.Unlock()
+	e.Header("kkv_blobs", "Payloads kept in the blob store.", "gauge")
+	e.Sample("kkv_blobs", float64(count))
+	e.Header("kkv_blob_bytes", "Bytes kept in the blob store.", "gauge")
+	e.Sample("kkv_blob_bytes", float64(bytes))
+}
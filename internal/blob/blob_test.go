@@ -0,0 +1,73 @@
+package blob
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"corti-kkv/internal/metrics"
+)
+
+func TestStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+	k1, err := s.Put([]byte("hello"))
+	assert.NoError(t, err)
+	assert.Equal(t, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", k1)
+	k2, err := s.Put([]byte("hello"))
+	assert.NoError(t, err)
+	assert.Equal(t, k1, k2, "same content, same key")
+	k3, err := s.Put([]byte("world!"))
+	assert.NoError(t, err)
+	assert.FileExists(t, filepath.Join(dir, k1[:2], k1))
+
+	b, err := s.Get(k1)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+	_, err = s.Get("../../etc/passwd")
+	assert.ErrorContains(t, err, "invalid blob key")
+	_, err = s.Get(k1[:63] + "0")
+	assert.Error(t, err)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, k3[:2], k3), []byte("w0rld!"), 0o644))
+	_, err = s.Get(k3)
+	assert.ErrorContains(t, err, "is corrupt")
+
+	var out bytes.Buffer
+	reg := metrics.NewRegistry()
+	reg.Register(s)
+	reg.WriteTo(&out)
+	assert.Contains(t, out.String(), "kkv_blobs 2\n")
+	assert.Contains(t, out.String(), "kkv_blob_bytes 11\n")
+
+	reopened, err := Open(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, [2]int64{2, 11}, [2]int64{reopened.count, reopened.bytes})
+}
+
+func TestStoreSweep(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if !assert.NoError(t, err) {
+		return
+	}
+	used, _ := s.Put([]byte("used"))
+	old, _ := s.Put([]byte("old"))
+	n, err := s.Sweep(func(k string) bool { return k == used }, time.Now().Add(-time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n, "recently stored blobs are kept")
+
+	n, err = s.Sweep(func(k string) bool { return k == used }, time.Now().Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	_, err = s.Get(old)
+	assert.Error(t, err)
+	_, err = s.Get(used)
+	assert.NoError(t, err)
+	assert.Equal(t, [2]int64{1, 4}, [2]int64{s.count, s.bytes})
+}
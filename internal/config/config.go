@@ -0,0 +1,515 @@
+// Package config loads the queue-service configuration from a YAML or JSON
+// file, the environment and command-line flags, in increasing order of
+// precedence.
+//
+// A file looks like this; every setting is optional:
+//
+//	listen:
+//	  http: ":8080"
+//	  resp: ":6379"
+//	auth:
+//	  credentials: /etc/kkv/credentials
+//	storage:
+//	  snapshot: ${DATA_DIR:-/var/lib/kkv}/queues.snap
+//	queues:
+//	  - pattern: "jobs*"
+//	    max_length: 100000
+//	    max_bytes: 256MiB
+//	    ttl: 1h
+//	    max_deliveries: 5
+//	    dlq: "*.dlq"
+//	  - pattern: "public.*"
+//	    anonymous: [consume]
+//	  - pattern: "orders"
+//	    validate:
+//	      utf8: true
+//	      json_schema: {type: object, required: [id]}
+//
+// ${VAR} and ${VAR:-default} are replaced from the environment before the
+// file is parsed. Every scalar setting can also be set by an environment
+// variable named after its path, such as KKV_LISTEN_HTTP or
+// KKV_STORAGE_SNAPSHOT.
+//
+// Queue policies apply to the first pattern that matches. Patterns without a
+// slash match queue names in every tenant; patterns with one match
+// tenant/queue, with "default" for queues outside any tenant. Dead-letter
+// queues only match patterns ending in .dlq. A "*" in dlq stands for the
+// queue's name, and the DLQ is in the queue's tenant.
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"corti-kkv/internal/auth"
+	"corti-kkv/internal/logging"
+	"corti-kkv/internal/queue"
+	"corti-kkv/internal/ratelimit"
+	"corti-kkv/internal/schema"
+	"corti-kkv/internal/tenant"
+)
+
+// EnvPrefix starts the names of environment variables that override
+// settings.
+const EnvPrefix = "KKV"
+
+type Config struct {
+	Listen          Listen        `yaml:"listen"`
+	TLS             TLS           `yaml:"tls"`
+	Storage         Storage       `yaml:"storage"`
+	Auth            Auth          `yaml:"auth"`
+	RateLimits      RateLimits    `yaml:"rate_limits"`
+	Log             Log           `yaml:"log"`
+	Trace           Trace         `yaml:"trace"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	Queues          []QueuePolicy `yaml:"queues"`
+}
+
+// Listen holds the listener addresses; empty disables a protocol.
+type Listen struct {
+	HTTP   string `yaml:"http"`
+	RESP   string `yaml:"resp"`
+	Binary string `yaml:"binary"`
+	STOMP  string `yaml:"stomp"`
+}
+
+// protocols returns the names of the enabled listeners other than HTTP.
+func (l Listen) protocols() []string {
+	var names []string
+	for _, p := range []struct{ name, addr string }{{"resp", l.RESP}, {"binary", l.Binary}, {"stomp", l.STOMP}} {
+		if p.addr != "" {
+			names = append(names, p.name)
+		}
+	}
+	return names
+}
+
+type TLS struct {
+	Cert     string `yaml:"cert"`
+	Key      string `yaml:"key"`
+	ClientCA string `yaml:"client_ca"`
+}
+
+type Storage struct {
+	Snapshot string `yaml:"snapshot"`
+	// Blobs is the directory payloads of at least BlobThreshold bytes are
+	// kept in instead of memory; empty keeps every payload in memory.
+	Blobs         string `yaml:"blobs"`
+	BlobThreshold Bytes  `yaml:"blob_threshold"`
+}
+
+// Auth names the credentials and tenants files.
+type Auth struct {
+	Credentials string `yaml:"credentials"`
+	Tenants     string `yaml:"tenants"`
+}
+
+// RateLimits holds rules in the format of ratelimit.ParseRules.
+type RateLimits struct {
+	Queue  string `yaml:"queue"`
+	Client string `yaml:"client"`
+}
+
+type Log struct {
+	Level  string `yaml:"level"`
+	Format string `yaml:"format"`
+}
+
+type Trace struct {
+	Export string `yaml:"export"`
+}
+
+// QueuePolicy sets the options of the queues matching Pattern, and which
+// permissions requests without credentials have on them.
+type QueuePolicy struct {
+	Pattern       string        `yaml:"pattern"`
+	MaxLength     int           `yaml:"max_length"`
+	MaxBytes      Bytes         `yaml:"max_bytes"`
+	TTL           time.Duration `yaml:"ttl"`
+	MaxDeliveries int           `yaml:"max_deliveries"`
+	DLQ           string        `yaml:"dlq"`
+	Priority      int           `yaml:"priority"`
+	Anonymous     []string      `yaml:"anonymous"`
+	Validate      *Validation   `yaml:"validate"`
+}
+
+// Validation lists the checks a queue's messages must pass to be enqueued,
+// as in package schema. The JSON schema is given inline or, with
+// json_schema_file, read from a file when the configuration is loaded.
+type Validation struct {
+	UTF8           bool           `yaml:"utf8"`
+	MaxLineLength  int            `yaml:"max_line_length"`
+	Regex          string         `yaml:"regex"`
+	JSONSchema     map[string]any `yaml:"json_schema"`
+	JSONSchemaFile string         `yaml:"json_schema_file"`
+}
+
+// validator compiles v; a nil v gives a nil validator.
+func (v *Validation) validator() (*schema.Validator, error) {
+	if v == nil {
+		return nil, nil
+	}
+	spec := schema.Spec{UTF8: v.UTF8, MaxLineLength: v.MaxLineLength, Regex: v.Regex}
+	switch {
+	case v.JSONSchema != nil && v.JSONSchemaFile != "":
+		return nil, fmt.Errorf("json_schema and json_schema_file are mutually exclusive")
+	case v.JSONSchema != nil:
+		b, err := json.Marshal(v.JSONSchema)
+		if err != nil {
+			return nil, fmt.Errorf("invalid json_schema: %w", err)
+		}
+		spec.JSONSchema = b
+	case v.JSONSchemaFile != "":
+		b, err := os.ReadFile(v.JSONSchemaFile)
+		if err != nil {
+			return nil, err
+		}
+		spec.JSONSchema = b
+	}
+	return schema.New(spec)
+}
+
+// Bytes is a byte count, written as a number or with a KiB, MiB or GiB
+// suffix.
+type Bytes int64
+
+func (b *Bytes) UnmarshalYAML(n *yaml.Node) error {
+	v, err := tenant.ParseBytes(n.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: invalid byte count %q: %w", n.Line, n.Value, err)
+	}
+	*b = Bytes(v)
+	return nil
+}
+
+func (b Bytes) String() string { return strconv.FormatInt(int64(b), 10) }
+
+// Set parses s for flags and environment variables.
+func (b *Bytes) Set(s string) error {
+	v, err := tenant.ParseBytes(s)
+	if err != nil {
+		return err
+	}
+	*b = Bytes(v)
+	return nil
+}
+
+// Default returns the settings used when nothing else is given.
+func Default() *Config {
+	return &Config{
+		Listen:          Listen{HTTP: ":8080"},
+		Storage:         Storage{BlobThreshold: 1 << 20},
+		Log:             Log{Level: "info", Format: "text"},
+		ShutdownTimeout: 30 * time.Second,
+	}
+}
+
+// Load returns the defaults overridden by the file at filename, if not
+// empty, and then by the environment. Call Validate once flags are applied.
+func Load(filename string) (*Config, error) {
+	var data []byte
+	if filename != "" {
+		var err error
+		if data, err = os.ReadFile(filename); err != nil {
+			return nil, err
+		}
+	}
+	c, err := load(data, os.LookupEnv)
+	if err != nil && filename != "" {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return c, err
+}
+
+func load(data []byte, lookup func(string) (string, bool)) (*Config, error) {
+	c := Default()
+	dec := yaml.NewDecoder(bytes.NewReader(expand(data, lookup)))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if err := applyEnv(reflect.ValueOf(c).Elem(), EnvPrefix, lookup); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+var envRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(?::-([^}]*))?\}`)
+
+// expand replaces ${VAR} and ${VAR:-default} as docker-compose does.
+func expand(data []byte, lookup func(string) (string, bool)) []byte {
+	return envRef.ReplaceAllFunc(data, func(ref []byte) []byte {
+		m := envRef.FindSubmatch(ref)
+		if v, ok := lookup(string(m[1])); ok && v != "" {
+			return []byte(v)
+		}
+		return m[2]
+	})
+}
+
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+	bytesType    = reflect.TypeOf(Bytes(0))
+)
+
+// applyEnv sets the string, duration and byte count fields of v from PREFIX_FIELD
+// variables, descending into nested structs.
+func applyEnv(v reflect.Value, prefix string, lookup func(string) (string, bool)) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+		name := prefix + "_" + strings.ToUpper(tag)
+		f := v.Field(i)
+		switch {
+		case f.Kind() == reflect.Struct:
+			if err := applyEnv(f, name, lookup); err != nil {
+				return err
+			}
+		case f.Type() == durationType:
+			if s, ok := lookup(name); ok {
+				d, err := time.ParseDuration(s)
+				if err != nil {
+					return fmt.Errorf("%s: %w", name, err)
+				}
+				f.SetInt(int64(d))
+			}
+		case f.Type() == bytesType:
+			if s, ok := lookup(name); ok {
+				if err := f.Addr().Interface().(*Bytes).Set(s); err != nil {
+					return fmt.Errorf("%s: %w", name, err)
+				}
+			}
+		case f.Kind() == reflect.String:
+			if s, ok := lookup(name); ok {
+				f.SetString(s)
+			}
+		}
+	}
+	return nil
+}
+
+// RegisterFlags defines the command-line flags of the settings on fs, with
+// c's current values as defaults, so that parsing only changes the
+// settings given.
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Listen.HTTP, "addr", c.Listen.HTTP, "address to listen on")
+	fs.StringVar(&c.Listen.RESP, "resp-addr", c.Listen.RESP, "address for the Redis protocol listener (disabled if empty)")
+	fs.StringVar(&c.Listen.Binary, "bin-addr", c.Listen.Binary, "host:port or unix:///path for the binary protocol listener (disabled if empty)")
+	fs.StringVar(&c.Listen.STOMP, "stomp-addr", c.Listen.STOMP, "address for the STOMP listener (disabled if empty)")
+	fs.StringVar(&c.Auth.Credentials, "credentials", c.Auth.Credentials, "path to a bearer-token credentials file (authentication disabled if empty)")
+	fs.StringVar(&c.Auth.Tenants, "tenants", c.Auth.Tenants, "path to a file listing tenants and their quotas (any tenant, no quotas if empty)")
+	fs.StringVar(&c.TLS.Cert, "tls-cert", c.TLS.Cert, "TLS certificate file; serves HTTPS when set together with -tls-key")
+	fs.StringVar(&c.TLS.Key, "tls-key", c.TLS.Key, "TLS private key file")
+	fs.StringVar(&c.TLS.ClientCA, "client-ca", c.TLS.ClientCA, "CA bundle for verifying client certificates (requires clients to present one)")
+	fs.StringVar(&c.RateLimits.Queue, "queue-rate", c.RateLimits.Queue, "per-queue rate limits as pattern=rate[:burst],... in requests/s, applied to enqueue and dequeue separately")
+	fs.StringVar(&c.RateLimits.Client, "client-rate", c.RateLimits.Client, "per-client rate limits on each queue, same format as -queue-rate")
+	fs.StringVar(&c.Storage.Snapshot, "snapshot", c.Storage.Snapshot, "file to restore queues from on start and save them to on shutdown (disabled if empty)")
+	fs.StringVar(&c.Storage.Blobs, "blob-dir", c.Storage.Blobs, "directory for payloads too large to keep in memory (all kept in memory if empty)")
+	fs.Var(&c.Storage.BlobThreshold, "blob-threshold", "payload size from which payloads go to -blob-dir, e.g. 512KiB")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "how long to wait for in-flight requests on shutdown")
+	fs.StringVar(&c.Log.Level, "log-level", c.Log.Level, "log level: debug, info, warn or error")
+	fs.StringVar(&c.Log.Format, "log-format", c.Log.Format, "log format: text or json")
+	fs.StringVar(&c.Trace.Export, "trace-export", c.Trace.Export, "export spans to this JSON-lines file or OTLP/HTTP collector URL (disabled if empty)")
+}
+
+// Validate checks the settings that are not checked when they are used.
+func (c *Config) Validate() error {
+	if _, err := logging.ParseLevel(c.Log.Level); err != nil {
+		return err
+	}
+	if _, _, err := c.RateRules(); err != nil {
+		return err
+	}
+	// The protocol listeners know nothing of tokens, tenants, rate limits or
+	// TLS, so they would be a way around them.
+	if l := strings.Join(c.Listen.protocols(), ", "); l != "" {
+		switch {
+		case c.Auth.Credentials != "":
+			return fmt.Errorf("credentials cannot be used with the %s listener: it is not authenticated", l)
+		case c.TLS.Cert != "" || c.TLS.Key != "":
+			return fmt.Errorf("TLS cannot be used with the %s listener: it is not encrypted", l)
+		}
+	}
+	for i, p := range c.Queues {
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("queues[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (p QueuePolicy) validate() error {
+	if _, err := path.Match(p.Pattern, ""); err != nil || p.Pattern == "" {
+		return fmt.Errorf("invalid pattern %q", p.Pattern)
+	}
+	switch {
+	case p.MaxLength < 0:
+		return fmt.Errorf("max_length must not be negative")
+	case p.MaxBytes < 0:
+		return fmt.Errorf("max_bytes must not be negative")
+	case p.TTL < 0:
+		return fmt.Errorf("ttl must not be negative")
+	case p.MaxDeliveries < 0:
+		return fmt.Errorf("max_deliveries must not be negative")
+	case p.Priority < 0 || p.Priority > queue.MaxPriority:
+		return fmt.Errorf("priority must be 0 to %d", queue.MaxPriority)
+	case strings.Contains(p.DLQ, "/"):
+		return fmt.Errorf("dlq %q must not name a tenant", p.DLQ)
+	case len(p.Anonymous) > 0 && strings.Contains(p.Pattern, "/"):
+		return fmt.Errorf("anonymous access is only possible outside tenants")
+	}
+	if _, err := p.Validate.validator(); err != nil {
+		return fmt.Errorf("validate: %w", err)
+	}
+	_, err := p.anonymousPerms()
+	return err
+}
+
+func (p QueuePolicy) anonymousPerms() (auth.Permission, error) {
+	var perms auth.Permission
+	for _, name := range p.Anonymous {
+		switch name {
+		case "produce":
+			perms |= auth.Produce
+		case "consume":
+			perms |= auth.Consume
+		default:
+			return 0, fmt.Errorf("invalid anonymous permission %q, want produce or consume", name)
+		}
+	}
+	return perms, nil
+}
+
+// matches reports whether p applies to queue in tenant ns.
+func (p QueuePolicy) matches(ns, name string) bool {
+	if strings.HasSuffix(name, queue.DLQSuffix) && !strings.HasSuffix(p.Pattern, queue.DLQSuffix) {
+		return false
+	}
+	if strings.Contains(p.Pattern, "/") {
+		name = ns + "/" + name
+	}
+	ok, _ := path.Match(p.Pattern, name)
+	return ok
+}
+
+// Policy returns the queue options for queue.QueueManager.SetPolicy.
+func (c *Config) Policy() func(name string) queue.Options {
+	policies := append([]QueuePolicy(nil), c.Queues...)
+	// Validators are compiled once and shared by the queues of a policy.
+	// Validate has reported any that fail to compile.
+	validators := make([]queue.Validator, len(policies))
+	for i, p := range policies {
+		if v, err := p.Validate.validator(); err == nil && v != nil {
+			validators[i] = v
+		}
+	}
+	return func(name string) queue.Options {
+		ns, qn := queue.SplitName(name)
+		for i, p := range policies {
+			if !p.matches(ns, qn) {
+				continue
+			}
+			o := queue.Options{
+				MaxLen:        p.MaxLength,
+				MaxBytes:      int64(p.MaxBytes),
+				TTL:           p.TTL,
+				MaxDeliveries: p.MaxDeliveries,
+				Priority:      uint8(p.Priority),
+				Validator:     validators[i],
+			}
+			if p.DLQ != "" {
+				o.DLQ = queue.JoinName(ns, strings.ReplaceAll(p.DLQ, "*", qn))
+			}
+			return o
+		}
+		return queue.Options{}
+	}
+}
+
+// AnonymousGrants returns the permissions of requests without credentials.
+// They apply outside tenants only.
+func (c *Config) AnonymousGrants() []auth.Grant {
+	var grants []auth.Grant
+	for _, p := range c.Queues {
+		if perms, err := p.anonymousPerms(); err == nil && perms != 0 {
+			grants = append(grants, auth.Grant{Pattern: p.Pattern, Perms: perms})
+		}
+	}
+	return grants
+}
+
+// RateRules parses the rate limits.
+func (c *Config) RateRules() (queueRules, clientRules []ratelimit.Rule, err error) {
+	if queueRules, err = ratelimit.ParseRules(c.RateLimits.Queue); err != nil {
+		return nil, nil, fmt.Errorf("invalid queue rate limits: %w", err)
+	}
+	if clientRules, err = ratelimit.ParseRules(c.RateLimits.Client); err != nil {
+		return nil, nil, fmt.Errorf("invalid client rate limits: %w", err)
+	}
+	return queueRules, clientRules, nil
+}
+
+// RestartRequired lists the settings that differ in next but only take
+// effect on restart. Turning authentication or tenants on or off counts;
+// changing their files does not.
+func (c *Config) RestartRequired(next *Config) []string {
+	var out []string
+	for _, s := range []struct {
+		name    string
+		changed bool
+	}{
+		{"listen", c.Listen != next.Listen},
+		{"tls", c.TLS != next.TLS},
+		{"storage", c.Storage != next.Storage},
+		{"auth.credentials", (c.Auth.Credentials == "") != (next.Auth.Credentials == "")},
+		{"auth.tenants", (c.Auth.Tenants == "") != (next.Auth.Tenants == "")},
+		{"log.format", c.Log.Format != next.Log.Format},
+		{"trace", c.Trace != next.Trace},
+		{"shutdown_timeout", c.ShutdownTimeout != next.ShutdownTimeout},
+	} {
+		if s.changed {
+			out = append(out, s.name)
+		}
+	}
+	return out
+}
+
+// Watch calls changed each time the modification time or size of the file
+// at filename changes, checking every interval until ctx is done.
+func Watch(ctx context.Context, filename string, interval time.Duration, changed func()) {
+	stat := func() (time.Time, int64) {
+		fi, err := os.Stat(filename)
+		if err != nil {
+			return time.Time{}, -1
+		}
+		return fi.ModTime(), fi.Size()
+	}
+	mod, size := stat()
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+		if m, s := stat(); !m.Equal(mod) || s != size {
+			mod, size = m, s
+			changed()
+		}
+	}
+}
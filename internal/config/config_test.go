@@ -0,0 +1,285 @@
+package config
+
+import (
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"corti-kkv/internal/auth"
+	"corti-kkv/internal/queue"
+)
+
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(k string) (string, bool) {
+		v, ok := vars[k]
+		return v, ok
+	}
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   string
+		env    map[string]string
+		check  func(t *testing.T, c *Config)
+		errMsg string
+	}{
+		{
+			name: "Empty_Defaults",
+			check: func(t *testing.T, c *Config) {
+				assert.Equal(t, Default(), c)
+			},
+		},
+		{
+			name: "YAML",
+			data: "listen:\n  resp: \":6379\"\nshutdown_timeout: 5s\nqueues:\n  - pattern: jobs*\n    max_bytes: 2KiB\n    ttl: 1m\n",
+			check: func(t *testing.T, c *Config) {
+				assert.Equal(t, Listen{HTTP: ":8080", RESP: ":6379"}, c.Listen)
+				assert.Equal(t, 5*time.Second, c.ShutdownTimeout)
+				assert.Equal(t, []QueuePolicy{{Pattern: "jobs*", MaxBytes: 2048, TTL: time.Minute}}, c.Queues)
+			},
+		},
+		{
+			name: "JSON",
+			data: `{"storage": {"snapshot": "/tmp/q.snap"}, "queues": [{"pattern": "*", "max_length": 10}]}`,
+			check: func(t *testing.T, c *Config) {
+				assert.Equal(t, "/tmp/q.snap", c.Storage.Snapshot)
+				assert.Equal(t, []QueuePolicy{{Pattern: "*", MaxLength: 10}}, c.Queues)
+			},
+		},
+		{
+			name: "Expansion",
+			data: "storage:\n  snapshot: ${DATA:-/data}/q.snap\nauth:\n  credentials: ${CREDS}\n  tenants: ${UNSET:-}\n",
+			env:  map[string]string{"CREDS": "/run/creds", "DATA": ""},
+			check: func(t *testing.T, c *Config) {
+				assert.Equal(t, "/data/q.snap", c.Storage.Snapshot)
+				assert.Equal(t, Auth{Credentials: "/run/creds"}, c.Auth)
+			},
+		},
+		{
+			name: "EnvOverridesFile",
+			data: "listen:\n  http: \":9000\"\nlog:\n  level: warn\n",
+			env:  map[string]string{"KKV_LISTEN_HTTP": ":9100", "KKV_RATE_LIMITS_CLIENT": "*=5", "KKV_SHUTDOWN_TIMEOUT": "1s", "KKV_TLS_CLIENT_CA": "ca.pem", "KKV_STORAGE_BLOB_THRESHOLD": "64KiB"},
+			check: func(t *testing.T, c *Config) {
+				assert.Equal(t, ":9100", c.Listen.HTTP)
+				assert.Equal(t, "warn", c.Log.Level)
+				assert.Equal(t, "*=5", c.RateLimits.Client)
+				assert.Equal(t, time.Second, c.ShutdownTimeout)
+				assert.Equal(t, "ca.pem", c.TLS.ClientCA)
+				assert.Equal(t, Bytes(64<<10), c.Storage.BlobThreshold)
+			},
+		},
+		{
+			name:   "UnknownField",
+			data:   "listen:\n  htp: \":80\"\n",
+			errMsg: "field htp not found",
+		},
+		{
+			name:   "InvalidBytes",
+			data:   "queues:\n  - pattern: a\n    max_bytes: lots\n",
+			errMsg: `line 3: invalid byte count "lots"`,
+		},
+		{
+			name:   "InvalidEnvDuration",
+			env:    map[string]string{"KKV_SHUTDOWN_TIMEOUT": "soon"},
+			errMsg: "KKV_SHUTDOWN_TIMEOUT",
+		},
+		{
+			name:   "InvalidEnvBytes",
+			env:    map[string]string{"KKV_STORAGE_BLOB_THRESHOLD": "-1"},
+			errMsg: "KKV_STORAGE_BLOB_THRESHOLD: want a positive number of bytes",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := load([]byte(tc.data), env(tc.env))
+			if tc.errMsg != "" {
+				assert.ErrorContains(t, err, tc.errMsg)
+				return
+			}
+			assert.NoError(t, err)
+			tc.check(t, c)
+		})
+	}
+}
+
+func TestLoadFileAndFlags(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kkv.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte("listen:\n  http: \":9000\"\n  stomp: \":61613\"\n"), 0o644))
+	c, err := Load(path)
+	assert.NoError(t, err)
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	c.RegisterFlags(fs)
+	assert.NoError(t, fs.Parse([]string{"-addr", ":9001", "-log-level", "debug", "-blob-dir", "/blobs", "-blob-threshold", "2MiB"}))
+	assert.Equal(t, Listen{HTTP: ":9001", STOMP: ":61613"}, c.Listen)
+	assert.Equal(t, Log{Level: "debug", Format: "text"}, c.Log)
+	assert.Equal(t, Storage{Blobs: "/blobs", BlobThreshold: 2 << 20}, c.Storage)
+
+	_, err = Load(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.Error(t, err)
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		errMsg string
+	}{
+		{"Defaults", func(c *Config) {}, ""},
+		{"LogLevel", func(c *Config) { c.Log.Level = "loud" }, "invalid log level"},
+		{"RateRules", func(c *Config) { c.RateLimits.Queue = "x" }, "invalid queue rate limits"},
+		{"Pattern", func(c *Config) { c.Queues = []QueuePolicy{{Pattern: "["}} }, "queues[0]: invalid pattern"},
+		{"Priority", func(c *Config) { c.Queues = []QueuePolicy{{Pattern: "a", Priority: 10}} }, "priority must be 0 to 9"},
+		{"TTL", func(c *Config) { c.Queues = []QueuePolicy{{Pattern: "a", TTL: -time.Second}} }, "ttl"},
+		{"DLQTenant", func(c *Config) { c.Queues = []QueuePolicy{{Pattern: "a", DLQ: "b/c"}} }, "must not name a tenant"},
+		{"AnonymousPerm", func(c *Config) { c.Queues = []QueuePolicy{{Pattern: "a", Anonymous: []string{"admin"}}} }, `invalid anonymous permission "admin"`},
+		{"ValidateRegex", func(c *Config) { c.Queues = []QueuePolicy{{Pattern: "a", Validate: &Validation{Regex: "("}}} }, "queues[0]: validate: invalid regex"},
+		{"ValidateSchema", func(c *Config) {
+			c.Queues = []QueuePolicy{{Pattern: "a", Validate: &Validation{JSONSchema: map[string]any{"type": "float"}}}}
+		}, "validate: invalid JSON schema: /type: unknown type float"},
+		{"ValidateBothSchemas", func(c *Config) {
+			c.Queues = []QueuePolicy{{Pattern: "a", Validate: &Validation{JSONSchema: map[string]any{}, JSONSchemaFile: "s.json"}}}
+		}, "mutually exclusive"},
+		{"ValidateSchemaFile", func(c *Config) {
+			c.Queues = []QueuePolicy{{Pattern: "a", Validate: &Validation{JSONSchemaFile: "missing.json"}}}
+		}, "missing.json"},
+		{"CredentialsWithRESP", func(c *Config) { c.Listen.RESP, c.Auth.Credentials = ":6379", "creds" }, "credentials cannot be used with the resp listener"},
+		{"CredentialsWithProtocols", func(c *Config) {
+			c.Listen.Binary, c.Listen.STOMP, c.Auth.Credentials = ":7000", ":61613", "creds"
+		}, "binary, stomp listener"},
+		{"TLSWithSTOMP", func(c *Config) { c.Listen.STOMP, c.TLS.Cert, c.TLS.Key = ":61613", "c.pem", "k.pem" }, "TLS cannot be used with the stomp listener"},
+		{"AnonymousTenant", func(c *Config) { c.Queues = []QueuePolicy{{Pattern: "acme/a", Anonymous: []string{"consume"}}} }, "only possible outside tenants"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := Default()
+			tc.modify(c)
+			err := c.Validate()
+			if tc.errMsg == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tc.errMsg)
+			}
+		})
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	c := Default()
+	c.Queues = []QueuePolicy{
+		{Pattern: "acme/jobs", MaxLength: 1},
+		{Pattern: "jobs*", TTL: time.Hour, MaxDeliveries: 3, DLQ: "*.dlq", Priority: 2},
+		{Pattern: "*.dlq", MaxBytes: 1 << 20},
+		{Pattern: "*/audit", DLQ: "graveyard"},
+	}
+	policy := c.Policy()
+	tests := []struct {
+		name   string
+		expect queue.Options
+	}{
+		{"jobs", queue.Options{TTL: time.Hour, MaxDeliveries: 3, DLQ: "jobs.dlq", Priority: 2}},
+		{"globex/jobs-x", queue.Options{TTL: time.Hour, MaxDeliveries: 3, DLQ: "globex/jobs-x.dlq", Priority: 2}},
+		{"acme/jobs", queue.Options{MaxLen: 1}},
+		{"jobs.dlq", queue.Options{MaxBytes: 1 << 20}},
+		{"audit", queue.Options{DLQ: "graveyard"}},
+		{"acme/audit", queue.Options{DLQ: "acme/graveyard"}},
+		{"other", queue.Options{}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expect, policy(tc.name))
+		})
+	}
+}
+
+func TestPolicyValidator(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "order.json"), []byte(`{"required": ["id"]}`), 0o644))
+	c, err := load([]byte("queues:\n  - pattern: lines\n    validate:\n      utf8: true\n      max_line_length: 4\n"+
+		"  - pattern: orders\n    validate:\n      json_schema:\n        type: object\n        properties:\n          id: {type: integer, minimum: 1}\n"+
+		"  - pattern: refunds\n    validate:\n      json_schema_file: "+filepath.Join(dir, "order.json")+"\n"), env(nil))
+	if !assert.NoError(t, err) || !assert.NoError(t, c.Validate()) {
+		return
+	}
+	policy := c.Policy()
+	tests := []struct {
+		queue  string
+		body   string
+		errMsg string
+	}{
+		{"lines", "abcd", ""},
+		{"lines", "abcde", "line 1 is 5 bytes long"},
+		{"acme/lines", "\xff", "not valid UTF-8"},
+		{"orders", `{"id": 2}`, ""},
+		{"orders", `{"id": 0}`, "/id: 0 is less than the minimum 1"},
+		{"refunds", `{}`, `missing required property "id"`},
+		{"other", "\xff", ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.queue, func(t *testing.T) {
+			v := policy(tc.queue).Validator
+			if tc.errMsg == "" {
+				assert.True(t, v == nil || v.Validate([]byte(tc.body)) == nil)
+				return
+			}
+			if assert.NotNil(t, v) {
+				assert.ErrorContains(t, v.Validate([]byte(tc.body)), tc.errMsg)
+			}
+		})
+	}
+	assert.Same(t, policy("lines").Validator, policy("acme/lines").Validator, "compiled once per policy")
+}
+
+func TestAnonymousGrants(t *testing.T) {
+	c := Default()
+	c.Queues = []QueuePolicy{
+		{Pattern: "jobs*"},
+		{Pattern: "public.*", Anonymous: []string{"consume"}},
+		{Pattern: "inbox", Anonymous: []string{"produce", "consume"}},
+	}
+	assert.Equal(t, []auth.Grant{
+		{Pattern: "public.*", Perms: auth.Consume},
+		{Pattern: "inbox", Perms: auth.Produce | auth.Consume},
+	}, c.AnonymousGrants())
+}
+
+func TestRestartRequired(t *testing.T) {
+	c := Default()
+	next := Default()
+	next.Queues = []QueuePolicy{{Pattern: "*", MaxLength: 5}}
+	next.Log.Level = "debug"
+	next.RateLimits.Queue = "*=1"
+	assert.Empty(t, c.RestartRequired(next))
+
+	c.Auth.Credentials = "a"
+	next.Auth.Credentials = "b"
+	assert.Empty(t, c.RestartRequired(next))
+
+	next.Listen.RESP = ":6379"
+	next.Auth.Tenants = "tenants"
+	next.Log.Format = "json"
+	assert.Equal(t, []string{"listen", "auth.tenants", "log.format"}, c.RestartRequired(next))
+}
+
+func TestWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kkv.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte("a"), 0o644))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changed := make(chan struct{}, 1)
+	go Watch(ctx, path, 5*time.Millisecond, func() { changed <- struct{}{} })
+
+	time.Sleep(20 * time.Millisecond)
+	assert.NoError(t, os.WriteFile(path, []byte("ab"), 0o644))
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		t.Fatal("change not noticed")
+	}
+}
@@ -0,0 +1,102 @@
+// Package frame implements the length-prefixed body format used to carry
+// several queue messages in a single HTTP request or response.
+package frame
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ContentType identifies a body made of message frames.
+const ContentType = "application/x-kkv-frames"
+
+// MaxFrameSize bounds a single frame so a corrupt length prefix cannot
+// trigger an arbitrarily large allocation.
+const MaxFrameSize = 64 << 20
+
+// Write encodes msgs as a sequence of frames, each a big-endian uint32
+// length followed by the message bytes.
+func Write(w io.Writer, msgs [][]byte) error {
+	var hdr [4]byte
+	for _, m := range msgs {
+		if len(m) > MaxFrameSize {
+			return fmt.Errorf("frame too large: %d bytes", len(m))
+		}
+		binary.BigEndian.PutUint32(hdr[:], uint32(len(m)))
+		if _, err := w.Write(hdr[:]); err != nil {
+			return err
+		}
+		if _, err := w.Write(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Read decodes frames from r until EOF.
+func Read(r io.Reader) ([][]byte, error) {
+	var msgs [][]byte
+	var hdr [4]byte
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				return msgs, nil
+			}
+			return nil, fmt.Errorf("read frame header: %w", err)
+		}
+		n := binary.BigEndian.Uint32(hdr[:])
+		if n > MaxFrameSize {
+			return nil, fmt.Errorf("frame too large: %d bytes", n)
+		}
+		m := make([]byte, n)
+		if _, err := io.ReadFull(r, m); err != nil {
+			return nil, fmt.Errorf("read frame body: %w", err)
+		}
+		msgs = append(msgs, m)
+	}
+}
+
+// TracedContentType identifies a body in which every message is preceded by
+// a frame holding its trace context, the traceparent and tracestate values
+// separated by a newline, or nothing if the message has none.
+const TracedContentType = "application/x-kkv-traced-frames"
+
+// Message is a message body with the W3C trace context it was enqueued with.
+type Message struct {
+	Body        []byte
+	Traceparent string
+	Tracestate  string
+}
+
+// WriteMessages encodes msgs in the TracedContentType format.
+func WriteMessages(w io.Writer, msgs []Message) error {
+	frames := make([][]byte, 0, 2*len(msgs))
+	for _, m := range msgs {
+		var tc []byte
+		if m.Traceparent != "" {
+			tc = []byte(m.Traceparent + "\n" + m.Tracestate)
+		}
+		frames = append(frames, tc, m.Body)
+	}
+	return Write(w, frames)
+}
+
+// ReadMessages decodes a body written by WriteMessages.
+func ReadMessages(r io.Reader) ([]Message, error) {
+	frames, err := Read(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(frames)%2 != 0 {
+		return nil, errors.New("traced frames: odd number of frames")
+	}
+	msgs := make([]Message, len(frames)/2)
+	for i := range msgs {
+		parent, state, _ := strings.Cut(string(frames[2*i]), "\n")
+		msgs[i] = Message{Body: frames[2*i+1], Traceparent: parent, Tracestate: state}
+	}
+	return msgs, nil
+}
@@ -0,0 +1,77 @@
+package frame
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		msgs [][]byte
+	}{
+		{name: "Empty", msgs: nil},
+		{name: "Single", msgs: [][]byte{[]byte("a\n")}},
+		{name: "Several_PreservesOrderAndBytes", msgs: [][]byte{[]byte("line1\n"), []byte("line2\r\n"), []byte("last")}},
+		{name: "EmptyMessage", msgs: [][]byte{{}, []byte("x")}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			assert.NoError(t, Write(&buf, tc.msgs))
+			got, err := Read(&buf)
+			assert.NoError(t, err)
+			assert.Equal(t, len(tc.msgs), len(got))
+			for i := range tc.msgs {
+				assert.Equal(t, string(tc.msgs[i]), string(got[i]))
+			}
+		})
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	oversized := make([]byte, 4)
+	binary.BigEndian.PutUint32(oversized, MaxFrameSize+1)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "TruncatedHeader", data: []byte{0, 0}},
+		{name: "TruncatedBody", data: []byte{0, 0, 0, 5, 'a', 'b'}},
+		{name: "OversizedFrame", data: oversized},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Read(bytes.NewReader(tc.data))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestMessagesRoundTrip(t *testing.T) {
+	msgs := []Message{
+		{Body: []byte("a\n"), Traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", Tracestate: "k=v"},
+		{Body: []byte("b\n")},
+		{Body: []byte{}, Traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b8-01"},
+	}
+	var buf bytes.Buffer
+	assert.NoError(t, WriteMessages(&buf, msgs))
+	got, err := ReadMessages(&buf)
+	assert.NoError(t, err)
+	if assert.Len(t, got, len(msgs)) {
+		for i := range msgs {
+			assert.Equal(t, string(msgs[i].Body), string(got[i].Body))
+			assert.Equal(t, msgs[i].Traceparent, got[i].Traceparent)
+			assert.Equal(t, msgs[i].Tracestate, got[i].Tracestate)
+		}
+	}
+
+	buf.Reset()
+	assert.NoError(t, Write(&buf, [][]byte{[]byte("lonely")}))
+	_, err = ReadMessages(&buf)
+	assert.Error(t, err)
+}
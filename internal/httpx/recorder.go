@@ -0,0 +1,80 @@
+// Package httpx holds small HTTP helpers shared by middleware.
+package httpx
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// Recorder remembers the status and size of a response while passing
+// through the optional interfaces that event streams and WebSocket upgrades
+// rely on.
+type Recorder struct {
+	http.ResponseWriter
+	code     int
+	bytes    int64
+	hijacked bool
+}
+
+func NewRecorder(w http.ResponseWriter) *Recorder {
+	if r, ok := w.(*Recorder); ok {
+		return r
+	}
+	return &Recorder{ResponseWriter: w}
+}
+
+// Status returns the response status, 200 if nothing was written yet and
+// 101 if the connection was hijacked.
+func (r *Recorder) Status() int {
+	switch {
+	case r.hijacked:
+		return http.StatusSwitchingProtocols
+	case r.code == 0:
+		return http.StatusOK
+	}
+	return r.code
+}
+
+// Bytes returns the number of body bytes written.
+func (r *Recorder) Bytes() int64 { return r.bytes }
+
+func (r *Recorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *Recorder) Write(b []byte) (int, error) {
+	if r.code == 0 {
+		r.code = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *Recorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		if r.code == 0 {
+			r.code = http.StatusOK
+		}
+		f.Flush()
+	}
+}
+
+func (r *Recorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("httpx: response writer does not support hijacking")
+	}
+	conn, rw, err := hj.Hijack()
+	if err == nil {
+		r.hijacked = true
+	}
+	return conn, rw, err
+}
+
+func (r *Recorder) Unwrap() http.ResponseWriter { return r.ResponseWriter }
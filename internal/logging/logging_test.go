@@ -0,0 +1,85 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, "warn", "json")
+	if !assert.NoError(t, err) {
+		return
+	}
+	logger.Info("dropped")
+	logger.WarnContext(WithRequestID(context.Background(), "abc"), "kept", "n", 1)
+
+	var rec map[string]any
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &rec))
+	assert.Equal(t, "kept", rec["msg"])
+	assert.Equal(t, "abc", rec["request_id"])
+	assert.Equal(t, float64(1), rec["n"])
+
+	buf.Reset()
+	logger, _ = New(&buf, "DEBUG", "text")
+	logger.With("svc", "q").DebugContext(WithRequestID(context.Background(), "xyz"), "hello")
+	assert.Contains(t, buf.String(), "svc=q")
+	assert.Contains(t, buf.String(), "request_id=xyz")
+
+	_, err = New(&buf, "loud", "text")
+	assert.ErrorContains(t, err, "invalid log level")
+	_, err = New(&buf, "info", "xml")
+	assert.ErrorContains(t, err, "invalid log format")
+}
+
+func TestMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+	logger, _ := New(&buf, "info", "json")
+	var seen string
+	h := Middleware(logger, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = RequestID(r.Context())
+		http.Error(w, "nope", http.StatusTeapot)
+	}))
+
+	tests := []struct {
+		name     string
+		incoming string
+		keep     bool
+	}{
+		{name: "TakenFromHeader", incoming: "upload-42", keep: true},
+		{name: "GeneratedWhenMissing", incoming: ""},
+		{name: "ReplacedWhenInvalid", incoming: "bad id\nforged=1"},
+		{name: "ReplacedWhenTooLong", incoming: strings.Repeat("x", maxRequestIDLen+1)},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			buf.Reset()
+			req := httptest.NewRequest(http.MethodPost, "/queues/a", nil)
+			if tc.incoming != "" {
+				req.Header.Set(RequestIDHeader, tc.incoming)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			id := rec.Header().Get(RequestIDHeader)
+			assert.Equal(t, id, seen)
+			if tc.keep {
+				assert.Equal(t, tc.incoming, id)
+			} else {
+				assert.Len(t, id, 32)
+			}
+			var line map[string]any
+			assert.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+			assert.Equal(t, id, line["request_id"])
+			assert.Equal(t, float64(http.StatusTeapot), line["status"])
+			assert.Equal(t, "/queues/a", line["path"])
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"corti-kkv/internal/httpx"
+)
+
+// HTTPMetrics counts requests and their latency by route, method and status.
+type HTTPMetrics struct {
+	requests *CounterVec
+	duration *HistogramVec
+}
+
+// NewHTTPMetrics registers http_requests_total and
+// http_request_duration_seconds with reg.
+func NewHTTPMetrics(reg *Registry) *HTTPMetrics {
+	m := &HTTPMetrics{
+		requests: NewCounterVec("http_requests_total", "HTTP requests by route, method and status code.", "route", "method", "code"),
+		duration: NewHistogramVec("http_request_duration_seconds", "HTTP request latency by route and status code.", DefBuckets, "route", "code"),
+	}
+	reg.Register(m.requests, m.duration)
+	return m
+}
+
+// Instrument wraps h. route maps a request to a low-cardinality label such
+// as "/queues/{name}"; raw paths must not be used since they are unbounded.
+func (m *HTTPMetrics) Instrument(route func(*http.Request) string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := httpx.NewRecorder(w)
+		h.ServeHTTP(rec, r)
+		code := strconv.Itoa(rec.Status())
+		rt := route(r)
+		m.requests.Inc(rt, r.Method, code)
+		m.duration.Observe(time.Since(start).Seconds(), rt, code)
+	})
+}
@@ -0,0 +1,254 @@
+// Package metrics implements the subset of the Prometheus text exposition
+// format the services need: counters, gauges and histograms with labels.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Collector writes its metrics to an Encoder when scraped.
+type Collector interface {
+	Collect(e *Encoder)
+}
+
+// CollectorFunc adapts a function to a Collector, for values that are read
+// at scrape time such as queue depths.
+type CollectorFunc func(e *Encoder)
+
+func (f CollectorFunc) Collect(e *Encoder) { f(e) }
+
+// Registry is a set of collectors exposed together.
+type Registry struct {
+	mu         sync.Mutex
+	collectors []Collector
+}
+
+func NewRegistry() *Registry { return &Registry{} }
+
+func (r *Registry) Register(cs ...Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, cs...)
+}
+
+// WriteTo writes every collector's metrics in registration order.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	cs := append([]Collector(nil), r.collectors...)
+	r.mu.Unlock()
+	cw := &countingWriter{w: w}
+	e := &Encoder{w: bufio.NewWriter(cw)}
+	for _, c := range cs {
+		c.Collect(e)
+	}
+	err := e.w.Flush()
+	return cw.n, err
+}
+
+// Handler serves the registry at a scrape endpoint.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteTo(w)
+	})
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Encoder writes metric families in the text exposition format.
+type Encoder struct {
+	w *bufio.Writer
+}
+
+// Header starts a metric family. typ is counter, gauge or histogram.
+func (e *Encoder) Header(name, help, typ string) {
+	fmt.Fprintf(e.w, "# HELP %s %s\n# TYPE %s %s\n", name, strings.ReplaceAll(help, "\n", " "), name, typ)
+}
+
+// Sample writes one sample. labels alternates names and values.
+func (e *Encoder) Sample(name string, value float64, labels ...string) {
+	e.w.WriteString(name)
+	if len(labels) > 0 {
+		e.w.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				e.w.WriteByte(',')
+			}
+			e.w.WriteString(labels[i])
+			e.w.WriteString(`="`)
+			e.w.WriteString(labelEscaper.Replace(labels[i+1]))
+			e.w.WriteByte('"')
+		}
+		e.w.WriteByte('}')
+	}
+	e.w.WriteByte(' ')
+	e.w.WriteString(formatFloat(value))
+	e.w.WriteByte('\n')
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// labelKey joins label values into a map key.
+func labelKey(values []string) string { return strings.Join(values, "\xff") }
+
+// pairs interleaves label names and values for Sample.
+func pairs(names, values []string, extra ...string) []string {
+	out := make([]string, 0, 2*len(names)+len(extra))
+	for i, n := range names {
+		out = append(out, n, values[i])
+	}
+	return append(out, extra...)
+}
+
+func checkLabels(name string, names, values []string) {
+	if len(names) != len(values) {
+		panic(fmt.Sprintf("metrics: %s wants %d label values, got %d", name, len(names), len(values)))
+	}
+}
+
+// CounterVec is a family of counters partitioned by labels.
+type CounterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]*series
+}
+
+type series struct {
+	labels []string
+	value  float64
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{name: name, help: help, labels: labels, values: make(map[string]*series)}
+}
+
+func (c *CounterVec) Inc(labelValues ...string) { c.Add(1, labelValues...) }
+
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	checkLabels(c.name, c.labels, labelValues)
+	k := labelKey(labelValues)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.values[k]
+	if s == nil {
+		s = &series{labels: append([]string(nil), labelValues...)}
+		c.values[k] = s
+	}
+	s.value += v
+}
+
+// Value returns the current value for the given labels.
+func (c *CounterVec) Value(labelValues ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s := c.values[labelKey(labelValues)]; s != nil {
+		return s.value
+	}
+	return 0
+}
+
+func (c *CounterVec) Collect(e *Encoder) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e.Header(c.name, c.help, "counter")
+	for _, k := range sortedKeys(c.values) {
+		s := c.values[k]
+		e.Sample(c.name, s.value, pairs(c.labels, s.labels)...)
+	}
+}
+
+// DefBuckets are latency buckets in seconds suited to HTTP requests.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// HistogramVec is a family of histograms partitioned by labels.
+type HistogramVec struct {
+	name, help string
+	buckets    []float64
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]*histogram
+}
+
+type histogram struct {
+	labels []string
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{name: name, help: help, buckets: buckets, labels: labels, values: make(map[string]*histogram)}
+}
+
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	checkLabels(h.name, h.labels, labelValues)
+	k := labelKey(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.values[k]
+	if s == nil {
+		s = &histogram{labels: append([]string(nil), labelValues...), counts: make([]uint64, len(h.buckets))}
+		h.values[k] = s
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *HistogramVec) Collect(e *Encoder) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	e.Header(h.name, h.help, "histogram")
+	for _, k := range sortedKeys(h.values) {
+		s := h.values[k]
+		var cum uint64
+		for i, b := range h.buckets {
+			cum += s.counts[i]
+			e.Sample(h.name+"_bucket", float64(cum), pairs(h.labels, s.labels, "le", formatFloat(b))...)
+		}
+		e.Sample(h.name+"_bucket", float64(s.count), pairs(h.labels, s.labels, "le", "+Inf")...)
+		e.Sample(h.name+"_sum", s.sum, pairs(h.labels, s.labels)...)
+		e.Sample(h.name+"_count", float64(s.count), pairs(h.labels, s.labels)...)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,73 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryExposition(t *testing.T) {
+	reg := NewRegistry()
+	c := NewCounterVec("jobs_total", "Jobs run.", "queue", "result")
+	h := NewHistogramVec("job_seconds", "Job latency.", []float64{0.1, 1}, "queue")
+	reg.Register(c, h, CollectorFunc(func(e *Encoder) {
+		e.Header("depth", "Queue depth.", "gauge")
+		e.Sample("depth", 3, "queue", `we"ird\`)
+	}))
+
+	c.Inc("b", "ok")
+	c.Add(2, "a", "error")
+	h.Observe(0.05, "a")
+	h.Observe(0.1, "a")
+	h.Observe(5, "a")
+
+	var buf bytes.Buffer
+	_, err := reg.WriteTo(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, `# HELP jobs_total Jobs run.
+# TYPE jobs_total counter
+jobs_total{queue="a",result="error"} 2
+jobs_total{queue="b",result="ok"} 1
+# HELP job_seconds Job latency.
+# TYPE job_seconds histogram
+job_seconds_bucket{queue="a",le="0.1"} 2
+job_seconds_bucket{queue="a",le="1"} 2
+job_seconds_bucket{queue="a",le="+Inf"} 3
+job_seconds_sum{queue="a"} 5.15
+job_seconds_count{queue="a"} 3
+# HELP depth Queue depth.
+# TYPE depth gauge
+depth{queue="we\"ird\\"} 3
+`, buf.String())
+	assert.Equal(t, float64(2), c.Value("a", "error"))
+	assert.Panics(t, func() { c.Inc("only-one") })
+}
+
+func TestInstrument(t *testing.T) {
+	reg := NewRegistry()
+	m := NewHTTPMetrics(reg)
+	h := m.Instrument(func(r *http.Request) string { return "/r" }, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing":
+			http.NotFound(w, r)
+		case "/flush":
+			w.(http.Flusher).Flush()
+		default:
+			w.Write([]byte("ok"))
+		}
+	}))
+	for _, p := range []string{"/", "/", "/missing", "/flush"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, p, nil))
+	}
+	assert.Equal(t, float64(3), m.requests.Value("/r", "GET", "200"))
+	assert.Equal(t, float64(1), m.requests.Value("/r", "GET", "404"))
+
+	rec := httptest.NewRecorder()
+	reg.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.True(t, strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain; version=0.0.4"))
+	assert.Contains(t, rec.Body.String(), `http_request_duration_seconds_count{route="/r",code="404"} 1`)
+}
@@ -0,0 +1,108 @@
+package queue
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// memBlobs is a BlobStore in memory.
+type memBlobs struct {
+	mu    sync.Mutex
+	blobs map[string][]byte
+	err   error
+}
+
+func (s *memBlobs) Put(data []byte) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return "", s.err
+	}
+	if s.blobs == nil {
+		s.blobs = make(map[string][]byte)
+	}
+	key := "k" + strconv.Itoa(len(s.blobs))
+	s.blobs[key] = clone(data)
+	return key, nil
+}
+
+func (s *memBlobs) Get(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.blobs[key]
+	if !ok {
+		return nil, errors.New("no such blob")
+	}
+	return b, nil
+}
+
+func TestQueueBlobs(t *testing.T) {
+	store := &memBlobs{}
+	m := NewQueueManager()
+	m.SetBlobStore(store, 4)
+	q := m.Get("big")
+	_, err := q.Push(Message{Body: []byte("tiny")}, false)
+	assert.NoError(t, err)
+	_, err = q.Push(Message{Body: []byte("large one"), Attributes: map[string]string{"a": "1"}}, false)
+	assert.NoError(t, err)
+	q.EnqueueMessage(Message{Body: []byte("large two")})
+
+	assert.Len(t, store.blobs, 2)
+	assert.Equal(t, int64(22), q.Size(), "sizes count offloaded payloads")
+	assert.Equal(t, map[string]bool{"k0": true, "k1": true}, m.BlobKeys())
+	_, msgs := q.snapshot()
+	assert.Equal(t, &BlobRef{Key: "k0", Size: 9}, msgs[1].Blob)
+	assert.Nil(t, msgs[1].Body, "only the reference is held")
+
+	assert.Equal(t, []Message{
+		{ID: 1, Body: []byte("tiny")},
+		{ID: 2, Body: []byte("large one"), Attributes: map[string]string{"a": "1"}},
+	}, q.Peek(2))
+	assert.Equal(t, []string{"tiny"}, bodies(q.TakeN(1)))
+	r := q.Reserve(1)
+	assert.Equal(t, []string{"large one"}, bodies(r))
+	assert.True(t, m.BlobKeys()["k0"], "in-flight messages keep their blob")
+	q.Release(r[0].ID)
+	r = q.Reserve(1)
+	q.Ack(r[0].ID)
+	assert.Equal(t, map[string]bool{"k1": true}, m.BlobKeys())
+	assert.Equal(t, int64(9), q.Size())
+
+	delete(store.blobs, "k1")
+	assert.Empty(t, q.Peek(1), "peek skips unreadable payloads")
+	assert.Empty(t, q.TakeN(1))
+	assert.Equal(t, uint64(1), q.Stats().DeadLettered)
+	assert.Equal(t, int64(0), q.Size())
+
+	store.err = errors.New("disk full")
+	_, err = q.Push(Message{Body: []byte("large three")}, false)
+	assert.ErrorContains(t, err, "store payload: disk full")
+	q.EnqueueMessage(Message{Body: []byte("large four")})
+	assert.Equal(t, []string{"large four"}, bodies(q.TakeN(1)), "EnqueueMessage keeps payloads it cannot store")
+
+	store.err = nil
+	q.EnqueueFront([]byte("large five"))
+	assert.Equal(t, map[string]bool{"k1": true}, m.BlobKeys(), "EnqueueFront offloads too")
+	assert.Equal(t, []string{"large five"}, bodies(q.TakeN(1)))
+}
+
+func TestQueueBlobsMoveAndRestore(t *testing.T) {
+	store := &memBlobs{}
+	m := NewQueueManager()
+	m.SetBlobStore(store, 0)
+	m.Get("a").Enqueue([]byte("payload"))
+	m.Move("a", "b", 0)
+	assert.Equal(t, map[string]bool{"k0": true}, m.BlobKeys())
+	assert.Len(t, store.blobs, 1, "moves keep the reference")
+
+	b := m.Get("b")
+	b.SetOptions(Options{TTL: time.Hour})
+	b.items[0].at = time.Now().Add(-2 * time.Hour)
+	m.Reap(time.Now())
+	assert.Empty(t, m.BlobKeys(), "dropped messages release their blob")
+}
@@ -0,0 +1,113 @@
+package queue
+
+import (
+	"sort"
+	"strings"
+)
+
+// DefaultNamespace holds the queues addressed without a namespace.
+const DefaultNamespace = "default"
+
+// DLQSuffix marks a dead-letter queue: "lines.dlq" holds the messages that
+// could not be delivered from "lines".
+const DLQSuffix = ".dlq"
+
+// View is the part of a QueueManager that belongs to one namespace. Queues
+// of a namespace ns are stored as "ns/name", so that snapshots and metrics
+// cover every namespace; those of DefaultNamespace keep their plain names.
+type View struct {
+	m  *QueueManager
+	ns string
+}
+
+// Namespace returns the view of namespace ns, which must not contain "/".
+func (m *QueueManager) Namespace(ns string) *View {
+	return &View{m: m, ns: ns}
+}
+
+// Namespace returns the view's namespace.
+func (v *View) Namespace() string { return v.ns }
+
+// Name returns the name the manager stores the view's queue under.
+func (v *View) Name(queue string) string { return JoinName(v.ns, queue) }
+
+func (v *View) Get(queue string) *Queue { return v.m.Get(v.Name(queue)) }
+
+// GetLimit is Get, but does not create the queue if the namespace already
+// has max queues, so that concurrent callers cannot exceed it. A max of 0 or
+// less is no limit.
+func (v *View) GetLimit(queue string, max int) (*Queue, bool) {
+	return v.m.getLimit(v.Name(queue), max)
+}
+
+// Lookup returns the named queue without creating it.
+func (v *View) Lookup(queue string) (*Queue, bool) { return v.m.Lookup(v.Name(queue)) }
+
+// Names returns the names of the namespace's queues in sorted order, without
+// the namespace prefix.
+func (v *View) Names() []string {
+	var names []string
+	for _, name := range v.m.Names() {
+		ns, queue := SplitName(name)
+		if ns == v.ns {
+			names = append(names, queue)
+		}
+	}
+	return names
+}
+
+// Len returns the number of the namespace's queues.
+func (v *View) Len() int {
+	v.m.mu.Lock()
+	defer v.m.mu.Unlock()
+	return v.m.counts[v.ns]
+}
+
+// Size returns the payload bytes held by all of the namespace's queues.
+func (v *View) Size() int64 {
+	v.m.mu.Lock()
+	var queues []*Queue
+	for name, q := range v.m.queues {
+		if ns, _ := SplitName(name); ns == v.ns {
+			queues = append(queues, q)
+		}
+	}
+	v.m.mu.Unlock()
+	var n int64
+	for _, q := range queues {
+		n += q.Size()
+	}
+	return n
+}
+
+// SplitName splits a stored queue name into its namespace and queue name.
+func SplitName(name string) (ns, queue string) {
+	if ns, queue, ok := strings.Cut(name, "/"); ok {
+		return ns, queue
+	}
+	return DefaultNamespace, name
+}
+
+// JoinName returns the stored name of queue in namespace ns, undoing
+// SplitName.
+func JoinName(ns, queue string) string {
+	if ns == DefaultNamespace {
+		return queue
+	}
+	return ns + "/" + queue
+}
+
+// Namespaces returns the namespaces that have at least one queue, in sorted
+// order.
+func (m *QueueManager) Namespaces() []string {
+	var out []string
+	seen := make(map[string]bool)
+	for _, name := range m.Names() {
+		if ns, _ := SplitName(name); !seen[ns] {
+			seen[ns] = true
+			out = append(out, ns)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
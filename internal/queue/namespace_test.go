@@ -0,0 +1,74 @@
+package queue
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNamespaces(t *testing.T) {
+	m := NewQueueManager()
+	def := m.Namespace(DefaultNamespace)
+	acme := m.Namespace("acme")
+	def.Get("lines").Enqueue([]byte("plain"))
+	acme.Get("lines").Enqueue([]byte("acme"))
+	acme.Get("jobs")
+
+	assert.Equal(t, []string{"acme/jobs", "acme/lines", "lines"}, m.Names())
+	assert.Equal(t, []string{"lines"}, def.Names())
+	assert.Equal(t, []string{"jobs", "lines"}, acme.Names())
+	assert.Equal(t, []string{"acme", DefaultNamespace}, m.Namespaces())
+	assert.Equal(t, []byte("acme"), acme.Get("lines").Dequeue())
+	assert.Equal(t, []byte("plain"), m.Get("lines").Dequeue())
+	_, ok := m.Namespace("other").Lookup("lines")
+	assert.False(t, ok)
+}
+
+func TestViewGetLimit(t *testing.T) {
+	m := NewQueueManager()
+	acme := m.Namespace("acme")
+	_, ok := acme.GetLimit("a", 2)
+	assert.True(t, ok)
+	_, ok = acme.GetLimit("b", 2)
+	assert.True(t, ok)
+	_, ok = acme.GetLimit("c", 2)
+	assert.False(t, ok, "a third queue is not created")
+	_, ok = acme.GetLimit("a", 2)
+	assert.True(t, ok, "existing queues are still returned")
+	_, ok = m.Namespace("globex").GetLimit("c", 2)
+	assert.True(t, ok, "other namespaces have their own count")
+	assert.Equal(t, 2, acme.Len())
+
+	m.Delete("acme/a")
+	m.Delete("acme/a")
+	assert.Equal(t, 1, acme.Len())
+	_, ok = acme.GetLimit("c", 2)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"b", "c"}, acme.Names())
+}
+
+func TestQueueSize(t *testing.T) {
+	q := NewQueue()
+	q.Enqueue([]byte("abc"))
+	q.EnqueueFront([]byte("de"))
+	q.Enqueue([]byte("fghi"))
+	assert.Equal(t, int64(9), q.Size())
+	r := q.Reserve(1)
+	assert.Equal(t, int64(9), q.Size(), "in-flight messages still count")
+	q.Release(r[0].ID)
+	r = q.Reserve(1)
+	q.Ack(r[0].ID)
+	assert.Equal(t, int64(7), q.Size())
+	q.TakeLast(1)
+	assert.Equal(t, int64(3), q.Size())
+	q.Enqueue([]byte("j"))
+	q.TakeN(1)
+	assert.Equal(t, int64(1), q.Size())
+	q.Purge()
+	assert.Equal(t, int64(0), q.Size())
+
+	m := NewQueueManager()
+	m.Namespace("t").Get("a").Enqueue([]byte("12"))
+	m.Namespace("t").Get("b").Enqueue([]byte("345"))
+	assert.Equal(t, int64(5), m.Namespace("t").Size())
+}
@@ -1,59 +1,1015 @@
 package queue
 
 import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"sort"
 	"sync"
+	"time"
 )
 
+// Message is a queued payload together with the ID the queue assigned to it.
+// IDs increase monotonically per queue.
+type Message struct {
+	ID   uint64
+	Body []byte
+	// Traceparent and Tracestate hold the W3C trace context the message was
+	// enqueued with, if any.
+	Traceparent string
+	Tracestate  string
+	// Priority orders delivery: higher first, FIFO within a priority.
+	Priority uint8
+	// Attributes are name-value pairs that selectors pick messages by.
+	Attributes map[string]string
+	// Blob, if set, refers to the payload in the manager's blob store and
+	// Body is empty. Messages handed out by a queue have their Body
+	// loaded; Blob is only seen in snapshots and dead letters.
+	Blob *BlobRef
+}
+
+// BlobRef locates a payload in a BlobStore.
+type BlobRef struct {
+	Key  string
+	Size int
+}
+
+// size returns the payload length, whether held in memory or not.
+func (m Message) size() int64 {
+	if m.Blob != nil {
+		return int64(m.Blob.Size)
+	}
+	return int64(len(m.Body))
+}
+
+// A BlobStore keeps payloads outside memory, addressed by key; see package
+// blob.
+type BlobStore interface {
+	Put(data []byte) (key string, err error)
+	Get(key string) ([]byte, error)
+}
+
+// MaxPriority is the highest message priority.
+const MaxPriority = 9
+
+// ErrFull is returned by Push when a queue is at its length or size limit.
+var ErrFull = errors.New("queue is full")
+
+// ErrInvalid is returned by Push when a queue's validator rejects a message.
+var ErrInvalid = errors.New("invalid message")
+
+// A Validator checks message bodies before Push queues them.
+type Validator interface {
+	Validate(body []byte) error
+}
+
+// Options are the settings of one queue. Zero values leave each limit or
+// feature off.
+type Options struct {
+	// MaxLen caps the messages held, in flight included, and MaxBytes
+	// their payload.
+	MaxLen   int
+	MaxBytes int64
+	// TTL is how long a message may wait to be delivered.
+	TTL time.Duration
+	// MaxDeliveries is how many times a message may be reserved before it
+	// is dead-lettered instead of released.
+	MaxDeliveries int
+	// DLQ names the queue that expired and undeliverable messages move to.
+	// Without one they are dropped.
+	DLQ string
+	// Priority is given to messages pushed without one.
+	Priority uint8
+	// Validator, if set, rejects bodies Push must not queue.
+	Validator Validator
+}
+
+// entry is a message plus its position key. Keys grow towards the tail and
+// shrink towards the head, so released messages can be put back exactly
+// where they were even after pushes to either end. Entries are ordered by
+// priority first.
+type entry struct {
+	seq int64
+	msg Message
+	// at is when the message entered the queue and deliveries how often
+	// it has been reserved.
+	at         time.Time
+	deliveries int
+	// gone marks an entry taken from the middle of items, which keeps its
+	// place until enough of them are compacted away; see removeAt.
+	gone bool
+}
+
+func (e entry) before(o entry) bool { return e.pos().before(o.pos()) }
+
+// Stats are cumulative counters for a queue. A message that is released
+// and taken again counts as dequeued twice.
+type Stats struct {
+	Enqueued      uint64
+	Dequeued      uint64
+	EnqueuedBytes uint64
+	DequeuedBytes uint64
+	// DeadLettered counts messages that expired or ran out of deliveries.
+	DeadLettered uint64
+}
+
 type Queue struct {
 	mu    sync.Mutex
-	items [][]byte
+	items []entry
+	// holes counts the gone entries in items, none of which is first or
+	// last.
+	holes    int
+	inflight map[uint64]entry
+	nextID   uint64
+	headSeq  int64
+	tailSeq  int64
+	ready    chan struct{}
+	stats    Stats
+	// size is the payload bytes held, in flight included.
+	size int64
+	opts Options
+	// dead holds expired and undeliverable messages until Reap moves them.
+	dead []Message
+	// index covers the attributes of the entries in items.
+	index attrIndex
+	// blobs receives payloads larger than blobMin bytes.
+	blobs   BlobStore
+	blobMin int
 }
 
 func NewQueue() *Queue { return &Queue{} }
 
-func (q *Queue) Enqueue(item []byte) {
+// Options returns the queue's settings.
+func (q *Queue) Options() Options {
 	q.mu.Lock()
 	defer q.mu.Unlock()
-	copied := make([]byte, len(item))
-	copy(copied, item)
-	q.items = append(q.items, copied)
+	return q.opts
 }
 
-func (q *Queue) Dequeue() []byte {
+// SetOptions changes the queue's settings. Messages already queued keep
+// their priority and are not checked against new limits.
+func (q *Queue) SetOptions(o Options) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.opts = o
+}
+
+// Enqueue appends a copy of item regardless of the queue's limits and
+// returns the ID assigned to it.
+func (q *Queue) Enqueue(item []byte) uint64 {
+	return q.EnqueueMessage(Message{Body: item})
+}
+
+// EnqueueMessage appends m with a copy of its body regardless of the
+// queue's limits, replacing its ID with the one assigned to it, which it
+// returns.
+func (q *Queue) EnqueueMessage(m Message) uint64 {
+	if offloaded, err := q.offload(m); err == nil {
+		m = offloaded
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.push(m, false)
+}
+
+// EnqueueFront inserts a copy of item at the head of the queue, ahead of
+// everything of its priority already queued, and returns the ID assigned
+// to it.
+func (q *Queue) EnqueueFront(item []byte) uint64 {
+	m := Message{Body: item}
+	if offloaded, err := q.offload(m); err == nil {
+		m = offloaded
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.push(m, true)
+}
+
+// Push adds m like EnqueueMessage, or like EnqueueFront if front is set,
+// but fails with ErrFull if that would exceed the queue's limits and with
+// ErrInvalid if the queue's validator rejects it.
+func (q *Queue) Push(m Message, front bool) (uint64, error) {
+	if err := q.Validate(m.Body); err != nil {
+		return 0, err
+	}
+	m, err := q.offload(m)
+	if err != nil {
+		return 0, err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if o := q.opts; o.MaxLen > 0 && q.len()+len(q.inflight) >= o.MaxLen {
+		return 0, fmt.Errorf("%w: limit is %d messages", ErrFull, o.MaxLen)
+	}
+	if o := q.opts; o.MaxBytes > 0 && q.size+m.size() > o.MaxBytes {
+		return 0, fmt.Errorf("%w: limit is %d bytes", ErrFull, o.MaxBytes)
+	}
+	return q.push(m, front), nil
+}
+
+// PushAll is Push for several messages in order: either all are queued or,
+// when one fails validation or they would exceed a limit together, none.
+func (q *Queue) PushAll(msgs []Message, front bool) error {
+	for _, m := range msgs {
+		if err := q.Validate(m.Body); err != nil {
+			return err
+		}
+	}
+	var size int64
+	stored := make([]Message, len(msgs))
+	for i, m := range msgs {
+		var err error
+		if stored[i], err = q.offload(m); err != nil {
+			return err
+		}
+		size += stored[i].size()
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if o := q.opts; o.MaxLen > 0 && q.len()+len(q.inflight)+len(msgs) > o.MaxLen {
+		return fmt.Errorf("%w: limit is %d messages", ErrFull, o.MaxLen)
+	}
+	if o := q.opts; o.MaxBytes > 0 && q.size+size > o.MaxBytes {
+		return fmt.Errorf("%w: limit is %d bytes", ErrFull, o.MaxBytes)
+	}
+	for _, m := range stored {
+		q.push(m, front)
+	}
+	return nil
+}
+
+// Validate checks body with the queue's validator, if any, without queuing
+// it.
+func (q *Queue) Validate(body []byte) error {
+	v := q.Options().Validator
+	if v == nil {
+		return nil
+	}
+	if err := v.Validate(body); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalid, err)
+	}
+	return nil
+}
+
+// offload moves a payload above the queue's blob threshold to the blob
+// store, returning m with a reference in place of its body. A failed
+// store keeps the payload out of the queue too.
+func (q *Queue) offload(m Message) (Message, error) {
+	q.mu.Lock()
+	store, threshold := q.blobs, q.blobMin
+	q.mu.Unlock()
+	if store == nil || m.Blob != nil || len(m.Body) <= threshold {
+		return m, nil
+	}
+	key, err := store.Put(m.Body)
+	if err != nil {
+		return m, fmt.Errorf("store payload: %w", err)
+	}
+	m.Blob, m.Body = &BlobRef{Key: key, Size: len(m.Body)}, nil
+	return m, nil
+}
+
+// load fills in the payloads of msgs kept in store. Messages whose payload
+// cannot be read are left out and, unless peeking, dead-lettered with
+// their reference.
+func (q *Queue) load(store BlobStore, msgs []Message, reserved, peek bool) []Message {
+	out := msgs[:0]
+	for _, m := range msgs {
+		if m.Blob == nil {
+			out = append(out, m)
+			continue
+		}
+		err := errors.New("no blob store")
+		if store != nil {
+			var body []byte
+			if body, err = store.Get(m.Blob.Key); err == nil {
+				m.Body, m.Blob = body, nil
+				out = append(out, m)
+				continue
+			}
+		}
+		slog.Error("payload unavailable", "message_id", m.ID, "blob", m.Blob.Key, "err", err)
+		if !peek {
+			q.lose(m, reserved)
+		}
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+// lose dead-letters a message taken or reserved but not handed out.
+func (q *Queue) lose(m Message, reserved bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if reserved {
+		if _, ok := q.inflight[m.ID]; !ok {
+			return
+		}
+		delete(q.inflight, m.ID)
+		q.size -= m.size()
+	}
+	q.stats.DeadLettered++
+	q.dead = append(q.dead, m)
+}
+
+// push stores a copy of m, filling in its ID and default priority. The
+// caller must hold q.mu.
+func (q *Queue) push(m Message, front bool) uint64 {
+	var seq int64
+	if front {
+		q.headSeq--
+		seq = q.headSeq
+	} else {
+		q.tailSeq++
+		seq = q.tailSeq
+	}
+	q.nextID++
+	m.ID, m.Attributes = q.nextID, maps.Clone(m.Attributes)
+	if m.Blob == nil {
+		m.Body = clone(m.Body)
+	}
+	if m.Priority == 0 {
+		m.Priority = q.opts.Priority
+	}
+	m.Priority = min(m.Priority, MaxPriority)
+	q.insert(entry{seq: seq, msg: m, at: time.Now()})
+	q.countIn(m)
+	q.size += m.size()
+	q.notify()
+	return q.nextID
+}
+
+// insert puts e in order. The caller must hold q.mu.
+func (q *Queue) insert(e entry) {
+	q.index.add(e)
+	n := len(q.items)
+	if n == 0 || !e.before(q.items[n-1]) {
+		q.items = append(q.items, e)
+		return
+	}
+	i := sort.Search(n, func(i int) bool { return e.before(q.items[i]) })
+	if i > 0 && q.items[i-1].gone && q.items[i-1].pos() == e.pos() {
+		// A released message goes back into the place it left.
+		q.items[i-1] = e
+		q.holes--
+		return
+	}
+	q.items = append(q.items, entry{})
+	copy(q.items[i+1:], q.items[i:])
+	q.items[i] = e
+}
+
+// countIn and countOut update the stats. The caller must hold q.mu.
+func (q *Queue) countIn(m Message) {
+	q.stats.Enqueued++
+	q.stats.EnqueuedBytes += uint64(m.size())
+}
+
+func (q *Queue) countOut(m Message) {
+	q.stats.Dequeued++
+	q.stats.DequeuedBytes += uint64(m.size())
+}
+
+// Stats returns the queue's counters.
+func (q *Queue) Stats() Stats {
 	q.mu.Lock()
 	defer q.mu.Unlock()
-	if len(q.items) == 0 {
+	return q.stats
+}
+
+// notify wakes everyone waiting on Ready. The caller must hold q.mu.
+func (q *Queue) notify() {
+	if q.ready != nil {
+		close(q.ready)
+		q.ready = nil
+	}
+}
+
+func (q *Queue) Dequeue() []byte {
+	msgs := q.TakeN(1)
+	if len(msgs) == 0 {
 		return nil
 	}
-	item := q.items[0]
-	if len(q.items) == 1 {
+	return msgs[0].Body
+}
+
+// DequeueN removes and returns up to n items in FIFO order.
+func (q *Queue) DequeueN(n int) [][]byte {
+	msgs := q.TakeN(n)
+	if len(msgs) == 0 {
+		return nil
+	}
+	out := make([][]byte, len(msgs))
+	for i, m := range msgs {
+		out[i] = m.Body
+	}
+	return out
+}
+
+// TakeN removes and returns up to n messages in FIFO order.
+func (q *Queue) TakeN(n int) []Message {
+	return q.TakeMatching(nil, n)
+}
+
+// TakeMatching removes and returns up to n messages that match sel, in
+// FIFO order, leaving the others where they are. A nil sel matches all.
+func (q *Queue) TakeMatching(sel *Selector, n int) []Message {
+	return q.TakeWithin(sel, n, 0)
+}
+
+// TakeWithin is TakeMatching, but stops before a message that would bring
+// the payload taken past maxBytes, so that the batch fits a reply. The
+// first message is taken regardless. A maxBytes of 0 or less is no limit.
+func (q *Queue) TakeWithin(sel *Selector, n int, maxBytes int64) []Message {
+	q.mu.Lock()
+	msgs := messages(q.take(sel, n, maxBytes))
+	for _, m := range msgs {
+		q.size -= m.size()
+	}
+	store := q.blobs
+	q.mu.Unlock()
+	return q.load(store, msgs, false, false)
+}
+
+// TakeLast removes and returns up to n messages from the tail, last first,
+// setting expired ones aside for Reap like TakeN.
+func (q *Queue) TakeLast(n int) []Message {
+	q.mu.Lock()
+	if n <= 0 || len(q.items) == 0 {
+		q.mu.Unlock()
+		return nil
+	}
+	now := time.Now()
+	out := make([]Message, 0, min(n, q.len()))
+	i := len(q.items)
+	for i > 0 && len(out) < n {
+		i--
+		e := q.items[i]
+		if e.gone {
+			q.holes--
+			continue
+		}
+		q.index.remove(e)
+		if q.expired(e, now) {
+			q.kill(e.msg)
+			continue
+		}
+		out = append(out, e.msg)
+		q.countOut(e.msg)
+		q.size -= e.msg.size()
+	}
+	clear(q.items[i:])
+	q.items = q.items[:i]
+	q.trim()
+	store := q.blobs
+	q.mu.Unlock()
+	return q.load(store, out, false, false)
+}
+
+// take removes up to n entries matching sel, and holding at most maxBytes
+// unless the first alone does, from the head, setting expired ones aside
+// for Reap. The caller must hold q.mu.
+func (q *Queue) take(sel *Selector, n int, maxBytes int64) []entry {
+	if n <= 0 || len(q.items) == 0 {
+		return nil
+	}
+	if sel != nil {
+		return q.takeMatching(sel, n, maxBytes)
+	}
+	now := time.Now()
+	var out []entry
+	var size int64
+	i := 0
+	for ; i < len(q.items) && len(out) < n; i++ {
+		e := q.items[i]
+		if e.gone {
+			q.holes--
+			continue
+		}
+		expired := q.expired(e, now)
+		if !expired && maxBytes > 0 && len(out) > 0 && size+e.msg.size() > maxBytes {
+			break
+		}
+		q.index.remove(e)
+		if expired {
+			q.kill(e.msg)
+			continue
+		}
+		q.countOut(e.msg)
+		out = append(out, e)
+		size += e.msg.size()
+	}
+	if i == len(q.items) {
 		q.items = q.items[:0]
 	} else {
-		q.items = q.items[1:]
+		q.items = q.items[i:]
+	}
+	q.trim()
+	return out
+}
+
+// takeMatching is take for a selector. Only the indexed candidates are
+// visited, each found by binary search. The caller must hold q.mu.
+func (q *Queue) takeMatching(sel *Selector, n int, maxBytes int64) []entry {
+	now := time.Now()
+	var out []entry
+	var drop []int
+	var size int64
+	for p := range q.index.candidates(sel) {
+		if len(out) == n {
+			break
+		}
+		j := q.find(p)
+		if j < 0 || !sel.Matches(q.items[j].msg.Attributes) {
+			continue
+		}
+		e := q.items[j]
+		expired := q.expired(e, now)
+		if !expired && maxBytes > 0 && len(out) > 0 && size+e.msg.size() > maxBytes {
+			break
+		}
+		drop = append(drop, j)
+		if expired {
+			q.kill(e.msg)
+			continue
+		}
+		q.countOut(e.msg)
+		out = append(out, e)
+		size += e.msg.size()
+	}
+	q.removeAt(drop)
+	return out
+}
+
+// find returns the index in items of the entry at p, or -1. The caller
+// must hold q.mu.
+func (q *Queue) find(p pos) int {
+	i := sort.Search(len(q.items), func(i int) bool { return !q.items[i].pos().before(p) })
+	if i < len(q.items) && q.items[i].seq == p.seq && !q.items[i].gone {
+		return i
 	}
-	return item
+	return -1
+}
+
+// removeAt removes the entries at the indexes idx. They are only marked
+// gone, so that the others need not move, until gone entries make up half
+// of items. The caller must hold q.mu.
+func (q *Queue) removeAt(idx []int) {
+	for _, i := range idx {
+		e := q.items[i]
+		q.index.remove(e)
+		// The priority stays for the order of items.
+		q.items[i] = entry{seq: e.seq, msg: Message{Priority: e.msg.Priority}, gone: true}
+	}
+	q.holes += len(idx)
+	q.trim()
+	if q.holes*2 <= len(q.items) {
+		return
+	}
+	kept := q.items[:0]
+	for _, e := range q.items {
+		if !e.gone {
+			kept = append(kept, e)
+		}
+	}
+	clear(q.items[len(kept):])
+	q.items, q.holes = kept, 0
+}
+
+// trim drops the gone entries at either end of items. The caller must
+// hold q.mu.
+func (q *Queue) trim() {
+	i := 0
+	for i < len(q.items) && q.items[i].gone {
+		i++
+	}
+	q.items = q.items[i:]
+	n := len(q.items)
+	for n > 0 && q.items[n-1].gone {
+		n--
+	}
+	clear(q.items[n:])
+	q.holes -= len(q.items) - n + i
+	q.items = q.items[:n]
+}
+
+// len returns the number of queued messages. The caller must hold q.mu.
+func (q *Queue) len() int { return len(q.items) - q.holes }
+
+// expired reports whether e has outlived the queue's TTL. The caller must
+// hold q.mu.
+func (q *Queue) expired(e entry, now time.Time) bool {
+	return q.opts.TTL > 0 && now.Sub(e.at) >= q.opts.TTL
+}
+
+// kill sets aside a message that was removed from items or inflight. The
+// caller must hold q.mu.
+func (q *Queue) kill(m Message) {
+	q.size -= m.size()
+	q.stats.DeadLettered++
+	q.dead = append(q.dead, m)
+}
+
+// Reserve removes up to n messages like TakeN but keeps them in flight until
+// they are acknowledged with Ack or handed back with Release.
+func (q *Queue) Reserve(n int) []Message {
+	return q.ReserveMatching(nil, n)
+}
+
+// ReserveMatching is Reserve for the messages that match sel.
+func (q *Queue) ReserveMatching(sel *Selector, n int) []Message {
+	return q.ReserveWithin(sel, n, 0)
+}
+
+// ReserveWithin is ReserveMatching with the byte limit of TakeWithin.
+func (q *Queue) ReserveWithin(sel *Selector, n int, maxBytes int64) []Message {
+	q.mu.Lock()
+	taken := q.take(sel, n, maxBytes)
+	if len(taken) == 0 {
+		q.mu.Unlock()
+		return nil
+	}
+	if q.inflight == nil {
+		q.inflight = make(map[uint64]entry)
+	}
+	for i := range taken {
+		taken[i].deliveries++
+		q.inflight[taken[i].msg.ID] = taken[i]
+	}
+	store := q.blobs
+	q.mu.Unlock()
+	return q.load(store, messages(taken), true, false)
+}
+
+// Ack drops a reserved message for good. It reports whether id was in flight.
+func (q *Queue) Ack(id uint64) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	e, ok := q.inflight[id]
+	if !ok {
+		return false
+	}
+	delete(q.inflight, id)
+	q.size -= e.msg.size()
+	return true
+}
+
+// Release puts a reserved message back into the queue at the position it was
+// taken from, so it is redelivered before anything queued behind it. A
+// message that has used up the queue's MaxDeliveries is set aside for Reap
+// instead. It reports whether id was in flight.
+func (q *Queue) Release(id uint64) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	e, ok := q.inflight[id]
+	if !ok {
+		return false
+	}
+	delete(q.inflight, id)
+	if q.opts.MaxDeliveries > 0 && e.deliveries >= q.opts.MaxDeliveries {
+		q.kill(e.msg)
+		return true
+	}
+	q.insert(e)
+	q.notify()
+	return true
+}
+
+// Ready returns a channel that is closed the next time an item is enqueued.
+// Callers should obtain the channel before checking for items so that an
+// enqueue between the check and the wait is not missed.
+func (q *Queue) Ready() <-chan struct{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.ready == nil {
+		q.ready = make(chan struct{})
+	}
+	return q.ready
+}
+
+// Inflight returns the number of reserved messages not yet acked or released.
+func (q *Queue) Inflight() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.inflight)
+}
+
+// Purge drops every queued message and returns how many there were.
+// Messages in flight are left alone.
+func (q *Queue) Purge() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := q.len()
+	for _, e := range q.items {
+		q.size -= e.msg.size()
+	}
+	q.items, q.holes = nil, 0
+	q.index = attrIndex{}
+	return n
+}
+
+// Peek returns up to n messages from the head without removing them.
+func (q *Queue) Peek(n int) []Message {
+	q.mu.Lock()
+	var msgs []Message
+	for _, e := range q.items {
+		if len(msgs) >= n {
+			break
+		}
+		if !e.gone {
+			msgs = append(msgs, e.msg)
+		}
+	}
+	store := q.blobs
+	q.mu.Unlock()
+	return q.load(store, msgs, false, true)
+}
+
+// PeekMatching returns up to n messages that match sel, in order, without
+// removing them. A nil sel matches all.
+func (q *Queue) PeekMatching(sel *Selector, n int) []Message {
+	if sel == nil {
+		return q.Peek(n)
+	}
+	q.mu.Lock()
+	var out []Message
+	for p := range q.index.candidates(sel) {
+		if len(out) >= n {
+			break
+		}
+		if j := q.find(p); j >= 0 && sel.Matches(q.items[j].msg.Attributes) {
+			out = append(out, q.items[j].msg)
+		}
+	}
+	store := q.blobs
+	q.mu.Unlock()
+	return q.load(store, out, false, true)
+}
+
+// Size returns the payload bytes held by the queue, in flight included.
+func (q *Queue) Size() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size
 }
 
 func (q *Queue) Len() int {
 	q.mu.Lock()
 	defer q.mu.Unlock()
-	return len(q.items)
+	return q.len()
+}
+
+func clone(b []byte) []byte {
+	c := make([]byte, len(b))
+	copy(c, b)
+	return c
+}
+
+func messages(entries []entry) []Message {
+	if len(entries) == 0 {
+		return nil
+	}
+	out := make([]Message, len(entries))
+	for i, e := range entries {
+		out[i] = e.msg
+	}
+	return out
 }
 
 type QueueManager struct {
 	mu     sync.Mutex
 	queues map[string]*Queue
+	// counts holds the number of queues in each namespace.
+	counts  map[string]int
+	policy  func(name string) Options
+	blobs   BlobStore
+	blobMin int
+}
+
+func NewQueueManager() *QueueManager {
+	return &QueueManager{queues: make(map[string]*Queue), counts: make(map[string]int)}
+}
+
+// SetPolicy sets the function that gives each queue its options, by stored
+// name, and applies it to the queues that already exist. A nil policy
+// gives every queue zero Options.
+func (m *QueueManager) SetPolicy(policy func(name string) Options) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.policy = policy
+	for name, q := range m.queues {
+		q.SetOptions(m.options(name))
+	}
+}
+
+// SetBlobStore makes every queue keep payloads larger than threshold bytes
+// in store, holding only a reference in memory, and load them back when
+// they are taken. A nil store keeps every payload in memory; payloads
+// already stored stay there.
+func (m *QueueManager) SetBlobStore(store BlobStore, threshold int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.blobs, m.blobMin = store, threshold
+	for _, q := range m.queues {
+		q.mu.Lock()
+		q.blobs, q.blobMin = store, threshold
+		q.mu.Unlock()
+	}
+}
+
+// BlobKeys returns the keys of the blobs referenced by any message, queued,
+// in flight or awaiting Reap.
+func (m *QueueManager) BlobKeys() map[string]bool {
+	m.mu.Lock()
+	queues := make([]*Queue, 0, len(m.queues))
+	for _, q := range m.queues {
+		queues = append(queues, q)
+	}
+	m.mu.Unlock()
+	keys := make(map[string]bool)
+	for _, q := range queues {
+		q.mu.Lock()
+		for _, e := range q.items {
+			if e.msg.Blob != nil {
+				keys[e.msg.Blob.Key] = true
+			}
+		}
+		for _, e := range q.inflight {
+			if e.msg.Blob != nil {
+				keys[e.msg.Blob.Key] = true
+			}
+		}
+		for _, msg := range q.dead {
+			if msg.Blob != nil {
+				keys[msg.Blob.Key] = true
+			}
+		}
+		q.mu.Unlock()
+	}
+	return keys
 }
 
-func NewQueueManager() *QueueManager { return &QueueManager{queues: make(map[string]*Queue)} }
+// options returns the policy's options for name. The caller must hold m.mu.
+func (m *QueueManager) options(name string) Options {
+	if m.policy == nil {
+		return Options{}
+	}
+	return m.policy(name)
+}
 
 func (m *QueueManager) Get(name string) *Queue {
+	q, _ := m.getLimit(name, 0)
+	return q
+}
+
+// getLimit is Get, but does not create the queue if its namespace already
+// has max queues. A max of 0 or less is no limit.
+func (m *QueueManager) getLimit(name string, max int) (*Queue, bool) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	q := m.queues[name]
 	if q == nil {
+		ns, _ := SplitName(name)
+		if max > 0 && m.counts[ns] >= max {
+			return nil, false
+		}
 		q = NewQueue()
+		q.opts = m.options(name)
+		q.blobs, q.blobMin = m.blobs, m.blobMin
 		m.queues[name] = q
+		m.counts[ns]++
 	}
-	return q
+	return q, true
+}
+
+// Lookup returns the named queue without creating it.
+func (m *QueueManager) Lookup(name string) (*Queue, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	q, ok := m.queues[name]
+	return q, ok
+}
+
+// Delete removes the named queue and returns how many messages it held,
+// in flight included. Consumers already waiting on it are not woken; the
+// next Get creates a new, empty queue.
+func (m *QueueManager) Delete(name string) (int, bool) {
+	m.mu.Lock()
+	q, ok := m.queues[name]
+	if ok {
+		delete(m.queues, name)
+		if ns, _ := SplitName(name); m.counts[ns] > 1 {
+			m.counts[ns]--
+		} else {
+			delete(m.counts, ns)
+		}
+	}
+	m.mu.Unlock()
+	if !ok {
+		return 0, false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.len() + len(q.inflight), true
+}
+
+// Move takes up to max messages (all if max <= 0) from the head of src and
+// appends them to dst in order, keeping their bodies, trace context,
+// priorities and attributes but assigning new IDs. dst's limits do not
+// apply. Both queues are locked throughout, so no consumer sees a message
+// in neither or both. It returns how many moved.
+func (m *QueueManager) Move(src, dst string, max int) int {
+	return m.MoveMatching(src, dst, nil, max)
+}
+
+// MoveMatching is Move for the messages of src that match sel. The others
+// stay where they are.
+func (m *QueueManager) MoveMatching(src, dst string, sel *Selector, max int) int {
+	if src == dst {
+		return 0
+	}
+	from, to := m.Get(src), m.Get(dst)
+	// Lock in name order so concurrent moves cannot deadlock.
+	if src < dst {
+		from.mu.Lock()
+		to.mu.Lock()
+	} else {
+		to.mu.Lock()
+		from.mu.Lock()
+	}
+	defer from.mu.Unlock()
+	defer to.mu.Unlock()
+	if max <= 0 {
+		max = from.len()
+	}
+	taken := from.take(sel, max, 0)
+	for _, e := range taken {
+		from.size -= e.msg.size()
+		to.push(e.msg, false)
+	}
+	return len(taken)
+}
+
+// Reap drops queued messages that have expired by now and moves every
+// message set aside as expired or undeliverable to its queue's DLQ, if it
+// has one. It returns how many messages it handled.
+func (m *QueueManager) Reap(now time.Time) int {
+	n := 0
+	for _, name := range m.Names() {
+		q, ok := m.Lookup(name)
+		if !ok {
+			continue
+		}
+		dead, dlq := q.reap(now)
+		n += len(dead)
+		if len(dead) == 0 || dlq == "" || dlq == name {
+			continue
+		}
+		to := m.Get(dlq)
+		for _, msg := range dead {
+			to.EnqueueMessage(msg)
+		}
+	}
+	return n
+}
+
+// reap removes the messages set aside and those expired by now, returning
+// them with the DLQ they should move to.
+func (q *Queue) reap(now time.Time) ([]Message, string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.opts.TTL > 0 {
+		kept := q.items[:0]
+		for _, e := range q.items {
+			if e.gone {
+				continue
+			}
+			if q.expired(e, now) {
+				q.index.remove(e)
+				q.kill(e.msg)
+			} else {
+				kept = append(kept, e)
+			}
+		}
+		clear(q.items[len(kept):])
+		q.items, q.holes = kept, 0
+	}
+	dead := q.dead
+	q.dead = nil
+	return dead, q.opts.DLQ
+}
+
+// Names returns the names of all known queues in sorted order.
+func (m *QueueManager) Names() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.queues))
+	for name := range m.queues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
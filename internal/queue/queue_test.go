@@ -1,7 +1,9 @@
 package queue
 
 import (
+	"errors"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -61,3 +63,398 @@ func max(a, b int) int {
 	}
 	return b
 }
+
+func TestQueueDequeueN(t *testing.T) {
+	tests := []struct {
+		name    string
+		pushes  []string
+		n       int
+		expect  []string
+		remains int
+	}{
+		{name: "EmptyQueue_ReturnsNothing", pushes: nil, n: 5, expect: nil, remains: 0},
+		{name: "FewerThanN_ReturnsAll", pushes: []string{"a", "b"}, n: 5, expect: []string{"a", "b"}, remains: 0},
+		{name: "MoreThanN_ReturnsFirstN", pushes: []string{"a", "b", "c"}, n: 2, expect: []string{"a", "b"}, remains: 1},
+		{name: "NonPositiveN_ReturnsNothing", pushes: []string{"a"}, n: 0, expect: nil, remains: 1},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			q := NewQueue()
+			for _, s := range tc.pushes {
+				q.Enqueue([]byte(s))
+			}
+			var got []string
+			for _, b := range q.DequeueN(tc.n) {
+				got = append(got, string(b))
+			}
+			assert.Equal(t, tc.expect, got)
+			assert.Equal(t, tc.remains, q.Len())
+		})
+	}
+}
+
+func TestQueueTakeWithin(t *testing.T) {
+	sel, _ := ParseSelector("k = v")
+	tests := []struct {
+		name     string
+		sel      *Selector
+		maxBytes int64
+		expect   []string
+	}{
+		{name: "NoLimit", sel: nil, maxBytes: 0, expect: []string{"aaa", "bb", "cccc"}},
+		{name: "StopsBeforeLimit", sel: nil, maxBytes: 5, expect: []string{"aaa", "bb"}},
+		{name: "FirstAlwaysTaken", sel: nil, maxBytes: 1, expect: []string{"aaa"}},
+		{name: "Selector", sel: sel, maxBytes: 6, expect: []string{"aaa", "bb"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			q := NewQueue()
+			for _, b := range []string{"aaa", "bb", "cccc"} {
+				q.EnqueueMessage(Message{Body: []byte(b), Attributes: map[string]string{"k": "v"}})
+			}
+			assert.Equal(t, tc.expect, bodies(q.TakeWithin(tc.sel, 10, tc.maxBytes)))
+			assert.Equal(t, 3-len(tc.expect), q.Len())
+		})
+	}
+
+	q := NewQueue()
+	q.Enqueue([]byte("dd"))
+	q.Enqueue([]byte("ee"))
+	assert.Len(t, q.ReserveWithin(nil, 10, 3), 1)
+	assert.Equal(t, 1, q.Inflight())
+}
+
+func TestQueueReady(t *testing.T) {
+	q := NewQueue()
+	ready := q.Ready()
+	select {
+	case <-ready:
+		t.Fatal("ready closed before enqueue")
+	default:
+	}
+	q.Enqueue([]byte("a"))
+	select {
+	case <-ready:
+	default:
+		t.Fatal("ready not closed after enqueue")
+	}
+	assert.NotEqual(t, ready, q.Ready(), "a fresh channel is handed out after notification")
+}
+
+func TestQueueMessageIDs(t *testing.T) {
+	q := NewQueue()
+	assert.Equal(t, uint64(1), q.Enqueue([]byte("a")))
+	assert.Equal(t, uint64(2), q.Enqueue([]byte("b")))
+	msgs := q.TakeN(5)
+	assert.Equal(t, []Message{{ID: 1, Body: []byte("a")}, {ID: 2, Body: []byte("b")}}, msgs)
+	assert.Equal(t, uint64(3), q.Enqueue([]byte("c")), "IDs keep increasing after the queue drains")
+}
+
+func TestQueueReserve(t *testing.T) {
+	tests := []struct {
+		name     string
+		pushes   []string
+		reserve  int
+		acks     []uint64
+		releases []uint64
+		expect   []string
+		inflight int
+	}{
+		{name: "AckedMessages_AreGone", pushes: []string{"a", "b"}, reserve: 2, acks: []uint64{1, 2}, expect: nil, inflight: 0},
+		{name: "ReleasedMessage_ComesBackFirst", pushes: []string{"a", "b", "c"}, reserve: 1, releases: []uint64{1}, expect: []string{"a", "b", "c"}, inflight: 0},
+		{name: "ReleaseKeepsIDOrder", pushes: []string{"a", "b", "c"}, reserve: 2, releases: []uint64{2, 1}, expect: []string{"a", "b", "c"}, inflight: 0},
+		{name: "UnackedMessages_StayInFlight", pushes: []string{"a", "b"}, reserve: 2, acks: []uint64{1}, expect: nil, inflight: 1},
+		{name: "UnknownIDs_AreIgnored", pushes: []string{"a"}, reserve: 0, acks: []uint64{7}, releases: []uint64{8}, expect: []string{"a"}, inflight: 0},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			q := NewQueue()
+			for _, s := range tc.pushes {
+				q.Enqueue([]byte(s))
+			}
+			q.Reserve(tc.reserve)
+			for _, id := range tc.acks {
+				q.Ack(id)
+			}
+			for _, id := range tc.releases {
+				q.Release(id)
+			}
+			var got []string
+			for _, b := range q.DequeueN(10) {
+				got = append(got, string(b))
+			}
+			assert.Equal(t, tc.expect, got)
+			assert.Equal(t, tc.inflight, q.Inflight())
+		})
+	}
+}
+
+func TestQueueBothEnds(t *testing.T) {
+	q := NewQueue()
+	q.Enqueue([]byte("b"))
+	q.EnqueueFront([]byte("a"))
+	q.Enqueue([]byte("c"))
+	q.EnqueueFront([]byte("z"))
+
+	reserved := q.Reserve(2)
+	assert.Equal(t, "z", string(reserved[0].Body))
+	assert.Equal(t, "a", string(reserved[1].Body))
+	q.Release(reserved[1].ID)
+	q.Release(reserved[0].ID)
+
+	last := q.TakeLast(2)
+	assert.Equal(t, "c", string(last[0].Body))
+	assert.Equal(t, "b", string(last[1].Body))
+	var got []string
+	for _, b := range q.DequeueN(10) {
+		got = append(got, string(b))
+	}
+	assert.Equal(t, []string{"z", "a"}, got)
+}
+
+func TestQueuePurgeAndNames(t *testing.T) {
+	m := NewQueueManager()
+	m.Get("b").Enqueue([]byte("x"))
+	m.Get("b").Enqueue([]byte("y"))
+	m.Get("a")
+	assert.Equal(t, []string{"a", "b"}, m.Names())
+	assert.Equal(t, 2, m.Get("b").Purge())
+	assert.Equal(t, 0, m.Get("b").Len())
+}
+
+func TestQueueStats(t *testing.T) {
+	q := NewQueue()
+	q.Enqueue([]byte("abc"))
+	q.EnqueueFront([]byte("de"))
+	q.Enqueue([]byte("f"))
+	msgs := q.Reserve(1)
+	q.Release(msgs[0].ID)
+	q.TakeN(2)
+	q.TakeLast(1)
+
+	assert.Equal(t, Stats{Enqueued: 3, Dequeued: 4, EnqueuedBytes: 6, DequeuedBytes: 2 + 2 + 3 + 1}, q.Stats())
+}
+
+func TestQueueEnqueueMessageKeepsTraceContext(t *testing.T) {
+	q := NewQueue()
+	body := []byte("a")
+	id := q.EnqueueMessage(Message{ID: 99, Body: body, Traceparent: "tp", Tracestate: "ts"})
+	body[0] = 'z'
+	assert.Equal(t, uint64(1), id)
+	assert.Equal(t, []Message{{ID: 1, Body: []byte("a"), Traceparent: "tp", Tracestate: "ts"}}, q.TakeN(1))
+}
+
+func TestQueuePeek(t *testing.T) {
+	q := NewQueue()
+	q.Enqueue([]byte("a"))
+	q.Enqueue([]byte("b"))
+	assert.Equal(t, []Message{{ID: 1, Body: []byte("a")}}, q.Peek(1))
+	assert.Len(t, q.Peek(10), 2)
+	assert.Nil(t, q.Peek(0))
+	assert.Equal(t, 2, q.Len())
+}
+
+func TestQueueManagerDeleteAndMove(t *testing.T) {
+	m := NewQueueManager()
+	dlq := m.Get("lines.dlq")
+	dlq.EnqueueMessage(Message{Body: []byte("1"), Traceparent: "tp"})
+	dlq.Enqueue([]byte("2"))
+	dlq.Enqueue([]byte("3"))
+	m.Get("lines").Enqueue([]byte("0"))
+
+	assert.Equal(t, 2, m.Move("lines.dlq", "lines", 2))
+	assert.Equal(t, 0, m.Move("lines", "lines", 0))
+	assert.Equal(t, []Message{
+		{ID: 1, Body: []byte("0")},
+		{ID: 2, Body: []byte("1"), Traceparent: "tp"},
+		{ID: 3, Body: []byte("2")},
+	}, m.Get("lines").Peek(10))
+	assert.Equal(t, int64(3), m.Get("lines").Size())
+	assert.Equal(t, int64(1), dlq.Size())
+	assert.Equal(t, 1, m.Move("lines.dlq", "lines", 0))
+
+	dlq.Enqueue([]byte("x"))
+	dlq.Reserve(1)
+	dlq.Enqueue([]byte("y"))
+	n, ok := m.Delete("lines.dlq")
+	assert.True(t, ok)
+	assert.Equal(t, 2, n)
+	_, ok = m.Lookup("lines.dlq")
+	assert.False(t, ok)
+	_, ok = m.Delete("lines.dlq")
+	assert.False(t, ok)
+}
+
+func TestQueueManagerMoveMatching(t *testing.T) {
+	m := NewQueueManager()
+	src := m.Get("backlog")
+	for i, source := range []string{"a", "b", "a", "c", "a"} {
+		src.EnqueueMessage(Message{Body: []byte{'0' + byte(i)}, Priority: uint8(i % 2), Traceparent: "tp", Attributes: map[string]string{"source": source}})
+	}
+	sel, _ := ParseSelector("source = a")
+	assert.Equal(t, 2, m.MoveMatching("backlog", "split", sel, 2))
+	assert.Equal(t, []Message{
+		{ID: 1, Body: []byte("0"), Traceparent: "tp", Attributes: map[string]string{"source": "a"}},
+		{ID: 2, Body: []byte("2"), Traceparent: "tp", Attributes: map[string]string{"source": "a"}},
+	}, m.Get("split").Peek(10))
+	assert.Equal(t, []string{"1", "3", "4"}, bodies(src.Peek(10)), "the rest keep their order")
+	assert.Equal(t, 1, m.MoveMatching("backlog", "split", sel, 0))
+	assert.Equal(t, 0, m.MoveMatching("backlog", "split", sel, 0))
+	assert.Equal(t, int64(2), src.Size())
+	assert.Equal(t, int64(3), m.Get("split").Size())
+	assert.Equal(t, []string{"0", "2", "4"}, bodies(m.Get("split").Peek(10)))
+}
+
+func TestQueuePriority(t *testing.T) {
+	q := NewQueue()
+	q.EnqueueMessage(Message{Body: []byte("low")})
+	q.EnqueueMessage(Message{Body: []byte("high"), Priority: 5})
+	q.EnqueueMessage(Message{Body: []byte("low2")})
+	q.EnqueueMessage(Message{Body: []byte("top"), Priority: 200})
+	q.EnqueueFront([]byte("front"))
+
+	msgs := q.Reserve(2)
+	assert.Equal(t, []string{"top", "high"}, bodies(msgs))
+	assert.Equal(t, uint8(MaxPriority), msgs[0].Priority)
+	q.Release(msgs[1].ID)
+	assert.Equal(t, []string{"high", "front", "low", "low2"}, bodies(q.TakeN(10)))
+
+	q.SetOptions(Options{Priority: 3})
+	q.Enqueue([]byte("a"))
+	q.EnqueueMessage(Message{Body: []byte("b"), Priority: 4})
+	assert.Equal(t, []Message{{ID: 7, Body: []byte("b"), Priority: 4}, {ID: 6, Body: []byte("a"), Priority: 3}}, q.TakeN(10))
+}
+
+func TestQueuePushLimits(t *testing.T) {
+	q := NewQueue()
+	q.SetOptions(Options{MaxLen: 2, MaxBytes: 5})
+	_, err := q.Push(Message{Body: []byte("abc")}, false)
+	assert.NoError(t, err)
+	_, err = q.Push(Message{Body: []byte("def")}, false)
+	assert.ErrorIs(t, err, ErrFull)
+	id, err := q.Push(Message{Body: []byte("de")}, true)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), id)
+	q.Reserve(1)
+	_, err = q.Push(Message{}, false)
+	assert.ErrorIs(t, err, ErrFull, "messages in flight count")
+	q.Enqueue([]byte("over"))
+	assert.Equal(t, 2, q.Len())
+}
+
+func TestQueuePushAll(t *testing.T) {
+	q := NewQueue()
+	q.SetOptions(Options{MaxLen: 3, Validator: validatorFunc(func(b []byte) error {
+		if len(b) > 0 && b[0] == '!' {
+			return errors.New("starts with !")
+		}
+		return nil
+	})})
+	msgs := func(bodies ...string) []Message {
+		var ms []Message
+		for _, b := range bodies {
+			ms = append(ms, Message{Body: []byte(b)})
+		}
+		return ms
+	}
+	assert.ErrorIs(t, q.PushAll(msgs("a", "!b", "c"), false), ErrInvalid)
+	assert.ErrorIs(t, q.PushAll(msgs("a", "b", "c", "d"), false), ErrFull)
+	assert.Equal(t, 0, q.Len())
+	assert.NoError(t, q.PushAll(msgs("a", "b"), false))
+	assert.NoError(t, q.PushAll(msgs("c"), true))
+	assert.ErrorIs(t, q.PushAll(msgs("d"), false), ErrFull)
+	assert.Equal(t, []string{"c", "a", "b"}, bodies(q.TakeN(3)))
+}
+
+type validatorFunc func([]byte) error
+
+func (f validatorFunc) Validate(body []byte) error { return f(body) }
+
+func TestQueuePushValidates(t *testing.T) {
+	q := NewQueue()
+	q.SetOptions(Options{Validator: validatorFunc(func(b []byte) error {
+		if len(b) > 0 && b[0] == '!' {
+			return errors.New("starts with !")
+		}
+		return nil
+	})})
+	_, err := q.Push(Message{Body: []byte("ok")}, false)
+	assert.NoError(t, err)
+	_, err = q.Push(Message{Body: []byte("!bad")}, false)
+	assert.ErrorIs(t, err, ErrInvalid)
+	assert.EqualError(t, err, "invalid message: starts with !")
+	assert.EqualError(t, q.Validate([]byte("!")), "invalid message: starts with !")
+	q.Enqueue([]byte("!unchecked"))
+	assert.Equal(t, 2, q.Len())
+}
+
+func TestQueueDeadLetters(t *testing.T) {
+	m := NewQueueManager()
+	m.SetPolicy(func(name string) Options {
+		if name == "jobs" {
+			return Options{TTL: time.Hour, MaxDeliveries: 2, DLQ: "jobs.dlq"}
+		}
+		return Options{}
+	})
+	q := m.Get("jobs")
+	q.Enqueue([]byte("a"))
+	q.Enqueue([]byte("b"))
+
+	for i := 0; i < 2; i++ {
+		msgs := q.Reserve(1)
+		assert.Equal(t, []string{"a"}, bodies(msgs))
+		q.Release(msgs[0].ID)
+	}
+	assert.Equal(t, 1, q.Len())
+	assert.Equal(t, 0, m.Get("jobs.dlq").Len(), "dead letters wait for Reap")
+
+	assert.Equal(t, 1, m.Reap(time.Now()))
+	assert.Equal(t, 1, m.Reap(time.Now().Add(2*time.Hour)))
+	assert.Equal(t, 0, q.Len())
+	assert.Equal(t, int64(0), q.Size())
+	assert.Equal(t, uint64(2), q.Stats().DeadLettered)
+	assert.Equal(t, []string{"a", "b"}, bodies(m.Get("jobs.dlq").TakeN(10)))
+}
+
+func TestQueueTakeSkipsExpired(t *testing.T) {
+	q := NewQueue()
+	q.Enqueue([]byte("old"))
+	q.SetOptions(Options{TTL: time.Millisecond})
+	time.Sleep(2 * time.Millisecond)
+	q.Enqueue([]byte("new"))
+	assert.Equal(t, []string{"new"}, bodies(q.TakeN(10)))
+	dead, _ := q.reap(time.Now())
+	assert.Equal(t, []string{"old"}, bodies(dead))
+}
+
+func TestQueueTakeLastSkipsExpired(t *testing.T) {
+	q := NewQueue()
+	q.Enqueue([]byte("a"))
+	q.Enqueue([]byte("b"))
+	q.SetOptions(Options{TTL: time.Millisecond})
+	time.Sleep(2 * time.Millisecond)
+	q.EnqueueFront([]byte("new"))
+	assert.Equal(t, []string{"new"}, bodies(q.TakeLast(1)))
+	assert.Equal(t, 0, q.Len())
+	dead, _ := q.reap(time.Now())
+	assert.Equal(t, []string{"b", "a"}, bodies(dead))
+}
+
+func TestQueueManagerPolicy(t *testing.T) {
+	m := NewQueueManager()
+	m.Get("a")
+	m.SetPolicy(func(name string) Options { return Options{MaxLen: len(name)} })
+	m.Get("bb")
+	assert.Equal(t, Options{MaxLen: 1}, m.Get("a").Options())
+	assert.Equal(t, Options{MaxLen: 2}, m.Get("bb").Options())
+	m.SetPolicy(nil)
+	assert.Equal(t, Options{}, m.Get("a").Options())
+}
+
+func bodies(msgs []Message) []string {
+	out := make([]string, len(msgs))
+	for i, m := range msgs {
+		out[i] = string(m.Body)
+	}
+	return out
+}
@@ -0,0 +1,468 @@
+package queue
+
+import (
+	"container/heap"
+	"fmt"
+	"iter"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// A Selector picks messages by their attributes. It is a list of terms
+// joined by AND, each naming an attribute the message must have:
+//
+//	source = 'upload-42' AND kind IN (csv, tsv) AND path ^= /data/ AND size >= 1024
+//
+// = compares strings, IN lists allowed values, ^= matches a prefix and <,
+// <=, > and >= compare numbers, never matching values that are not. Values
+// are quoted with ' or " or written bare.
+type Selector struct {
+	terms []term
+}
+
+type term struct {
+	name string
+	op   string
+	// values holds the operand, several for IN; num is it as a number
+	// for comparisons.
+	values []string
+	num    float64
+}
+
+// ParseSelector parses s. An empty selector gives nil, which matches every
+// message.
+func ParseSelector(s string) (*Selector, error) {
+	toks, err := tokenize(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(toks) == 0 {
+		return nil, nil
+	}
+	p := &selectorParser{toks: toks}
+	sel := &Selector{}
+	for {
+		t, err := p.term()
+		if err != nil {
+			return nil, fmt.Errorf("invalid selector: %w", err)
+		}
+		sel.terms = append(sel.terms, t)
+		if p.done() {
+			return sel, nil
+		}
+		if tok := p.next(); !tok.is("AND") {
+			return nil, fmt.Errorf("invalid selector: expected AND, got %q", tok.text)
+		}
+	}
+}
+
+// String returns the selector in canonical form.
+func (s *Selector) String() string {
+	if s == nil {
+		return ""
+	}
+	parts := make([]string, len(s.terms))
+	for i, t := range s.terms {
+		vals := make([]string, len(t.values))
+		for j, v := range t.values {
+			vals[j] = strconv.Quote(v)
+		}
+		if t.op == "IN" {
+			parts[i] = t.name + " IN (" + strings.Join(vals, ", ") + ")"
+		} else {
+			parts[i] = t.name + " " + t.op + " " + vals[0]
+		}
+	}
+	return strings.Join(parts, " AND ")
+}
+
+// Matches reports whether attributes satisfy every term.
+func (s *Selector) Matches(attrs map[string]string) bool {
+	if s == nil {
+		return true
+	}
+	for _, t := range s.terms {
+		if !t.matches(attrs) {
+			return false
+		}
+	}
+	return true
+}
+
+func (t term) matches(attrs map[string]string) bool {
+	v, ok := attrs[t.name]
+	if !ok {
+		return false
+	}
+	switch t.op {
+	case "=":
+		return v == t.values[0]
+	case "IN":
+		for _, want := range t.values {
+			if v == want {
+				return true
+			}
+		}
+		return false
+	case "^=":
+		return strings.HasPrefix(v, t.values[0])
+	}
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return false
+	}
+	switch t.op {
+	case "<":
+		return n < t.num
+	case "<=":
+		return n <= t.num
+	case ">":
+		return n > t.num
+	default:
+		return n >= t.num
+	}
+}
+
+type token struct {
+	text   string
+	quoted bool
+}
+
+// is reports whether tok is the unquoted keyword or operator kw.
+func (tok token) is(kw string) bool {
+	return !tok.quoted && strings.EqualFold(tok.text, kw)
+}
+
+func tokenize(s string) ([]token, error) {
+	var toks []token
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '(' || c == ')' || c == ',':
+			toks = append(toks, token{text: s[i : i+1]})
+			i++
+		case c == '\'' || c == '"':
+			end := strings.IndexByte(s[i+1:], c)
+			if end < 0 {
+				return nil, fmt.Errorf("invalid selector: unterminated quote at %d", i)
+			}
+			toks = append(toks, token{text: s[i+1 : i+1+end], quoted: true})
+			i += end + 2
+		case strings.IndexByte("=<>^", c) >= 0:
+			op := s[i : i+1]
+			if i+1 < len(s) && s[i+1] == '=' {
+				op = s[i : i+2]
+			}
+			if op == "^" || op == "==" {
+				return nil, fmt.Errorf("invalid selector: unknown operator %q at %d", op, i)
+			}
+			toks = append(toks, token{text: op})
+			i += len(op)
+		default:
+			j := i
+			for j < len(s) && isBare(rune(s[j])) {
+				j++
+			}
+			if j == i {
+				return nil, fmt.Errorf("invalid selector: unexpected %q at %d", s[i], i)
+			}
+			toks = append(toks, token{text: s[i:j]})
+			i = j
+		}
+	}
+	return toks, nil
+}
+
+// isBare reports whether c may appear in unquoted names and values.
+func isBare(c rune) bool {
+	return c < unicode.MaxASCII && (unicode.IsLetter(c) || unicode.IsDigit(c) || strings.ContainsRune("_-.:/+*@", c))
+}
+
+type selectorParser struct {
+	toks []token
+	pos  int
+}
+
+func (p *selectorParser) done() bool { return p.pos >= len(p.toks) }
+
+func (p *selectorParser) next() token {
+	if p.done() {
+		return token{}
+	}
+	p.pos++
+	return p.toks[p.pos-1]
+}
+
+func (p *selectorParser) value() (string, error) {
+	if p.done() {
+		return "", fmt.Errorf("missing value")
+	}
+	tok := p.next()
+	if !tok.quoted && (tok.text == "(" || tok.text == ")" || tok.text == "," || strings.ContainsAny(tok.text, "=<>^")) {
+		return "", fmt.Errorf("expected a value, got %q", tok.text)
+	}
+	return tok.text, nil
+}
+
+func (p *selectorParser) term() (term, error) {
+	name := p.next()
+	if name.quoted || name.text == "" || !isBare(rune(name.text[0])) || name.is("AND") || name.is("IN") {
+		return term{}, fmt.Errorf("expected an attribute name, got %q", name.text)
+	}
+	t := term{name: name.text}
+	op := p.next()
+	switch {
+	case op.is("IN"):
+		t.op = "IN"
+		if tok := p.next(); tok.text != "(" || tok.quoted {
+			return term{}, fmt.Errorf("expected ( after IN")
+		}
+		for {
+			v, err := p.value()
+			if err != nil {
+				return term{}, err
+			}
+			t.values = append(t.values, v)
+			tok := p.next()
+			if tok.quoted || (tok.text != "," && tok.text != ")") {
+				return term{}, fmt.Errorf("expected , or ) in IN list")
+			}
+			if tok.text == ")" {
+				break
+			}
+		}
+		return t, nil
+	case !op.quoted && (op.text == "=" || op.text == "^=" || op.text == "<" || op.text == "<=" || op.text == ">" || op.text == ">="):
+		t.op = op.text
+	default:
+		return term{}, fmt.Errorf("expected an operator after %q, got %q", t.name, op.text)
+	}
+	v, err := p.value()
+	if err != nil {
+		return term{}, err
+	}
+	t.values = []string{v}
+	if t.op != "=" && t.op != "^=" {
+		if t.num, err = strconv.ParseFloat(v, 64); err != nil {
+			return term{}, fmt.Errorf("%s %s needs a number, got %q", t.name, t.op, v)
+		}
+	}
+	return t, nil
+}
+
+// pos locates a queued entry by its ordering key.
+type pos struct {
+	prio uint8
+	seq  int64
+}
+
+func (e entry) pos() pos { return pos{prio: e.msg.Priority, seq: e.seq} }
+
+func (p pos) before(o pos) bool {
+	if p.prio != o.prio {
+		return p.prio > o.prio
+	}
+	return p.seq < o.seq
+}
+
+// posSet holds queued entries in queue order, by message ID. Removing an
+// entry forgets its ID and trims it from the list if at either end; the
+// others are dropped from the list once they make up half of it.
+type posSet struct {
+	live map[uint64]pos
+	list []idPos
+}
+
+type idPos struct {
+	id  uint64
+	pos pos
+}
+
+func newPosSet() *posSet { return &posSet{live: make(map[uint64]pos)} }
+
+func (s *posSet) len() int { return len(s.live) }
+
+func (s *posSet) add(id uint64, p pos) {
+	s.live[id] = p
+	n := len(s.list)
+	if n == 0 || !p.before(s.list[n-1].pos) {
+		s.list = append(s.list, idPos{id, p})
+		return
+	}
+	i := sort.Search(n, func(i int) bool { return p.before(s.list[i].pos) })
+	s.list = append(s.list, idPos{})
+	copy(s.list[i+1:], s.list[i:])
+	s.list[i] = idPos{id, p}
+}
+
+func (s *posSet) remove(id uint64) {
+	delete(s.live, id)
+	for len(s.list) > 0 && !s.has(s.list[0]) {
+		s.list = s.list[1:]
+	}
+	for n := len(s.list); n > 0 && !s.has(s.list[n-1]); n-- {
+		s.list = s.list[:n-1]
+	}
+	if len(s.list) < 2*len(s.live)+16 {
+		return
+	}
+	kept := s.list[:0]
+	for _, e := range s.list {
+		if s.has(e) && (len(kept) == 0 || kept[len(kept)-1] != e) {
+			kept = append(kept, e)
+		}
+	}
+	clear(s.list[len(kept):])
+	s.list = kept
+}
+
+// has reports whether e is in the set rather than left over from a removal.
+func (s *posSet) has(e idPos) bool {
+	p, ok := s.live[e.id]
+	return ok && p == e.pos
+}
+
+// attrIndex maps attributes to the queued entries that carry them, so that
+// a selector only visits messages with the attributes it names instead of
+// scanning the queue. Messages without attributes are not indexed; no
+// selector matches them.
+type attrIndex struct {
+	// names holds the entries having each attribute and values those
+	// having each attribute value.
+	names  map[string]*posSet
+	values map[string]map[string]*posSet
+}
+
+func (x *attrIndex) add(e entry) {
+	if len(e.msg.Attributes) == 0 {
+		return
+	}
+	if x.names == nil {
+		x.names = make(map[string]*posSet)
+		x.values = make(map[string]map[string]*posSet)
+	}
+	p := e.pos()
+	for k, v := range e.msg.Attributes {
+		if x.names[k] == nil {
+			x.names[k] = newPosSet()
+			x.values[k] = make(map[string]*posSet)
+		}
+		x.names[k].add(e.msg.ID, p)
+		if x.values[k][v] == nil {
+			x.values[k][v] = newPosSet()
+		}
+		x.values[k][v].add(e.msg.ID, p)
+	}
+}
+
+func (x *attrIndex) remove(e entry) {
+	for k, v := range e.msg.Attributes {
+		set := x.names[k]
+		if set == nil {
+			continue
+		}
+		if set.remove(e.msg.ID); set.len() == 0 {
+			delete(x.names, k)
+			delete(x.values, k)
+			continue
+		}
+		if set := x.values[k][v]; set != nil {
+			if set.remove(e.msg.ID); set.len() == 0 {
+				delete(x.values[k], v)
+			}
+		}
+	}
+}
+
+// candidates yields, in queue order, the positions of the entries that may
+// match sel, using the term that narrows them down most. The sets of that
+// term are merged as the caller goes, so stopping early costs only the
+// candidates visited. The index must not change until the caller stops.
+func (x *attrIndex) candidates(sel *Selector) iter.Seq[pos] {
+	var best []*posSet
+	bestN := -1
+	for _, t := range sel.terms {
+		var sets []*posSet
+		switch t.op {
+		case "=", "IN":
+			for _, v := range t.values {
+				if set := x.values[t.name][v]; set != nil {
+					sets = append(sets, set)
+				}
+			}
+		case "^=":
+			for v, set := range x.values[t.name] {
+				if strings.HasPrefix(v, t.values[0]) {
+					sets = append(sets, set)
+				}
+			}
+		default:
+			if set := x.names[t.name]; set != nil {
+				sets = append(sets, set)
+			}
+		}
+		n := 0
+		for _, set := range sets {
+			n += set.len()
+		}
+		if bestN < 0 || n < bestN {
+			best, bestN = sets, n
+		}
+	}
+	return func(yield func(pos) bool) {
+		if bestN <= 0 {
+			return
+		}
+		h := make(mergeHeap, 0, len(best))
+		for _, set := range best {
+			if len(set.list) > 0 {
+				h = append(h, cursor{set, 0})
+			}
+		}
+		heap.Init(&h)
+		var last pos
+		first := true
+		for len(h) > 0 {
+			c := h[0]
+			e := c.set.list[c.i]
+			if c.i+1 < len(c.set.list) {
+				h[0].i++
+				heap.Fix(&h, 0)
+			} else {
+				heap.Pop(&h)
+			}
+			if !c.set.has(e) || (!first && e.pos == last) {
+				continue
+			}
+			last, first = e.pos, false
+			if !yield(e.pos) {
+				return
+			}
+		}
+	}
+}
+
+// mergeHeap orders cursors into posSet lists by the position they are at.
+type mergeHeap []cursor
+
+type cursor struct {
+	set *posSet
+	i   int
+}
+
+func (h mergeHeap) Len() int { return len(h) }
+func (h mergeHeap) Less(i, j int) bool {
+	return h[i].set.list[h[i].i].pos.before(h[j].set.list[h[j].i].pos)
+}
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x any)   { *h = append(*h, x.(cursor)) }
+func (h *mergeHeap) Pop() any {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
@@ -0,0 +1,196 @@
+package queue
+
+import (
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSelector(t *testing.T) {
+	tests := []struct {
+		name   string
+		in     string
+		expect string
+		errMsg string
+	}{
+		{"Empty", "  ", "", ""},
+		{"Equal", "source = upload-42", `source = "upload-42"`, ""},
+		{"Quoted", `name='a b' and kind = "x'y"`, `name = "a b" AND kind = "x'y"`, ""},
+		{"In", "kind IN (csv, 'tsv',json)", `kind IN ("csv", "tsv", "json")`, ""},
+		{"Prefix", "path ^= /data/", `path ^= "/data/"`, ""},
+		{"Numeric", "size>=10 AND size < 2.5e3", `size >= "10" AND size < "2.5e3"`, ""},
+		{"MissingValue", "source =", "", "missing value"},
+		{"MissingOperator", "source upload", "", `expected an operator after "source"`},
+		{"UnknownOperator", "a == b", "", `unknown operator "=="`},
+		{"NotNumber", "size > big", "", `size > needs a number, got "big"`},
+		{"NoAnd", "a = 1 b = 2", "", `expected AND, got "b"`},
+		{"TrailingAnd", "a = 1 AND", "", "expected an attribute name"},
+		{"Unterminated", "a = 'x", "", "unterminated quote"},
+		{"BadIn", "a IN (1 2)", "", "expected , or ) in IN list"},
+		{"BadChar", "a = 1 ; b", "", `unexpected ';'`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			sel, err := ParseSelector(tc.in)
+			if tc.errMsg != "" {
+				assert.ErrorContains(t, err, tc.errMsg)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expect, sel.String())
+		})
+	}
+}
+
+func TestSelectorMatches(t *testing.T) {
+	attrs := map[string]string{"source": "upload-42", "kind": "csv", "size": "1024", "path": "/data/in.txt"}
+	tests := []struct {
+		sel    string
+		expect bool
+	}{
+		{"", true},
+		{"source = upload-42", true},
+		{"source = upload-4", false},
+		{"kind IN (tsv, csv)", true},
+		{"kind IN (tsv)", false},
+		{"path ^= /data/", true},
+		{"path ^= /tmp/", false},
+		{"size > 1000 AND size <= 1024", true},
+		{"size < 1024", false},
+		{"kind > 1", false},
+		{"missing = x", false},
+		{"source = upload-42 AND missing >= 0", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.sel, func(t *testing.T) {
+			sel, err := ParseSelector(tc.sel)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expect, sel.Matches(attrs))
+		})
+	}
+}
+
+func TestQueueTakeMatching(t *testing.T) {
+	q := NewQueue()
+	push := func(body string, prio uint8, attrs ...string) {
+		m := Message{Body: []byte(body), Priority: prio, Attributes: map[string]string{}}
+		for i := 0; i < len(attrs); i += 2 {
+			m.Attributes[attrs[i]] = attrs[i+1]
+		}
+		q.EnqueueMessage(m)
+	}
+	push("a", 0, "source", "x")
+	push("b", 0, "source", "y", "size", "5")
+	push("c", 0)
+	push("d", 0, "source", "y", "size", "50")
+	push("e", 3, "source", "y")
+
+	sel := func(s string) *Selector {
+		sel, err := ParseSelector(s)
+		assert.NoError(t, err)
+		return sel
+	}
+	assert.Equal(t, []string{"e", "b", "d"}, bodies(q.PeekMatching(sel("source = y"), 10)))
+	assert.Equal(t, []string{"b"}, bodies(q.TakeMatching(sel("source IN (y, z) AND size < 10"), 10)))
+	assert.Equal(t, []string{"e", "a", "c", "d"}, bodies(q.Peek(10)), "the others keep their order")
+
+	msgs := q.ReserveMatching(sel("size >= 10"), 1)
+	assert.Equal(t, []string{"d"}, bodies(msgs))
+	assert.Empty(t, q.TakeMatching(sel("size >= 10"), 1))
+	q.Release(msgs[0].ID)
+	assert.Equal(t, []string{"e", "a", "c", "d"}, bodies(q.Peek(10)))
+	assert.Equal(t, []string{"d"}, bodies(q.PeekMatching(sel("size >= 10"), 1)), "released messages are indexed again")
+
+	assert.Equal(t, []string{"e"}, bodies(q.TakeN(1)))
+	assert.Equal(t, []string{"d"}, bodies(q.PeekMatching(sel("source ^= y AND size ^= ''"), 10)))
+	assert.Equal(t, []string{"a", "d"}, bodies(q.TakeMatching(sel("source ^= ''"), 10)))
+	assert.Equal(t, []string{"c"}, bodies(q.Peek(10)))
+	assert.Empty(t, q.TakeMatching(sel("source = x"), 1))
+	assert.Empty(t, q.index.names, "the index is emptied with the queue")
+}
+
+func TestQueueTakeMatchingExpired(t *testing.T) {
+	q := NewQueue()
+	q.SetOptions(Options{TTL: time.Hour})
+	q.EnqueueMessage(Message{Body: []byte("old"), Attributes: map[string]string{"k": "v"}})
+	q.items[0].at = time.Now().Add(-2 * time.Hour)
+	q.EnqueueMessage(Message{Body: []byte("new"), Attributes: map[string]string{"k": "v"}})
+	sel, _ := ParseSelector("k = v")
+	assert.Equal(t, []string{"new"}, bodies(q.TakeMatching(sel, 10)))
+	assert.Equal(t, uint64(1), q.Stats().DeadLettered)
+	assert.Equal(t, 0, q.Len())
+}
+
+func TestAttrIndexCandidates(t *testing.T) {
+	q := NewQueue()
+	for i := 0; i < 10000; i++ {
+		q.EnqueueMessage(Message{Body: []byte("x"), Attributes: map[string]string{"source": "upload-" + strconv.Itoa(i%100), "n": strconv.Itoa(i)}})
+	}
+	sel, _ := ParseSelector("n >= 0 AND source IN (upload-7, upload-8)")
+	assert.Len(t, slices.Collect(q.index.candidates(sel)), 200, "the narrowest term is used")
+	assert.Len(t, q.TakeMatching(sel, 1000), 200)
+	assert.Equal(t, 9800, q.Len())
+
+	q.Purge()
+	assert.Empty(t, slices.Collect(q.index.candidates(sel)))
+}
+
+func TestQueueTakeMatchingDrain(t *testing.T) {
+	q := NewQueue()
+	for i := 0; i < 1000; i++ {
+		q.EnqueueMessage(Message{Body: []byte(strconv.Itoa(i)), Priority: uint8(i % 3), Attributes: map[string]string{"k": strconv.Itoa(i % 2)}})
+	}
+	want := bodies(q.PeekMatching(mustSelector(t, "k = 1"), 1000))
+	others := bodies(q.PeekMatching(mustSelector(t, "k = 0"), 1000))
+	if !assert.Len(t, want, 500) {
+		return
+	}
+	// Release puts taken messages back, leaving removed entries behind in
+	// the index's lists.
+	for i := 0; i < 100; i++ {
+		msgs := q.ReserveMatching(mustSelector(t, "k = 1"), 3)
+		for _, m := range msgs {
+			q.Release(m.ID)
+		}
+	}
+	var got []string
+	for {
+		msgs := q.TakeMatching(mustSelector(t, "k IN (1, 2)"), 1)
+		if len(msgs) == 0 {
+			break
+		}
+		got = append(got, string(msgs[0].Body))
+	}
+	assert.Equal(t, want, got)
+	assert.Equal(t, others, bodies(q.Peek(1000)), "the others keep their order")
+	assert.Len(t, q.index.values["k"], 1)
+	assert.LessOrEqual(t, len(q.index.names["k"].list), 2*500+16)
+}
+
+func TestQueueRemoveAt(t *testing.T) {
+	for _, idx := range [][]int{{1, 2}, {0, 7}, {6, 7}, {3}, {0, 1, 2, 3, 4, 5, 6, 7}} {
+		q := NewQueue()
+		for i := 0; i < 8; i++ {
+			q.Enqueue([]byte(strconv.Itoa(i)))
+		}
+		want := []string{}
+		for i := 0; i < 8; i++ {
+			if !slices.Contains(idx, i) {
+				want = append(want, strconv.Itoa(i))
+			}
+		}
+		q.removeAt(idx)
+		assert.Equal(t, want, bodies(q.Peek(8)), "%v", idx)
+		assert.Equal(t, len(want), q.Len(), "%v", idx)
+		assert.Equal(t, want, bodies(q.TakeN(8)), "%v", idx)
+	}
+}
+
+func mustSelector(t *testing.T, s string) *Selector {
+	sel, err := ParseSelector(s)
+	assert.NoError(t, err)
+	return sel
+}
@@ -0,0 +1,127 @@
+package queue
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// snapshotQueue is the stored form of one queue.
+type snapshotQueue struct {
+	Name     string
+	NextID   uint64
+	Messages []Message
+}
+
+// snapshot returns every message in queue order, in-flight ones included at
+// the position they were taken from.
+func (q *Queue) snapshot() (uint64, []Message) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	all := make([]entry, 0, q.len()+len(q.inflight))
+	for _, e := range q.items {
+		if !e.gone {
+			all = append(all, e)
+		}
+	}
+	for _, e := range q.inflight {
+		all = append(all, e)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].before(all[j]) })
+	return q.nextID, messages(all)
+}
+
+// restore replaces the queue's contents. Restored messages start their TTL
+// afresh.
+func (q *Queue) restore(nextID uint64, msgs []Message) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.items, q.holes = make([]entry, len(msgs)), 0
+	q.index = attrIndex{}
+	q.size = 0
+	now := time.Now()
+	for i, m := range msgs {
+		q.items[i] = entry{seq: int64(i + 1), msg: m, at: now}
+		q.index.add(q.items[i])
+		q.size += m.size()
+	}
+	q.inflight = nil
+	q.headSeq, q.tailSeq = 0, int64(len(msgs))
+	q.nextID = nextID
+	q.notify()
+}
+
+// WriteSnapshot writes every queue to w. Messages still in flight are
+// written as queued, since whoever holds them will not be able to ack them
+// after a restart.
+func (m *QueueManager) WriteSnapshot(w io.Writer) error {
+	enc := gob.NewEncoder(w)
+	for _, name := range m.Names() {
+		nextID, msgs := m.Get(name).snapshot()
+		if err := enc.Encode(snapshotQueue{Name: name, NextID: nextID, Messages: msgs}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadSnapshot restores the queues written by WriteSnapshot, replacing the
+// contents of queues with the same names.
+func (m *QueueManager) ReadSnapshot(r io.Reader) error {
+	dec := gob.NewDecoder(r)
+	for {
+		var sq snapshotQueue
+		if err := dec.Decode(&sq); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		m.Get(sq.Name).restore(sq.NextID, sq.Messages)
+	}
+}
+
+// SaveSnapshot writes a snapshot to path, replacing it atomically.
+func (m *QueueManager) SaveSnapshot(path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	bw := bufio.NewWriter(f)
+	if err := m.WriteSnapshot(bw); err != nil {
+		f.Close()
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// LoadSnapshot restores a snapshot saved by SaveSnapshot. A missing file is
+// not an error.
+func (m *QueueManager) LoadSnapshot(path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return m.ReadSnapshot(bufio.NewReader(f))
+}
@@ -0,0 +1,71 @@
+package queue
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	m := NewQueueManager()
+	a := m.Get("a")
+	a.Enqueue([]byte("1"))
+	a.Enqueue([]byte("2"))
+	a.Enqueue([]byte("3"))
+	a.EnqueueFront([]byte("0"))
+	reserved := a.Reserve(2) // "0" and "1" are in flight
+	m.Get("b").Enqueue([]byte("x"))
+	m.Get("empty")
+
+	var buf bytes.Buffer
+	assert.NoError(t, m.WriteSnapshot(&buf))
+
+	restored := NewQueueManager()
+	assert.NoError(t, restored.ReadSnapshot(&buf))
+	assert.Equal(t, []string{"a", "b", "empty"}, restored.Names())
+
+	ra := restored.Get("a")
+	msgs := ra.TakeN(10)
+	assert.Equal(t, []Message{reserved[0], reserved[1], {ID: 2, Body: []byte("2")}, {ID: 3, Body: []byte("3")}}, msgs, "in-flight messages come back first")
+	assert.Equal(t, 0, ra.Inflight())
+	assert.Equal(t, uint64(5), ra.Enqueue([]byte("new")), "IDs continue after the restored ones")
+	assert.Equal(t, []byte("x"), restored.Get("b").Dequeue())
+
+	// Releasing after a restore still puts messages back in order.
+	ra.Enqueue([]byte("later"))
+	r := ra.Reserve(1)
+	ra.Release(r[0].ID)
+	assert.Equal(t, []byte("new"), ra.Dequeue())
+}
+
+func TestSnapshotAttributes(t *testing.T) {
+	m := NewQueueManager()
+	m.Get("a").EnqueueMessage(Message{Body: []byte("1"), Attributes: map[string]string{"source": "upload-1"}})
+	m.Get("a").Enqueue([]byte("2"))
+	var buf bytes.Buffer
+	assert.NoError(t, m.WriteSnapshot(&buf))
+
+	restored := NewQueueManager()
+	assert.NoError(t, restored.ReadSnapshot(&buf))
+	sel, _ := ParseSelector("source = upload-1")
+	assert.Equal(t, []Message{{ID: 1, Body: []byte("1"), Attributes: map[string]string{"source": "upload-1"}}}, restored.Get("a").TakeMatching(sel, 10))
+}
+
+func TestSaveLoadSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queues.snapshot")
+	m := NewQueueManager()
+	assert.NoError(t, m.LoadSnapshot(path), "a missing snapshot is not an error")
+
+	m.Get("q").Enqueue([]byte("hello"))
+	assert.NoError(t, m.SaveSnapshot(path))
+	m.Get("q").Enqueue([]byte("world"))
+	assert.NoError(t, m.SaveSnapshot(path), "an existing snapshot is replaced")
+
+	restored := NewQueueManager()
+	assert.NoError(t, restored.LoadSnapshot(path))
+	assert.Equal(t, [][]byte{[]byte("hello"), []byte("world")}, restored.Get("q").DequeueN(10))
+	matches, _ := filepath.Glob(filepath.Join(filepath.Dir(path), "*.tmp*"))
+	assert.Empty(t, matches, "no temporary files are left behind")
+}
@@ -0,0 +1,184 @@
+// Package ratelimit implements token-bucket limits per queue and per client.
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limit allows Rate requests per second on average with bursts of up to
+// Burst requests.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// Rule applies Limit to queues whose name matches Pattern (see path.Match).
+type Rule struct {
+	Pattern string
+	Limit   Limit
+}
+
+// ParseRules parses a comma-separated list of pattern=rate[:burst] entries,
+// e.g. "lines*=100:200,*=1000". The burst defaults to the rate rounded up.
+func ParseRules(spec string) ([]Rule, error) {
+	var rules []Rule
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		pattern, limit, ok := strings.Cut(entry, "=")
+		if !ok || pattern == "" {
+			return nil, fmt.Errorf("invalid rule %q, want pattern=rate[:burst]", entry)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+		rateStr, burstStr, hasBurst := strings.Cut(limit, ":")
+		rate, err := strconv.ParseFloat(rateStr, 64)
+		if err != nil || rate <= 0 {
+			return nil, fmt.Errorf("invalid rate in %q", entry)
+		}
+		burst := int(math.Ceil(rate))
+		if hasBurst {
+			if burst, err = strconv.Atoi(burstStr); err != nil || burst < 1 {
+				return nil, fmt.Errorf("invalid burst in %q", entry)
+			}
+		}
+		rules = append(rules, Rule{Pattern: pattern, Limit: Limit{Rate: rate, Burst: burst}})
+	}
+	return rules, nil
+}
+
+func match(rules []Rule, queue string) (Limit, bool) {
+	for _, r := range rules {
+		if ok, _ := path.Match(r.Pattern, queue); ok {
+			return r.Limit, true
+		}
+	}
+	return Limit{}, false
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// wait refills b up to now and reports how long until a token is available;
+// zero means one is available now.
+func (b *bucket) wait(l Limit, now time.Time) time.Duration {
+	b.tokens = math.Min(float64(l.Burst), b.tokens+now.Sub(b.last).Seconds()*l.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / l.Rate * float64(time.Second))
+}
+
+type key struct {
+	op     string
+	queue  string
+	client string
+}
+
+// sweepEvery is how many calls to Allow pass between sweeps of idle buckets.
+const sweepEvery = 4096
+
+// Limiter tracks buckets for each operation: one per queue under the first
+// matching queue rule, and one per client and queue under the first matching
+// client rule. Queues without a matching rule are not limited.
+type Limiter struct {
+	queueRules  []Rule
+	clientRules []Rule
+
+	mu      sync.Mutex
+	buckets map[key]*bucket
+	calls   int
+	now     func() time.Time
+}
+
+func New(queueRules, clientRules []Rule) *Limiter {
+	return &Limiter{
+		queueRules:  queueRules,
+		clientRules: clientRules,
+		buckets:     make(map[key]*bucket),
+		now:         time.Now,
+	}
+}
+
+// Allow takes one token for op on queue by client from every bucket that
+// applies. If any of them is empty nothing is taken and Allow returns false
+// with the time until the request would be allowed.
+func (l *Limiter) Allow(op, queue, client string) (bool, time.Duration) {
+	type applied struct {
+		b     *bucket
+		limit Limit
+	}
+	var check [2]applied
+	n := 0
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.calls++
+	if l.calls%sweepEvery == 0 {
+		l.sweep(now)
+	}
+	if limit, ok := match(l.queueRules, queue); ok {
+		check[n] = applied{l.bucket(key{op, queue, ""}, limit, now), limit}
+		n++
+	}
+	if limit, ok := match(l.clientRules, queue); ok {
+		check[n] = applied{l.bucket(key{op, queue, client}, limit, now), limit}
+		n++
+	}
+	var wait time.Duration
+	for _, a := range check[:n] {
+		wait = max(wait, a.b.wait(a.limit, now))
+	}
+	if wait > 0 {
+		return false, wait
+	}
+	for _, a := range check[:n] {
+		a.b.tokens--
+	}
+	return true, 0
+}
+
+// SetRules replaces the limiter's rules. Buckets carry over, clamped to
+// their new burst the next time they are used.
+func (l *Limiter) SetRules(queueRules, clientRules []Rule) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.queueRules, l.clientRules = queueRules, clientRules
+}
+
+func (l *Limiter) bucket(k key, limit Limit, now time.Time) *bucket {
+	b := l.buckets[k]
+	if b == nil {
+		b = &bucket{tokens: float64(limit.Burst), last: now}
+		l.buckets[k] = b
+	}
+	return b
+}
+
+// sweep drops buckets that have been idle long enough to be full again;
+// recreating them later gives the same result.
+func (l *Limiter) sweep(now time.Time) {
+	for k, b := range l.buckets {
+		rules := l.queueRules
+		if k.client != "" {
+			rules = l.clientRules
+		}
+		limit, ok := match(rules, k.queue)
+		if !ok || b.tokens+now.Sub(b.last).Seconds()*limit.Rate >= float64(limit.Burst) {
+			delete(l.buckets, k)
+		}
+	}
+}
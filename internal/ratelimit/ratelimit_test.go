@@ -0,0 +1,102 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules("lines*=2.5:5, *=10")
+	assert.NoError(t, err)
+	assert.Equal(t, []Rule{
+		{Pattern: "lines*", Limit: Limit{Rate: 2.5, Burst: 5}},
+		{Pattern: "*", Limit: Limit{Rate: 10, Burst: 10}},
+	}, rules)
+
+	rules, err = ParseRules("")
+	assert.NoError(t, err)
+	assert.Empty(t, rules)
+
+	for _, bad := range []string{"lines", "=1", "a=x", "a=0", "a=1:0", "[=1"} {
+		_, err := ParseRules(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := New(
+		[]Rule{{Pattern: "busy", Limit: Limit{Rate: 10, Burst: 3}}},
+		[]Rule{{Pattern: "*", Limit: Limit{Rate: 1, Burst: 2}}},
+	)
+	l.now = func() time.Time { return now }
+
+	// Each client gets a burst of 2 on its own.
+	for i := 0; i < 2; i++ {
+		ok, _ := l.Allow("enqueue", "q", "a")
+		assert.True(t, ok)
+	}
+	ok, wait := l.Allow("enqueue", "q", "a")
+	assert.False(t, ok)
+	assert.Equal(t, time.Second, wait)
+	ok, _ = l.Allow("enqueue", "q", "b")
+	assert.True(t, ok, "other clients are not affected")
+	ok, _ = l.Allow("dequeue", "q", "a")
+	assert.True(t, ok, "operations have separate buckets")
+
+	now = now.Add(time.Second)
+	ok, _ = l.Allow("enqueue", "q", "a")
+	assert.True(t, ok, "a token was refilled")
+
+	// The queue bucket is shared by all clients.
+	for _, c := range []string{"x", "y", "z"} {
+		ok, _ := l.Allow("enqueue", "busy", c)
+		assert.True(t, ok)
+	}
+	ok, wait = l.Allow("enqueue", "busy", "w")
+	assert.False(t, ok)
+	assert.Equal(t, 100*time.Millisecond, wait)
+
+	// A denied request takes nothing from the buckets that had tokens left.
+	ok, _ = l.Allow("enqueue", "busy", "w")
+	assert.False(t, ok)
+	now = now.Add(100 * time.Millisecond)
+	ok, _ = l.Allow("enqueue", "busy", "w")
+	assert.True(t, ok)
+	ok, _ = l.Allow("enqueue", "busy", "w")
+	assert.False(t, ok, "queue bucket is empty again")
+}
+
+func TestLimiterSweep(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := New(nil, []Rule{{Pattern: "*", Limit: Limit{Rate: 1, Burst: 1}}})
+	l.now = func() time.Time { return now }
+	l.Allow("enqueue", "q", "a")
+	l.Allow("enqueue", "q", "b")
+	now = now.Add(time.Second)
+	l.Allow("enqueue", "q", "c")
+	l.sweep(now)
+	assert.Len(t, l.buckets, 1, "a and b have refilled and are dropped")
+	assert.Contains(t, l.buckets, key{"enqueue", "q", "c"})
+}
+
+func TestLimiterSetRules(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := New(nil, nil)
+	l.now = func() time.Time { return now }
+	ok, _ := l.Allow("enqueue", "lines", "c")
+	assert.True(t, ok)
+
+	l.SetRules([]Rule{{Pattern: "lines", Limit: Limit{Rate: 1, Burst: 1}}}, nil)
+	ok, _ = l.Allow("enqueue", "lines", "c")
+	assert.True(t, ok)
+	ok, wait := l.Allow("enqueue", "lines", "c")
+	assert.False(t, ok)
+	assert.Equal(t, time.Second, wait)
+
+	l.SetRules(nil, nil)
+	ok, _ = l.Allow("enqueue", "lines", "c")
+	assert.True(t, ok)
+}
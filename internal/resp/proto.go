@@ -0,0 +1,121 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+const (
+	// MaxBulkLen bounds a single bulk string argument.
+	MaxBulkLen = 64 << 20
+	// MaxArgs bounds the number of arguments in one command.
+	MaxArgs = 1 << 16
+	// MaxCommandSize bounds the total length of one command's arguments.
+	MaxCommandSize = 128 << 20
+)
+
+// errProtocol marks malformed input; the connection is closed after the
+// error is reported because the stream can no longer be trusted.
+type errProtocol struct{ msg string }
+
+func (e errProtocol) Error() string { return "ERR Protocol error: " + e.msg }
+
+// readCommand reads one command, either as a RESP array of bulk strings or
+// as an inline space-separated line like the ones typed into telnet.
+func readCommand(br *bufio.Reader) ([][]byte, error) {
+	b, err := br.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if b[0] != '*' {
+		line, err := readLine(br)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.Fields(line), nil
+	}
+	line, err := readLine(br)
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n > MaxArgs {
+		return nil, errProtocol{"invalid multibulk length"}
+	}
+	args := make([][]byte, 0, max(n, 0))
+	total := 0
+	for i := 0; i < n; i++ {
+		line, err := readLine(br)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errProtocol{fmt.Sprintf("expected '$', got %q", line)}
+		}
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil || size < 0 || size > MaxBulkLen {
+			return nil, errProtocol{"invalid bulk length"}
+		}
+		if total += size; total > MaxCommandSize {
+			return nil, errProtocol{"command too large"}
+		}
+		arg := make([]byte, size+2)
+		if _, err := io.ReadFull(br, arg); err != nil {
+			return nil, err
+		}
+		if arg[size] != '\r' || arg[size+1] != '\n' {
+			return nil, errProtocol{"bulk string not terminated by CRLF"}
+		}
+		args = append(args, arg[:size])
+	}
+	return args, nil
+}
+
+func readLine(br *bufio.Reader) ([]byte, error) {
+	line, err := br.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return nil, errProtocol{"line too long"}
+	}
+	if err != nil {
+		return nil, err
+	}
+	line = bytes.TrimSuffix(line[:len(line)-1], []byte("\r"))
+	return append([]byte(nil), line...), nil
+}
+
+// writer encodes RESP2 replies.
+type writer struct{ *bufio.Writer }
+
+func (w writer) simple(s string) {
+	w.WriteString("+" + s + "\r\n")
+}
+
+func (w writer) err(s string) {
+	w.WriteString("-" + s + "\r\n")
+}
+
+func (w writer) int(n int) {
+	w.WriteString(":" + strconv.Itoa(n) + "\r\n")
+}
+
+func (w writer) bulk(b []byte) {
+	w.WriteString("$" + strconv.Itoa(len(b)) + "\r\n")
+	w.Write(b)
+	w.WriteString("\r\n")
+}
+
+func (w writer) nullBulk() {
+	w.WriteString("$-1\r\n")
+}
+
+func (w writer) arrayLen(n int) {
+	w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+func (w writer) nullArray() {
+	w.WriteString("*-1\r\n")
+}
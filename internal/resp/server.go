@@ -0,0 +1,331 @@
+// Package resp serves a subset of the Redis protocol on top of the queue
+// manager, so redis-cli and Redis client libraries can produce and consume.
+// Each queue behaves like a Redis list whose head is the next message to be
+// dequeued: RPUSH enqueues, LPOP dequeues.
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"corti-kkv/internal/queue"
+)
+
+type Server struct {
+	Manager *queue.QueueManager
+
+	mu     sync.Mutex
+	lns    map[net.Listener]struct{}
+	conns  map[net.Conn]struct{}
+	done   chan struct{}
+	closed bool
+}
+
+func NewServer(m *queue.QueueManager) *Server {
+	return &Server{
+		Manager: m,
+		lns:     make(map[net.Listener]struct{}),
+		conns:   make(map[net.Conn]struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// ErrServerClosed is returned by Serve after Close.
+var ErrServerClosed = errors.New("resp: server closed")
+
+// Serve accepts connections on ln until Close is called.
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ln.Close()
+		return ErrServerClosed
+	}
+	s.lns[ln] = struct{}{}
+	s.mu.Unlock()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-s.done:
+				return ErrServerClosed
+			default:
+				return err
+			}
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+// ListenAndServe listens on addr and serves until Close is called.
+func (s *Server) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	slog.Info("resp listener started", "addr", ln.Addr().String())
+	return s.Serve(ln)
+}
+
+// Close stops all listeners and drops open connections.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	for ln := range s.lns {
+		ln.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	return nil
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	br := bufio.NewReader(conn)
+	w := writer{bufio.NewWriter(conn)}
+	for {
+		args, err := readCommand(br)
+		if err != nil {
+			var perr errProtocol
+			if errors.As(err, &perr) {
+				w.err(perr.Error())
+				_ = w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		quit := s.exec(w, args)
+		// Flush once the client has no more pipelined commands waiting.
+		if br.Buffered() == 0 || quit {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// exec runs one command and writes its reply. It reports whether the
+// connection should be closed afterwards.
+func (s *Server) exec(w writer, args [][]byte) (quit bool) {
+	cmd := strings.ToUpper(string(args[0]))
+	args = args[1:]
+	switch cmd {
+	case "PING":
+		switch len(args) {
+		case 0:
+			w.simple("PONG")
+		case 1:
+			w.bulk(args[0])
+		default:
+			wrongArgs(w, cmd)
+		}
+	case "ECHO":
+		if len(args) != 1 {
+			wrongArgs(w, cmd)
+			return false
+		}
+		w.bulk(args[0])
+	case "QUIT":
+		w.simple("OK")
+		return true
+	case "SELECT":
+		if len(args) != 1 {
+			wrongArgs(w, cmd)
+			return false
+		}
+		if string(args[0]) != "0" {
+			w.err("ERR DB index is out of range")
+			return false
+		}
+		w.simple("OK")
+	// redis-cli and client libraries probe these on connect.
+	case "COMMAND":
+		w.arrayLen(0)
+	case "CLIENT":
+		w.simple("OK")
+	case "LPUSH", "RPUSH":
+		if len(args) < 2 {
+			wrongArgs(w, cmd)
+			return false
+		}
+		q := s.Manager.Get(string(args[0]))
+		msgs := make([]queue.Message, len(args)-1)
+		for i, v := range args[1:] {
+			msgs[i] = queue.Message{Body: v}
+		}
+		if err := q.PushAll(msgs, cmd == "LPUSH"); err != nil {
+			w.err("ERR " + err.Error())
+			return false
+		}
+		w.int(q.Len())
+	case "LPOP", "RPOP":
+		s.pop(w, cmd, args)
+	case "BLPOP":
+		s.blpop(w, args)
+	case "LLEN":
+		if len(args) != 1 {
+			wrongArgs(w, cmd)
+			return false
+		}
+		w.int(s.Manager.Get(string(args[0])).Len())
+	case "DEL":
+		if len(args) < 1 {
+			wrongArgs(w, cmd)
+			return false
+		}
+		n := 0
+		for _, k := range args {
+			if s.Manager.Get(string(k)).Purge() > 0 {
+				n++
+			}
+		}
+		w.int(n)
+	case "KEYS":
+		if len(args) != 1 {
+			wrongArgs(w, cmd)
+			return false
+		}
+		s.keys(w, string(args[0]))
+	default:
+		w.err(fmt.Sprintf("ERR unknown command '%s'", cmd))
+	}
+	return false
+}
+
+func (s *Server) pop(w writer, cmd string, args [][]byte) {
+	if len(args) < 1 || len(args) > 2 {
+		wrongArgs(w, cmd)
+		return
+	}
+	q := s.Manager.Get(string(args[0]))
+	take := q.TakeN
+	if cmd == "RPOP" {
+		take = q.TakeLast
+	}
+	if len(args) == 1 {
+		msgs := take(1)
+		if len(msgs) == 0 {
+			w.nullBulk()
+			return
+		}
+		w.bulk(msgs[0].Body)
+		return
+	}
+	count, err := strconv.Atoi(string(args[1]))
+	if err != nil || count < 0 {
+		w.err("ERR value is out of range, must be positive")
+		return
+	}
+	msgs := take(count)
+	if len(msgs) == 0 {
+		w.nullArray()
+		return
+	}
+	w.arrayLen(len(msgs))
+	for _, m := range msgs {
+		w.bulk(m.Body)
+	}
+}
+
+// blpop pops from the first non-empty of the given queues, waiting up to the
+// timeout (in seconds, 0 meaning forever) for one of them to get a message.
+func (s *Server) blpop(w writer, args [][]byte) {
+	if len(args) < 2 {
+		wrongArgs(w, "BLPOP")
+		return
+	}
+	secs, err := strconv.ParseFloat(string(args[len(args)-1]), 64)
+	if err != nil || secs < 0 {
+		w.err("ERR timeout is not a float or out of range")
+		return
+	}
+	keys := args[:len(args)-1]
+	queues := make([]*queue.Queue, len(keys))
+	for i, k := range keys {
+		queues[i] = s.Manager.Get(string(k))
+	}
+
+	// One select case per queue, plus server shutdown and the timeout.
+	cases := make([]reflect.SelectCase, len(queues)+2)
+	cases[len(queues)] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(s.done)}
+	timeout := reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf((<-chan time.Time)(nil))}
+	if secs > 0 {
+		t := time.NewTimer(time.Duration(secs * float64(time.Second)))
+		defer t.Stop()
+		timeout.Chan = reflect.ValueOf(t.C)
+	}
+	cases[len(queues)+1] = timeout
+	for {
+		for i, q := range queues {
+			cases[i] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(q.Ready())}
+			if msgs := q.Reserve(1); len(msgs) > 0 {
+				w.arrayLen(2)
+				w.bulk(keys[i])
+				w.bulk(msgs[0].Body)
+				// The client may have gone away while we were blocked; only
+				// drop the message once the reply is on the wire.
+				if err := w.Flush(); err != nil {
+					q.Release(msgs[0].ID)
+					return
+				}
+				q.Ack(msgs[0].ID)
+				return
+			}
+		}
+		if chosen, _, _ := reflect.Select(cases); chosen >= len(queues) {
+			w.nullArray()
+			return
+		}
+	}
+}
+
+// keys lists non-empty queues matching a glob pattern. Like Redis, empty
+// lists are treated as not existing.
+func (s *Server) keys(w writer, pattern string) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		w.err("ERR invalid pattern")
+		return
+	}
+	var out []string
+	for _, name := range s.Manager.Names() {
+		if ok, _ := path.Match(pattern, name); ok && s.Manager.Get(name).Len() > 0 {
+			out = append(out, name)
+		}
+	}
+	w.arrayLen(len(out))
+	for _, name := range out {
+		w.bulk([]byte(name))
+	}
+}
+
+func wrongArgs(w writer, cmd string) {
+	w.err(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(cmd)))
+}
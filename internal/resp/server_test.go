@@ -0,0 +1,195 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"corti-kkv/internal/queue"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func startServer(t *testing.T) (*Server, string) {
+	t.Helper()
+	s := NewServer(queue.NewQueueManager())
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	go s.Serve(ln)
+	t.Cleanup(func() { s.Close() })
+	return s, ln.Addr().String()
+}
+
+type testConn struct {
+	t  *testing.T
+	c  net.Conn
+	br *bufio.Reader
+}
+
+func dial(t *testing.T, addr string) *testConn {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { c.Close() })
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+	return &testConn{t: t, c: c, br: bufio.NewReader(c)}
+}
+
+// do sends a command as a RESP array and returns the reply rendered as a
+// compact string: simple strings as-is, errors prefixed with "-", integers
+// with ":", bulk strings quoted, nil as "nil" and arrays as [a b].
+func (tc *testConn) do(args ...string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	_, err := io.WriteString(tc.c, b.String())
+	assert.NoError(tc.t, err)
+	return tc.reply()
+}
+
+func (tc *testConn) reply() string {
+	line, err := tc.br.ReadString('\n')
+	if !assert.NoError(tc.t, err) {
+		return ""
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case '+':
+		return line[1:]
+	case '-', ':':
+		return line
+	case '$':
+		if line == "$-1" {
+			return "nil"
+		}
+		var n int
+		fmt.Sscanf(line[1:], "%d", &n)
+		buf := make([]byte, n+2)
+		_, err := io.ReadFull(tc.br, buf)
+		assert.NoError(tc.t, err)
+		return fmt.Sprintf("%q", buf[:n])
+	case '*':
+		if line == "*-1" {
+			return "nil"
+		}
+		var n int
+		fmt.Sscanf(line[1:], "%d", &n)
+		parts := make([]string, n)
+		for i := range parts {
+			parts[i] = tc.reply()
+		}
+		return "[" + strings.Join(parts, " ") + "]"
+	}
+	return "?" + line
+}
+
+func TestCommands(t *testing.T) {
+	_, addr := startServer(t)
+	c := dial(t, addr)
+
+	steps := []struct {
+		args []string
+		want string
+	}{
+		{args: []string{"PING"}, want: "PONG"},
+		{args: []string{"ping", "hi"}, want: `"hi"`},
+		{args: []string{"RPUSH", "lines", "a\n", "b\n"}, want: ":2"},
+		{args: []string{"LPUSH", "lines", "z"}, want: ":3"},
+		{args: []string{"LLEN", "lines"}, want: ":3"},
+		{args: []string{"LPOP", "lines"}, want: `"z"`},
+		{args: []string{"RPOP", "lines"}, want: `"b\n"`},
+		{args: []string{"RPUSH", "other", "x"}, want: ":1"},
+		{args: []string{"KEYS", "*"}, want: `["lines" "other"]`},
+		{args: []string{"KEYS", "oth?r"}, want: `["other"]`},
+		{args: []string{"DEL", "other", "missing"}, want: ":1"},
+		{args: []string{"KEYS", "*"}, want: `["lines"]`},
+		{args: []string{"LPOP", "lines", "5"}, want: `["a\n"]`},
+		{args: []string{"LPOP", "lines"}, want: "nil"},
+		{args: []string{"LPOP", "lines", "2"}, want: "nil"},
+		{args: []string{"BLPOP", "lines", "0.01"}, want: "nil"},
+		{args: []string{"LPUSH", "lines"}, want: "-ERR wrong number of arguments for 'lpush' command"},
+		{args: []string{"FLUSHALL"}, want: "-ERR unknown command 'FLUSHALL'"},
+		{args: []string{"QUIT"}, want: "OK"},
+	}
+	for _, st := range steps {
+		assert.Equal(t, st.want, c.do(st.args...), "%v", st.args)
+	}
+}
+
+func TestBLPOPWakesOnPush(t *testing.T) {
+	s, addr := startServer(t)
+	c := dial(t, addr)
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		s.Manager.Get("second").Enqueue([]byte("late"))
+	}()
+	assert.Equal(t, `["second" "late"]`, c.do("BLPOP", "first", "second", "0"))
+	assert.Equal(t, 0, s.Manager.Get("second").Inflight())
+}
+
+func TestInlineAndPipelined(t *testing.T) {
+	_, addr := startServer(t)
+	c := dial(t, addr)
+
+	_, err := io.WriteString(c.c, "RPUSH q one\r\nRPUSH q two\r\nLLEN q\r\n")
+	assert.NoError(t, err)
+	assert.Equal(t, ":1", c.reply())
+	assert.Equal(t, ":2", c.reply())
+	assert.Equal(t, ":2", c.reply())
+}
+
+func TestProtocolError(t *testing.T) {
+	_, addr := startServer(t)
+	c := dial(t, addr)
+
+	_, err := io.WriteString(c.c, "*1\r\n+PING\r\n")
+	assert.NoError(t, err)
+	assert.Contains(t, c.reply(), "-ERR Protocol error")
+	_, err = c.br.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+type rejectBad struct{}
+
+func (rejectBad) Validate(b []byte) error {
+	if string(b) == "bad" {
+		return fmt.Errorf("bad body")
+	}
+	return nil
+}
+
+func TestPushIsAllOrNothing(t *testing.T) {
+	s, addr := startServer(t)
+	s.Manager.SetPolicy(func(name string) queue.Options {
+		return queue.Options{MaxLen: 3, Validator: rejectBad{}}
+	})
+	c := dial(t, addr)
+	assert.Contains(t, c.do("RPUSH", "q", "a", "bad", "c"), "-ERR invalid message")
+	assert.Contains(t, c.do("RPUSH", "q", "a", "b", "c", "d"), "-ERR queue is full")
+	assert.Equal(t, ":0", c.do("LLEN", "q"))
+	assert.Equal(t, ":3", c.do("LPUSH", "q", "a", "b", "c"))
+	assert.Equal(t, `["c" "b" "a"]`, c.do("LPOP", "q", "3"))
+}
+
+func TestCommandSizeLimit(t *testing.T) {
+	bulk := fmt.Sprintf("\r\n$%d\r\n", MaxBulkLen)
+	data := bytes.Repeat([]byte{'x'}, MaxBulkLen)
+	r := io.MultiReader(
+		strings.NewReader("*4\r\n$5\r\nRPUSH"+bulk), bytes.NewReader(data),
+		strings.NewReader(bulk), bytes.NewReader(data),
+		strings.NewReader("\r\n$1\r\nx\r\n"),
+	)
+	_, err := readCommand(bufio.NewReader(r))
+	assert.EqualError(t, err, "ERR Protocol error: command too large")
+}
@@ -0,0 +1,144 @@
+package rwclient
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// checkpointInterval is how often Produce saves its progress while lines
+// are being confirmed. A crash resends at most the lines confirmed since.
+const checkpointInterval = time.Second
+
+// checkpointHead is how much of the input's start is hashed to identify it.
+const checkpointHead = 64 << 10
+
+// checkpoint is the sidecar file's content. Size, ModTime and Head identify
+// the input; Offset is the byte just past the last confirmed line, which is
+// line number Line.
+type checkpoint struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Head    string    `json:"head_sha256"`
+	Offset  int64     `json:"offset"`
+	Line    int64     `json:"line"`
+}
+
+func (cp checkpoint) sameFile(o checkpoint) bool {
+	return cp.Size == o.Size && cp.ModTime.Equal(o.ModTime) && cp.Head == o.Head
+}
+
+// checkpointer tracks the lines of one Produce call from being read to
+// being confirmed and saves the progress to a sidecar file.
+type checkpointer struct {
+	path  string
+	cp    checkpoint
+	saved time.Time
+	// pending holds the sizes of the lines read but not yet confirmed.
+	pending []int64
+}
+
+// openCheckpoint identifies the input f and, with resume set, seeks it past
+// the lines the checkpoint at path records as confirmed. A missing
+// checkpoint starts from the beginning; one for another or a changed file
+// is an error.
+func openCheckpoint(f *os.File, path string, resume bool) (*checkpointer, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, io.LimitReader(f, checkpointHead)); err != nil {
+		return nil, err
+	}
+	abs, _ := filepath.Abs(f.Name())
+	c := &checkpointer{path: path, cp: checkpoint{
+		Path:    abs,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime().UTC(),
+		Head:    hex.EncodeToString(h.Sum(nil)),
+	}}
+	if resume {
+		data, err := os.ReadFile(path)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+		case err != nil:
+			return nil, err
+		default:
+			var prev checkpoint
+			if err := json.Unmarshal(data, &prev); err != nil {
+				return nil, fmt.Errorf("checkpoint %s: %w", path, err)
+			}
+			if !prev.sameFile(c.cp) || prev.Offset < 0 || prev.Offset > c.cp.Size {
+				return nil, fmt.Errorf("checkpoint %s is for another or a changed file; remove it to start over", path)
+			}
+			c.cp.Offset, c.cp.Line = prev.Offset, prev.Line
+		}
+	}
+	if _, err := f.Seek(c.cp.Offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return c, c.save()
+}
+
+// read notes a line of n bytes about to be sent.
+func (c *checkpointer) read(n int) {
+	if c != nil {
+		c.pending = append(c.pending, int64(n))
+	}
+}
+
+// confirmed notes that the oldest line sent is enqueued, saving the
+// progress if it was not saved for checkpointInterval.
+func (c *checkpointer) confirmed() error {
+	if c == nil {
+		return nil
+	}
+	c.cp.Offset += c.pending[0]
+	c.cp.Line++
+	c.pending = c.pending[1:]
+	if time.Since(c.saved) < checkpointInterval {
+		return nil
+	}
+	return c.save()
+}
+
+// save replaces the sidecar file with the current progress.
+func (c *checkpointer) save() error {
+	if c == nil {
+		return nil
+	}
+	data, err := json.Marshal(c.cp)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), c.path); err != nil {
+		return err
+	}
+	c.saved = time.Now()
+	return nil
+}
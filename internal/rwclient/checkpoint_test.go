@@ -0,0 +1,119 @@
+package rwclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	api "corti-kkv/internal/api"
+	"corti-kkv/internal/binproto"
+	"corti-kkv/internal/queue"
+)
+
+func TestProduceResume(t *testing.T) {
+	for _, transport := range []string{"http", "binary"} {
+		t.Run(transport, func(t *testing.T) {
+			m := queue.NewQueueManager()
+			url := ""
+			if transport == "http" {
+				ts := httptest.NewServer(api.NewServer(m).Handler())
+				defer ts.Close()
+				url = ts.URL
+			} else {
+				s := binproto.NewServer(m)
+				ln, err := binproto.Listen("127.0.0.1:0")
+				if !assert.NoError(t, err) {
+					return
+				}
+				go s.Serve(ln)
+				defer s.Close()
+				url = "kkv://" + ln.Addr().String()
+			}
+			dir := t.TempDir()
+			in := filepath.Join(dir, "in.txt")
+			sidecar := in + ".checkpoint"
+			var lines []string
+			for i := 0; i < 10; i++ {
+				lines = append(lines, fmt.Sprintf("line %d\n", i))
+			}
+			lines = append(lines, "last")
+			assert.NoError(t, os.WriteFile(in, []byte(strings.Join(lines, "")), 0o644))
+
+			// The queue only has room for four lines, so the first run fails.
+			q := m.Get("resume")
+			q.SetOptions(queue.Options{MaxLen: 4})
+			c := New(url, "resume")
+			opts := ProduceOptions{Checkpoint: sidecar, Resume: true}
+			assert.ErrorContains(t, c.ProduceWith(context.Background(), in, opts), "full")
+
+			var cp checkpoint
+			b, err := os.ReadFile(sidecar)
+			assert.NoError(t, err)
+			assert.NoError(t, json.Unmarshal(b, &cp))
+			assert.Equal(t, int64(4), cp.Line)
+			assert.Equal(t, int64(len(strings.Join(lines[:4], ""))), cp.Offset)
+			assert.Equal(t, int64(len(strings.Join(lines, ""))), cp.Size)
+
+			// A restarted producer continues after the last confirmed line.
+			q.SetOptions(queue.Options{})
+			assert.NoError(t, New(url, "resume").ProduceWith(context.Background(), in, opts))
+			assert.Equal(t, lines, bodies(q.Peek(100)))
+
+			// Done files have nothing left to send.
+			assert.NoError(t, New(url, "resume").ProduceWith(context.Background(), in, opts))
+			assert.Equal(t, 11, q.Len())
+
+			// Without Resume the checkpoint is started over.
+			assert.NoError(t, New(url, "resume").ProduceWith(context.Background(), in, ProduceOptions{Checkpoint: sidecar}))
+			assert.Equal(t, 22, q.Len())
+		})
+	}
+}
+
+func TestProduceResumeChangedFile(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.txt")
+	sidecar := filepath.Join(dir, "in.cp")
+	assert.NoError(t, os.WriteFile(in, []byte("a\nb\n"), 0o644))
+	f, err := os.Open(in)
+	if !assert.NoError(t, err) {
+		return
+	}
+	cp, err := openCheckpoint(f, sidecar, true)
+	f.Close()
+	if !assert.NoError(t, err) {
+		return
+	}
+	cp.read(2)
+	assert.NoError(t, cp.confirmed())
+	assert.NoError(t, cp.save())
+
+	f, _ = os.Open(in)
+	defer f.Close()
+	resumed, err := openCheckpoint(f, sidecar, true)
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(1), resumed.cp.Line)
+		b := make([]byte, 2)
+		f.Read(b)
+		assert.Equal(t, "b\n", string(b), "the input is positioned after the confirmed line")
+	}
+
+	assert.NoError(t, os.WriteFile(in, []byte("x\ny\n"), 0o644))
+	assert.NoError(t, os.Chtimes(in, time.Now(), time.Now().Add(time.Hour)))
+	f2, _ := os.Open(in)
+	defer f2.Close()
+	_, err = openCheckpoint(f2, sidecar, true)
+	assert.ErrorContains(t, err, "is for another or a changed file")
+
+	assert.NoError(t, os.WriteFile(sidecar, []byte("{"), 0o644))
+	_, err = openCheckpoint(f2, sidecar, true)
+	assert.ErrorContains(t, err, "checkpoint "+sidecar)
+}
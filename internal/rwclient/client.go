@@ -7,107 +7,473 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"os"
 	"strconv"
 	"time"
+
+	"corti-kkv/internal/binproto"
+	"corti-kkv/internal/frame"
+	"corti-kkv/internal/logging"
+	"corti-kkv/internal/metrics"
+	"corti-kkv/internal/tlsutil"
+	"corti-kkv/internal/trace"
+)
+
+const (
+	// DefaultBatchSize is the number of messages Consume asks for per request.
+	DefaultBatchSize = 100
+	// DefaultPollWait is how long Consume lets the server hold an empty
+	// dequeue open before answering.
+	DefaultPollWait = time.Second
+	// MaxRetryAfter caps how long the client waits when a throttled request
+	// asks it to come back later.
+	MaxRetryAfter = 30 * time.Second
 )
 
 type Client struct {
 	QueueURL   string
 	QueueName  string
 	HttpClient *http.Client
+	BatchSize  int
+	PollWait   time.Duration
+	// Token is sent as a bearer token on HTTP requests when set.
+	Token string
+	// Tracer, when set, records produce, enqueue and write spans. Trace
+	// context from the caller's ctx is propagated either way.
+	Tracer *trace.Tracer
+	// Retry says how failed requests are retried and OnRetry, when set, is
+	// called before each retry.
+	Retry   RetryPolicy
+	OnRetry func(Retry)
+
+	// bin is set when QueueURL selects the binary protocol.
+	bin *binproto.Client
+
+	retries  *metrics.CounterVec
+	failures *metrics.CounterVec
 }
 
+// New returns a client for the named queue. queueURL is either the HTTP base
+// URL of the queue service or, for the binary protocol, kkv://host:port or
+// kkv+unix:///path/to/socket.
 func New(queueURL, queueName string) *Client {
 	return &Client{
 		QueueURL:   queueURL,
 		QueueName:  queueName,
 		HttpClient: &http.Client{Timeout: 30 * time.Second},
+		BatchSize:  DefaultBatchSize,
+		PollWait:   DefaultPollWait,
+		Retry:      DefaultRetryPolicy(),
+		bin:        binaryTransport(queueURL),
+		retries:    metrics.NewCounterVec("kkv_rwclient_retries_total", "Requests resent after a transient failure or being asked to back off.", "op"),
+		failures:   metrics.NewCounterVec("kkv_rwclient_errors_total", "Failed queue operations.", "op"),
 	}
 }
 
+// Collect reports retry and error counters by operation.
+func (c *Client) Collect(e *metrics.Encoder) {
+	c.retries.Collect(e)
+	c.failures.Collect(e)
+}
+
+// countErr records err, if any, as a failed op and returns it.
+func (c *Client) countErr(op string, err error) error {
+	if err != nil {
+		c.failures.Inc(op)
+	}
+	return err
+}
+
+// SetTLS makes HTTPS requests trust the CAs in caFile instead of the system
+// roots and present the client certificate in certFile and keyFile. Empty
+// arguments keep the respective default.
+func (c *Client) SetTLS(caFile, certFile, keyFile string) error {
+	cfg, err := tlsutil.ClientConfig(caFile, certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = cfg
+	c.HttpClient.Transport = t
+	return nil
+}
+
+// ProduceOptions controls a ProduceWith call.
+type ProduceOptions struct {
+	// Checkpoint, when set, names a sidecar file, such as the input path
+	// with ".checkpoint" appended, recording the input's identity and the
+	// lines confirmed enqueued. It is kept after the input is done.
+	Checkpoint string
+	// Resume skips the lines Checkpoint records as enqueued. The input must
+	// be unchanged since the checkpoint was written.
+	Resume bool
+	// Split cuts the input into messages; nil means SplitLines. A record
+	// may be up to MaxRecordSize bytes.
+	Split Splitter
+}
+
+// Produce enqueues every line of the file at inputPath. A line longer than
+// MaxRecordSize, newline included, stops it with an error wrapping
+// bufio.ErrTooLong after the lines before it are enqueued.
 func (c *Client) Produce(ctx context.Context, inputPath string) error {
+	return c.ProduceWith(ctx, inputPath, ProduceOptions{})
+}
+
+// ProduceWith is Produce with options.
+func (c *Client) ProduceWith(ctx context.Context, inputPath string, opts ProduceOptions) (err error) {
+	ctx, span := c.Tracer.Start(ctx, "produce", trace.Internal)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+	span.SetAttr("queue", c.QueueName)
 	f, err := os.Open(inputPath)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
-	reader := bufio.NewReader(f)
-	for {
+	var cp *checkpointer
+	if opts.Checkpoint != "" {
+		if cp, err = openCheckpoint(f, opts.Checkpoint, opts.Resume); err != nil {
+			return err
+		}
+		if cp.cp.Line > 0 {
+			slog.InfoContext(ctx, "resuming produce", "queue", c.QueueName, "path", inputPath, "line", cp.cp.Line, "offset", cp.cp.Offset)
+			span.SetAttr("resumed_at_line", cp.cp.Line)
+		}
+		defer func() {
+			if serr := cp.save(); serr != nil {
+				err = errors.Join(err, fmt.Errorf("save checkpoint: %w", serr))
+			}
+		}()
+	}
+
+	split := opts.Split
+	if split == nil {
+		split = SplitLines
+	}
+	// consumed adds up the input bytes behind the next message.
+	consumed := 0
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, MaxRecordSize)
+	sc.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		adv, token, err := split(data, atEOF)
+		consumed += adv
+		return adv, token, err
+	})
+	p := &pipeline{c: c, cp: cp}
+	for sc.Scan() {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 		default:
 		}
-		line, err := reader.ReadBytes('\n')
-		if errors.Is(err, io.EOF) {
-			if len(line) > 0 {
-				// last line without newline — still enqueue
-				if err := c.enqueue(ctx, line); err != nil {
-					return err
-				}
-			}
-			return nil
-		}
-		if err != nil {
+		// The pipeline may resend the message, so it must not share the
+		// scanner's buffer.
+		if err := p.add(ctx, bytes.Clone(sc.Bytes()), consumed); err != nil {
 			return err
 		}
-		if err := c.enqueue(ctx, line); err != nil {
-			return err
+		consumed = 0
+	}
+	if err := sc.Err(); err != nil {
+		if errors.Is(err, bufio.ErrTooLong) {
+			err = fmt.Errorf("record larger than %d bytes: %w", MaxRecordSize, err)
 		}
+		return errors.Join(err, p.flush(ctx))
+	}
+	return p.flush(ctx)
+}
+
+// ProduceSplit is Produce cutting the input as the ParseSplitter spec
+// split says.
+func (c *Client) ProduceSplit(ctx context.Context, inputPath, split string) error {
+	s, err := ParseSplitter(split)
+	if err != nil {
+		return err
 	}
+	return c.ProduceWith(ctx, inputPath, ProduceOptions{Split: s})
+}
+
+// ValidateSplit reports whether split is a valid ParseSplitter spec.
+func (c *Client) ValidateSplit(split string) error {
+	_, err := ParseSplitter(split)
+	return err
 }
 
+// ExitMode says when Consume returns on its own.
+type ExitMode int
+
+const (
+	// RunForever consumes until the context ends, which is not an error.
+	RunForever ExitMode = iota
+	// StopWhenEmpty returns once a dequeue, having waited PollWait, finds
+	// the queue empty.
+	StopWhenEmpty
+	// StopAfterN returns once ConsumeOptions.N messages are written.
+	StopAfterN
+)
+
+// DefaultMaxFailures is how many dequeues in a row may fail before Consume
+// gives up, unless ConsumeOptions says otherwise.
+const DefaultMaxFailures = 10
+
+type ConsumeOptions struct {
+	Exit ExitMode
+	N    int
+	// MaxFailures is how many dequeues in a row may fail, each after its
+	// retries, before Consume returns the last error. 0 means
+	// DefaultMaxFailures and a negative value never gives up.
+	MaxFailures int
+	// OnError, when set, is called with every failed dequeue.
+	OnError func(error)
+}
+
+// Consume writes the queue's messages to outputPath until ctx ends or
+// DefaultMaxFailures dequeues in a row fail.
 func (c *Client) Consume(ctx context.Context, outputPath string) error {
+	return c.ConsumeWith(ctx, outputPath, ConsumeOptions{})
+}
+
+// ConsumeWith writes the queue's messages to outputPath until opts.Exit
+// says to stop or too many dequeues fail. If ctx ends first it returns
+// ctx.Err(), except with RunForever. Failed dequeues are paced by the
+// client's retry backoff.
+func (c *Client) ConsumeWith(ctx context.Context, outputPath string, opts ConsumeOptions) error {
+	if opts.Exit == StopAfterN && opts.N < 1 {
+		return fmt.Errorf("StopAfterN needs N > 0, got %d", opts.N)
+	}
+	maxFailures := opts.MaxFailures
+	if maxFailures == 0 {
+		maxFailures = DefaultMaxFailures
+	}
 	f, err := os.Create(outputPath)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
+	written, failures := 0, 0
 	for {
-		select {
-		case <-ctx.Done():
-			return nil
-		default:
+		if ctx.Err() != nil {
+			if opts.Exit == RunForever {
+				return nil
+			}
+			return ctx.Err()
+		}
+		batch := c.BatchSize
+		if opts.Exit == StopAfterN {
+			if written >= opts.N {
+				return nil
+			}
+			batch = min(batch, opts.N-written)
 		}
-		msg, err := c.dequeue(ctx)
-		if err != nil || len(msg) == 0 {
+		msgs, ids, err := c.dequeueMessages(ctx, batch, c.PollWait)
+		if err != nil {
+			if ctx.Err() != nil {
+				continue
+			}
+			failures++
+			slog.WarnContext(ctx, "dequeue failed", "queue", c.QueueName, "failures", failures, "err", err)
+			if opts.OnError != nil {
+				opts.OnError(err)
+			}
+			if maxFailures > 0 && failures >= maxFailures {
+				return fmt.Errorf("giving up after %d failed dequeues: %w", failures, err)
+			}
+			t := time.NewTimer(c.Retry.Backoff(failures))
+			select {
+			case <-ctx.Done():
+				t.Stop()
+			case <-t.C:
+			}
 			continue
 		}
-		if _, err := f.Write(msg); err != nil {
-			return err
+		failures = 0
+		if len(msgs) == 0 {
+			if opts.Exit == StopWhenEmpty {
+				return nil
+			}
+			continue
+		}
+		// Messages are acknowledged only once written, so that none is lost
+		// to a failed write.
+		if err := c.write(ctx, f, msgs); err != nil {
+			return errors.Join(err, c.settle(context.WithoutCancel(ctx), ids, false))
+		}
+		if err := c.settle(context.WithoutCancel(ctx), ids, true); err != nil {
+			slog.WarnContext(ctx, "ack failed", "queue", c.QueueName, "err", err)
 		}
+		written += len(msgs)
 	}
 }
 
-func (c *Client) enqueue(ctx context.Context, body []byte) error {
-	url := fmt.Sprintf("%s/queues/%s", c.QueueURL, c.QueueName)
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
-	if err != nil {
-		return err
+// write appends a batch to f, recording a write span per message in the
+// message's trace.
+func (c *Client) write(ctx context.Context, f io.Writer, msgs []frame.Message) error {
+	var spans []*trace.Span
+	bodies := make([][]byte, len(msgs))
+	for i, m := range msgs {
+		bodies[i] = m.Body
+		if sc, ok := trace.Parse(m.Traceparent, m.Tracestate); ok {
+			_, span := c.Tracer.Start(trace.ContextWithSpanContext(ctx, sc), "write", trace.Consumer)
+			span.SetAttr("queue", c.QueueName)
+			span.SetAttr("bytes", len(m.Body))
+			spans = append(spans, span)
+		}
 	}
-	req.Header.Set("Content-Type", "application/octet-stream")
-	resp, err := c.HttpClient.Do(req)
+	_, err := f.Write(bytes.Join(bodies, nil))
+	for _, span := range spans {
+		span.SetError(err)
+		span.End()
+	}
+	return err
+}
+
+func (c *Client) newRequest(ctx context.Context, method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusAccepted {
-		b, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("enqueue failed: %s: %s", resp.Status, string(b))
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
 	}
-	return nil
+	if id := logging.RequestID(ctx); id != "" {
+		req.Header.Set(logging.RequestIDHeader, id)
+	}
+	trace.Inject(trace.FromContext(ctx), req.Header)
+	return req, nil
+}
+
+// retryAfter parses a Retry-After value in seconds or as an HTTP date.
+func retryAfter(v string, now time.Time) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+		return time.Duration(n) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(t.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+func (c *Client) enqueue(ctx context.Context, body []byte) (err error) {
+	ctx, span := c.Tracer.Start(ctx, "enqueue", trace.Producer)
+	defer func() {
+		c.countErr("enqueue", err)
+		span.SetError(err)
+		span.End()
+	}()
+	span.SetAttr("queue", c.QueueName)
+	span.SetAttr("bytes", len(body))
+	return c.retry(ctx, "enqueue", func() error {
+		if c.bin != nil {
+			_, err := c.bin.Enqueue(ctx, c.QueueName, body)
+			return err
+		}
+		url := fmt.Sprintf("%s/queues/%s", c.QueueURL, c.QueueName)
+		req, err := c.newRequest(ctx, http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		resp, err := c.HttpClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted {
+			return statusError("enqueue", resp)
+		}
+		return nil
+	})
 }
 
 func (c *Client) dequeue(ctx context.Context) ([]byte, error) {
-	url := fmt.Sprintf("%s/queues/%s", c.QueueURL, c.QueueName)
-	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, url, nil)
+	msgs, err := c.dequeueBatch(ctx, 1, 0)
+	if err != nil || len(msgs) == 0 {
+		return nil, err
+	}
+	return msgs[0], nil
+}
+
+// dequeueBatch asks for up to max messages, letting the server wait up to
+// wait for the first one.
+func (c *Client) dequeueBatch(ctx context.Context, max int, wait time.Duration) ([][]byte, error) {
+	msgs, ids, err := c.dequeueMessages(ctx, max, wait)
+	if err != nil || len(msgs) == 0 {
+		return nil, err
+	}
+	if err := c.settle(ctx, ids, true); err != nil {
+		return nil, err
+	}
+	out := make([][]byte, len(msgs))
+	for i, m := range msgs {
+		out[i] = m.Body
+	}
+	return out, nil
+}
+
+// dequeueMessages is dequeueBatch keeping each message's trace context,
+// which only HTTP carries. A non-framed 200 response is treated as a single
+// message. Over the binary protocol the messages stay in flight until
+// settle is called with the returned IDs.
+func (c *Client) dequeueMessages(ctx context.Context, max int, wait time.Duration) (msgs []frame.Message, ids []uint64, err error) {
+	defer func() { c.countErr("dequeue", err) }()
+	if max < 1 {
+		max = 1
+	}
+	err = c.retry(ctx, "dequeue", func() (err error) {
+		msgs, ids, err = c.dequeueOnce(ctx, max, wait)
+		return err
+	})
+	return msgs, ids, err
+}
+
+// settle acknowledges the messages of a binary protocol dequeue or, if ok
+// is false, hands them back to the queue. HTTP dequeues have no IDs.
+func (c *Client) settle(ctx context.Context, ids []uint64, ok bool) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	if ok {
+		return c.bin.AckAll(ctx, c.QueueName, ids)
+	}
+	return c.bin.NackAll(ctx, c.QueueName, ids)
+}
+
+func (c *Client) dequeueOnce(ctx context.Context, max int, wait time.Duration) ([]frame.Message, []uint64, error) {
+	if c.bin != nil {
+		msgs, err := c.bin.Dequeue(ctx, c.QueueName, max, wait, true)
+		if err != nil || len(msgs) == 0 {
+			return nil, nil, err
+		}
+		out := make([]frame.Message, len(msgs))
+		ids := make([]uint64, len(msgs))
+		for i, m := range msgs {
+			out[i] = frame.Message{Body: m.Body}
+			ids[i] = m.ID
+		}
+		return out, ids, nil
+	}
+	msgs, err := c.dequeueHTTP(ctx, max, wait)
+	return msgs, nil, err
+}
+
+func (c *Client) dequeueHTTP(ctx context.Context, max int, wait time.Duration) ([]frame.Message, error) {
+	url := fmt.Sprintf("%s/queues/%s?max=%d", c.QueueURL, c.QueueName, max)
+	if wait > 0 {
+		url += "&wait=" + wait.String()
+	}
+	req, err := c.newRequest(ctx, http.MethodDelete, url, nil)
 	if err != nil {
 		return nil, err
 	}
+	req.Header.Set("Accept", frame.TracedContentType+", "+frame.ContentType+", */*")
 	resp, err := c.HttpClient.Do(req)
 	if err != nil {
 		return nil, err
@@ -115,22 +481,48 @@ func (c *Client) dequeue(ctx context.Context) ([]byte, error) {
 	defer resp.Body.Close()
 	switch resp.StatusCode {
 	case http.StatusOK:
+		switch resp.Header.Get("Content-Type") {
+		case frame.TracedContentType:
+			return frame.ReadMessages(resp.Body)
+		case frame.ContentType:
+			bodies, err := frame.Read(resp.Body)
+			if err != nil {
+				return nil, err
+			}
+			out := make([]frame.Message, len(bodies))
+			for i, b := range bodies {
+				out[i] = frame.Message{Body: b}
+			}
+			return out, nil
+		}
 		b, err := io.ReadAll(resp.Body)
 		if err != nil {
 			return nil, err
 		}
-		return b, nil
+		sc, _ := trace.Extract(resp.Header)
+		return []frame.Message{{Body: b, Traceparent: sc.Traceparent(), Tracestate: sc.State}}, nil
 	case http.StatusNoContent:
 		return nil, nil
 	default:
-		b, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("dequeue failed: %s: %s", resp.Status, string(b))
+		return nil, statusError("dequeue", resp)
 	}
 }
 
-func (c *Client) QueueLength(ctx context.Context) (int, error) {
+func (c *Client) QueueLength(ctx context.Context) (n int, err error) {
+	defer func() { c.countErr("length", err) }()
+	err = c.retry(ctx, "length", func() (err error) {
+		n, err = c.queueLength(ctx)
+		return err
+	})
+	return n, err
+}
+
+func (c *Client) queueLength(ctx context.Context) (int, error) {
+	if c.bin != nil {
+		return c.bin.Len(ctx, c.QueueName)
+	}
 	url := fmt.Sprintf("%s/queues/%s", c.QueueURL, c.QueueName)
-	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	req, err := c.newRequest(ctx, http.MethodHead, url, nil)
 	if err != nil {
 		return 0, err
 	}
@@ -140,8 +532,7 @@ func (c *Client) QueueLength(ctx context.Context) (int, error) {
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		b, _ := io.ReadAll(resp.Body)
-		return 0, fmt.Errorf("queue length failed: %s: %s", resp.Status, string(b))
+		return 0, statusError("queue length", resp)
 	}
 	h := resp.Header.Get("X-Queue-Len")
 	if h == "" {
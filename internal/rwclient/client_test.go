@@ -3,7 +3,12 @@ package rwclient
 import (
 	"context"
 	api "corti-kkv/internal/api"
+	"corti-kkv/internal/auth"
+	"corti-kkv/internal/logging"
 	"corti-kkv/internal/queue"
+	"corti-kkv/internal/tlsutil"
+	"corti-kkv/internal/tlsutil/tlstest"
+	"corti-kkv/internal/trace"
 	"errors"
 	"fmt"
 	"io"
@@ -12,6 +17,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -483,3 +489,315 @@ func waitForFileContent(t *testing.T, path string, want []byte, timeout time.Dur
 	got, _ := os.ReadFile(path)
 	assert.Equal(t, string(want), string(got), "content mismatch after timeout")
 }
+
+func TestClientDequeueBatch(t *testing.T) {
+	m := queue.NewQueueManager()
+	ts := httptest.NewServer(api.NewServer(m).Handler())
+	defer ts.Close()
+	client := New(ts.URL, "batch")
+
+	for i := 0; i < 5; i++ {
+		m.Get("batch").Enqueue([]byte(fmt.Sprintf("m%d\n", i)))
+	}
+	got, err := client.dequeueBatch(context.Background(), 3, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("m0\n"), []byte("m1\n"), []byte("m2\n")}, got)
+
+	got, err = client.dequeueBatch(context.Background(), 10, 10*time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("m3\n"), []byte("m4\n")}, got)
+
+	got, err = client.dequeueBatch(context.Background(), 10, 10*time.Millisecond)
+	assert.NoError(t, err)
+	assert.Empty(t, got)
+}
+
+func TestClientToken(t *testing.T) {
+	store, err := auth.Parse(strings.NewReader("secret worker tq:produce,consume\n"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	s := api.NewServer(queue.NewQueueManager())
+	s.Auth = store
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	c := New(ts.URL, "tq")
+	assert.ErrorContains(t, c.enqueue(context.Background(), []byte("x")), "401")
+
+	c.Token = "secret"
+	assert.NoError(t, c.enqueue(context.Background(), []byte("x")))
+	n, err := c.QueueLength(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	got, err := c.dequeue(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("x"), got)
+}
+
+func TestClientSetTLS(t *testing.T) {
+	ca := tlstest.NewCA(t, "test-ca")
+	srvCert, srvKey := ca.Server()
+	cliCert, cliKey := ca.Client("producer")
+
+	cfg, err := tlsutil.ServerConfig(srvCert, srvKey, ca.CertFile)
+	if !assert.NoError(t, err) {
+		return
+	}
+	ts := httptest.NewUnstartedServer(api.NewServer(queue.NewQueueManager()).Handler())
+	ts.TLS = cfg
+	ts.StartTLS()
+	defer ts.Close()
+
+	c := New(ts.URL, "tls")
+	assert.Error(t, c.enqueue(context.Background(), []byte("x")), "server CA is not trusted by default")
+
+	assert.NoError(t, c.SetTLS(ca.CertFile, cliCert, cliKey))
+	assert.NoError(t, c.enqueue(context.Background(), []byte("x")))
+	n, err := c.QueueLength(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	assert.Error(t, c.SetTLS(ca.CertFile, cliCert, ""))
+}
+
+func TestClientHonorsRetryAfter(t *testing.T) {
+	var calls int
+	var bodies []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		b, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+		if calls < 3 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer ts.Close()
+
+	c := New(ts.URL, "q")
+	assert.NoError(t, c.enqueue(context.Background(), []byte("line\n")))
+	assert.Equal(t, 3, calls)
+	assert.Equal(t, []string{"line\n", "line\n", "line\n"}, bodies, "the body is resent")
+
+	// Throttled requests count as attempts, so they do not go on forever.
+	var throttled int
+	ts3 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		throttled++
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer ts3.Close()
+	assert.ErrorContains(t, New(ts3.URL, "q").enqueue(context.Background(), []byte("x")), "429")
+	assert.Equal(t, DefaultRetryPolicy().MaxAttempts, throttled)
+
+	// Without Retry-After the 429 is returned as an error.
+	ts2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer ts2.Close()
+	assert.ErrorContains(t, New(ts2.URL, "q").enqueue(context.Background(), []byte("x")), "429")
+}
+
+func TestClientRetryAfterRespectsContext(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "5")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := New(ts.URL, "q").QueueLength(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		in   string
+		want time.Duration
+		ok   bool
+	}{
+		{in: "", ok: false},
+		{in: "3", want: 3 * time.Second, ok: true},
+		{in: "-1", ok: false},
+		{in: "Mon, 01 Jan 2024 00:00:07 GMT", want: 7 * time.Second, ok: true},
+		{in: "Sun, 31 Dec 2023 23:00:00 GMT", want: 0, ok: true},
+		{in: "soon", ok: false},
+	}
+	for _, tc := range tests {
+		got, ok := retryAfter(tc.in, now)
+		assert.Equal(t, tc.ok, ok, tc.in)
+		assert.Equal(t, tc.want, got, tc.in)
+	}
+}
+
+func TestClientMetrics(t *testing.T) {
+	var calls int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	c := New(ts.URL, "q")
+	assert.Error(t, c.enqueue(context.Background(), []byte("x")))
+	_, err := c.QueueLength(context.Background())
+	assert.Error(t, err)
+	assert.Equal(t, float64(1), c.retries.Value("enqueue"))
+	assert.Equal(t, float64(1), c.failures.Value("enqueue"))
+	assert.Equal(t, float64(1), c.failures.Value("length"))
+	assert.Equal(t, float64(0), c.failures.Value("dequeue"))
+}
+
+func TestClientPropagatesRequestID(t *testing.T) {
+	var got []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.Header.Get(logging.RequestIDHeader))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer ts.Close()
+
+	c := New(ts.URL, "q")
+	assert.NoError(t, c.enqueue(logging.WithRequestID(context.Background(), "req-1"), []byte("x")))
+	assert.NoError(t, c.enqueue(context.Background(), []byte("y")))
+	assert.Equal(t, []string{"req-1", ""}, got)
+}
+
+type memExporter struct {
+	mu    sync.Mutex
+	spans []trace.SpanData
+}
+
+func (e *memExporter) Export(_ context.Context, _ string, spans []trace.SpanData) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func (e *memExporter) Close() error { return nil }
+
+func TestClientTracesUploadToConsumer(t *testing.T) {
+	const tp = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	dir := t.TempDir()
+	queueSpans, uploadSpans := &memExporter{}, &memExporter{}
+	queueTracer := trace.NewTracer("queue-service", queueSpans)
+	uploadTracer := trace.NewTracer("upload-service", uploadSpans)
+
+	s := api.NewServer(queue.NewQueueManager())
+	s.Tracer = queueTracer
+	qs := httptest.NewServer(trace.Middleware(s.Handler()))
+	defer qs.Close()
+	producer := New(qs.URL, "lines")
+	producer.Tracer = uploadTracer
+	up := api.NewUploadServer(producer, filepath.Join(dir, "in.txt"))
+	up.Tracer = uploadTracer
+	us := httptest.NewServer(trace.Middleware(up.Handler()))
+	defer us.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, us.URL+"/upload", strings.NewReader("a\nb\n"))
+	req.Header.Set("traceparent", tp)
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	sc, ok := trace.Extract(resp.Header)
+	assert.True(t, ok)
+
+	consumer := New(qs.URL, "lines")
+	consumer.Tracer = uploadTracer
+	consumer.PollWait = 10 * time.Millisecond
+	out := filepath.Join(dir, "out.txt")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- consumer.Consume(ctx, out) }()
+	waitForFileContent(t, out, []byte("a\nb\n"), 2*time.Second, 10*time.Millisecond)
+	cancel()
+	assert.NoError(t, <-done)
+	assert.NoError(t, queueTracer.Shutdown(context.Background()))
+	assert.NoError(t, uploadTracer.Shutdown(context.Background()))
+
+	names := map[string]int{}
+	for _, span := range append(queueSpans.spans, uploadSpans.spans...) {
+		assert.Equal(t, sc.TraceID, span.TraceID, span.Name)
+		names[span.Kind.String()+" "+span.Name]++
+	}
+	assert.Equal(t, map[string]int{
+		"server upload":    1,
+		"internal produce": 1,
+		"producer enqueue": 2,
+		"server enqueue":   2,
+		"server dequeue":   2,
+		"consumer write":   2,
+	}, names)
+}
+
+func TestClientConsumeWith(t *testing.T) {
+	m := queue.NewQueueManager()
+	ts := httptest.NewServer(api.NewServer(m).Handler())
+	defer ts.Close()
+	bad := httptest.NewServer(http.NotFoundHandler())
+	defer bad.Close()
+
+	tests := []struct {
+		name    string
+		url     string
+		queued  int
+		opts    ConsumeOptions
+		timeout time.Duration
+		want    string
+		left    int
+		errMsg  string
+		errors  int
+	}{
+		{name: "StopWhenEmpty", url: ts.URL, queued: 3, opts: ConsumeOptions{Exit: StopWhenEmpty}, want: "m0m1m2"},
+		{name: "StopAfterN", url: ts.URL, queued: 5, opts: ConsumeOptions{Exit: StopAfterN, N: 2}, want: "m0m1", left: 3},
+		{name: "StopAfterN_Cancelled", url: ts.URL, queued: 1, opts: ConsumeOptions{Exit: StopAfterN, N: 2}, timeout: 100 * time.Millisecond, want: "m0", errMsg: "context deadline exceeded"},
+		{name: "StopAfterN_Zero", url: ts.URL, opts: ConsumeOptions{Exit: StopAfterN}, errMsg: "StopAfterN needs N > 0"},
+		{name: "GiveUp", url: bad.URL, opts: ConsumeOptions{MaxFailures: 3}, errMsg: "giving up after 3 failed dequeues: dequeue failed: 404 Not Found", errors: 3},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			q := m.Get(tc.name)
+			for i := 0; i < tc.queued; i++ {
+				q.Enqueue([]byte(fmt.Sprintf("m%d", i)))
+			}
+			c := New(tc.url, tc.name)
+			c.PollWait = 10 * time.Millisecond
+			c.BatchSize = 10
+			fastRetries(c)
+			var errs []error
+			tc.opts.OnError = func(err error) { errs = append(errs, err) }
+			ctx := context.Background()
+			if tc.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tc.timeout)
+				defer cancel()
+			}
+			out := filepath.Join(t.TempDir(), "out.txt")
+			err := c.ConsumeWith(ctx, out, tc.opts)
+			if tc.errMsg != "" {
+				assert.ErrorContains(t, err, tc.errMsg)
+			} else {
+				assert.NoError(t, err)
+			}
+			b, _ := os.ReadFile(out)
+			assert.Equal(t, tc.want, string(b))
+			assert.Equal(t, tc.left, q.Len())
+			assert.Len(t, errs, tc.errors)
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package rwclient
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"slices"
+	"time"
+
+	"corti-kkv/internal/binproto"
+)
+
+// RetryPolicy says how a failed enqueue, dequeue or length request is
+// retried. Network errors, broken binary protocol connections and HTTP
+// answers with one of RetryStatuses are retried; others fail right away.
+// A 429 answer with a Retry-After header is retried too, after the time it
+// asks for, capped at MaxRetryAfter; it counts as an attempt like any other
+// failure, so that a request throttled for good still fails.
+//
+// Retries are at least once: an enqueue whose answer was lost may be
+// stored twice, and the messages of a dequeue whose answer was lost are
+// gone.
+type RetryPolicy struct {
+	// MaxAttempts is how often a request is sent in total; 0 or 1 disables
+	// retries.
+	MaxAttempts int
+	// The wait before retry n is BaseBackoff * 2^(n-1), at most MaxBackoff.
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+	// Jitter is the fraction, from 0 to 1, of each wait that is randomly
+	// left out so that clients failing together do not retry together.
+	Jitter        float64
+	RetryStatuses []int
+}
+
+// DefaultRetryPolicy is the policy of clients returned by New.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:   4,
+		BaseBackoff:   100 * time.Millisecond,
+		MaxBackoff:    5 * time.Second,
+		Jitter:        0.5,
+		RetryStatuses: []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout},
+	}
+}
+
+// Backoff returns the wait before retry n, counted from 1, with jitter. An
+// n below 1 counts as 1.
+func (p RetryPolicy) Backoff(n int) time.Duration {
+	n = max(n, 1)
+	d := p.MaxBackoff
+	if n < 64 && p.BaseBackoff < p.MaxBackoff>>(n-1) {
+		d = p.BaseBackoff << (n - 1)
+	}
+	if j := min(max(p.Jitter, 0), 1); j > 0 {
+		d -= time.Duration(j * rand.Float64() * float64(d))
+	}
+	return d
+}
+
+// Retry describes a failed attempt that is about to be retried.
+type Retry struct {
+	Op string
+	// Attempt counts the failed attempts so far.
+	Attempt int
+	Err     error
+	Wait    time.Duration
+}
+
+// StatusError is an unexpected HTTP answer from the queue service.
+type StatusError struct {
+	Op         string
+	Status     string
+	StatusCode int
+	Body       string
+	// RetryAfter holds the parsed Retry-After header, if any.
+	RetryAfter    time.Duration
+	hasRetryAfter bool
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s failed: %s: %s", e.Op, e.Status, e.Body)
+}
+
+// statusError reads the body of an unexpected answer to op into an error.
+func statusError(op string, resp *http.Response) error {
+	b, _ := io.ReadAll(resp.Body)
+	e := &StatusError{Op: op, Status: resp.Status, StatusCode: resp.StatusCode, Body: string(b)}
+	e.RetryAfter, e.hasRetryAfter = retryAfter(resp.Header.Get("Retry-After"), time.Now())
+	return e
+}
+
+// retry calls fn until it succeeds or fails for good, waiting between
+// attempts as c.Retry says. It never waits past ctx's deadline.
+func (c *Client) retry(ctx context.Context, op string, fn func() error) error {
+	attempt := 0
+	for {
+		err := fn()
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		attempt++
+		var se *StatusError
+		throttled := errors.As(err, &se) && se.StatusCode == http.StatusTooManyRequests && se.hasRetryAfter
+		if attempt >= c.Retry.MaxAttempts || !throttled && !c.retryable(err) {
+			return err
+		}
+		wait := c.Retry.Backoff(attempt)
+		if throttled {
+			wait = min(se.RetryAfter, MaxRetryAfter)
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return fmt.Errorf("%w (not retrying: %w)", err, context.DeadlineExceeded)
+		}
+		c.retries.Inc(op)
+		slog.DebugContext(ctx, "retrying queue request", "op", op, "attempt", attempt, "wait", wait, "err", err)
+		if c.OnRetry != nil {
+			c.OnRetry(Retry{Op: op, Attempt: attempt, Err: err, Wait: wait})
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+func (c *Client) retryable(err error) bool {
+	var se *StatusError
+	if errors.As(err, &se) {
+		return slices.Contains(c.Retry.RetryStatuses, se.StatusCode)
+	}
+	var cert *tls.CertificateVerificationError
+	if errors.As(err, &cert) {
+		return false
+	}
+	var ne net.Error
+	return errors.As(err, &ne) || errors.Is(err, binproto.ErrConnClosed) || errors.Is(err, io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,176 @@
+package rwclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"corti-kkv/internal/binproto"
+	"corti-kkv/internal/queue"
+)
+
+func fastRetries(c *Client) *[]Retry {
+	c.Retry.BaseBackoff = time.Millisecond
+	c.Retry.MaxBackoff = 4 * time.Millisecond
+	var got []Retry
+	c.OnRetry = func(r Retry) { got = append(got, r) }
+	return &got
+}
+
+func TestClientRetries(t *testing.T) {
+	var calls atomic.Int32
+	var bodies []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+		switch n := calls.Add(1); {
+		case strings.HasSuffix(r.URL.Path, "/failing"):
+		case n == 2:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		case n > 3:
+			w.Header().Set("X-Queue-Len", "7")
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, "draining")
+	}))
+	defer ts.Close()
+
+	c := New(ts.URL, "q")
+	retries := fastRetries(c)
+	assert.NoError(t, c.enqueue(context.Background(), []byte("x")))
+	assert.Equal(t, []string{"x", "x", "x", "x"}, bodies, "the body is resent")
+	if assert.Len(t, *retries, 3) {
+		assert.Equal(t, []int{1, 2, 3}, []int{(*retries)[0].Attempt, (*retries)[1].Attempt, (*retries)[2].Attempt}, "429 with Retry-After is an attempt")
+		assert.Equal(t, "enqueue", (*retries)[0].Op)
+		assert.EqualError(t, (*retries)[0].Err, "enqueue failed: 503 Service Unavailable: draining")
+		assert.Zero(t, (*retries)[1].Wait, "Retry-After is the wait")
+		assert.LessOrEqual(t, (*retries)[2].Wait, 4*time.Millisecond)
+	}
+	assert.Equal(t, float64(3), c.retries.Value("enqueue"))
+
+	// Attempts run out.
+	c.QueueName = "failing"
+	calls.Store(0)
+	*retries = nil
+	_, err := c.QueueLength(context.Background())
+	var se *StatusError
+	if assert.ErrorAs(t, err, &se) {
+		assert.Equal(t, http.StatusServiceUnavailable, se.StatusCode)
+	}
+	assert.Equal(t, int32(4), calls.Load())
+	assert.Len(t, *retries, 3)
+
+	// Statuses not listed are not retried.
+	c.Retry.RetryStatuses = []int{http.StatusBadGateway}
+	calls.Store(0)
+	_, err = c.QueueLength(context.Background())
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), calls.Load())
+
+	// A retry that would pass the deadline is not made.
+	c.Retry = DefaultRetryPolicy()
+	c.Retry.BaseBackoff, c.Retry.Jitter = time.Minute, 0
+	calls.Store(0)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	_, err = c.dequeue(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.ErrorAs(t, err, &se)
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+}
+
+func TestClientRetriesTransportErrors(t *testing.T) {
+	var calls atomic.Int32
+	c := New("http://invalid", "q")
+	c.HttpClient = &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if calls.Add(1) < 3 {
+			return nil, errors.New("connection reset")
+		}
+		return &http.Response{StatusCode: http.StatusNoContent, Body: http.NoBody, Request: r}, nil
+	})}
+	retries := fastRetries(c)
+	msgs, err := c.dequeueBatch(context.Background(), 10, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, msgs)
+	assert.Len(t, *retries, 2)
+	assert.Equal(t, float64(0), c.failures.Value("dequeue"))
+
+	c.Retry = RetryPolicy{}
+	calls.Store(0)
+	_, err = c.dequeue(context.Background())
+	assert.ErrorContains(t, err, "connection reset")
+	assert.Equal(t, int32(1), calls.Load(), "the zero policy does not retry")
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{BaseBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	var got []time.Duration
+	for n := 1; n <= 6; n++ {
+		got = append(got, p.Backoff(n))
+	}
+	assert.Equal(t, []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second}, got)
+	assert.Equal(t, time.Second, p.Backoff(100))
+	assert.Equal(t, 100*time.Millisecond, p.Backoff(0))
+	assert.Equal(t, 100*time.Millisecond, p.Backoff(-3))
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		d := p.Backoff(2)
+		assert.True(t, d > 100*time.Millisecond && d <= 200*time.Millisecond, d)
+	}
+}
+
+func TestClientBinaryResendsAfterBrokenConnection(t *testing.T) {
+	m := queue.NewQueueManager()
+	s := binproto.NewServer(m)
+	ln, err := binproto.Listen("127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	go s.Serve(ln)
+	defer s.Close()
+
+	c := New("kkv://"+ln.Addr().String(), "bin")
+	fastRetries(c)
+	ctx := context.Background()
+	p := &pipeline{c: c}
+	var want []string
+	for i := 0; i < 10; i++ {
+		want = append(want, fmt.Sprintf("line %d\n", i))
+		assert.NoError(t, p.add(ctx, []byte(want[i]), len(want[i])))
+	}
+	c.bin.Close()
+	assert.NoError(t, p.flush(ctx))
+
+	// Lines the server got before the connection broke are sent again, so
+	// the queue ends with all of them in order.
+	got := bodies(m.Get("bin").Peek(100))
+	assert.GreaterOrEqual(t, len(got), 10)
+	assert.Equal(t, want, got[len(got)-10:])
+}
+
+func bodies(msgs []queue.Message) []string {
+	out := make([]string, len(msgs))
+	for i, m := range msgs {
+		out[i] = string(m.Body)
+	}
+	return out
+}
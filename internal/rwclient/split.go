@@ -0,0 +1,208 @@
+package rwclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MaxRecordSize is the largest message a Splitter may cut from Produce's
+// input.
+const MaxRecordSize = 64 << 20
+
+// A Splitter cuts Produce's input into messages. It works like a
+// bufio.SplitFunc, which converts to it: it returns how many bytes of data
+// to consume and the next message, or a nil message to skip the bytes. The
+// bytes consumed for a message, including any skipped before it, count as
+// that message's in checkpoints.
+//
+// The line-based splitters keep each line's newline, so that Consume writes
+// the input back as it was; the others drop their separators.
+type Splitter func(data []byte, atEOF bool) (advance int, token []byte, err error)
+
+// SplitLines cuts the input after every \n. It is the default.
+func SplitLines(data []byte, atEOF bool) (int, []byte, error) {
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		return i + 1, data[:i+1], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// SplitCRLF is SplitLines for files with \r\n line ends, which become \n.
+func SplitCRLF(data []byte, atEOF bool) (int, []byte, error) {
+	adv, line, err := SplitLines(data, atEOF)
+	if n := len(line); n >= 2 && line[n-2] == '\r' && line[n-1] == '\n' {
+		line = append(line[:n-2:n-2], '\n')
+	}
+	return adv, line, err
+}
+
+// SplitParagraphs cuts the input at blank lines, which are dropped, so
+// that each message is a paragraph of one or more lines.
+func SplitParagraphs(data []byte, atEOF bool) (int, []byte, error) {
+	start := 0
+	for {
+		n := bytes.IndexByte(data[start:], '\n')
+		if n < 0 || !blank(data[start:start+n]) {
+			break
+		}
+		start += n + 1
+	}
+	for end := start; ; {
+		n := bytes.IndexByte(data[end:], '\n')
+		if n < 0 {
+			if !atEOF {
+				return start, nil, nil
+			}
+			if blank(data[start:]) {
+				return len(data), nil, nil
+			}
+			return len(data), data[start:], nil
+		}
+		if blank(data[end : end+n]) {
+			return end + n + 1, data[start:end], nil
+		}
+		end += n + 1
+	}
+}
+
+func blank(line []byte) bool { return len(bytes.TrimSpace(line)) == 0 }
+
+// SplitCSV returns a splitter that cuts the input into CSV records, which
+// may span lines inside double-quoted fields. Records keep their newline.
+// The splitter remembers how far it has scanned a record that is not yet
+// complete, so that each byte is looked at once; use one per input.
+func SplitCSV() Splitter {
+	scanned, quoted := 0, false
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		for i := scanned; i < len(data); i++ {
+			switch {
+			case data[i] == '"':
+				quoted = !quoted
+			case data[i] == '\n' && !quoted:
+				scanned = 0
+				return i + 1, data[:i+1], nil
+			}
+		}
+		scanned = len(data)
+		if !atEOF || len(data) == 0 {
+			return 0, nil, nil
+		}
+		unterminated := quoted
+		scanned, quoted = 0, false
+		if unterminated {
+			return 0, nil, errors.New("csv: unterminated quoted field")
+		}
+		return len(data), data, nil
+	}
+}
+
+// SplitJSONLines cuts the input into JSON Lines documents, without their
+// newline, skipping blank lines. A line that is not valid JSON stops
+// Produce.
+func SplitJSONLines(data []byte, atEOF bool) (int, []byte, error) {
+	adv, line, err := SplitLines(data, atEOF)
+	if err != nil || line == nil {
+		return adv, nil, err
+	}
+	doc := bytes.TrimSpace(line)
+	if len(doc) == 0 {
+		return adv, nil, nil
+	}
+	if !json.Valid(doc) {
+		if len(doc) > 40 {
+			doc = append(doc[:37:37], "..."...)
+		}
+		return 0, nil, fmt.Errorf("jsonl: invalid JSON %q", doc)
+	}
+	return adv, doc, nil
+}
+
+// SplitFixed cuts the input into chunks of size bytes; the last one may be
+// shorter. The size must be from 1 to MaxRecordSize.
+func SplitFixed(size int) (Splitter, error) {
+	if size < 1 || size > MaxRecordSize {
+		return nil, fmt.Errorf("fixed: size %d is not from 1 to %d bytes", size, MaxRecordSize)
+	}
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if len(data) >= size {
+			return size, data[:size], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	}, nil
+}
+
+// SplitDelimiter cuts the input at every occurrence of delim, which is
+// dropped and may not be empty. Empty records are skipped.
+func SplitDelimiter(delim []byte) (Splitter, error) {
+	if len(delim) == 0 {
+		return nil, errors.New("delim: empty delimiter")
+	}
+	delim = bytes.Clone(delim)
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if i := bytes.Index(data, delim); i >= 0 {
+			if i == 0 {
+				return len(delim), nil, nil
+			}
+			return i + len(delim), data[:i], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	}, nil
+}
+
+// ParseSplitter returns the splitter named by spec: lines (or empty), crlf,
+// paragraphs, csv, jsonl, fixed:<bytes> or delim:<delimiter>, where the
+// delimiter may use Go escapes such as \t, \x00 or \n. Each call returns a
+// new splitter, so that one with state such as SplitCSV's serves one input.
+func ParseSplitter(spec string) (Splitter, error) {
+	name, arg, hasArg := strings.Cut(spec, ":")
+	simple := map[string]Splitter{
+		"":           SplitLines,
+		"lines":      SplitLines,
+		"crlf":       SplitCRLF,
+		"paragraphs": SplitParagraphs,
+		"jsonl":      SplitJSONLines,
+	}
+	if s, ok := simple[name]; ok && !hasArg {
+		return s, nil
+	}
+	switch name {
+	case "csv":
+		if !hasArg {
+			return SplitCSV(), nil
+		}
+	case "fixed":
+		n, err := strconv.Atoi(arg)
+		var s Splitter
+		if err == nil {
+			s, err = SplitFixed(n)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid splitter %q: want fixed:<bytes> with 1 to %d bytes", spec, MaxRecordSize)
+		}
+		return s, nil
+	case "delim":
+		delim, err := strconv.Unquote(`"` + strings.ReplaceAll(arg, `"`, `\"`) + `"`)
+		var s Splitter
+		if err == nil {
+			s, err = SplitDelimiter([]byte(delim))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid splitter %q: want delim:<delimiter>", spec)
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("unknown splitter %q: want lines, crlf, paragraphs, csv, jsonl, fixed:<bytes> or delim:<delimiter>", spec)
+}
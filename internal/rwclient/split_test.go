@@ -0,0 +1,138 @@
+package rwclient
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	api "corti-kkv/internal/api"
+	"corti-kkv/internal/queue"
+)
+
+func TestSplitters(t *testing.T) {
+	tests := []struct {
+		name   string
+		spec   string
+		in     string
+		want   []string
+		errMsg string
+	}{
+		{name: "Lines", spec: "lines", in: "a\n\nb", want: []string{"a\n", "\n", "b"}},
+		{name: "Default", in: "a\nb\n", want: []string{"a\n", "b\n"}},
+		{name: "CRLF", spec: "crlf", in: "a\r\nb\nc\r\n", want: []string{"a\n", "b\n", "c\n"}},
+		{name: "Paragraphs", spec: "paragraphs", in: "\n\nHello world!\n\nAsd\nmore\n \r\n\nTest!!", want: []string{"Hello world!\n", "Asd\nmore\n", "Test!!"}},
+		{name: "Paragraphs_TrailingBlank", spec: "paragraphs", in: "a\r\n\r\nb\n\n\n", want: []string{"a\r\n", "b\n"}},
+		{name: "CSV", spec: "csv", in: "id,note\n1,\"two\nlines\"\n2,\"say \"\"hi\"\"\"", want: []string{"id,note\n", "1,\"two\nlines\"\n", "2,\"say \"\"hi\"\"\""}},
+		{name: "CSV_Unterminated", spec: "csv", in: "1,\"open\n", errMsg: "unterminated quoted field"},
+		{name: "JSONLines", spec: "jsonl", in: "{\"a\": 1}\n\n  [1,2] \r\n\"s\"", want: []string{`{"a": 1}`, "[1,2]", `"s"`}},
+		{name: "JSONLines_Invalid", spec: "jsonl", in: "{\"a\": 1}\n{nope}\n", want: []string{`{"a": 1}`}, errMsg: `invalid JSON "{nope}"`},
+		{name: "Fixed", spec: "fixed:3", in: "abcdefgh", want: []string{"abc", "def", "gh"}},
+		{name: "Delimiter", spec: `delim:\x00`, in: "a\x00\x00b\x00", want: []string{"a", "b"}},
+		{name: "Delimiter_Multibyte", spec: "delim:---", in: "a\n---b\n---", want: []string{"a\n", "b\n"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			split, err := ParseSplitter(tc.spec)
+			if !assert.NoError(t, err) {
+				return
+			}
+			sc := bufio.NewScanner(strings.NewReader(tc.in))
+			sc.Buffer(make([]byte, 4), 1<<10)
+			sc.Split(bufio.SplitFunc(split))
+			var got []string
+			for sc.Scan() {
+				got = append(got, sc.Text())
+			}
+			assert.Equal(t, tc.want, got)
+			if tc.errMsg != "" {
+				assert.ErrorContains(t, sc.Err(), tc.errMsg)
+			} else {
+				assert.NoError(t, sc.Err())
+			}
+		})
+	}
+}
+
+func TestParseSplitterErrors(t *testing.T) {
+	for _, spec := range []string{"words", "fixed:0", "fixed:x", "fixed:999999999", "delim:", `delim:\q`, "csv:x"} {
+		_, err := ParseSplitter(spec)
+		assert.Error(t, err, spec)
+	}
+	assert.NoError(t, New("http://x", "q").ValidateSplit("fixed:512"))
+}
+
+func TestSplitterArgs(t *testing.T) {
+	for _, size := range []int{0, -1, MaxRecordSize + 1} {
+		_, err := SplitFixed(size)
+		assert.Error(t, err, size)
+	}
+	_, err := SplitDelimiter(nil)
+	assert.EqualError(t, err, "delim: empty delimiter")
+}
+
+func TestSplitCSVResumes(t *testing.T) {
+	split := SplitCSV()
+	in := []byte("1,\"a\nb\"\n2,c\n")
+	adv, token, err := split(in[:4], false)
+	assert.Equal(t, 0, adv)
+	assert.Nil(t, token)
+	assert.NoError(t, err)
+	adv, token, _ = split(in, false)
+	assert.Equal(t, "1,\"a\nb\"\n", string(token))
+	_, token, _ = split(in[adv:], false)
+	assert.Equal(t, "2,c\n", string(token))
+	_, _, err = split([]byte("\"open"), true)
+	assert.Error(t, err)
+	_, token, _ = split([]byte("x\n"), false)
+	assert.Equal(t, "x\n", string(token), "an error resets the splitter")
+}
+
+func TestProduceSplit(t *testing.T) {
+	m := queue.NewQueueManager()
+	ts := httptest.NewServer(api.NewServer(m).Handler())
+	defer ts.Close()
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.txt")
+	assert.NoError(t, os.WriteFile(in, []byte("Hello world!\r\n\r\nAsd\r\n\r\nTest!!\r\n"), 0o644))
+
+	c := New(ts.URL, "paras")
+	assert.NoError(t, c.ProduceSplit(context.Background(), in, "paragraphs"))
+	assert.Equal(t, []string{"Hello world!\r\n", "Asd\r\n", "Test!!\r\n"}, bodies(m.Get("paras").Peek(10)))
+	assert.ErrorContains(t, c.ProduceSplit(context.Background(), in, "words"), "unknown splitter")
+
+	// Checkpoints count the input bytes, not the message bytes.
+	sidecar := in + ".checkpoint"
+	c.QueueName = "lines"
+	assert.NoError(t, c.ProduceWith(context.Background(), in, ProduceOptions{Split: SplitCRLF, Checkpoint: sidecar}))
+	assert.Equal(t, []string{"Hello world!\n", "\n", "Asd\n", "\n", "Test!!\n"}, bodies(m.Get("lines").Peek(10)))
+	var cp checkpoint
+	b, _ := os.ReadFile(sidecar)
+	assert.NoError(t, json.Unmarshal(b, &cp))
+	assert.Equal(t, checkpoint{Offset: cp.Size, Line: 5}, checkpoint{Offset: cp.Offset, Line: cp.Line})
+}
+
+func TestProduceRecordTooLong(t *testing.T) {
+	m := queue.NewQueueManager()
+	ts := httptest.NewServer(api.NewServer(m).Handler())
+	defer ts.Close()
+	in := filepath.Join(t.TempDir(), "in.txt")
+	f, err := os.Create(in)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f.WriteString("short\n")
+	f.Write(make([]byte, MaxRecordSize+1))
+	assert.NoError(t, f.Close())
+
+	err = New(ts.URL, "big").Produce(context.Background(), in)
+	assert.ErrorIs(t, err, bufio.ErrTooLong)
+	assert.ErrorContains(t, err, "record larger than 67108864 bytes")
+	assert.Equal(t, []string{"short\n"}, bodies(m.Get("big").Peek(10)))
+}
@@ -0,0 +1,137 @@
+package rwclient
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// StreamRetry is how long ConsumeStream waits before reconnecting after the
+// event stream drops.
+const StreamRetry = 500 * time.Millisecond
+
+// errWrite marks failures writing to the output file, which end
+// ConsumeStream instead of triggering a reconnect.
+type errWrite struct{ err error }
+
+func (e errWrite) Error() string { return e.err.Error() }
+func (e errWrite) Unwrap() error { return e.err }
+
+// ConsumeStream is like Consume but receives messages over the queue's
+// server-sent event stream instead of polling. When the connection drops it
+// reconnects with the last seen event ID so that messages the server sent
+// but the client never received are replayed.
+func (c *Client) ConsumeStream(ctx context.Context, outputPath string) error {
+	if c.bin != nil {
+		return errors.New("event streams need an http(s) queue URL")
+	}
+	f, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	lastID := ""
+	for {
+		err := c.stream(ctx, lastID, func(id string, data []byte) error {
+			if _, err := f.Write(data); err != nil {
+				return errWrite{err}
+			}
+			lastID = id
+			return nil
+		})
+		var werr errWrite
+		if errors.As(err, &werr) {
+			return werr.err
+		}
+		if ctx.Err() == nil && err != nil {
+			c.countErr("stream", err)
+			slog.WarnContext(ctx, "event stream failed, reconnecting", "queue", c.QueueName, "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(StreamRetry):
+		}
+	}
+}
+
+// stream opens the event stream and calls fn for every event until the
+// connection ends or fn fails.
+func (c *Client) stream(ctx context.Context, lastID string, fn func(id string, data []byte) error) error {
+	url := fmt.Sprintf("%s/queues/%s/stream?encoding=base64", c.QueueURL, c.QueueName)
+	req, err := c.newRequest(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if lastID != "" {
+		req.Header.Set("Last-Event-ID", lastID)
+	}
+	// The stream stays open indefinitely, so the client-wide timeout must not
+	// apply to it.
+	hc := *c.HttpClient
+	hc.Timeout = 0
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("stream failed: %s: %s", resp.Status, string(b))
+	}
+	return readEvents(resp.Body, func(id, data string) error {
+		b, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return fmt.Errorf("decode event %s: %w", id, err)
+		}
+		return fn(id, b)
+	})
+}
+
+// readEvents parses a text/event-stream body, calling fn for each event
+// that carries data.
+func readEvents(r io.Reader, fn func(id, data string) error) error {
+	br := bufio.NewReader(r)
+	var id string
+	var data []string
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+		if line == "" {
+			if data != nil {
+				if err := fn(id, strings.Join(data, "\n")); err != nil {
+					return err
+				}
+			}
+			data = nil
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "id":
+			id = value
+		case "data":
+			data = append(data, value)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package rwclient
+
+import (
+	"context"
+	api "corti-kkv/internal/api"
+	"corti-kkv/internal/queue"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientConsumeStream(t *testing.T) {
+	m := queue.NewQueueManager()
+	ts := httptest.NewServer(api.NewServer(m).Handler())
+	defer ts.Close()
+
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.txt")
+	out := filepath.Join(dir, "out.txt")
+	content := "line1\r\nline2\n\nlast"
+	assert.NoError(t, os.WriteFile(in, []byte(content), 0o644))
+
+	c := New(ts.URL, "stream")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.ConsumeStream(ctx, out) }()
+
+	assert.NoError(t, c.Produce(context.Background(), in))
+	waitForFileContent(t, out, []byte(content), time.Second, 5*time.Millisecond)
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+func TestClientConsumeStreamReconnects(t *testing.T) {
+	var mu sync.Mutex
+	var lastIDs []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		lastIDs = append(lastIDs, r.Header.Get("Last-Event-ID"))
+		conn := len(lastIDs)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "text/event-stream")
+		if conn == 1 {
+			// first connection delivers one event then drops
+			fmt.Fprint(w, "id: s:1\ndata: YQ==\n\n")
+			return
+		}
+		fmt.Fprint(w, ": ping\n\nid: s:2\ndata: Yg==\n\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+
+	out := filepath.Join(t.TempDir(), "out.txt")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- New(ts.URL, "q").ConsumeStream(ctx, out) }()
+	waitForFileContent(t, out, []byte("ab"), 2*time.Second, 5*time.Millisecond)
+	cancel()
+	assert.NoError(t, <-done)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"", "s:1"}, lastIDs[:2])
+}
+
+func TestReadEvents(t *testing.T) {
+	body := "retry: 1000\n\n: comment\nid: x:1\ndata: a\ndata: b\n\nid: x:2\r\ndata:c\r\n\r\n"
+	var got []string
+	err := readEvents(strings.NewReader(body), func(id, data string) error {
+		got = append(got, id+"="+data)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"x:1=a\nb", "x:2=c"}, got)
+}
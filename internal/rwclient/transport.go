@@ -0,0 +1,104 @@
+package rwclient
+
+import (
+	"context"
+	"net/url"
+
+	"corti-kkv/internal/binproto"
+)
+
+// pipelineDepth is how many enqueues Produce keeps in flight when talking
+// the binary protocol.
+const pipelineDepth = 64
+
+// binaryTransport returns a binary protocol client if queueURL uses the
+// kkv:// (TCP) or kkv+unix:// (Unix socket) scheme, and nil for HTTP.
+func binaryTransport(queueURL string) *binproto.Client {
+	u, err := url.Parse(queueURL)
+	if err != nil {
+		return nil
+	}
+	switch u.Scheme {
+	case "kkv":
+		return binproto.NewClient("tcp", u.Host)
+	case "kkv+unix":
+		return binproto.NewClient("unix", u.Path)
+	}
+	return nil
+}
+
+// pipeline sends the lines of one Produce call. Over the binary protocol it
+// keeps up to pipelineDepth enqueues unconfirmed, relying on the server to
+// apply them in order; over HTTP each enqueue is confirmed before the next.
+type pipeline struct {
+	c     *Client
+	calls []*binproto.Call
+	lines [][]byte
+	// broken is set when the unconfirmed enqueues must be sent again.
+	broken bool
+	// cp, if not nil, is told about every confirmed line.
+	cp *checkpointer
+}
+
+// add sends line, which was cut from raw bytes of the input.
+func (p *pipeline) add(ctx context.Context, line []byte, raw int) error {
+	p.cp.read(raw)
+	if p.c.bin == nil {
+		if err := p.c.enqueue(ctx, line); err != nil {
+			return err
+		}
+		return p.cp.confirmed()
+	}
+	if p.broken {
+		// Confirm what is outstanding first so that lines keep their order.
+		if err := p.flush(ctx); err != nil {
+			return err
+		}
+	}
+	if len(p.calls) == pipelineDepth {
+		if err := p.confirm(ctx); err != nil {
+			return err
+		}
+	}
+	call, err := p.c.bin.StartEnqueue(ctx, p.c.QueueName, line)
+	p.calls = append(p.calls, call)
+	p.lines = append(p.lines, line)
+	p.broken = err != nil
+	return nil
+}
+
+// confirm waits for the oldest unconfirmed enqueue. If the connection
+// broke, it and every later enqueue are sent again as the retry policy
+// allows.
+func (p *pipeline) confirm(ctx context.Context) error {
+	err := p.c.retry(ctx, "enqueue", func() error {
+		if p.broken {
+			for i, line := range p.lines {
+				call, err := p.c.bin.StartEnqueue(ctx, p.c.QueueName, line)
+				if err != nil {
+					return err
+				}
+				p.calls[i] = call
+			}
+			p.broken = false
+		}
+		_, err := binproto.EnqueueResult(ctx, p.calls[0])
+		p.broken = err != nil
+		return err
+	})
+	if err != nil {
+		return p.c.countErr("enqueue", err)
+	}
+	p.calls, p.lines = p.calls[1:], p.lines[1:]
+	return p.cp.confirmed()
+}
+
+// flush waits until every enqueue sent so far is confirmed.
+func (p *pipeline) flush(ctx context.Context) error {
+	for len(p.calls) > 0 {
+		if err := p.confirm(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package rwclient
+
+import (
+	"context"
+	"corti-kkv/internal/binproto"
+	"corti-kkv/internal/queue"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBinaryTransportSelection(t *testing.T) {
+	tests := []struct {
+		url    string
+		binary bool
+	}{
+		{url: "http://localhost:8080", binary: false},
+		{url: "https://queue.example", binary: false},
+		{url: "kkv://localhost:7070", binary: true},
+		{url: "kkv+unix:///tmp/kkv.sock", binary: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.url, func(t *testing.T) {
+			assert.Equal(t, tc.binary, New(tc.url, "q").bin != nil)
+		})
+	}
+}
+
+func TestClientBinaryProduceConsume(t *testing.T) {
+	for _, scheme := range []string{"kkv", "kkv+unix"} {
+		t.Run(scheme, func(t *testing.T) {
+			m := queue.NewQueueManager()
+			s := binproto.NewServer(m)
+			dir := t.TempDir()
+			addr := "127.0.0.1:0"
+			if scheme == "kkv+unix" {
+				addr = "unix://" + filepath.Join(dir, "kkv.sock")
+			}
+			ln, err := binproto.Listen(addr)
+			if !assert.NoError(t, err) {
+				return
+			}
+			go s.Serve(ln)
+			defer s.Close()
+
+			// For Unix sockets the address is an absolute path, giving kkv+unix:///...
+			url := scheme + "://" + ln.Addr().String()
+			in := filepath.Join(dir, "in.txt")
+			out := filepath.Join(dir, "out.txt")
+			var b strings.Builder
+			for i := 0; i < 500; i++ {
+				fmt.Fprintf(&b, "line %d\n", i)
+			}
+			b.WriteString("last")
+			assert.NoError(t, os.WriteFile(in, []byte(b.String()), 0o644))
+
+			c := New(url, "bin")
+			assert.NoError(t, c.Produce(context.Background(), in))
+			n, err := c.QueueLength(context.Background())
+			assert.NoError(t, err)
+			assert.Equal(t, 501, n)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() { done <- c.Consume(ctx, out) }()
+			waitForFileContent(t, out, []byte(b.String()), 2*time.Second, 5*time.Millisecond)
+			cancel()
+			assert.NoError(t, <-done)
+		})
+	}
+}
+
+func TestClientBinaryConsumeKeepsUnwritten(t *testing.T) {
+	m := queue.NewQueueManager()
+	s := binproto.NewServer(m)
+	ln, err := binproto.Listen("127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	go s.Serve(ln)
+	defer s.Close()
+	url := "kkv://" + ln.Addr().String()
+	q := m.Get("bin")
+
+	// A consumer cancelled in the middle of a long poll hands back what the
+	// server reserves for it afterwards.
+	c := New(url, "bin")
+	c.PollWait = time.Second
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Consume(ctx, filepath.Join(t.TempDir(), "out.txt")) }()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	assert.NoError(t, <-done)
+	q.Enqueue([]byte("hello\n"))
+	assert.Eventually(t, func() bool { return q.Len() == 1 }, 2*time.Second, 5*time.Millisecond)
+	got, err := New(url, "bin").dequeue(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "hello\n", string(got))
+
+	// A failed write releases the batch instead of acknowledging it.
+	if _, err := os.Stat("/dev/full"); err != nil {
+		t.Skip("no /dev/full")
+	}
+	q.Enqueue([]byte("again\n"))
+	err = New(url, "bin").ConsumeWith(context.Background(), "/dev/full", ConsumeOptions{Exit: StopAfterN, N: 1})
+	assert.Error(t, err)
+	assert.Equal(t, 1, q.Len())
+}
@@ -0,0 +1,444 @@
+// Package schema checks message payloads before they are queued.
+//
+// A Validator combines any of four checks: valid UTF-8, a maximum line
+// length, a regular expression the payload must match, and a JSON Schema
+// subset. The subset covers the keywords type, enum, const, properties,
+// required, additionalProperties, items, minItems, maxItems, minLength,
+// maxLength, pattern, minimum and maximum; $schema, $id, title and
+// description are ignored and anything else is rejected when compiling, so
+// a schema never silently checks less than it says.
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Spec selects the checks of a Validator. Zero values leave a check off.
+type Spec struct {
+	UTF8          bool
+	MaxLineLength int
+	// Regex must match the payload; anchor it with ^ and $ to match all of
+	// it.
+	Regex string
+	// JSONSchema, if set, requires the payload to be a JSON document
+	// conforming to it.
+	JSONSchema []byte
+}
+
+// Validator checks payloads against a Spec. It is safe for concurrent use.
+type Validator struct {
+	utf8    bool
+	maxLine int
+	re      *regexp.Regexp
+	schema  *node
+}
+
+// New compiles spec.
+func New(spec Spec) (*Validator, error) {
+	if spec.MaxLineLength < 0 {
+		return nil, fmt.Errorf("max line length must not be negative")
+	}
+	v := &Validator{utf8: spec.UTF8, maxLine: spec.MaxLineLength}
+	if spec.Regex != "" {
+		re, err := regexp.Compile(spec.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex: %w", err)
+		}
+		v.re = re
+	}
+	if len(spec.JSONSchema) > 0 {
+		var raw any
+		if err := json.Unmarshal(spec.JSONSchema, &raw); err != nil {
+			return nil, fmt.Errorf("invalid JSON schema: %w", err)
+		}
+		n, err := compile(raw, "")
+		if err != nil {
+			return nil, fmt.Errorf("invalid JSON schema: %w", err)
+		}
+		v.schema = n
+	}
+	return v, nil
+}
+
+// Validate returns a descriptive error if body fails any check.
+func (v *Validator) Validate(body []byte) error {
+	if v.utf8 && !utf8.Valid(body) {
+		return fmt.Errorf("not valid UTF-8 at byte %d", invalidAt(body))
+	}
+	if v.maxLine > 0 {
+		for i, line := 1, body; len(line) > 0; i++ {
+			var rest []byte
+			if j := bytes.IndexByte(line, '\n'); j >= 0 {
+				line, rest = line[:j], line[j+1:]
+			}
+			if len(line) > v.maxLine {
+				return fmt.Errorf("line %d is %d bytes long, limit is %d", i, len(line), v.maxLine)
+			}
+			line = rest
+		}
+	}
+	if v.re != nil && !v.re.Match(body) {
+		return fmt.Errorf("does not match %s", v.re)
+	}
+	if v.schema != nil {
+		d := json.NewDecoder(bytes.NewReader(body))
+		d.UseNumber()
+		var doc any
+		if err := d.Decode(&doc); err != nil {
+			return fmt.Errorf("invalid JSON: %w", err)
+		}
+		if d.More() {
+			return fmt.Errorf("invalid JSON: data after the document")
+		}
+		if err := v.schema.check(doc, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func invalidAt(b []byte) int {
+	for i := 0; i < len(b); {
+		r, n := utf8.DecodeRune(b[i:])
+		if r == utf8.RuneError && n <= 1 {
+			return i
+		}
+		i += n
+	}
+	return len(b)
+}
+
+// node is a compiled schema. Nil fields are not checked.
+type node struct {
+	types      []string
+	enum       []any
+	properties map[string]*node
+	required   []string
+	// additional applies to properties not listed; noAdditional forbids
+	// them.
+	additional   *node
+	noAdditional bool
+	items        *node
+	minItems     *int
+	maxItems     *int
+	minLength    *int
+	maxLength    *int
+	pattern      *regexp.Regexp
+	minimum      *float64
+	maximum      *float64
+}
+
+var jsonTypes = map[string]bool{
+	"object": true, "array": true, "string": true, "number": true,
+	"integer": true, "boolean": true, "null": true,
+}
+
+func compile(raw any, at string) (*node, error) {
+	if b, ok := raw.(bool); ok {
+		// true accepts anything and false nothing.
+		if b {
+			return &node{}, nil
+		}
+		return &node{enum: []any{}}, nil
+	}
+	obj, ok := raw.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%s: schema must be an object", pointer(at))
+	}
+	n := &node{}
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := obj[k]
+		var err error
+		switch k {
+		case "$schema", "$id", "title", "description":
+		case "type":
+			n.types, err = compileTypes(v)
+		case "enum":
+			vals, ok := v.([]any)
+			if !ok {
+				err = fmt.Errorf("must be an array")
+			}
+			n.enum = append([]any{}, vals...)
+		case "const":
+			n.enum = []any{v}
+		case "properties":
+			props, ok := v.(map[string]any)
+			if !ok {
+				err = fmt.Errorf("must be an object")
+				break
+			}
+			n.properties = make(map[string]*node, len(props))
+			for name, p := range props {
+				if n.properties[name], err = compile(p, at+"/properties/"+escape(name)); err != nil {
+					return nil, err
+				}
+			}
+		case "required":
+			names, ok := v.([]any)
+			for _, name := range names {
+				s, isStr := name.(string)
+				ok = ok && isStr
+				n.required = append(n.required, s)
+			}
+			if !ok {
+				err = fmt.Errorf("must be an array of strings")
+			}
+		case "additionalProperties":
+			if b, isBool := v.(bool); isBool {
+				n.noAdditional = !b
+			} else if n.additional, err = compile(v, at+"/additionalProperties"); err != nil {
+				return nil, err
+			}
+		case "items":
+			if n.items, err = compile(v, at+"/items"); err != nil {
+				return nil, err
+			}
+		case "minItems":
+			n.minItems, err = count(v)
+		case "maxItems":
+			n.maxItems, err = count(v)
+		case "minLength":
+			n.minLength, err = count(v)
+		case "maxLength":
+			n.maxLength, err = count(v)
+		case "pattern":
+			s, isStr := v.(string)
+			if !isStr {
+				err = fmt.Errorf("must be a string")
+				break
+			}
+			n.pattern, err = regexp.Compile(s)
+		case "minimum":
+			n.minimum, err = number(v)
+		case "maximum":
+			n.maximum, err = number(v)
+		default:
+			err = fmt.Errorf("unsupported keyword")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", pointer(at+"/"+k), err)
+		}
+	}
+	return n, nil
+}
+
+func compileTypes(v any) ([]string, error) {
+	var names []any
+	switch v := v.(type) {
+	case string:
+		names = []any{v}
+	case []any:
+		names = v
+	default:
+		return nil, fmt.Errorf("must be a string or an array of strings")
+	}
+	types := make([]string, 0, len(names))
+	for _, name := range names {
+		s, _ := name.(string)
+		if !jsonTypes[s] {
+			return nil, fmt.Errorf("unknown type %v", name)
+		}
+		types = append(types, s)
+	}
+	return types, nil
+}
+
+func count(v any) (*int, error) {
+	f, ok := v.(float64)
+	if !ok || f < 0 || f != math.Trunc(f) {
+		return nil, fmt.Errorf("must be a non-negative integer")
+	}
+	n := int(f)
+	return &n, nil
+}
+
+func number(v any) (*float64, error) {
+	f, ok := v.(float64)
+	if !ok {
+		return nil, fmt.Errorf("must be a number")
+	}
+	return &f, nil
+}
+
+// check validates the decoded document v, found at JSON pointer at.
+func (n *node) check(v any, at string) error {
+	if len(n.types) > 0 && !n.hasType(v) {
+		return fmt.Errorf("%s: expected %s, got %s", pointer(at), strings.Join(n.types, " or "), typeOf(v))
+	}
+	if n.enum != nil && !n.inEnum(v) {
+		if len(n.enum) == 0 {
+			return fmt.Errorf("%s: no value is allowed", pointer(at))
+		}
+		return fmt.Errorf("%s: %s is not one of the allowed values", pointer(at), encode(v))
+	}
+	switch v := v.(type) {
+	case map[string]any:
+		for _, name := range n.required {
+			if _, ok := v[name]; !ok {
+				return fmt.Errorf("%s: missing required property %q", pointer(at), name)
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			p, listed := n.properties[name]
+			switch {
+			case listed:
+			case n.noAdditional:
+				return fmt.Errorf("%s: property %q is not allowed", pointer(at), name)
+			case n.additional != nil:
+				p = n.additional
+			default:
+				continue
+			}
+			if err := p.check(v[name], at+"/"+escape(name)); err != nil {
+				return err
+			}
+		}
+	case []any:
+		if n.minItems != nil && len(v) < *n.minItems {
+			return fmt.Errorf("%s: has %d items, minimum is %d", pointer(at), len(v), *n.minItems)
+		}
+		if n.maxItems != nil && len(v) > *n.maxItems {
+			return fmt.Errorf("%s: has %d items, maximum is %d", pointer(at), len(v), *n.maxItems)
+		}
+		if n.items != nil {
+			for i, item := range v {
+				if err := n.items.check(item, at+"/"+strconv.Itoa(i)); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		l := utf8.RuneCountInString(v)
+		if n.minLength != nil && l < *n.minLength {
+			return fmt.Errorf("%s: is %d characters long, minimum is %d", pointer(at), l, *n.minLength)
+		}
+		if n.maxLength != nil && l > *n.maxLength {
+			return fmt.Errorf("%s: is %d characters long, maximum is %d", pointer(at), l, *n.maxLength)
+		}
+		if n.pattern != nil && !n.pattern.MatchString(v) {
+			return fmt.Errorf("%s: does not match %s", pointer(at), n.pattern)
+		}
+	case json.Number:
+		f, _ := v.Float64()
+		if n.minimum != nil && f < *n.minimum {
+			return fmt.Errorf("%s: %s is less than the minimum %v", pointer(at), v, *n.minimum)
+		}
+		if n.maximum != nil && f > *n.maximum {
+			return fmt.Errorf("%s: %s is greater than the maximum %v", pointer(at), v, *n.maximum)
+		}
+	}
+	return nil
+}
+
+func (n *node) hasType(v any) bool {
+	t := typeOf(v)
+	for _, want := range n.types {
+		if want == t || (want == "number" && t == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *node) inEnum(v any) bool {
+	for _, e := range n.enum {
+		if equal(v, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// equal compares a document value, with json.Number numbers, to a schema
+// value, with float64 ones.
+func equal(v, schema any) bool {
+	switch v := v.(type) {
+	case json.Number:
+		f, err := v.Float64()
+		s, ok := schema.(float64)
+		return err == nil && ok && f == s
+	case map[string]any:
+		s, ok := schema.(map[string]any)
+		if !ok || len(s) != len(v) {
+			return false
+		}
+		for k, x := range v {
+			if y, ok := s[k]; !ok || !equal(x, y) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		s, ok := schema.([]any)
+		if !ok || len(s) != len(v) {
+			return false
+		}
+		for i := range v {
+			if !equal(v[i], s[i]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return v == schema
+	}
+}
+
+func typeOf(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	case json.Number:
+		if f, err := v.Float64(); err == nil && f == math.Trunc(f) && !math.IsInf(f, 0) {
+			return "integer"
+		}
+		return "number"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func encode(v any) string {
+	b, _ := json.Marshal(v)
+	if len(b) > 40 {
+		return string(b[:37]) + "..."
+	}
+	return string(b)
+}
+
+// pointer formats a JSON pointer for messages, naming the root.
+func pointer(at string) string {
+	if at == "" {
+		return "document"
+	}
+	return at
+}
+
+func escape(name string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(name)
+}
@@ -0,0 +1,98 @@
+package schema
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const order = `{
+	"type": "object",
+	"required": ["id", "lines"],
+	"additionalProperties": false,
+	"properties": {
+		"id": {"type": "integer", "minimum": 1},
+		"status": {"enum": ["new", "paid"]},
+		"note": {"type": ["string", "null"], "maxLength": 5},
+		"lines": {
+			"type": "array",
+			"minItems": 1,
+			"items": {
+				"type": "object",
+				"additionalProperties": {"type": "number"},
+				"properties": {"sku": {"type": "string", "pattern": "^[A-Z]{3}-[0-9]+$"}}
+			}
+		}
+	}
+}`
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		spec   Spec
+		body   string
+		errMsg string
+	}{
+		{"NoChecks", Spec{}, "\xff", ""},
+		{"UTF8", Spec{UTF8: true}, "héllo", ""},
+		{"UTF8_Invalid", Spec{UTF8: true}, "ab\xffc", "not valid UTF-8 at byte 2"},
+		{"MaxLine", Spec{MaxLineLength: 3}, "abc\nde\n", ""},
+		{"MaxLine_TooLong", Spec{MaxLineLength: 3}, "abc\nabcd", "line 2 is 4 bytes long, limit is 3"},
+		{"Regex", Spec{Regex: `^\d+,\w+$`}, "12,ab", ""},
+		{"Regex_NoMatch", Spec{Regex: `^\d+,\w+$`}, "12;ab", `does not match ^\d+,\w+$`},
+		{"JSON", Spec{JSONSchema: []byte(order)}, `{"id": 7, "status": "paid", "note": null, "lines": [{"sku": "ABC-1", "qty": 2.5}]}`, ""},
+		{"JSON_Syntax", Spec{JSONSchema: []byte(order)}, `{"id": `, "invalid JSON"},
+		{"JSON_Trailing", Spec{JSONSchema: []byte(order)}, `{"id": 1, "lines": [{}]} {}`, "data after the document"},
+		{"JSON_RootType", Spec{JSONSchema: []byte(order)}, `[]`, "document: expected object, got array"},
+		{"JSON_Required", Spec{JSONSchema: []byte(order)}, `{"id": 1}`, `document: missing required property "lines"`},
+		{"JSON_Integer", Spec{JSONSchema: []byte(order)}, `{"id": 1.5, "lines": [{}]}`, "/id: expected integer, got number"},
+		{"JSON_Minimum", Spec{JSONSchema: []byte(order)}, `{"id": 0, "lines": [{}]}`, "/id: 0 is less than the minimum 1"},
+		{"JSON_Enum", Spec{JSONSchema: []byte(order)}, `{"id": 1, "status": "lost", "lines": [{}]}`, `/status: "lost" is not one of the allowed values`},
+		{"JSON_MaxLength", Spec{JSONSchema: []byte(order)}, `{"id": 1, "note": "ééééééé", "lines": [{}]}`, "/note: is 7 characters long, maximum is 5"},
+		{"JSON_Additional", Spec{JSONSchema: []byte(order)}, `{"id": 1, "extra": 1, "lines": [{}]}`, `document: property "extra" is not allowed`},
+		{"JSON_MinItems", Spec{JSONSchema: []byte(order)}, `{"id": 1, "lines": []}`, "/lines: has 0 items, minimum is 1"},
+		{"JSON_ItemPattern", Spec{JSONSchema: []byte(order)}, `{"id": 1, "lines": [{"sku": "ABC-1"}, {"sku": "abc"}]}`, "/lines/1/sku: does not match"},
+		{"JSON_AdditionalSchema", Spec{JSONSchema: []byte(order)}, `{"id": 1, "lines": [{"qty": "2"}]}`, "/lines/0/qty: expected number, got string"},
+		{"JSON_Const", Spec{JSONSchema: []byte(`{"const": {"v": [1, true]}}`)}, `{"v": [1.0, true]}`, ""},
+		{"JSON_False", Spec{JSONSchema: []byte(`{"properties": {"a": false}}`)}, `{"a": 1}`, "/a: no value is allowed"},
+		{"Combined", Spec{UTF8: true, Regex: "^{", JSONSchema: []byte(`{"type": "object"}`)}, `{}`, ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			v, err := New(tc.spec)
+			if !assert.NoError(t, err) {
+				return
+			}
+			err = v.Validate([]byte(tc.body))
+			if tc.errMsg == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tc.errMsg)
+			}
+		})
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		spec   Spec
+		errMsg string
+	}{
+		{"MaxLine", Spec{MaxLineLength: -1}, "must not be negative"},
+		{"Regex", Spec{Regex: "("}, "invalid regex"},
+		{"JSON", Spec{JSONSchema: []byte("{")}, "invalid JSON schema"},
+		{"NotObject", Spec{JSONSchema: []byte(`[]`)}, "document: schema must be an object"},
+		{"Unsupported", Spec{JSONSchema: []byte(`{"properties": {"a": {"oneOf": []}}}`)}, "/properties/a/oneOf: unsupported keyword"},
+		{"Type", Spec{JSONSchema: []byte(`{"type": "float"}`)}, "/type: unknown type float"},
+		{"Count", Spec{JSONSchema: []byte(`{"maxLength": 1.5}`)}, "/maxLength: must be a non-negative integer"},
+		{"Required", Spec{JSONSchema: []byte(`{"required": [1]}`)}, "/required: must be an array of strings"},
+		{"Pattern", Spec{JSONSchema: []byte(`{"pattern": "("}`)}, "/pattern: error parsing regexp"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := New(tc.spec)
+			assert.ErrorContains(t, err, tc.errMsg)
+		})
+	}
+}
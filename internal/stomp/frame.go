@@ -0,0 +1,200 @@
+package stomp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// MaxBodySize bounds the body of a single frame.
+const MaxBodySize = 16 << 20
+
+// maxHeaders bounds the number of header lines in a single frame, and
+// maxLineLen the command and each header line.
+const (
+	maxHeaders = 128
+	maxLineLen = 64 << 10
+)
+
+// Frame is a STOMP frame. Headers keep their wire order; when a header is
+// repeated the first occurrence wins, as the specification requires.
+type Frame struct {
+	Command string
+	Headers [][2]string
+	Body    []byte
+}
+
+// Get returns the first value of header key.
+func (f Frame) Get(key string) string {
+	for _, h := range f.Headers {
+		if h[0] == key {
+			return h[1]
+		}
+	}
+	return ""
+}
+
+// Set appends a header.
+func (f *Frame) Set(key, value string) {
+	f.Headers = append(f.Headers, [2]string{key, value})
+}
+
+var errHeartbeat = errors.New("heartbeat")
+
+// readFrame reads the next frame. A bare end-of-line between frames is a
+// heartbeat and is reported as errHeartbeat.
+func readFrame(br *bufio.Reader) (Frame, error) {
+	var f Frame
+	line, err := readLine(br)
+	if err != nil {
+		return f, err
+	}
+	if line == "" {
+		return f, errHeartbeat
+	}
+	f.Command = line
+	for {
+		line, err := readLine(br)
+		if err != nil {
+			return f, err
+		}
+		if line == "" {
+			break
+		}
+		if len(f.Headers) == maxHeaders {
+			return f, errors.New("too many headers")
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return f, fmt.Errorf("malformed header %q", line)
+		}
+		// CONNECT frames are not escaped, for compatibility with STOMP 1.0.
+		if f.Command != "CONNECT" {
+			if key, err = unescape(key); err != nil {
+				return f, err
+			}
+			if value, err = unescape(value); err != nil {
+				return f, err
+			}
+		}
+		f.Headers = append(f.Headers, [2]string{key, value})
+	}
+	if v := f.Get("content-length"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > MaxBodySize {
+			return f, fmt.Errorf("invalid content-length %q", v)
+		}
+		f.Body = make([]byte, n)
+		if _, err := io.ReadFull(br, f.Body); err != nil {
+			return f, err
+		}
+		b, err := br.ReadByte()
+		if err != nil {
+			return f, err
+		}
+		if b != 0 {
+			return f, errors.New("frame not terminated by NUL")
+		}
+		return f, nil
+	}
+	body, err := readUntil(br, 0, MaxBodySize+1)
+	if errors.Is(err, errTooLong) {
+		return f, errors.New("body too large")
+	}
+	if err != nil {
+		return f, err
+	}
+	f.Body = body[:len(body)-1]
+	return f, nil
+}
+
+func readLine(br *bufio.Reader) (string, error) {
+	line, err := readUntil(br, '\n', maxLineLen)
+	if errors.Is(err, errTooLong) {
+		return "", errors.New("header line too long")
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(bytes.TrimSuffix(line[:len(line)-1], []byte("\r"))), nil
+}
+
+var errTooLong = errors.New("too long")
+
+// readUntil is br.ReadBytes(delim), but fails with errTooLong as soon as
+// limit bytes have been read without delim being among them.
+func readUntil(br *bufio.Reader, delim byte, limit int) ([]byte, error) {
+	var out []byte
+	for {
+		chunk, err := br.ReadSlice(delim)
+		n := len(out) + len(chunk)
+		if n > limit || n == limit && chunk[len(chunk)-1] != delim {
+			return nil, errTooLong
+		}
+		out = append(out, chunk...)
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return out, err
+		}
+	}
+}
+
+// writeFrame encodes f, always with a content-length so bodies may contain
+// NUL bytes.
+func writeFrame(w io.Writer, f Frame) error {
+	var b bytes.Buffer
+	b.WriteString(f.Command)
+	b.WriteByte('\n')
+	for _, h := range f.Headers {
+		if h[0] == "content-length" {
+			continue
+		}
+		b.WriteString(escape(h[0]))
+		b.WriteByte(':')
+		b.WriteString(escape(h[1]))
+		b.WriteByte('\n')
+	}
+	fmt.Fprintf(&b, "content-length:%d\n", len(f.Body))
+	b.WriteByte('\n')
+	b.Write(f.Body)
+	b.WriteByte(0)
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+var escaper = strings.NewReplacer("\\", "\\\\", "\r", "\\r", "\n", "\\n", ":", "\\c")
+
+func escape(s string) string { return escaper.Replace(s) }
+
+func unescape(s string) (string, error) {
+	if !strings.Contains(s, "\\") {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		if i == len(s) {
+			return "", errors.New("invalid escape at end of header")
+		}
+		switch s[i] {
+		case 'r':
+			b.WriteByte('\r')
+		case 'n':
+			b.WriteByte('\n')
+		case 'c':
+			b.WriteByte(':')
+		case '\\':
+			b.WriteByte('\\')
+		default:
+			return "", fmt.Errorf("invalid escape \\%c", s[i])
+		}
+	}
+	return b.String(), nil
+}
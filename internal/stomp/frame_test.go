@@ -0,0 +1,62 @@
+package stomp
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	f := Frame{Command: "MESSAGE", Body: []byte("line\x00with nul\n")}
+	f.Set("destination", "/queue/lines")
+	f.Set("odd:key", "multi\nline\\value")
+
+	var buf bytes.Buffer
+	assert.NoError(t, writeFrame(&buf, f))
+	got, err := readFrame(bufio.NewReader(&buf))
+	assert.NoError(t, err)
+	assert.Equal(t, "MESSAGE", got.Command)
+	assert.Equal(t, "/queue/lines", got.Get("destination"))
+	assert.Equal(t, "multi\nline\\value", got.Get("odd:key"))
+	assert.Equal(t, f.Body, got.Body)
+}
+
+func TestReadFrame(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		command string
+		body    string
+		header  [2]string
+		wantErr string
+	}{
+		{name: "NulTerminatedBody", raw: "SEND\ndestination:/queue/a\n\nhello\x00", command: "SEND", body: "hello", header: [2]string{"destination", "/queue/a"}},
+		{name: "CRLFLines", raw: "SEND\r\ndestination:/queue/a\r\n\r\nhi\x00", command: "SEND", body: "hi", header: [2]string{"destination", "/queue/a"}},
+		{name: "RepeatedHeader_FirstWins", raw: "SEND\nfoo:1\nfoo:2\n\n\x00", command: "SEND", header: [2]string{"foo", "1"}},
+		{name: "ConnectHeadersNotUnescaped", raw: "CONNECT\nlogin:a\\cb\n\n\x00", command: "CONNECT", header: [2]string{"login", "a\\cb"}},
+		{name: "Heartbeat", raw: "\n", wantErr: "heartbeat"},
+		{name: "BadEscape", raw: "SEND\nfoo:\\t\n\n\x00", wantErr: "invalid escape"},
+		{name: "MalformedHeader", raw: "SEND\nnocolon\n\n\x00", wantErr: "malformed header"},
+		{name: "MissingNulAfterContentLength", raw: "SEND\ncontent-length:2\n\nhiX", wantErr: "not terminated"},
+		{name: "BodyTooLarge", raw: "SEND\n\n" + strings.Repeat("x", MaxBodySize+1), wantErr: "body too large"},
+		{name: "BodyAtLimit", raw: "SEND\n\n" + strings.Repeat("x", MaxBodySize) + "\x00", command: "SEND", body: strings.Repeat("x", MaxBodySize)},
+		{name: "HeaderLineTooLong", raw: "SEND\nfoo:" + strings.Repeat("x", maxLineLen), wantErr: "header line too long"},
+		{name: "CommandTooLong", raw: strings.Repeat("X", maxLineLen+1), wantErr: "header line too long"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := readFrame(bufio.NewReader(strings.NewReader(tc.raw)))
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.command, f.Command)
+			assert.Equal(t, tc.body, string(f.Body))
+			assert.Equal(t, tc.header[1], f.Get(tc.header[0]))
+		})
+	}
+}
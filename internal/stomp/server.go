@@ -0,0 +1,473 @@
+// Package stomp serves STOMP 1.2 on top of the queue manager. Destinations
+// of the form /queue/{name} map onto queues; SEND enqueues and SUBSCRIBE
+// delivers messages with auto, client or client-individual acknowledgement.
+// Transactions are not supported.
+package stomp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"corti-kkv/internal/queue"
+)
+
+// DefaultPrefetch is how many unacknowledged messages a subscription using
+// client acks may hold unless the client sets a prefetch-count header.
+const DefaultPrefetch = 10
+
+const destinationPrefix = "/queue/"
+
+type Server struct {
+	Manager *queue.QueueManager
+
+	mu     sync.Mutex
+	lns    map[net.Listener]struct{}
+	conns  map[net.Conn]struct{}
+	done   chan struct{}
+	closed bool
+}
+
+func NewServer(m *queue.QueueManager) *Server {
+	return &Server{
+		Manager: m,
+		lns:     make(map[net.Listener]struct{}),
+		conns:   make(map[net.Conn]struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// ErrServerClosed is returned by Serve after Close.
+var ErrServerClosed = errors.New("stomp: server closed")
+
+// ListenAndServe listens on addr and serves until Close is called.
+func (s *Server) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	slog.Info("stomp listener started", "addr", ln.Addr().String())
+	return s.Serve(ln)
+}
+
+// Serve accepts connections on ln until Close is called.
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ln.Close()
+		return ErrServerClosed
+	}
+	s.lns[ln] = struct{}{}
+	s.mu.Unlock()
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-s.done:
+				return ErrServerClosed
+			default:
+				return err
+			}
+		}
+		s.mu.Lock()
+		s.conns[nc] = struct{}{}
+		s.mu.Unlock()
+		go s.serveConn(nc)
+	}
+}
+
+// Close stops all listeners and drops open connections.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	for ln := range s.lns {
+		ln.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	return nil
+}
+
+// conn is the state of one client connection.
+type conn struct {
+	s   *Server
+	nc  net.Conn
+	ctx context.Context
+	wg  sync.WaitGroup
+
+	wmu sync.Mutex
+	bw  *bufio.Writer
+
+	mu   sync.Mutex
+	subs map[string]*subscription
+}
+
+// subscription delivers one destination to the client. pending lists the
+// IDs of delivered messages that still await an ACK or NACK, oldest first.
+type subscription struct {
+	id      string
+	queue   string
+	ack     string
+	cancel  context.CancelFunc
+	credits chan struct{}
+	pending []uint64
+	closed  bool
+}
+
+func (s *Server) serveConn(nc net.Conn) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &conn{
+		s:    s,
+		nc:   nc,
+		ctx:  ctx,
+		bw:   bufio.NewWriter(nc),
+		subs: make(map[string]*subscription),
+	}
+	defer func() {
+		cancel()
+		nc.Close()
+		c.wg.Wait()
+		c.releaseAll()
+		s.mu.Lock()
+		delete(s.conns, nc)
+		s.mu.Unlock()
+	}()
+
+	br := bufio.NewReader(nc)
+	connected := false
+	for {
+		f, err := readFrame(br)
+		if errors.Is(err, errHeartbeat) {
+			continue
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				c.sendError(Frame{}, "malformed frame", err.Error())
+			}
+			return
+		}
+		if !connected {
+			if f.Command != "CONNECT" && f.Command != "STOMP" {
+				c.sendError(f, "not connected", "the first frame must be CONNECT or STOMP")
+				return
+			}
+			if !c.connect(f) {
+				return
+			}
+			connected = true
+			continue
+		}
+		if err := c.handle(f); err != nil {
+			c.sendError(f, err.Error(), "")
+			return
+		}
+		if f.Command == "DISCONNECT" {
+			return
+		}
+	}
+}
+
+func (c *conn) connect(f Frame) bool {
+	if v := f.Get("accept-version"); v != "" && !containsVersion(v, "1.2") {
+		c.sendError(f, "unsupported protocol version", "supported versions are 1.2")
+		return false
+	}
+	resp := Frame{Command: "CONNECTED"}
+	resp.Set("version", "1.2")
+	resp.Set("server", "kkv-queue")
+	resp.Set("heart-beat", "0,0")
+	return c.write(resp) == nil
+}
+
+// handle processes one frame after CONNECT. A returned error is reported in
+// an ERROR frame and closes the connection, as STOMP requires.
+func (c *conn) handle(f Frame) error {
+	switch f.Command {
+	case "SEND":
+		name, err := queueName(f.Get("destination"))
+		if err != nil {
+			return err
+		}
+		if len(f.Body) == 0 {
+			return errors.New("empty body")
+		}
+		if _, err := c.s.Manager.Get(name).Push(queue.Message{Body: f.Body}, false); err != nil {
+			return err
+		}
+	case "SUBSCRIBE":
+		if err := c.subscribe(f); err != nil {
+			return err
+		}
+	case "UNSUBSCRIBE":
+		if err := c.unsubscribe(f.Get("id")); err != nil {
+			return err
+		}
+	case "ACK", "NACK":
+		if err := c.settle(f.Get("id"), f.Command == "ACK"); err != nil {
+			return err
+		}
+	case "DISCONNECT":
+	case "BEGIN", "COMMIT", "ABORT":
+		return errors.New("transactions are not supported")
+	default:
+		return fmt.Errorf("unknown command %q", f.Command)
+	}
+	if receipt := f.Get("receipt"); receipt != "" {
+		r := Frame{Command: "RECEIPT"}
+		r.Set("receipt-id", receipt)
+		return c.write(r)
+	}
+	return nil
+}
+
+func (c *conn) subscribe(f Frame) error {
+	id := f.Get("id")
+	if id == "" {
+		return errors.New("missing subscription id")
+	}
+	name, err := queueName(f.Get("destination"))
+	if err != nil {
+		return err
+	}
+	mode := f.Get("ack")
+	switch mode {
+	case "":
+		mode = "auto"
+	case "auto", "client", "client-individual":
+	default:
+		return fmt.Errorf("invalid ack mode %q", mode)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.subs[id]; ok {
+		return fmt.Errorf("duplicate subscription id %q", id)
+	}
+	ctx, cancel := context.WithCancel(c.ctx)
+	sub := &subscription{id: id, queue: name, ack: mode, cancel: cancel}
+	if mode != "auto" {
+		prefetch := DefaultPrefetch
+		if v := f.Get("prefetch-count"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				cancel()
+				return fmt.Errorf("invalid prefetch-count %q", v)
+			}
+			prefetch = n
+		}
+		sub.credits = make(chan struct{}, prefetch)
+	}
+	c.subs[id] = sub
+	c.wg.Add(1)
+	go c.deliver(ctx, sub)
+	return nil
+}
+
+// unsubscribe stops a subscription and hands its unacknowledged messages
+// back to the queue.
+func (c *conn) unsubscribe(id string) error {
+	c.mu.Lock()
+	sub := c.subs[id]
+	if sub == nil {
+		c.mu.Unlock()
+		return fmt.Errorf("no subscription %q", id)
+	}
+	delete(c.subs, id)
+	sub.closed = true
+	pending := sub.pending
+	sub.pending = nil
+	c.mu.Unlock()
+
+	sub.cancel()
+	q := c.s.Manager.Get(sub.queue)
+	for _, m := range pending {
+		q.Release(m)
+	}
+	return nil
+}
+
+// deliver sends MESSAGE frames for sub until it is cancelled. With client
+// acks a credit is taken per message and returned on ACK or NACK.
+func (c *conn) deliver(ctx context.Context, sub *subscription) {
+	defer c.wg.Done()
+	q := c.s.Manager.Get(sub.queue)
+	for {
+		if sub.credits != nil {
+			select {
+			case sub.credits <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+		}
+		var msg queue.Message
+		for {
+			ready := q.Ready()
+			var msgs []queue.Message
+			if sub.credits != nil {
+				msgs = q.Reserve(1)
+			} else {
+				msgs = q.TakeN(1)
+			}
+			if len(msgs) > 0 {
+				msg = msgs[0]
+				break
+			}
+			select {
+			case <-ready:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if sub.credits != nil {
+			c.mu.Lock()
+			if sub.closed {
+				c.mu.Unlock()
+				q.Release(msg.ID)
+				return
+			}
+			sub.pending = append(sub.pending, msg.ID)
+			c.mu.Unlock()
+		}
+		f := Frame{Command: "MESSAGE", Body: msg.Body}
+		f.Set("subscription", sub.id)
+		f.Set("message-id", strconv.FormatUint(msg.ID, 10))
+		f.Set("destination", destinationPrefix+sub.queue)
+		f.Set("content-type", "application/octet-stream")
+		if sub.credits != nil {
+			f.Set("ack", ackID(sub.id, msg.ID))
+		}
+		if err := c.write(f); err != nil {
+			return
+		}
+	}
+}
+
+// settle handles ACK and NACK. For client-individual subscriptions only the
+// named message is settled; for client subscriptions every pending message
+// up to and including it is.
+func (c *conn) settle(id string, ack bool) error {
+	subID, msgID, err := parseAckID(id)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	sub := c.subs[subID]
+	if sub == nil {
+		c.mu.Unlock()
+		return fmt.Errorf("no subscription %q", subID)
+	}
+	i := indexOf(sub.pending, msgID)
+	if i < 0 {
+		c.mu.Unlock()
+		return fmt.Errorf("message %d is not pending", msgID)
+	}
+	var settled []uint64
+	if sub.ack == "client" {
+		settled = append(settled, sub.pending[:i+1]...)
+		sub.pending = append(sub.pending[:0], sub.pending[i+1:]...)
+	} else {
+		settled = []uint64{msgID}
+		sub.pending = append(sub.pending[:i], sub.pending[i+1:]...)
+	}
+	c.mu.Unlock()
+
+	q := c.s.Manager.Get(sub.queue)
+	for _, m := range settled {
+		if ack {
+			q.Ack(m)
+		} else {
+			q.Release(m)
+		}
+		select {
+		case <-sub.credits:
+		default:
+		}
+	}
+	return nil
+}
+
+// releaseAll hands every unacknowledged message back to its queue.
+func (c *conn) releaseAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, sub := range c.subs {
+		q := c.s.Manager.Get(sub.queue)
+		for _, id := range sub.pending {
+			q.Release(id)
+		}
+		sub.pending = nil
+	}
+}
+
+func (c *conn) write(f Frame) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if err := writeFrame(c.bw, f); err != nil {
+		return err
+	}
+	return c.bw.Flush()
+}
+
+func (c *conn) sendError(cause Frame, msg, detail string) {
+	f := Frame{Command: "ERROR", Body: []byte(detail)}
+	f.Set("message", msg)
+	if receipt := cause.Get("receipt"); receipt != "" {
+		f.Set("receipt-id", receipt)
+	}
+	_ = c.write(f)
+}
+
+func queueName(dest string) (string, error) {
+	name, ok := strings.CutPrefix(dest, destinationPrefix)
+	if !ok || name == "" || strings.Contains(name, "/") {
+		return "", fmt.Errorf("invalid destination %q, want %s{name}", dest, destinationPrefix)
+	}
+	return name, nil
+}
+
+func ackID(subID string, msgID uint64) string {
+	return subID + ":" + strconv.FormatUint(msgID, 10)
+}
+
+func parseAckID(id string) (string, uint64, error) {
+	i := strings.LastIndexByte(id, ':')
+	if i < 0 {
+		return "", 0, fmt.Errorf("invalid ack id %q", id)
+	}
+	msgID, err := strconv.ParseUint(id[i+1:], 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid ack id %q", id)
+	}
+	return id[:i], msgID, nil
+}
+
+func indexOf(ids []uint64, id uint64) int {
+	for i, v := range ids {
+		if v == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func containsVersion(list, version string) bool {
+	for _, v := range strings.Split(list, ",") {
+		if strings.TrimSpace(v) == version {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,220 @@
+package stomp
+
+import (
+	"bufio"
+	"corti-kkv/internal/queue"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// client is a minimal in-process STOMP client for exercising the server.
+type client struct {
+	t  *testing.T
+	nc net.Conn
+	br *bufio.Reader
+}
+
+func startServer(t *testing.T) (*Server, string) {
+	t.Helper()
+	s := NewServer(queue.NewQueueManager())
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	go s.Serve(ln)
+	t.Cleanup(func() { s.Close() })
+	return s, ln.Addr().String()
+}
+
+func connect(t *testing.T, addr string) *client {
+	t.Helper()
+	nc, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { nc.Close() })
+	_ = nc.SetDeadline(time.Now().Add(5 * time.Second))
+	c := &client{t: t, nc: nc, br: bufio.NewReader(nc)}
+	f := c.call("CONNECT", "", "accept-version", "1.0,1.2", "host", "localhost")
+	assert.Equal(t, "CONNECTED", f.Command)
+	assert.Equal(t, "1.2", f.Get("version"))
+	return c
+}
+
+func (c *client) send(command, body string, headers ...string) {
+	f := Frame{Command: command, Body: []byte(body)}
+	for i := 0; i+1 < len(headers); i += 2 {
+		f.Set(headers[i], headers[i+1])
+	}
+	assert.NoError(c.t, writeFrame(c.nc, f))
+}
+
+func (c *client) recv() Frame {
+	for {
+		f, err := readFrame(c.br)
+		if errors.Is(err, errHeartbeat) {
+			continue
+		}
+		assert.NoError(c.t, err)
+		return f
+	}
+}
+
+// recvBoth reads a RECEIPT and a MESSAGE, which may arrive in either order.
+func (c *client) recvBoth() map[string]Frame {
+	got := make(map[string]Frame)
+	for i := 0; i < 2; i++ {
+		f := c.recv()
+		got[f.Command] = f
+	}
+	return got
+}
+
+func (c *client) call(command, body string, headers ...string) Frame {
+	c.send(command, body, headers...)
+	return c.recv()
+}
+
+func TestSendWithReceipt(t *testing.T) {
+	s, addr := startServer(t)
+	c := connect(t, addr)
+
+	f := c.call("SEND", "hello\n", "destination", "/queue/lines", "receipt", "r1")
+	assert.Equal(t, "RECEIPT", f.Command)
+	assert.Equal(t, "r1", f.Get("receipt-id"))
+	assert.Equal(t, []byte("hello\n"), s.Manager.Get("lines").Dequeue())
+}
+
+func TestSubscribeAuto(t *testing.T) {
+	s, addr := startServer(t)
+	c := connect(t, addr)
+	s.Manager.Get("auto").Enqueue([]byte("a"))
+	s.Manager.Get("auto").Enqueue([]byte("b"))
+
+	c.send("SUBSCRIBE", "", "id", "0", "destination", "/queue/auto")
+	for _, want := range []string{"a", "b"} {
+		f := c.recv()
+		assert.Equal(t, "MESSAGE", f.Command)
+		assert.Equal(t, "0", f.Get("subscription"))
+		assert.Equal(t, "/queue/auto", f.Get("destination"))
+		assert.Equal(t, "", f.Get("ack"))
+		assert.Equal(t, want, string(f.Body))
+	}
+	assert.Equal(t, 0, s.Manager.Get("auto").Inflight())
+}
+
+func TestClientIndividualAck(t *testing.T) {
+	s, addr := startServer(t)
+	c := connect(t, addr)
+	q := s.Manager.Get("ci")
+	for _, v := range []string{"a", "b", "c"} {
+		q.Enqueue([]byte(v))
+	}
+
+	c.send("SUBSCRIBE", "", "id", "s1", "destination", "/queue/ci", "ack", "client-individual", "prefetch-count", "2")
+	a, b := c.recv(), c.recv()
+	assert.Equal(t, "a", string(a.Body))
+	assert.Equal(t, "b", string(b.Body))
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 1, q.Len(), "prefetch holds c back")
+
+	// Acking b alone frees one credit, so c follows the receipt while a
+	// stays pending.
+	c.send("ACK", "", "id", b.Get("ack"), "receipt", "ack-b")
+	got := c.recvBoth()
+	assert.Equal(t, "ack-b", got["RECEIPT"].Get("receipt-id"))
+	assert.Equal(t, "c", string(got["MESSAGE"].Body))
+	assert.Equal(t, 0, q.Len())
+	assert.Equal(t, 2, q.Inflight())
+
+	// A nacked message goes back to the queue and is delivered again.
+	c.send("NACK", "", "id", a.Get("ack"), "receipt", "nack-a")
+	got = c.recvBoth()
+	assert.Equal(t, "nack-a", got["RECEIPT"].Get("receipt-id"))
+	redelivered := got["MESSAGE"]
+	assert.Equal(t, "a", string(redelivered.Body))
+
+	f := c.call("ACK", "", "id", redelivered.Get("ack"), "receipt", "ack-a")
+	assert.Equal(t, "RECEIPT", f.Command)
+	assert.Equal(t, 1, q.Inflight(), "only c is still pending")
+}
+
+func TestClientCumulativeAck(t *testing.T) {
+	s, addr := startServer(t)
+	c := connect(t, addr)
+	q := s.Manager.Get("cum")
+	for _, v := range []string{"a", "b", "c"} {
+		q.Enqueue([]byte(v))
+	}
+
+	c.send("SUBSCRIBE", "", "id", "s", "destination", "/queue/cum", "ack", "client")
+	var msgs []Frame
+	for i := 0; i < 3; i++ {
+		msgs = append(msgs, c.recv())
+	}
+	assert.Equal(t, 3, q.Inflight())
+
+	f := c.call("ACK", "", "id", msgs[1].Get("ack"), "receipt", "r")
+	assert.Equal(t, "RECEIPT", f.Command)
+	assert.Equal(t, 1, q.Inflight(), "a and b are acked together")
+
+	// Disconnecting returns the still-pending c to the queue.
+	f = c.call("DISCONNECT", "", "receipt", "bye")
+	assert.Equal(t, "bye", f.Get("receipt-id"))
+	assert.Eventually(t, func() bool { return q.Len() == 1 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, []byte("c"), q.Dequeue())
+}
+
+func TestUnsubscribeReleasesPending(t *testing.T) {
+	s, addr := startServer(t)
+	c := connect(t, addr)
+	q := s.Manager.Get("u")
+	q.Enqueue([]byte("x"))
+
+	c.send("SUBSCRIBE", "", "id", "s", "destination", "/queue/u", "ack", "client-individual")
+	assert.Equal(t, "x", string(c.recv().Body))
+	f := c.call("UNSUBSCRIBE", "", "id", "s", "receipt", "r")
+	assert.Equal(t, "RECEIPT", f.Command)
+	assert.Equal(t, 1, q.Len())
+	assert.Equal(t, 0, q.Inflight())
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		connect bool
+		command string
+		headers []string
+		want    string
+	}{
+		{name: "NotConnected", connect: false, command: "SEND", headers: []string{"destination", "/queue/a"}, want: "not connected"},
+		{name: "BadDestination", connect: true, command: "SEND", headers: []string{"destination", "/topic/a"}, want: "invalid destination"},
+		{name: "BadAckMode", connect: true, command: "SUBSCRIBE", headers: []string{"id", "1", "destination", "/queue/a", "ack", "sometimes"}, want: "invalid ack mode"},
+		{name: "UnknownAck", connect: true, command: "ACK", headers: []string{"id", "nope:1"}, want: "no subscription"},
+		{name: "Transactions", connect: true, command: "BEGIN", headers: []string{"transaction", "tx1"}, want: "not supported"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, addr := startServer(t)
+			var c *client
+			if tc.connect {
+				c = connect(t, addr)
+			} else {
+				nc, err := net.Dial("tcp", addr)
+				if !assert.NoError(t, err) {
+					return
+				}
+				defer nc.Close()
+				c = &client{t: t, nc: nc, br: bufio.NewReader(nc)}
+			}
+			f := c.call(tc.command, "x", tc.headers...)
+			assert.Equal(t, "ERROR", f.Command)
+			assert.True(t, strings.Contains(f.Get("message"), tc.want), f.Get("message"))
+		})
+	}
+}
@@ -0,0 +1,232 @@
+// Package tenant loads the tenants allowed on a queue-service and their
+// quotas.
+//
+// A tenants file has one tenant per line followed by its quotas:
+//
+//	# tenant  quotas
+//	acme      queues=20 bytes=256MiB rate=500:1000
+//	globex    rate=50
+//	*         queues=10 bytes=64MiB rate=100
+//
+// queues caps the number of queues, bytes the payload held across them, in
+// flight included, and rate the messages enqueued per second with an
+// optional burst as in package ratelimit. Omitted quotas are unlimited. The
+// * line applies to tenants not listed; without it they are rejected.
+// Blank lines and lines starting with # are ignored.
+package tenant
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"corti-kkv/internal/queue"
+	"corti-kkv/internal/ratelimit"
+)
+
+// Quota limits one tenant. Zero values mean unlimited.
+type Quota struct {
+	MaxQueues int
+	MaxBytes  int64
+	Rate      ratelimit.Limit
+}
+
+// Config holds the known tenants and enforces their rates. It is safe to
+// replace them while in use.
+type Config struct {
+	mu      sync.RWMutex
+	quotas  map[string]Quota
+	def     *Quota
+	limiter *ratelimit.Limiter
+}
+
+// Load reads a tenants file.
+func Load(filename string) (*Config, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	c, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return c, nil
+}
+
+// Parse reads tenants in the format described in the package comment.
+func Parse(r io.Reader) (*Config, error) {
+	c := &Config{quotas: make(map[string]Quota)}
+	var rules []ratelimit.Rule
+	var defRule *ratelimit.Rule
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		name := fields[0]
+		if name != "*" && !Valid(name) {
+			return nil, fmt.Errorf("line %d: invalid tenant name %q", n, name)
+		}
+		if _, dup := c.quotas[name]; dup || (name == "*" && c.def != nil) {
+			return nil, fmt.Errorf("line %d: duplicate tenant %q", n, name)
+		}
+		var q Quota
+		for _, f := range fields[1:] {
+			if err := q.set(f); err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+		}
+		if name == "*" {
+			c.def = &q
+			if q.Rate.Rate > 0 {
+				defRule = &ratelimit.Rule{Pattern: "*", Limit: q.Rate}
+			}
+			continue
+		}
+		c.quotas[name] = q
+		if q.Rate.Rate > 0 {
+			rules = append(rules, ratelimit.Rule{Pattern: name, Limit: q.Rate})
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if defRule != nil {
+		rules = append(rules, *defRule)
+	}
+	c.limiter = ratelimit.New(rules, nil)
+	return c, nil
+}
+
+func (q *Quota) set(field string) error {
+	key, value, ok := strings.Cut(field, "=")
+	if !ok {
+		return fmt.Errorf("invalid quota %q, want key=value", field)
+	}
+	var err error
+	switch key {
+	case "queues":
+		q.MaxQueues, err = strconv.Atoi(value)
+		if err == nil && q.MaxQueues < 1 {
+			err = fmt.Errorf("must be positive")
+		}
+	case "bytes":
+		q.MaxBytes, err = ParseBytes(value)
+	case "rate":
+		var rules []ratelimit.Rule
+		rules, err = ratelimit.ParseRules("*=" + value)
+		if err == nil {
+			q.Rate = rules[0].Limit
+		}
+	default:
+		return fmt.Errorf("unknown quota %q", key)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s quota %q: %w", key, value, err)
+	}
+	return nil
+}
+
+// ParseBytes reads a positive byte count with an optional KiB, MiB or GiB
+// suffix.
+func ParseBytes(s string) (int64, error) {
+	mult := int64(1)
+	for _, u := range []struct {
+		suffix string
+		mult   int64
+	}{{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}} {
+		if v, ok := strings.CutSuffix(s, u.suffix); ok {
+			s, mult = v, u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("want a positive number of bytes")
+	}
+	return n * mult, nil
+}
+
+// Valid reports whether name can be used as a tenant: 1 to 64 ASCII
+// letters, digits, '-', '_' or '.'.
+func Valid(name string) bool {
+	if name == "" || len(name) > 64 {
+		return false
+	}
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Quota returns the quota of the named tenant and whether it may use the
+// service. The default namespace is always allowed. A nil Config allows
+// every tenant without limits.
+func (c *Config) Quota(name string) (Quota, bool) {
+	if c == nil {
+		return Quota{}, true
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if q, ok := c.quotas[name]; ok {
+		return q, true
+	}
+	if c.def != nil {
+		return *c.def, true
+	}
+	return Quota{}, name == queue.DefaultNamespace
+}
+
+// Names returns the tenants listed by name, in no particular order.
+func (c *Config) Names() []string {
+	if c == nil {
+		return nil
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	names := make([]string, 0, len(c.quotas))
+	for name := range c.quotas {
+		names = append(names, name)
+	}
+	return names
+}
+
+// Allow takes one message from the tenant's rate, reporting how long to wait
+// if it is exhausted.
+func (c *Config) Allow(name string) (bool, time.Duration) {
+	if c == nil {
+		return true, 0
+	}
+	c.mu.RLock()
+	q, listed := c.quotas[name]
+	limiter := c.limiter
+	c.mu.RUnlock()
+	// Listed tenants without a rate must not fall through to the * rule.
+	if listed && q.Rate.Rate == 0 {
+		return true, 0
+	}
+	return limiter.Allow("enqueue", name, "")
+}
+
+// Replace swaps in the tenants and quotas of from. Rates start over with
+// full bursts.
+func (c *Config) Replace(from *Config) {
+	from.mu.RLock()
+	quotas, def, limiter := from.quotas, from.def, from.limiter
+	from.mu.RUnlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.quotas, c.def, c.limiter = quotas, def, limiter
+}
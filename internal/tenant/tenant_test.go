@@ -0,0 +1,101 @@
+package tenant
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"corti-kkv/internal/ratelimit"
+)
+
+func TestParse(t *testing.T) {
+	c, err := Parse(strings.NewReader(`
+# tenant quotas
+acme   queues=2 bytes=1KiB rate=1:2
+open
+*      bytes=10
+`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	q, ok := c.Quota("acme")
+	assert.True(t, ok)
+	assert.Equal(t, Quota{MaxQueues: 2, MaxBytes: 1024, Rate: ratelimit.Limit{Rate: 1, Burst: 2}}, q)
+	q, ok = c.Quota("open")
+	assert.True(t, ok)
+	assert.Equal(t, Quota{}, q)
+	q, ok = c.Quota("other")
+	assert.True(t, ok)
+	assert.Equal(t, Quota{MaxBytes: 10}, q)
+	assert.ElementsMatch(t, []string{"acme", "open"}, c.Names())
+
+	ok1, _ := c.Allow("acme")
+	ok2, _ := c.Allow("acme")
+	ok3, wait := c.Allow("acme")
+	assert.Equal(t, []bool{true, true, false}, []bool{ok1, ok2, ok3})
+	assert.Greater(t, wait, time.Duration(0))
+	for i := 0; i < 100; i++ {
+		ok, _ := c.Allow("open")
+		assert.True(t, ok)
+	}
+
+	c, _ = Parse(strings.NewReader("acme\n"))
+	_, ok = c.Quota("other")
+	assert.False(t, ok, "unlisted tenants are rejected without a * line")
+	_, ok = c.Quota("default")
+	assert.True(t, ok, "the default namespace is always allowed")
+
+	var nilConfig *Config
+	_, ok = nilConfig.Quota("anything")
+	assert.True(t, ok)
+	ok, _ = nilConfig.Allow("anything")
+	assert.True(t, ok)
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "InvalidName", in: "a/b\n", want: "line 1: invalid tenant name"},
+		{name: "Duplicate", in: "a\na\n", want: "line 2: duplicate tenant"},
+		{name: "DuplicateDefault", in: "*\n*\n", want: "line 2: duplicate tenant"},
+		{name: "NoValue", in: "a queues\n", want: "want key=value"},
+		{name: "UnknownQuota", in: "a disk=1\n", want: "unknown quota"},
+		{name: "BadQueues", in: "a queues=0\n", want: "invalid queues quota"},
+		{name: "BadBytes", in: "a bytes=1TB\n", want: "invalid bytes quota"},
+		{name: "BadRate", in: "a rate=fast\n", want: "invalid rate quota"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(tc.in))
+			assert.ErrorContains(t, err, tc.want)
+		})
+	}
+}
+
+func TestValid(t *testing.T) {
+	for name, want := range map[string]bool{
+		"acme": true, "team-1.prod_x": true, "": false, "a/b": false, "a b": false, "*": false,
+		strings.Repeat("a", 64): true, strings.Repeat("a", 65): false,
+	} {
+		assert.Equal(t, want, Valid(name), name)
+	}
+}
+
+func TestReplace(t *testing.T) {
+	c, _ := Parse(strings.NewReader("acme rate=1:1\n"))
+	next, _ := Parse(strings.NewReader("globex queues=3\n"))
+	ok, _ := c.Allow("acme")
+	assert.True(t, ok)
+	c.Replace(next)
+	_, ok = c.Quota("acme")
+	assert.False(t, ok)
+	q, ok := c.Quota("globex")
+	assert.True(t, ok)
+	assert.Equal(t, Quota{MaxQueues: 3}, q)
+	assert.Equal(t, []string{"globex"}, c.Names())
+}
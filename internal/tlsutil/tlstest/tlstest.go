@@ -0,0 +1,110 @@
+// Package tlstest generates certificates for tests.
+package tlstest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// CA is a throwaway certificate authority whose files live in a test's
+// temporary directory.
+type CA struct {
+	// CertFile is the PEM-encoded CA certificate.
+	CertFile string
+
+	t    *testing.T
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	n    int64
+}
+
+// NewCA creates a CA valid for the duration of the test.
+func NewCA(t *testing.T, name string) *CA {
+	t.Helper()
+	ca := &CA{t: t, dir: t.TempDir()}
+	ca.key = ca.newKey()
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &ca.key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ca.cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	ca.CertFile = ca.write(name+".crt", "CERTIFICATE", der)
+	return ca
+}
+
+// Server issues a certificate for localhost and 127.0.0.1 and returns the
+// certificate and key files.
+func (ca *CA) Server() (certFile, keyFile string) {
+	ca.t.Helper()
+	return ca.issue("localhost", x509.ExtKeyUsageServerAuth, []string{"localhost"}, []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback})
+}
+
+// Client issues a client certificate with the given common name.
+func (ca *CA) Client(commonName string) (certFile, keyFile string) {
+	ca.t.Helper()
+	return ca.issue(commonName, x509.ExtKeyUsageClientAuth, nil, nil)
+}
+
+func (ca *CA) issue(cn string, usage x509.ExtKeyUsage, dns []string, ips []net.IP) (string, string) {
+	ca.n++
+	key := ca.newKey()
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.n + 1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		DNSNames:     dns,
+		IPAddresses:  ips,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	base := filepath.Base(cn)
+	return ca.write(base+".crt", "CERTIFICATE", der), ca.write(base+".key", "EC PRIVATE KEY", keyDER)
+}
+
+func (ca *CA) newKey() *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	return key
+}
+
+func (ca *CA) write(name, blockType string, der []byte) string {
+	p := filepath.Join(ca.dir, name)
+	b := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(p, b, 0o600); err != nil {
+		ca.t.Fatal(err)
+	}
+	return p
+}
@@ -0,0 +1,76 @@
+package tlsutil
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"corti-kkv/internal/tlsutil/tlstest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMutualTLS(t *testing.T) {
+	ca := tlstest.NewCA(t, "test-ca")
+	srvCert, srvKey := ca.Server()
+	cliCert, cliKey := ca.Client("worker")
+
+	srvCfg, err := ServerConfig(srvCert, srvKey, ca.CertFile)
+	if !assert.NoError(t, err) {
+		return
+	}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	ts.TLS = srvCfg
+	ts.StartTLS()
+	defer ts.Close()
+
+	get := func(cfg *tls.Config) (*http.Response, error) {
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+		return c.Get(ts.URL)
+	}
+
+	cfg, err := ClientConfig(ca.CertFile, cliCert, cliKey)
+	if !assert.NoError(t, err) {
+		return
+	}
+	resp, err := get(cfg)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	// Without a client certificate the handshake is refused.
+	cfg, err = ClientConfig(ca.CertFile, "", "")
+	assert.NoError(t, err)
+	_, err = get(cfg)
+	assert.Error(t, err)
+
+	// A certificate from another CA is not trusted.
+	other := tlstest.NewCA(t, "other-ca")
+	otherCert, otherKey := other.Client("worker")
+	cfg, err = ClientConfig(ca.CertFile, otherCert, otherKey)
+	assert.NoError(t, err)
+	_, err = get(cfg)
+	assert.Error(t, err)
+}
+
+func TestConfigErrors(t *testing.T) {
+	ca := tlstest.NewCA(t, "test-ca")
+	cert, key := ca.Client("c")
+	junk := filepath.Join(t.TempDir(), "junk.pem")
+	assert.NoError(t, os.WriteFile(junk, []byte("not a cert"), 0o600))
+
+	_, err := ClientConfig("", cert, "")
+	assert.ErrorContains(t, err, "together")
+	_, err = ClientConfig(junk, "", "")
+	assert.ErrorContains(t, err, "no certificates")
+	_, err = ServerConfig(junk, key, "")
+	assert.ErrorContains(t, err, "load server certificate")
+	_, err = ServerConfig(cert, key, junk)
+	assert.ErrorContains(t, err, "no certificates")
+}
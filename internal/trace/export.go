@@ -0,0 +1,220 @@
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Exporter sends finished spans somewhere.
+type Exporter interface {
+	Export(ctx context.Context, service string, spans []SpanData) error
+	Close() error
+}
+
+// NewExporter returns an exporter for target: an http:// or https:// URL of
+// an OTLP collector, or the path of a JSON-lines file to append to.
+func NewExporter(target string) (Exporter, error) {
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		return NewOTLPExporter(target)
+	}
+	return NewFileExporter(strings.TrimPrefix(target, "file://"))
+}
+
+// FileExporter appends spans to a file, one JSON object per line.
+type FileExporter struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func NewFileExporter(path string) (*FileExporter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileExporter{f: f}, nil
+}
+
+// jsonSpan is the line written per span by FileExporter.
+type jsonSpan struct {
+	TraceID    string         `json:"trace_id"`
+	SpanID     string         `json:"span_id"`
+	ParentID   string         `json:"parent_span_id,omitempty"`
+	Service    string         `json:"service"`
+	Name       string         `json:"name"`
+	Kind       string         `json:"kind"`
+	Start      time.Time      `json:"start"`
+	End        time.Time      `json:"end"`
+	Attributes map[string]any `json:"attributes,omitempty"`
+	Links      []jsonLink     `json:"links,omitempty"`
+	Error      string         `json:"error,omitempty"`
+}
+
+type jsonLink struct {
+	TraceID string `json:"trace_id"`
+	SpanID  string `json:"span_id"`
+}
+
+func (e *FileExporter) Export(_ context.Context, service string, spans []SpanData) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, s := range spans {
+		js := jsonSpan{
+			TraceID: hex.EncodeToString(s.TraceID[:]),
+			SpanID:  hex.EncodeToString(s.SpanID[:]),
+			Service: service,
+			Name:    s.Name,
+			Kind:    s.Kind.String(),
+			Start:   s.Start,
+			End:     s.End,
+			Error:   s.Err,
+		}
+		if s.Parent != [8]byte{} {
+			js.ParentID = hex.EncodeToString(s.Parent[:])
+		}
+		if len(s.Attrs) > 0 {
+			js.Attributes = make(map[string]any, len(s.Attrs))
+			for _, a := range s.Attrs {
+				js.Attributes[a.Key] = a.Value
+			}
+		}
+		for _, l := range s.Links {
+			js.Links = append(js.Links, jsonLink{hex.EncodeToString(l.TraceID[:]), hex.EncodeToString(l.SpanID[:])})
+		}
+		if err := enc.Encode(js); err != nil {
+			return err
+		}
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err := e.f.Write(buf.Bytes())
+	return err
+}
+
+func (e *FileExporter) Close() error { return e.f.Close() }
+
+// OTLPExporter posts spans to an OpenTelemetry collector using OTLP/HTTP
+// with JSON encoding.
+type OTLPExporter struct {
+	URL    string
+	Client *http.Client
+}
+
+// NewOTLPExporter returns an exporter for the collector at endpoint. An
+// endpoint without a path gets the default /v1/traces.
+func NewOTLPExporter(endpoint string) (*OTLPExporter, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OTLP endpoint: %w", err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid OTLP endpoint %q: missing host", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	return &OTLPExporter{URL: u.String(), Client: &http.Client{Timeout: 10 * time.Second}}, nil
+}
+
+func (e *OTLPExporter) Export(ctx context.Context, service string, spans []SpanData) error {
+	body, err := json.Marshal(otlpRequest(service, spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("collector answered %s: %s", resp.Status, bytes.TrimSpace(b))
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+func (e *OTLPExporter) Close() error { return nil }
+
+// otlpRequest builds an ExportTraceServiceRequest in the OTLP JSON mapping,
+// where IDs are hex strings and 64-bit integers are decimal strings.
+func otlpRequest(service string, spans []SpanData) map[string]any {
+	out := make([]map[string]any, len(spans))
+	for i, s := range spans {
+		span := map[string]any{
+			"traceId":           hex.EncodeToString(s.TraceID[:]),
+			"spanId":            hex.EncodeToString(s.SpanID[:]),
+			"name":              s.Name,
+			"kind":              int(s.Kind),
+			"startTimeUnixNano": strconv.FormatInt(s.Start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.End.UnixNano(), 10),
+			"attributes":        otlpAttrs(s.Attrs),
+		}
+		if s.Parent != [8]byte{} {
+			span["parentSpanId"] = hex.EncodeToString(s.Parent[:])
+		}
+		if s.State != "" {
+			span["traceState"] = s.State
+		}
+		if len(s.Links) > 0 {
+			links := make([]map[string]any, len(s.Links))
+			for j, l := range s.Links {
+				links[j] = map[string]any{"traceId": hex.EncodeToString(l.TraceID[:]), "spanId": hex.EncodeToString(l.SpanID[:])}
+			}
+			span["links"] = links
+		}
+		if s.Err != "" {
+			span["status"] = map[string]any{"code": 2, "message": s.Err}
+		}
+		out[i] = span
+	}
+	return map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": otlpAttrs([]Attr{{"service.name", service}}),
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "corti-kkv"},
+				"spans": out,
+			}},
+		}},
+	}
+}
+
+func otlpAttrs(attrs []Attr) []map[string]any {
+	out := make([]map[string]any, 0, len(attrs))
+	for _, a := range attrs {
+		var v map[string]any
+		switch x := a.Value.(type) {
+		case string:
+			v = map[string]any{"stringValue": x}
+		case bool:
+			v = map[string]any{"boolValue": x}
+		case int:
+			v = map[string]any{"intValue": strconv.Itoa(x)}
+		case int64:
+			v = map[string]any{"intValue": strconv.FormatInt(x, 10)}
+		case float64:
+			v = map[string]any{"doubleValue": x}
+		default:
+			v = map[string]any{"stringValue": fmt.Sprint(x)}
+		}
+		out = append(out, map[string]any{"key": a.Key, "value": v})
+	}
+	return out
+}
@@ -0,0 +1,361 @@
+// Package trace propagates W3C trace context (traceparent and tracestate)
+// through HTTP requests and queued messages, and records spans for export.
+//
+// Propagation works without a Tracer: a nil *Tracer passes the incoming
+// trace context through unchanged and records nothing.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Header names defined by the W3C Trace Context recommendation.
+const (
+	TraceparentHeader = "traceparent"
+	TracestateHeader  = "tracestate"
+)
+
+// maxTracestateLen bounds tracestate values taken from requests.
+const maxTracestateLen = 512
+
+// SpanContext identifies a span within a trace.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Flags   byte
+	State   string
+}
+
+// IsValid reports whether sc has non-zero trace and span IDs.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// Sampled reports whether the sampled flag is set.
+func (sc SpanContext) Sampled() bool { return sc.Flags&1 != 0 }
+
+// Traceparent formats sc as a version 00 traceparent value, or returns ""
+// if sc is not valid.
+func (sc SpanContext) Traceparent() string {
+	if !sc.IsValid() {
+		return ""
+	}
+	return "00-" + hex.EncodeToString(sc.TraceID[:]) + "-" + hex.EncodeToString(sc.SpanID[:]) + "-" + hex.EncodeToString([]byte{sc.Flags})
+}
+
+// Parse reads a traceparent and its tracestate. Values of versions other
+// than 00 are accepted as long as they start with the version 00 fields.
+func Parse(traceparent, tracestate string) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, false
+	}
+	if !decodeHex(sc.TraceID[:], parts[1]) || !decodeHex(sc.SpanID[:], parts[2]) {
+		return sc, false
+	}
+	var flags [1]byte
+	if !decodeHex(flags[:], parts[3]) || !sc.IsValid() {
+		return SpanContext{}, false
+	}
+	sc.Flags = flags[0]
+	if len(tracestate) <= maxTracestateLen && !strings.ContainsAny(tracestate, "\r\n") {
+		sc.State = strings.TrimSpace(tracestate)
+	}
+	return sc, true
+}
+
+// decodeHex decodes lowercase hex s into dst, which it must fill exactly.
+func decodeHex(dst []byte, s string) bool {
+	if len(s) != 2*len(dst) || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err == nil
+}
+
+type spanContextKey struct{}
+
+// ContextWithSpanContext returns a context carrying sc as the current span.
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// FromContext returns the current span context, which is not valid if ctx
+// carries none.
+func FromContext(ctx context.Context) SpanContext {
+	sc, _ := ctx.Value(spanContextKey{}).(SpanContext)
+	return sc
+}
+
+// Extract reads the trace context from h.
+func Extract(h http.Header) (SpanContext, bool) {
+	return Parse(h.Get(TraceparentHeader), h.Get(TracestateHeader))
+}
+
+// Inject writes sc to h, leaving h alone if sc is not valid.
+func Inject(sc SpanContext, h http.Header) {
+	if !sc.IsValid() {
+		return
+	}
+	h.Set(TraceparentHeader, sc.Traceparent())
+	if sc.State != "" {
+		h.Set(TracestateHeader, sc.State)
+	}
+}
+
+// Middleware puts the trace context of incoming requests into their
+// context, where handlers and Tracer.Start pick it up.
+func Middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sc, ok := Extract(r.Header); ok {
+			r = r.WithContext(ContextWithSpanContext(r.Context(), sc))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Kind describes a span's role, with the values OTLP uses.
+type Kind int
+
+const (
+	Internal Kind = 1 + iota
+	Server
+	Client
+	Producer
+	Consumer
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Server:
+		return "server"
+	case Client:
+		return "client"
+	case Producer:
+		return "producer"
+	case Consumer:
+		return "consumer"
+	}
+	return "internal"
+}
+
+// SpanData is a finished span as handed to an Exporter.
+type SpanData struct {
+	SpanContext
+	Parent     [8]byte
+	Name       string
+	Kind       Kind
+	Start, End time.Time
+	Attrs      []Attr
+	Links      []SpanContext
+	Err        string
+}
+
+// Attr is a span attribute. Values are strings, bools, ints, int64s or
+// float64s.
+type Attr struct {
+	Key   string
+	Value any
+}
+
+const (
+	// batchSize is how many spans are exported at once.
+	batchSize = 512
+	// maxPending bounds the spans buffered for export; further spans are
+	// dropped until the exporter catches up.
+	maxPending = 8192
+	// flushInterval is how long a span waits for its batch to fill.
+	flushInterval = 2 * time.Second
+)
+
+// Tracer records spans and exports them in the background.
+type Tracer struct {
+	service string
+	exp     Exporter
+
+	mu      sync.Mutex
+	pending []SpanData
+	dropped int
+
+	kick chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewTracer returns a tracer that exports spans of the named service to exp.
+// Call Shutdown to flush them before exiting.
+func NewTracer(service string, exp Exporter) *Tracer {
+	t := &Tracer{
+		service: service,
+		exp:     exp,
+		kick:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// Start begins a span that is a child of the span context in ctx, or the
+// root of a new trace if there is none, and returns a context carrying it.
+// On a nil Tracer it returns ctx and a nil Span, whose methods do nothing.
+func (t *Tracer) Start(ctx context.Context, name string, kind Kind) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	parent := FromContext(ctx)
+	s := &Span{t: t, data: SpanData{Name: name, Kind: kind, Start: time.Now()}}
+	if parent.IsValid() {
+		s.data.TraceID = parent.TraceID
+		s.data.Parent = parent.SpanID
+		s.data.Flags = parent.Flags
+		s.data.State = parent.State
+	} else {
+		rand.Read(s.data.TraceID[:])
+		s.data.Flags = 1
+	}
+	rand.Read(s.data.SpanID[:])
+	return ContextWithSpanContext(ctx, s.data.SpanContext), s
+}
+
+// Shutdown exports the spans still buffered and closes the exporter.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	close(t.stop)
+	select {
+	case <-t.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return t.exp.Close()
+}
+
+func (t *Tracer) record(d SpanData) {
+	if !d.Sampled() {
+		return
+	}
+	t.mu.Lock()
+	if len(t.pending) >= maxPending {
+		t.dropped++
+		t.mu.Unlock()
+		return
+	}
+	t.pending = append(t.pending, d)
+	full := len(t.pending) >= batchSize
+	t.mu.Unlock()
+	if full {
+		select {
+		case t.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (t *Tracer) run() {
+	defer close(t.done)
+	tick := time.NewTicker(flushInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-t.kick:
+		case <-t.stop:
+			for t.flush() {
+			}
+			return
+		}
+		for t.flush() {
+		}
+	}
+}
+
+// flush exports one batch and reports whether there may be more.
+func (t *Tracer) flush() bool {
+	t.mu.Lock()
+	n := min(len(t.pending), batchSize)
+	batch := t.pending[:n:n]
+	t.pending = t.pending[n:]
+	dropped := t.dropped
+	t.dropped = 0
+	t.mu.Unlock()
+	if dropped > 0 {
+		slog.Warn("dropped spans, exporter too slow", "spans", dropped)
+	}
+	if n == 0 {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := t.exp.Export(ctx, t.service, batch); err != nil {
+		slog.Warn("export spans", "spans", n, "err", err)
+	}
+	return true
+}
+
+// Span is a span in progress. A nil *Span is valid and records nothing.
+type Span struct {
+	t    *Tracer
+	mu   sync.Mutex
+	data SpanData
+}
+
+// Context returns the span's context.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.data.SpanContext
+}
+
+// SetAttr adds an attribute.
+func (s *Span) SetAttr(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Attrs = append(s.data.Attrs, Attr{key, value})
+}
+
+// AddLink records a related span in another trace, such as the consumer
+// request that dequeued a message.
+func (s *Span) AddLink(sc SpanContext) {
+	if s == nil || !sc.IsValid() {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Links = append(s.data.Links, sc)
+}
+
+// SetError marks the span as failed if err is not nil.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Err = err.Error()
+}
+
+// End finishes the span and queues it for export.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	d := s.data
+	d.End = time.Now()
+	s.mu.Unlock()
+	s.t.record(d)
+}
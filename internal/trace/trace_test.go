@@ -0,0 +1,199 @@
+package trace
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const parent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		ok    bool
+	}{
+		{name: "Valid", value: parent, ok: true},
+		{name: "FutureVersionWithExtraField", value: "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-abc", ok: true},
+		{name: "Version00WithExtraField", value: parent + "-abc"},
+		{name: "VersionFF", value: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		{name: "Uppercase", value: "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01"},
+		{name: "ZeroTraceID", value: "00-00000000000000000000000000000000-00f067aa0ba902b7-01"},
+		{name: "ZeroSpanID", value: "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01"},
+		{name: "ShortSpanID", value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902-01"},
+		{name: "Empty", value: ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			sc, ok := Parse(tc.value, "")
+			assert.Equal(t, tc.ok, ok)
+			assert.Equal(t, tc.ok, sc.IsValid())
+		})
+	}
+
+	sc, _ := Parse(parent, "vendor=x")
+	assert.Equal(t, parent, sc.Traceparent())
+	assert.True(t, sc.Sampled())
+	assert.Equal(t, "vendor=x", sc.State)
+	sc, _ = Parse(parent, "bad\r\nvalue")
+	assert.Empty(t, sc.State)
+}
+
+func TestMiddlewareAndInject(t *testing.T) {
+	var got SpanContext
+	h := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = FromContext(r.Context())
+		Inject(got, w.Header())
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(TraceparentHeader, parent)
+	req.Header.Set(TracestateHeader, "a=1")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(t, parent, got.Traceparent())
+	assert.Equal(t, parent, rec.Header().Get(TraceparentHeader))
+	assert.Equal(t, "a=1", rec.Header().Get(TracestateHeader))
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Empty(t, rec.Header().Get(TraceparentHeader))
+}
+
+type memExporter struct {
+	mu     sync.Mutex
+	spans  []SpanData
+	closed bool
+}
+
+func (e *memExporter) Export(_ context.Context, _ string, spans []SpanData) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func (e *memExporter) Close() error {
+	e.closed = true
+	return nil
+}
+
+func TestTracer(t *testing.T) {
+	var nilTracer *Tracer
+	in, _ := Parse(parent, "")
+	ctx := ContextWithSpanContext(context.Background(), in)
+	out, span := nilTracer.Start(ctx, "x", Internal)
+	assert.Nil(t, span)
+	assert.Equal(t, in, FromContext(out))
+	span.SetAttr("ignored", 1)
+	span.End()
+
+	exp := &memExporter{}
+	tr := NewTracer("svc", exp)
+	child, s1 := tr.Start(ctx, "child", Server)
+	s1.SetAttr("queue", "q")
+	s1.SetError(errors.New("boom"))
+	s1.End()
+	_, s2 := tr.Start(context.Background(), "root", Client)
+	s2.End()
+	unsampled, _ := Parse("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", "")
+	_, s3 := tr.Start(ContextWithSpanContext(context.Background(), unsampled), "dropped", Internal)
+	s3.End()
+	assert.NoError(t, tr.Shutdown(context.Background()))
+	assert.True(t, exp.closed)
+
+	if !assert.Len(t, exp.spans, 2) {
+		return
+	}
+	c := exp.spans[0]
+	assert.Equal(t, in.TraceID, c.TraceID)
+	assert.Equal(t, in.SpanID, c.Parent)
+	assert.Equal(t, FromContext(child), c.SpanContext)
+	assert.Equal(t, []Attr{{"queue", "q"}}, c.Attrs)
+	assert.Equal(t, "boom", c.Err)
+	r := exp.spans[1]
+	assert.NotEqual(t, in.TraceID, r.TraceID)
+	assert.Equal(t, [8]byte{}, r.Parent)
+	assert.True(t, r.Sampled())
+}
+
+func TestFileExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.jsonl")
+	exp, err := NewExporter(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	tr := NewTracer("svc", exp)
+	in, _ := Parse(parent, "")
+	_, s := tr.Start(ContextWithSpanContext(context.Background(), in), "enqueue", Producer)
+	s.SetAttr("bytes", 3)
+	s.AddLink(in)
+	s.End()
+	assert.NoError(t, tr.Shutdown(context.Background()))
+
+	f, err := os.Open(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	assert.True(t, sc.Scan())
+	var line map[string]any
+	assert.NoError(t, json.Unmarshal(sc.Bytes(), &line))
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", line["trace_id"])
+	assert.Equal(t, "00f067aa0ba902b7", line["parent_span_id"])
+	assert.Equal(t, "svc", line["service"])
+	assert.Equal(t, "enqueue", line["name"])
+	assert.Equal(t, "producer", line["kind"])
+	assert.Equal(t, map[string]any{"bytes": float64(3)}, line["attributes"])
+	assert.Len(t, line["links"], 1)
+	assert.False(t, sc.Scan())
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var body map[string]any
+	var path, ct string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, ct = r.URL.Path, r.Header.Get("Content-Type")
+		b, _ := io.ReadAll(r.Body)
+		json.Unmarshal(b, &body)
+	}))
+	defer ts.Close()
+
+	exp, err := NewExporter(ts.URL)
+	if !assert.NoError(t, err) {
+		return
+	}
+	tr := NewTracer("queue-service", exp)
+	in, _ := Parse(parent, "k=v")
+	_, s := tr.Start(ContextWithSpanContext(context.Background(), in), "dequeue", Server)
+	s.SetAttr("queue", "lines")
+	s.SetError(errors.New("boom"))
+	s.End()
+	assert.NoError(t, tr.Shutdown(context.Background()))
+
+	assert.Equal(t, "/v1/traces", path)
+	assert.Equal(t, "application/json", ct)
+	rs := body["resourceSpans"].([]any)[0].(map[string]any)
+	assert.Equal(t, "queue-service", rs["resource"].(map[string]any)["attributes"].([]any)[0].(map[string]any)["value"].(map[string]any)["stringValue"])
+	span := rs["scopeSpans"].([]any)[0].(map[string]any)["spans"].([]any)[0].(map[string]any)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span["traceId"])
+	assert.Equal(t, "00f067aa0ba902b7", span["parentSpanId"])
+	assert.Equal(t, "dequeue", span["name"])
+	assert.Equal(t, float64(Server), span["kind"])
+	assert.Equal(t, "k=v", span["traceState"])
+	assert.Equal(t, float64(2), span["status"].(map[string]any)["code"])
+
+	_, err = NewExporter("http://")
+	assert.Error(t, err)
+}
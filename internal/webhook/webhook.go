@@ -0,0 +1,378 @@
+// Package webhook pushes queued messages to subscribers' HTTP endpoints.
+//
+// Each subscription has a worker that reserves messages from its queue and
+// POSTs each one, body as is, with up to Concurrency requests in flight. A
+// 2xx answer acks the message; anything else is retried with exponential
+// backoff and jitter, and after MaxAttempts the message moves to the queue's
+// dead-letter queue. Subscriptions to the same queue compete for its
+// messages like any other consumers.
+//
+// Every request carries X-KKV-Timestamp, the Unix time in seconds, and
+// X-KKV-Signature, "sha256=" and the hex HMAC-SHA256 of the timestamp, a
+// dot and the body, keyed with the subscription's secret. Receivers check
+// it with Verify.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"corti-kkv/internal/metrics"
+	"corti-kkv/internal/queue"
+	"corti-kkv/internal/trace"
+)
+
+// Headers sent with each delivery.
+const (
+	SignatureHeader    = "X-KKV-Signature"
+	TimestampHeader    = "X-KKV-Timestamp"
+	SubscriptionHeader = "X-KKV-Subscription"
+	QueueHeader        = "X-KKV-Queue"
+	MessageIDHeader    = "X-KKV-Message-Id"
+	AttemptHeader      = "X-KKV-Attempt"
+)
+
+const (
+	DefaultConcurrency = 4
+	MaxConcurrency     = 64
+	DefaultMaxAttempts = 5
+	MaxAttempts        = 100
+)
+
+// Subscription registers URL as a push consumer of Queue, a stored queue
+// name.
+type Subscription struct {
+	ID          string    `json:"id"`
+	Queue       string    `json:"queue"`
+	URL         string    `json:"url"`
+	Secret      string    `json:"-"`
+	Concurrency int       `json:"concurrency"`
+	MaxAttempts int       `json:"max_attempts"`
+	Created     time.Time `json:"created"`
+}
+
+// Status is a subscription with its delivery counters.
+type Status struct {
+	Subscription
+	Delivered    uint64 `json:"delivered"`
+	Failed       uint64 `json:"failed_attempts"`
+	DeadLettered uint64 `json:"dead_lettered"`
+	LastError    string `json:"last_error,omitempty"`
+}
+
+// Dispatcher runs the delivery workers.
+type Dispatcher struct {
+	manager *queue.QueueManager
+	// Client sends the deliveries. Its timeout bounds each attempt.
+	Client *http.Client
+	// Backoff is the wait before the first retry, doubling up to
+	// MaxBackoff for later ones.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	deliveries *metrics.CounterVec
+
+	mu      sync.Mutex
+	workers map[string]*worker
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+func NewDispatcher(m *queue.QueueManager) *Dispatcher {
+	return &Dispatcher{
+		manager:    m,
+		Client:     &http.Client{Timeout: 30 * time.Second},
+		Backoff:    500 * time.Millisecond,
+		MaxBackoff: time.Minute,
+		deliveries: metrics.NewCounterVec("kkv_webhook_deliveries_total", "Webhook delivery attempts by result: delivered, failed or dead_lettered.", "queue", "result"),
+		workers:    make(map[string]*worker),
+	}
+}
+
+type worker struct {
+	d      *Dispatcher
+	sub    Subscription
+	cancel context.CancelFunc
+
+	mu     sync.Mutex
+	status Status
+}
+
+// Subscribe validates s, fills in its defaults, ID, creation time and, if
+// empty, a random secret, and starts delivering to it.
+func (d *Dispatcher) Subscribe(s Subscription) (Subscription, error) {
+	u, err := url.Parse(s.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return Subscription{}, fmt.Errorf("invalid url %q, want an absolute http or https URL", s.URL)
+	}
+	if s.Concurrency == 0 {
+		s.Concurrency = DefaultConcurrency
+	}
+	if s.Concurrency < 1 || s.Concurrency > MaxConcurrency {
+		return Subscription{}, fmt.Errorf("concurrency must be 1 to %d", MaxConcurrency)
+	}
+	if s.MaxAttempts == 0 {
+		s.MaxAttempts = DefaultMaxAttempts
+	}
+	if s.MaxAttempts < 1 || s.MaxAttempts > MaxAttempts {
+		return Subscription{}, fmt.Errorf("max_attempts must be 1 to %d", MaxAttempts)
+	}
+	if s.Secret == "" {
+		s.Secret = randomHex(32)
+	}
+	s.ID = randomHex(8)
+	s.Created = time.Now().UTC()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return Subscription{}, errors.New("dispatcher is closed")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &worker{d: d, sub: s, cancel: cancel, status: Status{Subscription: s}}
+	d.workers[s.ID] = w
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		w.run(ctx)
+	}()
+	return s, nil
+}
+
+// Unsubscribe stops the subscription with the given ID. Messages being
+// delivered to it go back to the queue.
+func (d *Dispatcher) Unsubscribe(id string) bool {
+	d.mu.Lock()
+	w, ok := d.workers[id]
+	delete(d.workers, id)
+	d.mu.Unlock()
+	if ok {
+		w.cancel()
+	}
+	return ok
+}
+
+// Get returns the status of the subscription with the given ID.
+func (d *Dispatcher) Get(id string) (Status, bool) {
+	d.mu.Lock()
+	w, ok := d.workers[id]
+	d.mu.Unlock()
+	if !ok {
+		return Status{}, false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.status, true
+}
+
+// List returns the subscriptions to the named queue, or all of them if name
+// is empty, oldest first.
+func (d *Dispatcher) List(name string) []Status {
+	d.mu.Lock()
+	var out []Status
+	for _, w := range d.workers {
+		if name == "" || w.sub.Queue == name {
+			w.mu.Lock()
+			out = append(out, w.status)
+			w.mu.Unlock()
+		}
+	}
+	d.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].Created.Equal(out[j].Created) {
+			return out[i].Created.Before(out[j].Created)
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+// Close stops every worker and waits for them, releasing the messages they
+// hold.
+func (d *Dispatcher) Close() {
+	d.mu.Lock()
+	d.closed = true
+	for id, w := range d.workers {
+		w.cancel()
+		delete(d.workers, id)
+	}
+	d.mu.Unlock()
+	d.wg.Wait()
+}
+
+// Collect reports delivery counters by queue.
+func (d *Dispatcher) Collect(e *metrics.Encoder) { d.deliveries.Collect(e) }
+
+// idlePoll bounds how long a worker waits on an empty queue, so that it
+// notices when the queue is deleted and recreated.
+const idlePoll = time.Second
+
+func (w *worker) run(ctx context.Context) {
+	var inflight sync.WaitGroup
+	defer inflight.Wait()
+	slots := make(chan struct{}, w.sub.Concurrency)
+	for {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		q := w.d.manager.Get(w.sub.Queue)
+		ready := q.Ready()
+		msgs := q.Reserve(1)
+		if len(msgs) == 0 {
+			<-slots
+			select {
+			case <-ready:
+			case <-time.After(idlePoll):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		inflight.Add(1)
+		go func() {
+			defer inflight.Done()
+			defer func() { <-slots }()
+			w.deliver(ctx, q, msgs[0])
+		}()
+	}
+}
+
+// deliver tries m until it is accepted, runs out of attempts or ctx ends,
+// in which case it goes back to q.
+func (w *worker) deliver(ctx context.Context, q *queue.Queue, m queue.Message) {
+	for attempt := 1; ; attempt++ {
+		err := w.post(ctx, m, attempt)
+		if err == nil {
+			q.Ack(m.ID)
+			w.count(func(s *Status) { s.Delivered++ })
+			w.d.deliveries.Inc(w.sub.Queue, "delivered")
+			return
+		}
+		if ctx.Err() != nil {
+			q.Release(m.ID)
+			return
+		}
+		w.count(func(s *Status) { s.Failed++; s.LastError = err.Error() })
+		w.d.deliveries.Inc(w.sub.Queue, "failed")
+		slog.Warn("webhook delivery failed", "subscription", w.sub.ID, "queue", w.sub.Queue, "message_id", m.ID, "attempt", attempt, "err", err)
+		if attempt >= w.sub.MaxAttempts {
+			w.deadLetter(q, m)
+			return
+		}
+		select {
+		case <-time.After(w.d.backoff(attempt)):
+		case <-ctx.Done():
+			q.Release(m.ID)
+			return
+		}
+	}
+}
+
+// deadLetter moves m to the queue's DLQ, <queue>.dlq unless its options
+// name another.
+func (w *worker) deadLetter(q *queue.Queue, m queue.Message) {
+	dlq := q.Options().DLQ
+	if dlq == "" {
+		dlq = w.sub.Queue + queue.DLQSuffix
+	}
+	w.d.manager.Get(dlq).EnqueueMessage(m)
+	q.Ack(m.ID)
+	w.count(func(s *Status) { s.DeadLettered++ })
+	w.d.deliveries.Inc(w.sub.Queue, "dead_lettered")
+	slog.Warn("webhook delivery dead-lettered", "subscription", w.sub.ID, "queue", w.sub.Queue, "message_id", m.ID, "dlq", dlq)
+}
+
+func (w *worker) count(f func(*Status)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	f(&w.status)
+}
+
+func (w *worker) post(ctx context.Context, m queue.Message, attempt int) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.sub.URL, bytes.NewReader(m.Body))
+	if err != nil {
+		return err
+	}
+	ts := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set(TimestampHeader, strconv.FormatInt(ts, 10))
+	req.Header.Set(SignatureHeader, Sign(w.sub.Secret, ts, m.Body))
+	req.Header.Set(SubscriptionHeader, w.sub.ID)
+	req.Header.Set(QueueHeader, w.sub.Queue)
+	req.Header.Set(MessageIDHeader, strconv.FormatUint(m.ID, 10))
+	req.Header.Set(AttemptHeader, strconv.Itoa(attempt))
+	if sc, ok := trace.Parse(m.Traceparent, m.Tracestate); ok {
+		trace.Inject(sc, req.Header)
+	}
+	resp, err := w.d.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("endpoint answered %s", resp.Status)
+	}
+	return nil
+}
+
+// backoff returns the wait after the given failed attempt: Backoff doubled
+// per attempt up to MaxBackoff, less up to half at random.
+func (d *Dispatcher) backoff(attempt int) time.Duration {
+	b := d.Backoff
+	for i := 1; i < attempt && b < d.MaxBackoff; i++ {
+		b *= 2
+	}
+	b = min(b, d.MaxBackoff)
+	if b <= 0 {
+		return 0
+	}
+	return b/2 + rand.N(b/2+1)
+}
+
+// Sign returns the signature header value for body sent at Unix time ts.
+func Sign(secret string, ts int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", ts)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature of a delivery with the given body, rejecting
+// timestamps more than tolerance away from now to limit replays.
+func Verify(secret string, h http.Header, body []byte, tolerance time.Duration) error {
+	ts, err := strconv.ParseInt(h.Get(TimestampHeader), 10, 64)
+	if err != nil {
+		return fmt.Errorf("missing or invalid %s", TimestampHeader)
+	}
+	if d := time.Since(time.Unix(ts, 0)); d > tolerance || d < -tolerance {
+		return fmt.Errorf("timestamp outside tolerance of %s", tolerance)
+	}
+	if !hmac.Equal([]byte(h.Get(SignatureHeader)), []byte(Sign(secret, ts, body))) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	cryptorand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,228 @@
+package webhook
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"corti-kkv/internal/queue"
+)
+
+// receiver records verified deliveries, failing the first failures
+// requests.
+type receiver struct {
+	t        *testing.T
+	secret   string
+	failures int32
+
+	mu       sync.Mutex
+	bodies   []string
+	headers  []http.Header
+	requests atomic.Int32
+	active   atomic.Int32
+	peak     atomic.Int32
+	hold     time.Duration
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := rc.active.Add(1)
+	defer rc.active.Add(-1)
+	for p := rc.peak.Load(); n > p && !rc.peak.CompareAndSwap(p, n); p = rc.peak.Load() {
+	}
+	time.Sleep(rc.hold)
+	body, _ := io.ReadAll(r.Body)
+	assert.NoError(rc.t, Verify(rc.secret, r.Header, body, time.Minute))
+	if rc.requests.Add(1) <= rc.failures {
+		http.Error(w, "try later", http.StatusServiceUnavailable)
+		return
+	}
+	rc.mu.Lock()
+	rc.bodies = append(rc.bodies, string(body))
+	rc.headers = append(rc.headers, r.Header.Clone())
+	rc.mu.Unlock()
+}
+
+func (rc *receiver) received() []string {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return append([]string(nil), rc.bodies...)
+}
+
+func (rc *receiver) header(i int) http.Header {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.headers[i]
+}
+
+func newDispatcher(m *queue.QueueManager) *Dispatcher {
+	d := NewDispatcher(m)
+	d.Backoff, d.MaxBackoff = time.Millisecond, 5*time.Millisecond
+	return d
+}
+
+func TestDispatcherDelivers(t *testing.T) {
+	rc := &receiver{t: t, secret: "s3cret", failures: 2}
+	ts := httptest.NewServer(rc)
+	defer ts.Close()
+	m := queue.NewQueueManager()
+	m.Get("jobs").EnqueueMessage(queue.Message{Body: []byte("a"), Traceparent: "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"})
+	d := newDispatcher(m)
+	defer d.Close()
+
+	sub, err := d.Subscribe(Subscription{Queue: "jobs", URL: ts.URL, Secret: "s3cret", Concurrency: 1})
+	if !assert.NoError(t, err) {
+		return
+	}
+	m.Get("jobs").Enqueue([]byte("b"))
+	assert.Eventually(t, func() bool { return len(rc.received()) == 2 }, 2*time.Second, 5*time.Millisecond)
+	assert.Equal(t, []string{"a", "b"}, rc.received())
+
+	h := rc.header(0)
+	assert.Equal(t, sub.ID, h.Get(SubscriptionHeader))
+	assert.Equal(t, "jobs", h.Get(QueueHeader))
+	assert.Equal(t, "1", h.Get(MessageIDHeader))
+	assert.Equal(t, "3", h.Get(AttemptHeader), "two failed attempts came first")
+	assert.Equal(t, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", h.Get("traceparent"))
+
+	// The receiver has the message before the dispatcher sees the answer.
+	assert.Eventually(t, func() bool {
+		st, _ := d.Get(sub.ID)
+		return st.Delivered == 2 && m.Get("jobs").Inflight() == 0
+	}, 2*time.Second, 5*time.Millisecond)
+	st, ok := d.Get(sub.ID)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(2), st.Delivered)
+	assert.Equal(t, uint64(2), st.Failed)
+	assert.Contains(t, st.LastError, "503")
+	assert.Equal(t, 0, m.Get("jobs").Inflight())
+}
+
+func TestDispatcherDeadLetters(t *testing.T) {
+	rc := &receiver{t: t, secret: "k", failures: 1000}
+	ts := httptest.NewServer(rc)
+	defer ts.Close()
+	m := queue.NewQueueManager()
+	m.Get("acme/jobs").Enqueue([]byte("poison"))
+	d := newDispatcher(m)
+	defer d.Close()
+
+	sub, err := d.Subscribe(Subscription{Queue: "acme/jobs", URL: ts.URL, Secret: "k", MaxAttempts: 3})
+	if !assert.NoError(t, err) {
+		return
+	}
+	dlq := m.Get("acme/jobs.dlq")
+	assert.Eventually(t, func() bool { return dlq.Len() == 1 }, 2*time.Second, 5*time.Millisecond)
+	assert.Equal(t, int32(3), rc.requests.Load())
+	assert.Equal(t, 0, m.Get("acme/jobs").Len()+m.Get("acme/jobs").Inflight())
+	assert.Eventually(t, func() bool {
+		st, _ := d.Get(sub.ID)
+		return st.DeadLettered == 1
+	}, 2*time.Second, 5*time.Millisecond)
+}
+
+func TestDispatcherConcurrency(t *testing.T) {
+	rc := &receiver{t: t, secret: "k", hold: 20 * time.Millisecond}
+	ts := httptest.NewServer(rc)
+	defer ts.Close()
+	m := queue.NewQueueManager()
+	for i := 0; i < 12; i++ {
+		m.Get("jobs").Enqueue([]byte("x"))
+	}
+	d := newDispatcher(m)
+	defer d.Close()
+
+	_, err := d.Subscribe(Subscription{Queue: "jobs", URL: ts.URL, Secret: "k", Concurrency: 3})
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool { return len(rc.received()) == 12 }, 2*time.Second, 5*time.Millisecond)
+	assert.Equal(t, int32(3), rc.peak.Load())
+}
+
+func TestDispatcherUnsubscribeReleases(t *testing.T) {
+	block := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer ts.Close()
+	defer close(block)
+	m := queue.NewQueueManager()
+	q := m.Get("jobs")
+	q.Enqueue([]byte("a"))
+	d := newDispatcher(m)
+	defer d.Close()
+
+	sub, err := d.Subscribe(Subscription{Queue: "jobs", URL: ts.URL})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NotEmpty(t, sub.Secret, "a secret is generated")
+	assert.Eventually(t, func() bool { return q.Inflight() == 1 }, time.Second, 5*time.Millisecond)
+	assert.Len(t, d.List("jobs"), 1)
+	assert.True(t, d.Unsubscribe(sub.ID))
+	assert.False(t, d.Unsubscribe(sub.ID))
+	assert.Eventually(t, func() bool { return q.Len() == 1 }, time.Second, 5*time.Millisecond)
+	assert.Empty(t, d.List(""))
+}
+
+func TestSubscribeValidation(t *testing.T) {
+	d := NewDispatcher(queue.NewQueueManager())
+	defer d.Close()
+	tests := []struct {
+		name   string
+		sub    Subscription
+		errMsg string
+	}{
+		{"RelativeURL", Subscription{URL: "/hook"}, "invalid url"},
+		{"OtherScheme", Subscription{URL: "ftp://host/hook"}, "invalid url"},
+		{"Concurrency", Subscription{URL: "http://host/hook", Concurrency: MaxConcurrency + 1}, "concurrency"},
+		{"MaxAttempts", Subscription{URL: "http://host/hook", MaxAttempts: -1}, "max_attempts"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := d.Subscribe(tc.sub)
+			assert.ErrorContains(t, err, tc.errMsg)
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Now().Unix()
+	h := http.Header{}
+	h.Set(TimestampHeader, "1700000000")
+	h.Set(SignatureHeader, Sign("k", 1700000000, []byte("body")))
+	assert.ErrorContains(t, Verify("k", h, []byte("body"), time.Minute), "tolerance")
+
+	h.Set(TimestampHeader, "soon")
+	assert.ErrorContains(t, Verify("k", h, []byte("body"), time.Minute), "invalid")
+
+	h = http.Header{}
+	h.Set(TimestampHeader, strconv.FormatInt(now, 10))
+	h.Set(SignatureHeader, Sign("k", now, []byte("body")))
+	assert.NoError(t, Verify("k", h, []byte("body"), time.Minute))
+	assert.ErrorContains(t, Verify("k", h, []byte("other"), time.Minute), "mismatch")
+	assert.ErrorContains(t, Verify("other", h, []byte("body"), time.Minute), "mismatch")
+}
+
+func TestBackoff(t *testing.T) {
+	d := &Dispatcher{Backoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	for _, tc := range []struct {
+		attempt  int
+		min, max time.Duration
+	}{
+		{1, 50 * time.Millisecond, 100 * time.Millisecond},
+		{3, 200 * time.Millisecond, 400 * time.Millisecond},
+		{10, 500 * time.Millisecond, time.Second},
+	} {
+		for i := 0; i < 20; i++ {
+			b := d.backoff(tc.attempt)
+			assert.GreaterOrEqual(t, b, tc.min)
+			assert.LessOrEqual(t, b, tc.max)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package ws
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newEchoServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			mt, msg, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := c.WriteMessage(mt, msg); err != nil {
+				return
+			}
+		}
+	}))
+}
+
+func dial(t *testing.T, ts *httptest.Server) *Conn {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	c, err := Dial(ctx, "ws"+strings.TrimPrefix(ts.URL, "http")+"/", nil, nil)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return c
+}
+
+func TestAcceptKey(t *testing.T) {
+	// Example from RFC 6455 section 1.3.
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", acceptKey("dGhlIHNhbXBsZSBub25jZQ=="))
+}
+
+func TestEcho(t *testing.T) {
+	ts := newEchoServer(t)
+	defer ts.Close()
+	c := dial(t, ts)
+	defer c.Close()
+
+	tests := []struct {
+		name string
+		typ  MessageType
+		data []byte
+	}{
+		{name: "ShortText", typ: TextMessage, data: []byte("hello")},
+		{name: "Empty", typ: TextMessage, data: []byte{}},
+		{name: "MediumBinary_16BitLength", typ: BinaryMessage, data: bytes.Repeat([]byte{0xAB}, 1000)},
+		{name: "LargeBinary_64BitLength", typ: BinaryMessage, data: bytes.Repeat([]byte("x"), 70000)},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.NoError(t, c.WriteMessage(tc.typ, tc.data))
+			mt, got, err := c.ReadMessage()
+			assert.NoError(t, err)
+			assert.Equal(t, tc.typ, mt)
+			assert.Equal(t, len(tc.data), len(got))
+			assert.True(t, bytes.Equal(tc.data, got))
+		})
+	}
+}
+
+func TestFragmentsAndPing(t *testing.T) {
+	ts := newEchoServer(t)
+	defer ts.Close()
+	c := dial(t, ts)
+	defer c.Close()
+
+	// A ping between fragments must be answered without disturbing the
+	// message being reassembled.
+	assert.NoError(t, c.writeRaw(0x01, []byte("hel")))
+	assert.NoError(t, c.writeFrame(opPing, []byte("p")))
+	assert.NoError(t, c.writeRaw(0x80|opContinuation, []byte("lo")))
+
+	fin, op, payload, err := c.readFrame()
+	assert.NoError(t, err)
+	assert.True(t, fin)
+	assert.Equal(t, byte(opPong), op)
+	assert.Equal(t, "p", string(payload))
+
+	mt, msg, err := c.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, TextMessage, mt)
+	assert.Equal(t, "hello", string(msg))
+}
+
+func TestClose(t *testing.T) {
+	ts := newEchoServer(t)
+	defer ts.Close()
+	c := dial(t, ts)
+	assert.NoError(t, c.writeFrame(opClose, []byte{0x03, 0xE8}))
+	_, _, err := c.ReadMessage()
+	assert.ErrorIs(t, err, ErrClosed)
+	assert.ErrorIs(t, c.WriteMessage(TextMessage, []byte("late")), ErrClosed)
+}
+
+func TestUpgradeRejectsPlainRequests(t *testing.T) {
+	ts := newEchoServer(t)
+	defer ts.Close()
+	resp, err := http.Get(ts.URL)
+	if assert.NoError(t, err) {
+		_ = resp.Body.Close()
+		assert.Equal(t, http.StatusUpgradeRequired, resp.StatusCode)
+	}
+}
+
+// writeRaw sends a frame with an explicit first header byte, which lets
+// tests produce non-final fragments.
+func (c *Conn) writeRaw(b0 byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	buf := []byte{b0, 0x80 | byte(len(payload)), 0, 0, 0, 0}
+	buf = append(buf, payload...)
+	_, err := c.conn.Write(buf)
+	return err
+}